@@ -0,0 +1,154 @@
+/*
+ln-paywall-cli sends a request to an endpoint that's protected by ln-paywall, for smoke testing a deployment end-to-end.
+
+It prints the invoice from the "402 Payment Required" response, pays it via your lnd node,
+sends the request again with the preimage and prints the final response.
+Without the "-pay" flag the invoice is only printed and not paid.
+
+Usage:
+
+	ln-paywall-cli [flags] URL
+
+For example:
+
+	ln-paywall-cli -pay -dataDir ~/.lnd-data/ -maxAmount 10 https://api.example.com/ping
+
+Paying requires a macaroon with the "offchain:write" permission, like the "admin.macaroon".
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/pay"
+)
+
+var method = flag.String("method", "GET", "HTTP method of the request")
+var data = flag.String("data", "", "Body of the request")
+var payInvoice = flag.Bool("pay", false, "Pay the invoice and send the request again with the preimage. Without this flag the invoice is only printed.")
+var maxAmount = flag.Int64("maxAmount", pay.DefaultOptions.MaxAmount, "Maximum amount in Satoshis that's paid, not including routing fees")
+var headerName = flag.String("headerName", pay.DefaultOptions.HeaderName, "Name of the header in which the preimage is sent")
+var lndAddress = flag.String("addr", ln.DefaultLNDoptions.Address, "Address of the lnd node (including gRPC port)")
+var dataDir = flag.String("dataDir", "data/", "Relative path to the data directory, where tls.cert and the macaroon are located")
+var macaroonFile = flag.String("macaroon", "admin.macaroon", "Name of the macaroon file in the data directory")
+
+// errNotPaid is returned by the printingClient instead of paying the invoice.
+var errNotPaid = errors.New("the invoice wasn't paid")
+
+// printingClient is a pay.LNclient that prints the invoice and the result of the payment.
+// If no LN client is set, the invoice isn't paid and errNotPaid is returned.
+type printingClient struct {
+	lnClient pay.LNclient
+}
+
+// PayInvoice prints the invoice and, if the printingClient has an LN client, pays it with that client.
+func (c printingClient) PayInvoice(invoice string) (string, int64, error) {
+	fmt.Printf("Invoice: %v\n", invoice)
+	if c.lnClient == nil {
+		return "", 0, errNotPaid
+	}
+	preimage, amountPaid, err := c.lnClient.PayInvoice(invoice)
+	if err != nil {
+		fmt.Printf("Payment failed: %v\n", err)
+		return "", 0, err
+	}
+	fmt.Printf("Paid %v Satoshis (including routing fees), preimage: %v\n", amountPaid, preimage)
+	return preimage, amountPaid, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] URL\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Arg(0)))
+}
+
+// run sends the request to the URL, pays the invoice if the "-pay" flag is set and prints the results.
+// It returns the exit code, which is only 0 if the final response has a 2xx status code,
+// so that the tool is usable in scripts.
+func run(url string) int {
+	client := printingClient{}
+	if *payInvoice {
+		// Make sure the path to the data directory ends with "/"
+		dataDirSuffixed := *dataDir
+		if !strings.HasSuffix(dataDirSuffixed, "/") && !strings.HasSuffix(dataDirSuffixed, "\\") {
+			dataDirSuffixed += "/"
+		}
+		lnClient, err := ln.NewLNDclient(ln.LNDoptions{
+			Address:      *lndAddress,
+			CertFile:     dataDirSuffixed + "tls.cert",
+			MacaroonFile: dataDirSuffixed + *macaroonFile,
+		})
+		if err != nil {
+			return printError(err)
+		}
+		defer lnClient.Close()
+		client.lnClient = lnClient
+	}
+	payClient := pay.NewClient(client, pay.Options{
+		MaxAmount:  *maxAmount,
+		HeaderName: *headerName,
+	})
+
+	req, err := http.NewRequest(*method, url, strings.NewReader(*data))
+	if err != nil {
+		return printError(err)
+	}
+	res, _, err := payClient.Do(req)
+	if err == errNotPaid {
+		fmt.Println("Not paying the invoice, because the \"-pay\" flag isn't set")
+		return 0
+	} else if err == pay.ErrMaxAmountExceeded {
+		return printError(fmt.Errorf("%v (%v Satoshis), see the \"-maxAmount\" flag", err, *maxAmount))
+	} else if err != nil {
+		return printError(err)
+	}
+	defer res.Body.Close()
+
+	if err = printResponse(res); err != nil {
+		return printError(err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return 1
+	}
+	return 0
+}
+
+// printResponse prints the status, the headers and the body of the response.
+func printResponse(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Response: %v %v\n", res.Proto, res.Status)
+	keys := make([]string, 0, len(res.Header))
+	for key := range res.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%v: %v\n", key, strings.Join(res.Header[key], ", "))
+	}
+	fmt.Printf("\n%s\n", body)
+	return nil
+}
+
+// printError prints the error and returns the exit code 1.
+func printError(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
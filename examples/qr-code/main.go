@@ -57,6 +57,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	defer storageClient.Close()
 
 	// Use middleware
 	r.Use(wall.NewGinMiddleware(invoiceOptions, lnClient, storageClient))
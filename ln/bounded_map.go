@@ -0,0 +1,60 @@
+package ln
+
+import (
+	"sync"
+)
+
+// boundedMap is a map with a maximum number of entries, for remembering data about recently generated invoices,
+// like which charge or which node an invoice belongs to.
+// When it's full, the oldest entry is overwritten. It's safe for concurrent use.
+type boundedMap struct {
+	lock *sync.Mutex
+	m    map[string]interface{}
+	// Keys in the order they were added, for overwriting the oldest one
+	ring []string
+	next int
+}
+
+func newBoundedMap(maxSize int) *boundedMap {
+	return &boundedMap{
+		lock: &sync.Mutex{},
+		m:    make(map[string]interface{}),
+		ring: make([]string, maxSize),
+	}
+}
+
+func (c *boundedMap) add(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Otherwise the key would be in the ring twice and the older one would delete the entry
+	if _, ok := c.m[key]; ok {
+		c.m[key] = value
+		return
+	}
+	if oldest := c.ring[c.next]; oldest != "" {
+		delete(c.m, oldest)
+	}
+	c.ring[c.next] = key
+	c.m[key] = value
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+func (c *boundedMap) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.m[key]
+	return value, ok
+}
+
+// pop removes the entry with the given key and returns its value.
+// The key stays in the ring until it's overwritten, so if the same key is added again in the meantime,
+// it's removed earlier than other entries, which is fine for remembering data.
+func (c *boundedMap) pop(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.m[key]
+	if ok {
+		delete(c.m, key)
+	}
+	return value, ok
+}
@@ -0,0 +1,266 @@
+package ln
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BTCPayClient is an implementation of the wall.LNclient interface for BTCPay Server (https://btcpayserver.org).
+// It uses the Greenfield API of BTCPay to create invoices on a store and to check their status,
+// so the Lightning Network node that's connected to the store receives the payments
+// and the invoices show up in BTCPay like all other invoices of the store.
+//
+// BTCPay doesn't provide a way to look up an invoice by its payment hash,
+// so after creating an invoice the client stores the hex encoded payment hash as order ID in its metadata,
+// and CheckInvoice(...) searches for the invoice with that order ID.
+// This means that generating an invoice takes three requests to BTCPay.
+type BTCPayClient struct {
+	address       string
+	storeID       string
+	apiKey        string
+	paymentMethod string
+	httpClient    *http.Client
+	logger        Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo.
+// It creates a BTCPay invoice that can only be paid via Lightning and returns its BOLT11 invoice.
+// BTCPay invoices always have an amount, so an amount of 0 leads to an error.
+func (c BTCPayClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	if amount == 0 {
+		return "", errors.New("the BTCPayClient doesn't support amountless invoices")
+	}
+	// Create the request and send it
+	createInvoice := btcpayCreateInvoice{
+		Amount:   strconv.FormatInt(amount, 10),
+		Currency: "SATS",
+		Metadata: btcpayMetadata{
+			ItemDesc: memo,
+		},
+	}
+	createInvoice.Checkout.PaymentMethods = []string{c.paymentMethod}
+	reqBody, err := json.Marshal(createInvoice)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	invoice := btcpayInvoice{}
+	err = c.do("POST", c.storePath("/invoices"), reqBody, &invoice)
+	if err != nil {
+		return "", err
+	}
+
+	// Get the BOLT11 invoice
+	paymentMethods := []btcpayPaymentMethod{}
+	err = c.do("GET", c.storePath("/invoices/"+url.PathEscape(invoice.ID)+"/payment-methods"), nil, &paymentMethods)
+	if err != nil {
+		return "", err
+	}
+	var bolt11 string
+	for _, paymentMethod := range paymentMethods {
+		if strings.HasPrefix(strings.ToLower(paymentMethod.Destination), "ln") {
+			bolt11 = paymentMethod.Destination
+			break
+		}
+	}
+	if bolt11 == "" {
+		return "", fmt.Errorf("the BTCPay invoice %v doesn't contain a Lightning invoice, check if Lightning is enabled for the store", invoice.ID)
+	}
+
+	// Store the payment hash, so that we can find the invoice when we get the preimage
+	paymentHash, err := PaymentHashFromInvoice(bolt11)
+	if err != nil {
+		return "", err
+	}
+	updateInvoice := btcpayUpdateInvoice{
+		Metadata: btcpayMetadata{
+			ItemDesc: memo,
+			OrderID:  hex.EncodeToString(paymentHash),
+		},
+	}
+	reqBody, err = json.Marshal(updateInvoice)
+	if err != nil {
+		return "", err
+	}
+	err = c.do("PUT", c.storePath("/invoices/"+url.PathEscape(invoice.ID)), reqBody, &invoice)
+	if err != nil {
+		return "", err
+	}
+
+	return bolt11, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// The BTCPay statuses "Settled" and "Processing" count as paid:
+// The preimage proves that the Lightning payment was made, and "Processing" only means
+// that BTCPay waits for something that's only relevant for on-chain payments.
+// An error is returned if the preimage contains invalid Base64 characters or if no corresponding invoice was found.
+// ErrInsufficientAmount is returned if the amount of the invoice is lower than the expected amount.
+// ErrInvoiceCanceled is returned for the statuses "Expired" and "Invalid".
+// False is returned if the invoice isn't paid ("New").
+func (c BTCPayClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding invoice to check if it's settled
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the invoice for that hash
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	orderID := hex.EncodeToString(hashSlice)
+	invoices := []btcpayInvoice{}
+	err = c.do("GET", c.storePath("/invoices?orderId="+orderID), nil, &invoices)
+	if err != nil {
+		return false, err
+	}
+	var invoice *btcpayInvoice
+	for i := range invoices {
+		if invoices[i].Metadata.OrderID == orderID {
+			invoice = &invoices[i]
+			break
+		}
+	}
+	if invoice == nil {
+		return false, ErrInvoiceNotFound
+	}
+
+	// Check if invoice was settled
+	switch invoice.Status {
+	case "Settled", "Processing":
+	case "Expired", "Invalid":
+		return false, ErrInvoiceCanceled
+	default:
+		return false, nil
+	}
+	// Check if enough was paid. The currency is always "SATS", see GenerateInvoice(...).
+	amount, err := strconv.ParseFloat(invoice.Amount, 64)
+	if err != nil {
+		return false, fmt.Errorf("the BTCPay invoice contains an invalid amount: %v", err)
+	}
+	if invoice.Currency != "SATS" || amount < float64(expectedAmount) {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// storePath returns the path of the given endpoint of the store in BTCPay's Greenfield API.
+func (c BTCPayClient) storePath(endpoint string) string {
+	return "/api/v1/stores/" + url.PathEscape(c.storeID) + endpoint
+}
+
+// do sends a request to the given endpoint of the BTCPay Greenfield API
+// and decodes the JSON response into the given result object.
+func (c BTCPayClient) do(method string, endpoint string, reqBody []byte, result interface{}) error {
+	req, err := http.NewRequest(method, c.address+endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "token "+c.apiKey)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrInvoiceNotFound
+	} else if res.StatusCode != http.StatusOK {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("BTCPay responded with status %v to %v: %s", res.StatusCode, endpoint, resBody)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// NewBTCPayClient creates a new BTCPayClient instance.
+func NewBTCPayClient(btcpayOptions BTCPayOptions) BTCPayClient {
+	// Set default values
+	if btcpayOptions.Address == "" {
+		btcpayOptions.Address = DefaultBTCPayOptions.Address
+	}
+	if btcpayOptions.PaymentMethod == "" {
+		btcpayOptions.PaymentMethod = DefaultBTCPayOptions.PaymentMethod
+	}
+	if btcpayOptions.Logger == nil {
+		btcpayOptions.Logger = NoopLogger{}
+	}
+
+	return BTCPayClient{
+		address:       strings.TrimSuffix(btcpayOptions.Address, "/"),
+		storeID:       btcpayOptions.StoreID,
+		apiKey:        btcpayOptions.APIKey,
+		paymentMethod: btcpayOptions.PaymentMethod,
+		httpClient:    http.DefaultClient,
+		logger:        btcpayOptions.Logger,
+	}
+}
+
+// BTCPayOptions are the options for the connection to the BTCPay Server instance.
+type BTCPayOptions struct {
+	// Base URL of the BTCPay Server instance, including the scheme and port (if it's not the default port of the scheme).
+	// Optional ("http://localhost:23000" by default).
+	Address string
+	// ID of the store on which the invoices are created. You can find it in the general settings of the store.
+	StoreID string
+	// Greenfield API key with the permissions "btcpay.store.cancreateinvoice", "btcpay.store.canviewinvoices"
+	// and "btcpay.store.canmodifyinvoices" for the store. You can create it in the account settings under "API Keys".
+	APIKey string
+	// ID of BTCPay's payment method for Lightning, which is the only payment method of the created invoices.
+	// BTCPay Server 2.0 calls it "BTC-LN", but still accepts the old ID.
+	// Optional ("BTC-LightningNetwork" by default).
+	PaymentMethod string
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultBTCPayOptions provides default values for BTCPayOptions.
+var DefaultBTCPayOptions = BTCPayOptions{
+	Address:       "http://localhost:23000",
+	PaymentMethod: "BTC-LightningNetwork",
+}
+
+type btcpayMetadata struct {
+	ItemDesc string `json:"itemDesc,omitempty"`
+	OrderID  string `json:"orderId,omitempty"`
+}
+
+type btcpayCreateInvoice struct {
+	Amount   string         `json:"amount"`
+	Currency string         `json:"currency"`
+	Metadata btcpayMetadata `json:"metadata"`
+	Checkout struct {
+		PaymentMethods []string `json:"paymentMethods"`
+	} `json:"checkout"`
+}
+
+type btcpayUpdateInvoice struct {
+	Metadata btcpayMetadata `json:"metadata"`
+}
+
+type btcpayInvoice struct {
+	ID string `json:"id"`
+	// "New", "Processing", "Settled", "Expired" or "Invalid"
+	Status   string         `json:"status"`
+	Amount   string         `json:"amount"`
+	Currency string         `json:"currency"`
+	Metadata btcpayMetadata `json:"metadata"`
+}
+
+type btcpayPaymentMethod struct {
+	// The BOLT11 invoice for Lightning payment methods
+	Destination string `json:"destination"`
+}
@@ -0,0 +1,111 @@
+package ln_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestBTCPayClientImpl tests if BTCPayClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestBTCPayClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.BTCPayClient{}
+}
+
+// TestBTCPayClient tests the payment flow of the BTCPayClient with a fake Greenfield API:
+// Creating an invoice, storing its payment hash as order ID and checking it with the preimage.
+func TestBTCPayClient(t *testing.T) {
+	fakeClient := ln.NewFakeClient()
+	bolt11, err := fakeClient.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := "New"
+	var orderID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		invoice := map[string]interface{}{
+			"id":       "inv1",
+			"status":   status,
+			"amount":   "10",
+			"currency": "SATS",
+			"metadata": map[string]string{"orderId": orderID},
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v1/stores/store1/invoices":
+			json.NewEncoder(w).Encode(invoice)
+		case "GET /api/v1/stores/store1/invoices/inv1/payment-methods":
+			json.NewEncoder(w).Encode([]map[string]string{{"destination": "bc1qonchain"}, {"destination": bolt11}})
+		case "PUT /api/v1/stores/store1/invoices/inv1":
+			var body struct {
+				Metadata struct {
+					OrderID string `json:"orderId"`
+				} `json:"metadata"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			orderID = body.Metadata.OrderID
+			json.NewEncoder(w).Encode(invoice)
+		case "GET /api/v1/stores/store1/invoices":
+			if r.URL.Query().Get("orderId") != orderID {
+				json.NewEncoder(w).Encode([]interface{}{})
+				return
+			}
+			json.NewEncoder(w).Encode([]interface{}{invoice})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	c := ln.NewBTCPayClient(ln.BTCPayOptions{
+		Address: server.URL,
+		StoreID: "store1",
+		APIKey:  "secret",
+	})
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice != bolt11 {
+		t.Errorf("Expected the invoice %v, but was %v", bolt11, invoice)
+	}
+	preimage, err := fakeClient.Pay(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		status         string
+		expectedAmount int64
+		expected       bool
+		expectedErr    error
+	}{
+		{"New", 10, false, nil},
+		{"Processing", 10, true, nil},
+		{"Settled", 10, true, nil},
+		{"Settled", 11, false, ln.ErrInsufficientAmount},
+		{"Expired", 10, false, ln.ErrInvoiceCanceled},
+	}
+	for _, testCase := range testCases {
+		status = testCase.status
+		settled, err := c.CheckInvoice(preimage, testCase.expectedAmount)
+		if settled != testCase.expected || err != testCase.expectedErr {
+			t.Errorf("Expected %v and error %v for status %v, but was %v and %v", testCase.expected, testCase.expectedErr, testCase.status, settled, err)
+		}
+	}
+
+	// A preimage of another invoice must not match
+	otherInvoice, _ := fakeClient.GenerateInvoice(10, "API call")
+	otherPreimage, _ := fakeClient.Pay(otherInvoice)
+	if _, err = c.CheckInvoice(otherPreimage, 10); err != ln.ErrInvoiceNotFound {
+		t.Errorf("Expected error %v, but was %v", ln.ErrInvoiceNotFound, err)
+	}
+}
@@ -0,0 +1,280 @@
+package ln
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clnRequestID is used as JSON-RPC request ID. It's incremented with every request.
+var clnRequestID uint64
+
+// CLNclient is an implementation of the wall.LNclient interface for the Core Lightning (formerly c-lightning) Lightning Network node implementation.
+// It talks to the node via its JSON-RPC interface, which is exposed on a Unix domain socket.
+type CLNclient struct {
+	socketPath string
+	timeout    time.Duration
+	logger     Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo.
+// An amount of 0 leads to an amountless invoice.
+func (c CLNclient) GenerateInvoice(amount int64, memo string) (string, error) {
+	return c.GenerateInvoiceCtx(context.Background(), amount, memo)
+}
+
+// GenerateInvoiceCtx does the same as GenerateInvoice, but the call to the node is canceled
+// when the given context is canceled or its deadline is exceeded.
+// The middlewares use it with the context of the incoming request.
+func (c CLNclient) GenerateInvoiceCtx(ctx context.Context, amount int64, memo string) (string, error) {
+	// Core Lightning requires a unique label for each invoice
+	label, err := generateLabel()
+	if err != nil {
+		return "", err
+	}
+
+	// Create the request and send it
+	params := map[string]interface{}{
+		"amount_msat": amount * 1000,
+		"label":       label,
+		"description": memo,
+	}
+	if amount == 0 {
+		// Amountless invoice, the payer chooses the amount
+		params["amount_msat"] = "any"
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	res := clnInvoiceResult{}
+	err = c.call(ctx, "invoice", params, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Bolt11, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// An error is returned if the preimage contains invalid Base64 characters or if no corresponding invoice was found.
+// ErrInsufficientAmount is returned if less than the expected amount was paid.
+// False is returned if the invoice isn't settled.
+func (c CLNclient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	return c.CheckInvoiceCtx(context.Background(), preimage, expectedAmount)
+}
+
+// CheckInvoiceCtx does the same as CheckInvoice, but the call to the node is canceled
+// when the given context is canceled or its deadline is exceeded.
+// The middlewares use it with the context of the incoming request.
+func (c CLNclient) CheckInvoiceCtx(ctx context.Context, preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding invoice to check if it's settled
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the invoice for that hash
+	params := map[string]interface{}{
+		// Hex encoded
+		"payment_hash": hex.EncodeToString(hashSlice),
+	}
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	res := clnListInvoicesResult{}
+	err = c.call(ctx, "listinvoices", params, &res)
+	if err != nil {
+		return false, err
+	}
+	if len(res.Invoices) == 0 {
+		return false, ErrInvoiceNotFound
+	}
+
+	// Check if invoice was settled
+	if res.Invoices[0].Status == "expired" {
+		return false, ErrInvoiceCanceled
+	} else if res.Invoices[0].Status != "paid" {
+		return false, nil
+	}
+	// Check if enough was paid
+	if int64(res.Invoices[0].AmountReceivedMsat) < expectedAmount*1000 {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// call sends a JSON-RPC request to the Core Lightning node and decodes the result into the given result object.
+// A new connection is used for each call, because Core Lightning closes the connection when it's idle.
+// The call is aborted after the timeout of the client or when the context is done, whichever comes first,
+// so that a hanging node doesn't block the requests to the web service forever.
+func (c CLNclient) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The deadline only covers the timeout, a canceled context must also abort the blocking reads and writes
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	err = c.exchange(conn, method, params, result)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// exchange sends the JSON-RPC request via the connection and decodes the result into the given result object.
+func (c CLNclient) exchange(conn net.Conn, method string, params interface{}, result interface{}) error {
+	req := clnRequest{
+		Version: "2.0",
+		ID:      atomic.AddUint64(&clnRequestID, 1),
+		Method:  method,
+		Params:  params,
+	}
+	err := json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return err
+	}
+
+	res := clnResponse{}
+	err = json.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("the Core Lightning node returned an error for method %v: %v (code %v)", method, res.Error.Message, res.Error.Code)
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// NewCLNclient creates a new CLNclient instance.
+func NewCLNclient(clnOptions CLNoptions) (CLNclient, error) {
+	result := CLNclient{}
+
+	// Set default values
+	if clnOptions.SocketPath == "" {
+		clnOptions.SocketPath = DefaultCLNoptions.SocketPath
+	}
+	if clnOptions.Timeout <= 0 {
+		clnOptions.Timeout = DefaultCLNoptions.Timeout
+	}
+	if clnOptions.Logger == nil {
+		clnOptions.Logger = NoopLogger{}
+	}
+
+	// Make sure the socket exists, so that a wrong path leads to an error now instead of with the first request
+	_, err := os.Stat(clnOptions.SocketPath)
+	if err != nil {
+		return result, err
+	}
+
+	result = CLNclient{
+		socketPath: clnOptions.SocketPath,
+		timeout:    clnOptions.Timeout,
+		logger:     clnOptions.Logger,
+	}
+
+	return result, nil
+}
+
+// CLNoptions are the options for the connection to the Core Lightning node.
+type CLNoptions struct {
+	// Path to the "lightning-rpc" Unix domain socket that your Core Lightning node exposes.
+	// It's located in the Core Lightning data directory, for example "~/.lightning/bitcoin/lightning-rpc".
+	// Optional ("lightning-rpc" by default).
+	SocketPath string
+	// Maximum duration of a call to the node, including connecting to the socket.
+	// Calls with a context (like the ones of the middlewares) are also aborted when the context is done.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (10 seconds by default).
+	Timeout time.Duration
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultCLNoptions provides default values for CLNoptions.
+var DefaultCLNoptions = CLNoptions{
+	SocketPath: "lightning-rpc",
+	Timeout:    10 * time.Second,
+}
+
+type clnRequest struct {
+	Version string      `json:"jsonrpc"`
+	ID      uint64      `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type clnResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type clnInvoiceResult struct {
+	Bolt11      string `json:"bolt11"`
+	PaymentHash string `json:"payment_hash"`
+}
+
+type clnListInvoicesResult struct {
+	Invoices []struct {
+		PaymentHash        string  `json:"payment_hash"`
+		Status             string  `json:"status"`
+		AmountReceivedMsat clnMsat `json:"amount_received_msat"`
+	} `json:"invoices"`
+}
+
+// clnMsat is an amount in millisatoshis.
+// Older Core Lightning versions encode amounts as strings with an "msat" suffix, newer ones as JSON numbers.
+// clnMsat can be decoded from both.
+type clnMsat int64
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (m *clnMsat) UnmarshalJSON(data []byte) error {
+	s := strings.TrimSuffix(strings.Trim(string(data), `"`), "msat")
+	if s == "" || s == "null" {
+		*m = 0
+		return nil
+	}
+	amount, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*m = clnMsat(amount)
+	return nil
+}
+
+// generateLabel generates a random label for Core Lightning invoices.
+func generateLabel() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return "ln-paywall-" + hex.EncodeToString(randomBytes), nil
+}
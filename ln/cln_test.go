@@ -0,0 +1,183 @@
+package ln_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestCLNclientImpl tests if CLNclient implements the wall.LNclient and the optional wall.ContextLNclient interfaces.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestCLNclientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.CLNclient{}
+	var _ wall.ContextLNclient = ln.CLNclient{}
+}
+
+// serveCLN starts a fake Core Lightning JSON-RPC server on a Unix domain socket in the given directory
+// and returns its listener, whose address is the path of the socket.
+// The handler returns the result for the method and params of a request.
+// A nil result leads to no response at all, like a hanging node.
+func serveCLN(t *testing.T, dir string, handler func(method string, params map[string]interface{}) interface{}) net.Listener {
+	socketPath := filepath.Join(dir, "lightning-rpc")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var req struct {
+					ID     uint64                 `json:"id"`
+					Method string                 `json:"method"`
+					Params map[string]interface{} `json:"params"`
+				}
+				if err := json.NewDecoder(conn).Decode(&req); err != nil {
+					return
+				}
+				result := handler(req.Method, req.Params)
+				if result == nil {
+					// Wait until the client gives up
+					ioutil.ReadAll(conn)
+					return
+				}
+				json.NewEncoder(conn).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+			}()
+		}
+	}()
+	return listener
+}
+
+// TestCLNclient tests if the CLNclient creates invoices and maps the states of the invoices in "listinvoices"
+// to the results of CheckInvoice.
+func TestCLNclient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	preimages := map[string]string{}
+	// Hex encoded payment hash -> invoice in the "listinvoices" result
+	invoices := map[string]map[string]interface{}{}
+	addInvoice := func(name string, invoice map[string]interface{}) {
+		preimage, hash, err := ln.NewPreimage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashBytes, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preimages[name] = preimage
+		invoices[hex.EncodeToString(hashBytes)] = invoice
+	}
+	addInvoice("paid", map[string]interface{}{"status": "paid", "amount_received_msat": 10000})
+	// Older versions encode amounts as strings
+	addInvoice("paid legacy", map[string]interface{}{"status": "paid", "amount_received_msat": "10000msat"})
+	addInvoice("underpaid", map[string]interface{}{"status": "paid", "amount_received_msat": 9999})
+	addInvoice("unpaid", map[string]interface{}{"status": "unpaid"})
+	addInvoice("expired", map[string]interface{}{"status": "expired"})
+	unknownPreimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimages["unknown"] = unknownPreimage
+
+	listener := serveCLN(t, dir, func(method string, params map[string]interface{}) interface{} {
+		switch method {
+		case "invoice":
+			if params["amount_msat"] != float64(10000) || params["description"] != "API call" {
+				t.Errorf("Unexpected params for the invoice: %v", params)
+			}
+			return map[string]interface{}{"bolt11": "lnbcrt100n1", "payment_hash": "00"}
+		case "listinvoices":
+			result := []interface{}{}
+			if invoice, ok := invoices[params["payment_hash"].(string)]; ok {
+				result = append(result, invoice)
+			}
+			return map[string]interface{}{"invoices": result}
+		}
+		t.Errorf("Unexpected method %v", method)
+		return map[string]interface{}{}
+	})
+	defer listener.Close()
+	c, err := ln.NewCLNclient(ln.CLNoptions{SocketPath: listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil || invoice != "lnbcrt100n1" {
+		t.Errorf("Expected the invoice lnbcrt100n1, but was %q (error: %v)", invoice, err)
+	}
+	testCases := []struct {
+		name            string
+		expectedSettled bool
+		expectedErr     error
+	}{
+		{"paid", true, nil},
+		{"paid legacy", true, nil},
+		{"underpaid", false, ln.ErrInsufficientAmount},
+		{"unpaid", false, nil},
+		{"expired", false, ln.ErrInvoiceCanceled},
+		{"unknown", false, ln.ErrInvoiceNotFound},
+	}
+	for _, testCase := range testCases {
+		settled, err := c.CheckInvoice(preimages[testCase.name], 10)
+		if settled != testCase.expectedSettled || err != testCase.expectedErr {
+			t.Errorf("Expected %v and error %v for the %v invoice, but was %v and %v", testCase.expectedSettled, testCase.expectedErr, testCase.name, settled, err)
+		}
+	}
+}
+
+// TestCLNclientTimeout tests if calls to a hanging node are aborted after the timeout
+// and when the context is canceled.
+func TestCLNclientTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := serveCLN(t, dir, func(method string, params map[string]interface{}) interface{} {
+		return nil
+	})
+	defer listener.Close()
+	c, err := ln.NewCLNclient(ln.CLNoptions{SocketPath: listener.Addr().String(), Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err = c.CheckInvoice(preimage, 10); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, but was %v", context.DeadlineExceeded, err)
+	}
+	if duration := time.Since(start); duration > time.Second {
+		t.Errorf("Expected the call to be aborted after the timeout, but it took %v", duration)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err = c.GenerateInvoiceCtx(ctx, 10, "API call"); err != context.Canceled {
+		t.Errorf("Expected error %v, but was %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,194 @@
+package ln
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// EclairClient is an implementation of the wall.LNclient interface for the Eclair Lightning Network node implementation.
+// It talks to the node via its HTTP API.
+type EclairClient struct {
+	address    string
+	password   string
+	httpClient *http.Client
+	logger     Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo.
+// An amount of 0 leads to an amountless invoice.
+func (c EclairClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	// Create the request and send it
+	data := url.Values{}
+	// Without amount the invoice is amountless and the payer chooses the amount
+	if amount != 0 {
+		data.Set("amountMsat", strconv.FormatInt(amount*1000, 10))
+	}
+	data.Set("description", memo)
+	c.logger.Printf("Creating invoice for a new API request")
+	res := eclairInvoice{}
+	err := c.post("/createinvoice", data, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Serialized, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// An error is returned if the preimage contains invalid Base64 characters.
+// ErrInvoiceNotFound is returned if no corresponding invoice was found
+// and ErrInvoiceCanceled if the invoice has expired.
+// ErrInsufficientAmount is returned if less than the expected amount was paid.
+// False is returned if the invoice isn't settled.
+func (c EclairClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding invoice to check if it's settled
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the invoice for that hash
+	data := url.Values{}
+	// Hex encoded
+	data.Set("paymentHash", hex.EncodeToString(hashSlice))
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	res := eclairReceivedInfo{}
+	err = c.post("/getreceivedinfo", data, &res)
+	if apiErr, ok := err.(eclairAPIError); ok && apiErr.isNotFound() {
+		return false, ErrInvoiceNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	// Check if invoice was settled
+	if res.Status.Type == "" {
+		// Eclair always reports a status for the payments it knows, so this is a "null" response for an unknown one
+		return false, ErrInvoiceNotFound
+	} else if res.Status.Type == "expired" {
+		return false, ErrInvoiceCanceled
+	} else if res.Status.Type != "received" {
+		return false, nil
+	}
+	// Check if enough was paid
+	if res.Status.Amount < expectedAmount*1000 {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// post sends a form encoded POST request to the given endpoint of the Eclair HTTP API
+// and decodes the JSON response into the given result object.
+func (c EclairClient) post(endpoint string, data url.Values, result interface{}) error {
+	req, err := http.NewRequest("POST", c.address+endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Eclair doesn't use a user name, only the password
+	req.SetBasicAuth("", c.password)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		apiErr := eclairAPIError{statusCode: res.StatusCode, endpoint: endpoint, body: string(body)}
+		// Eclair's errors have the format {"error":"..."}
+		var errRes struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &errRes) == nil {
+			apiErr.message = errRes.Error
+		}
+		return apiErr
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// eclairAPIError is the error for a response of the Eclair HTTP API with a status other than 200.
+type eclairAPIError struct {
+	statusCode int
+	endpoint   string
+	body       string
+	// The message of Eclair's JSON error, if the body contains one
+	message string
+}
+
+func (e eclairAPIError) Error() string {
+	return fmt.Sprintf("the Eclair node responded with status %v to %v: %s", e.statusCode, e.endpoint, e.body)
+}
+
+// isNotFound returns true if Eclair doesn't know the requested payment.
+// Eclair responds with 404 and {"error":"Not found"} then, but a reverse proxy might change the status code.
+// It's only meaningful for lookups, because for other endpoints a 404 means that the address is wrong.
+func (e eclairAPIError) isNotFound() bool {
+	return e.statusCode == http.StatusNotFound || strings.EqualFold(e.message, "not found")
+}
+
+// NewEclairClient creates a new EclairClient instance.
+func NewEclairClient(eclairOptions EclairOptions) EclairClient {
+	// Set default values
+	if eclairOptions.Address == "" {
+		eclairOptions.Address = DefaultEclairOptions.Address
+	}
+	if eclairOptions.HTTPClient == nil {
+		eclairOptions.HTTPClient = http.DefaultClient
+	}
+	if eclairOptions.Logger == nil {
+		eclairOptions.Logger = NoopLogger{}
+	}
+
+	return EclairClient{
+		address:    strings.TrimSuffix(eclairOptions.Address, "/"),
+		password:   eclairOptions.Password,
+		httpClient: eclairOptions.HTTPClient,
+		logger:     eclairOptions.Logger,
+	}
+}
+
+// EclairOptions are the options for the connection to the Eclair node.
+type EclairOptions struct {
+	// Address of the Eclair HTTP API, including the scheme and port.
+	// Optional ("http://localhost:8080" by default).
+	Address string
+	// Password of the Eclair HTTP API ("eclair.api.password" in the Eclair configuration).
+	Password string
+	// HTTP client to use for the requests to the Eclair node.
+	// Optional (http.DefaultClient by default).
+	HTTPClient *http.Client
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultEclairOptions provides default values for EclairOptions.
+var DefaultEclairOptions = EclairOptions{
+	Address: "http://localhost:8080",
+}
+
+type eclairInvoice struct {
+	Serialized  string `json:"serialized"`
+	PaymentHash string `json:"paymentHash"`
+}
+
+type eclairReceivedInfo struct {
+	Status struct {
+		// "pending", "expired" or "received"
+		Type string `json:"type"`
+		// Received amount in millisatoshis
+		Amount int64 `json:"amount"`
+	} `json:"status"`
+}
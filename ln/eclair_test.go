@@ -0,0 +1,125 @@
+package ln_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestEclairClientImpl tests if EclairClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestEclairClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.EclairClient{}
+}
+
+// TestEclairClient tests if the EclairClient creates invoices and maps the responses of "getreceivedinfo"
+// to the results of CheckInvoice.
+func TestEclairClient(t *testing.T) {
+	preimages := map[string]string{}
+	// Hex encoded payment hash -> status code and body of the "getreceivedinfo" response
+	responses := map[string]struct {
+		statusCode int
+		body       string
+	}{}
+	addPayment := func(name string, statusCode int, body string) {
+		preimage, hash, err := ln.NewPreimage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashBytes, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preimages[name] = preimage
+		responses[hex.EncodeToString(hashBytes)] = struct {
+			statusCode int
+			body       string
+		}{statusCode, body}
+	}
+	addPayment("received", http.StatusOK, `{"paymentHash":"00","status":{"type":"received","amount":10000,"receivedAt":1}}`)
+	addPayment("underpaid", http.StatusOK, `{"paymentHash":"00","status":{"type":"received","amount":9999,"receivedAt":1}}`)
+	addPayment("pending", http.StatusOK, `{"paymentHash":"00","status":{"type":"pending"}}`)
+	addPayment("expired", http.StatusOK, `{"paymentHash":"00","status":{"type":"expired"}}`)
+	addPayment("null", http.StatusOK, `null`)
+	// Behind a proxy that changes the status code
+	addPayment("not found error", http.StatusInternalServerError, `{"error":"Not found"}`)
+	addPayment("other error", http.StatusInternalServerError, `{"error":"database is locked"}`)
+	unknownPreimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimages["unknown"] = unknownPreimage
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/createinvoice":
+			if r.FormValue("amountMsat") != "10000" || r.FormValue("description") != "API call" {
+				t.Errorf("Unexpected form for the invoice: %v", r.Form)
+			}
+			fmt.Fprint(w, `{"serialized":"lnbcrt100n1","paymentHash":"00"}`)
+		case "/getreceivedinfo":
+			response, ok := responses[r.FormValue("paymentHash")]
+			if !ok {
+				// Eclair's response for an unknown payment hash
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":"Not found"}`)
+				return
+			}
+			w.WriteHeader(response.statusCode)
+			fmt.Fprint(w, response.body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	c := ln.NewEclairClient(ln.EclairOptions{Address: server.URL, Password: "secret"})
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil || invoice != "lnbcrt100n1" {
+		t.Errorf("Expected the invoice lnbcrt100n1, but was %q (error: %v)", invoice, err)
+	}
+	testCases := []struct {
+		name            string
+		expectedSettled bool
+		expectedErr     error
+	}{
+		{"received", true, nil},
+		{"underpaid", false, ln.ErrInsufficientAmount},
+		{"pending", false, nil},
+		{"expired", false, ln.ErrInvoiceCanceled},
+		{"null", false, ln.ErrInvoiceNotFound},
+		{"not found error", false, ln.ErrInvoiceNotFound},
+		{"unknown", false, ln.ErrInvoiceNotFound},
+	}
+	for _, testCase := range testCases {
+		settled, err := c.CheckInvoice(preimages[testCase.name], 10)
+		if settled != testCase.expectedSettled || err != testCase.expectedErr {
+			t.Errorf("Expected %v and error %v for the %v payment, but was %v and %v", testCase.expectedSettled, testCase.expectedErr, testCase.name, settled, err)
+		}
+	}
+
+	// Other errors must not be mistaken for an unknown payment
+	if _, err = c.CheckInvoice(preimages["other error"], 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a failing node, but was %v", err)
+	}
+	wrongPasswordClient := ln.NewEclairClient(ln.EclairOptions{Address: server.URL, Password: "wrong"})
+	if _, err = wrongPasswordClient.CheckInvoice(preimages["received"], 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a wrong password, but was %v", err)
+	}
+	// A 404 for the invoice creation means a wrong address, not an unknown payment
+	wrongAddressClient := ln.NewEclairClient(ln.EclairOptions{Address: server.URL + "/wrong", Password: "secret"})
+	if _, err = wrongAddressClient.GenerateInvoice(10, "API call"); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a wrong address, but was %v", err)
+	}
+}
@@ -0,0 +1,337 @@
+package ln
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// fakeInvoiceTimestamp is the creation time of all fake invoices, so that they're deterministic.
+// It's the timestamp of the examples in BOLT 11.
+const fakeInvoiceTimestamp int64 = 1496314658
+
+// fakePollInterval is the interval in which WaitForSettlement(...) checks if an invoice is settled.
+const fakePollInterval = 10 * time.Millisecond
+
+// fakeInvoice is an invoice that was generated by a FakeClient or whose preimage was settled via Settle(...).
+type fakeInvoice struct {
+	// Only set for invoices that were generated by the FakeClient
+	preimage   []byte
+	amount     int64
+	amountPaid int64
+	settled    bool
+	canceled   bool
+}
+
+// FakeClient is an LN client that doesn't connect to any Lightning Network node.
+// It's meant for tests of web services that use the middlewares,
+// so that the whole payment flow can be tested without lnd or any other node.
+//
+// The invoices it generates are deterministic and well-formed BOLT11 strings for regtest ("lnbcrt..."),
+// containing the amount, the payment hash and the memo, but they have an invalid signature,
+// so they can't be paid with a real wallet. Instead you pay them with Pay(...), which returns the preimage,
+// or you mark any preimage as settled with Settle(...). All other preimages aren't found by CheckInvoice(...).
+// For testing expired invoices you can cancel them with Cancel(...).
+type FakeClient struct {
+	lock *sync.Mutex
+	// Hex encoded payment hash -> invoice
+	invoices map[string]*fakeInvoice
+	// Payment request -> hex encoded payment hash
+	paymentRequests map[string]string
+	// Number of generated invoices, used for deriving the preimages
+	count *int
+}
+
+// GenerateInvoice generates a fake invoice with the given price and memo.
+// An amount of 0 leads to an amountless invoice.
+// The preimage of the n-th invoice is always the same, so the generated invoices are deterministic.
+func (c FakeClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	*c.count++
+	preimage := sha256.Sum256([]byte("ln-paywall fake preimage " + strconv.Itoa(*c.count)))
+	hash := sha256.Sum256(preimage[:])
+	invoice, err := encodeFakeInvoice(amount, hash[:], memo)
+	if err != nil {
+		return "", err
+	}
+	encodedHash := hex.EncodeToString(hash[:])
+	c.invoices[encodedHash] = &fakeInvoice{
+		preimage: preimage[:],
+		amount:   amount,
+	}
+	c.paymentRequests[invoice] = encodedHash
+	return invoice, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage and checks if it belongs to an invoice that was settled,
+// either via Pay(...) or via Settle(...). The expected amount is checked the same way the other LN clients check it.
+// ErrInvoiceNotFound is returned for preimages that the client doesn't know.
+func (c FakeClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	invoice, ok := c.invoices[hex.EncodeToString(hashSlice)]
+	if !ok {
+		return false, ErrInvoiceNotFound
+	}
+	if invoice.canceled {
+		return false, ErrInvoiceCanceled
+	} else if !invoice.settled {
+		return false, nil
+	}
+	if invoice.amountPaid < expectedAmount {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// CheckInvoicePaid takes a Base64 encoded preimage and returns if its invoice was settled and how much was paid (in Satoshis).
+// ErrInvoiceNotFound is returned for preimages that the client doesn't know.
+func (c FakeClient) CheckInvoicePaid(preimage string) (settled bool, amountPaid int64, err error) {
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	invoice, ok := c.invoices[hex.EncodeToString(hashSlice)]
+	if !ok {
+		return false, 0, ErrInvoiceNotFound
+	}
+	if invoice.canceled {
+		return false, 0, ErrInvoiceCanceled
+	} else if !invoice.settled {
+		return false, 0, nil
+	}
+	return true, invoice.amountPaid, nil
+}
+
+// WaitForSettlement waits until the invoice with the given hex encoded payment hash is settled,
+// either via Pay(...) or via Settle(...), so the FakeClient can be used with wall.NewSettlementHandler(...).
+// It checks the invoice every fakePollInterval and only stops when the context is done,
+// in which case the error of the context is returned.
+// ErrInvoiceCanceled is returned if the invoice was canceled and ErrInvoiceNotFound if the client doesn't know it.
+func (c FakeClient) WaitForSettlement(ctx context.Context, paymentHash string) error {
+	hashSlice, err := hex.DecodeString(paymentHash)
+	if err != nil {
+		return err
+	}
+	encodedHash := hex.EncodeToString(hashSlice)
+	ticker := time.NewTicker(fakePollInterval)
+	defer ticker.Stop()
+	for {
+		c.lock.Lock()
+		invoice, ok := c.invoices[encodedHash]
+		var settled, canceled bool
+		if ok {
+			settled, canceled = invoice.settled, invoice.canceled
+		}
+		c.lock.Unlock()
+		if !ok {
+			return ErrInvoiceNotFound
+		} else if settled {
+			return nil
+		} else if canceled {
+			return ErrInvoiceCanceled
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pay settles an invoice that was generated by the client, with the full amount of the invoice.
+// It returns the Base64 encoded preimage, which the client of a web service sends in the preimage header.
+// Amountless invoices can't be paid with Pay(...), use PayAmount(...) for them.
+func (c FakeClient) Pay(invoice string) (string, error) {
+	return c.pay(invoice, 0)
+}
+
+// PayAmount settles an invoice that was generated by the client, with the given amount (in Satoshis).
+// This way you can pay amountless invoices, or pay more or less than the amount of an invoice,
+// which a real wallet wouldn't do, but which is useful for testing how a web service handles it.
+func (c FakeClient) PayAmount(invoice string, amount int64) (string, error) {
+	if amount <= 0 {
+		return "", errors.New("the amount must be positive")
+	}
+	return c.pay(invoice, amount)
+}
+
+// pay settles the invoice with the given amount, or with the amount of the invoice if amount is 0.
+func (c FakeClient) pay(invoice string, amount int64) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	encodedHash, ok := c.paymentRequests[invoice]
+	if !ok {
+		return "", errors.New("the invoice wasn't generated by this FakeClient")
+	}
+	fakeInvoice := c.invoices[encodedHash]
+	if fakeInvoice.canceled {
+		return "", errors.New("the invoice was canceled")
+	}
+	if amount == 0 {
+		if fakeInvoice.amount == 0 {
+			return "", errors.New("the invoice is amountless, so an amount must be chosen")
+		}
+		amount = fakeInvoice.amount
+	}
+	fakeInvoice.settled = true
+	fakeInvoice.amountPaid = amount
+	return base64.StdEncoding.EncodeToString(fakeInvoice.preimage), nil
+}
+
+// PayInvoice does the same as Pay(...), but also returns the paid amount, which is the amount of the invoice.
+// This way the FakeClient can also be used for the pay package.
+func (c FakeClient) PayInvoice(invoice string) (string, int64, error) {
+	preimage, err := c.Pay(invoice)
+	if err != nil {
+		return "", 0, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return preimage, c.invoices[c.paymentRequests[invoice]].amountPaid, nil
+}
+
+// Settle marks the invoice of the given Base64 encoded preimage as settled, with the given paid amount.
+// The preimage doesn't need to belong to an invoice that was generated by the client,
+// for example you can use a preimage that was generated with NewPreimage().
+func (c FakeClient) Settle(preimage string, amountPaid int64) error {
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	encodedHash := hex.EncodeToString(hashSlice)
+	invoice, ok := c.invoices[encodedHash]
+	if !ok {
+		invoice = &fakeInvoice{
+			amount: amountPaid,
+		}
+		c.invoices[encodedHash] = invoice
+	}
+	invoice.settled = true
+	invoice.amountPaid = amountPaid
+	return nil
+}
+
+// Preimage returns the Base64 encoded preimage of an invoice that was generated by the client, without paying it.
+// This is useful for testing how unpaid or canceled invoices are handled.
+func (c FakeClient) Preimage(invoice string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	encodedHash, ok := c.paymentRequests[invoice]
+	if !ok {
+		return "", errors.New("the invoice wasn't generated by this FakeClient")
+	}
+	return base64.StdEncoding.EncodeToString(c.invoices[encodedHash].preimage), nil
+}
+
+// Cancel cancels an invoice that was generated by the client and wasn't paid yet,
+// like a real node does when the invoice expires.
+func (c FakeClient) Cancel(invoice string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	encodedHash, ok := c.paymentRequests[invoice]
+	if !ok {
+		return errors.New("the invoice wasn't generated by this FakeClient")
+	}
+	fakeInvoice := c.invoices[encodedHash]
+	if fakeInvoice.settled {
+		return errors.New("the invoice was already paid")
+	}
+	fakeInvoice.canceled = true
+	return nil
+}
+
+// NewFakeClient creates a new FakeClient.
+func NewFakeClient() FakeClient {
+	return FakeClient{
+		lock:            &sync.Mutex{},
+		invoices:        make(map[string]*fakeInvoice),
+		paymentRequests: make(map[string]string),
+		count:           new(int),
+	}
+}
+
+// NewPreimage generates a random preimage and returns it as well as its hash, both Base64 encoded.
+// It's the same format that HashPreimage(...) returns and that's being shown by lncli listinvoices.
+func NewPreimage() (preimage string, hash string, err error) {
+	preimageBytes := make([]byte, 32)
+	if _, err = rand.Read(preimageBytes); err != nil {
+		return "", "", err
+	}
+	hashBytes := sha256.Sum256(preimageBytes)
+	preimage = base64.StdEncoding.EncodeToString(preimageBytes)
+	hash = base64.StdEncoding.EncodeToString(hashBytes[:])
+	return preimage, hash, nil
+}
+
+// encodeFakeInvoice encodes a BOLT11 invoice for regtest with the given amount (in Satoshis), payment hash and memo.
+// The signature consists of zeros only, so it's invalid.
+func encodeFakeInvoice(amount int64, hash []byte, memo string) (string, error) {
+	// The data part consists of 5-bit groups: 7 for the timestamp, then the tagged fields and finally 104 for the signature.
+	data := make([]byte, 0, 7+3+52+104)
+	for i := 6; i >= 0; i-- {
+		data = append(data, byte((fakeInvoiceTimestamp>>(uint(i)*5))&31))
+	}
+	const paymentHashType = 1
+	const descriptionType = 13
+	data, err := appendTaggedField(data, paymentHashType, hash)
+	if err != nil {
+		return "", err
+	}
+	if memo != "" {
+		data, err = appendTaggedField(data, descriptionType, []byte(memo))
+		if err != nil {
+			return "", err
+		}
+	}
+	data = append(data, make([]byte, 104)...)
+
+	hrp := "lnbcrt"
+	if amount > 0 {
+		// 1 Satoshi is 10 nano-bitcoin
+		hrp += fmt.Sprintf("%dn", amount*10)
+	}
+	return bech32.Encode(hrp, data)
+}
+
+// appendTaggedField appends a tagged field to the 5-bit groups of an invoice.
+// A tagged field consists of 1 group for the type, 2 groups for the data length and the data.
+func appendTaggedField(data []byte, fieldType byte, value []byte) ([]byte, error) {
+	converted, err := bech32.ConvertBits(value, 8, 5, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(converted) > 1023 {
+		return nil, errors.New("the value of the tagged field is too long")
+	}
+	data = append(data, fieldType, byte(len(converted)>>5), byte(len(converted)&31))
+	return append(data, converted...), nil
+}
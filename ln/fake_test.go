@@ -0,0 +1,134 @@
+package ln_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestFakeClientImpl tests if FakeClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestFakeClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.NewFakeClient()
+}
+
+// TestLNDclientContextImpl tests if LNDclient implements the optional wall.ContextLNclient
+// and wall.ContextAmountPaidLNclient interfaces.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestLNDclientContextImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.ContextLNclient = ln.LNDclient{}
+	var _ wall.ContextAmountPaidLNclient = ln.LNDclient{}
+}
+
+// TestAmountPaidImpl tests if LNDclient and FakeClient implement the optional wall.AmountPaidLNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestAmountPaidImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.AmountPaidLNclient = ln.LNDclient{}
+	var _ wall.AmountPaidLNclient = ln.NewFakeClient()
+}
+
+// TestSettlementImpl tests if LNDclient and FakeClient implement the wall.SettlementLNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestSettlementImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.SettlementLNclient = ln.LNDclient{}
+	var _ wall.SettlementLNclient = ln.NewFakeClient()
+}
+
+// TestFakeClientPaymentFlow tests the whole payment flow of a middleware with a FakeClient:
+// Getting an invoice, paying it and using the preimage once.
+func TestFakeClientPaymentFlow(t *testing.T) {
+	fakeClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{Price: 10}, fakeClient, storage.NewGoMap())(next)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.Code)
+	}
+	invoice, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, err := fakeClient.Pay(string(invoice))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The preimage must only be accepted once
+	for _, expectedCode := range []int{http.StatusOK, http.StatusBadRequest} {
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Preimage", preimage)
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != expectedCode {
+			t.Errorf("Expected status code %v, but was %v", expectedCode, res.Code)
+		}
+	}
+}
+
+// TestFakeClientSettle tests if CheckInvoice(...) returns the correct results for settled, unpaid and unknown preimages.
+func TestFakeClientSettle(t *testing.T) {
+	fakeClient := ln.NewFakeClient()
+	preimage, hash, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHash, err := ln.HashPreimage(preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != expectedHash {
+		t.Errorf("Expected hash %v, but was %v", expectedHash, hash)
+	}
+
+	_, err = fakeClient.CheckInvoice(preimage, 10)
+	if err != ln.ErrInvoiceNotFound {
+		t.Errorf("Expected error %v, but was %v", ln.ErrInvoiceNotFound, err)
+	}
+	if err = fakeClient.Settle(preimage, 10); err != nil {
+		t.Fatal(err)
+	}
+	settled, err := fakeClient.CheckInvoice(preimage, 10)
+	if err != nil || !settled {
+		t.Errorf("Expected the invoice to be settled, but was %v (error: %v)", settled, err)
+	}
+	_, err = fakeClient.CheckInvoice(preimage, 11)
+	if err != ln.ErrInsufficientAmount {
+		t.Errorf("Expected error %v, but was %v", ln.ErrInsufficientAmount, err)
+	}
+
+	// Generated, but not paid
+	invoice, err := fakeClient.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClient := ln.NewFakeClient()
+	otherInvoice, err := otherClient.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice != otherInvoice {
+		t.Errorf("Expected the invoices to be deterministic, but %v != %v", invoice, otherInvoice)
+	}
+	otherPreimage, err := otherClient.Pay(otherInvoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settled, err = fakeClient.CheckInvoice(otherPreimage, 10)
+	if err != nil || settled {
+		t.Errorf("Expected the invoice not to be settled, but was %v (error: %v)", settled, err)
+	}
+}
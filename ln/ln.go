@@ -3,17 +3,248 @@ package ln
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
 )
 
-// HashPreimage hashes the Base64 preimage and encodes the hash in Base64.
+// ErrInvoiceNotFound is returned by LN clients when no invoice exists for a given preimage.
+// The error message is the same as the one lnd returns in this case.
+var ErrInvoiceNotFound = errors.New("unable to locate invoice")
+
+// ErrInsufficientAmount is returned by LN clients when the invoice for a given preimage was settled,
+// but the paid amount is lower than the expected amount.
+var ErrInsufficientAmount = errors.New("the paid amount is lower than the expected amount")
+
+// ErrInvoiceCanceled is returned by LN clients when the invoice for a given preimage was canceled or has expired,
+// which means it can't be paid anymore.
+var ErrInvoiceCanceled = errors.New("the invoice was canceled or has expired")
+
+// ErrInsufficientInboundLiquidity is returned by LN clients when the inbound liquidity of the node
+// is lower than the amount of the invoice that should be generated, so the invoice couldn't be paid.
+var ErrInsufficientInboundLiquidity = errors.New("the inbound liquidity of the node is lower than the amount of the invoice")
+
+// ErrSettlementTimeout is returned by LN clients when an invoice wasn't settled within the time they waited for it.
+var ErrSettlementTimeout = errors.New("the invoice wasn't settled in time")
+
+// MaxMemoLength is the maximum length of the memo of an invoice in bytes.
+// The length of a tagged field in a BOLT11 invoice is limited to 1023 5-bit groups, which are 639 bytes.
+// lnd accepts memos of up to 1024 bytes, but then fails to encode the invoice.
+const MaxMemoLength = 639
+
+// DescriptionHash returns the SHA-256 hash of the given description,
+// for invoices that contain the hash instead of a memo, see LNDclient.GenerateInvoiceWithDescriptionHash.
+func DescriptionHash(description string) []byte {
+	hash := sha256.Sum256([]byte(description))
+	return hash[:]
+}
+
+// ErrMemoTooLong is returned by LN clients when the memo of an invoice that should be generated is longer than MaxMemoLength.
+// The middlewares trim memos with TrimMemo, so they never lead to this error.
+var ErrMemoTooLong = fmt.Errorf("the memo is longer than the %v bytes that an invoice allows", MaxMemoLength)
+
+// TrimMemo trims the memo to MaxMemoLength bytes, without splitting a multi-byte UTF-8 character.
+func TrimMemo(memo string) string {
+	if len(memo) <= MaxMemoLength {
+		return memo
+	}
+	end := MaxMemoLength
+	for end > 0 && !utf8.RuneStart(memo[end]) {
+		end--
+	}
+	return memo[:end]
+}
+
+// InvoiceState is the state of an invoice.
+type InvoiceState string
+
+const (
+	// InvoiceStateOpen means the invoice wasn't paid yet, but can still be paid.
+	InvoiceStateOpen InvoiceState = "open"
+	// InvoiceStateAccepted means the payment of a hold invoice was accepted, but the invoice wasn't settled yet.
+	InvoiceStateAccepted InvoiceState = "accepted"
+	// InvoiceStateSettled means the invoice was paid.
+	InvoiceStateSettled InvoiceState = "settled"
+	// InvoiceStateCanceled means the invoice was canceled or has expired, so it can't be paid anymore.
+	InvoiceStateCanceled InvoiceState = "canceled"
+)
+
+// Invoice contains the payment request of a Lightning invoice as well as some of its details.
+type Invoice struct {
+	// BOLT-11 encoded payment request
+	PaymentRequest string
+	// Hex encoded payment hash
+	RHash string
+	// Amount of the invoice in Satoshis, 0 for amountless invoices.
+	// Note that this is the amount that's requested, not the amount that was paid,
+	// which can be higher and is returned by LNDclient.CheckInvoicePaid(...).
+	Value int64
+}
+
+// DecodedInvoice contains the details of a decoded BOLT-11 payment request.
+type DecodedInvoice struct {
+	// Hex encoded payment hash
+	PaymentHash string
+	// Amount in Satoshis, 0 for invoices without amount
+	Amount int64
+	// Memo of the invoice
+	Description string
+	// Hex encoded public key of the node that created the invoice
+	Destination string
+	// Creation time of the invoice
+	CreatedAt time.Time
+	// Duration after the creation time after which the invoice can't be paid anymore
+	Expiry time.Duration
+	// Number of route hints, which are required for paying nodes that only have private channels
+	RouteHints int
+}
+
+// NodeInfo contains general information about a Lightning Network node.
+type NodeInfo struct {
+	// Hex encoded public key of the node
+	IdentityPubkey string
+	// Alias of the node
+	Alias string
+	// Height of the latest block the node knows of
+	BlockHeight uint32
+	// Whether the node is synced to the chain
+	SyncedToChain bool
+}
+
+// HashPreimage hashes the Base64 (or hex) encoded preimage and encodes the hash in Base64.
 // It's the same format that's being shown by lncli listinvoices (preimage as well as hash).
 func HashPreimage(preimage string) (string, error) {
-	decodedPreimage, err := base64.StdEncoding.DecodeString(preimage)
+	hashSlice, err := decodeAndHashPreimage(preimage)
 	if err != nil {
 		return "", err
 	}
-	hash := sha256.Sum256([]byte(decodedPreimage))
-	hashSlice := hash[:]
 	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
 	return encodedHash, nil
 }
+
+// DecodePreimage decodes a preimage that's encoded in Base64 or in hex.
+// Preimages are 32 bytes, so the encoding is detected by the length:
+// A hex encoded preimage consists of exactly 64 hex characters, while a Base64 encoded one has 44 characters.
+// All other values are decoded as Base64.
+// In case of invalid Base64 characters the error from the base64 package is returned unchanged,
+// so the middleware can detect it as such.
+func DecodePreimage(preimage string) ([]byte, error) {
+	if IsHexPreimage(preimage) {
+		return hex.DecodeString(preimage)
+	}
+	return base64.StdEncoding.DecodeString(preimage)
+}
+
+// IsHexPreimage returns true if the preimage consists of exactly 64 hex characters,
+// which is the hex encoding of 32 bytes, as shown by most wallets.
+func IsHexPreimage(preimage string) bool {
+	if len(preimage) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(preimage)
+	return err == nil
+}
+
+// decodeAndHashPreimage decodes the Base64 or hex encoded preimage and returns the SHA-256 hash of the decoded bytes.
+// In case of invalid Base64 characters the error from the base64 package is returned unchanged,
+// so the middleware can detect it as such.
+func decodeAndHashPreimage(preimage string) ([]byte, error) {
+	decodedPreimage, err := DecodePreimage(preimage)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(decodedPreimage)
+	return hash[:], nil
+}
+
+// Logger is an abstraction for loggers, so that you can use the logger of your choice or disable logging.
+// *log.Logger from the standard library implements it, and most other logging libraries have a Printf method as well.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// NoopLogger is a Logger that discards all messages.
+type NoopLogger struct{}
+
+// Printf does nothing.
+func (l NoopLogger) Printf(format string, v ...interface{}) {}
+
+// DefaultInvoiceExpiry is the expiry of a BOLT11 invoice that doesn't specify one.
+const DefaultInvoiceExpiry = time.Hour
+
+// PaymentHashFromInvoice extracts the payment hash from a BOLT11 invoice without validating the invoice,
+// so only use it for invoices from a trusted source, like the invoices that your own LN node generated.
+func PaymentHashFromInvoice(invoice string) ([]byte, error) {
+	const paymentHashType = 1
+	_, fields, err := decodeInvoiceData(invoice)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if field[0] == paymentHashType && len(field) == 1+52 {
+			return bech32.ConvertBits(field[1:], 5, 8, false)
+		}
+	}
+	return nil, errors.New("the invoice doesn't contain a payment hash")
+}
+
+// ExpiryFromInvoice returns the time at which a BOLT11 invoice expires, which is its timestamp plus its expiry,
+// or plus DefaultInvoiceExpiry if it doesn't specify one.
+// Like PaymentHashFromInvoice it doesn't validate the invoice, so only use it for invoices from a trusted source.
+func ExpiryFromInvoice(invoice string) (time.Time, error) {
+	const expiryType = 6
+	timestamp, fields, err := decodeInvoiceData(invoice)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiry := DefaultInvoiceExpiry
+	for _, field := range fields {
+		if field[0] == expiryType {
+			expiry = time.Duration(decodeInvoiceInt(field[1:])) * time.Second
+			break
+		}
+	}
+	return time.Unix(timestamp, 0).Add(expiry), nil
+}
+
+// decodeInvoiceData returns the timestamp and the tagged fields of a BOLT11 invoice, without validating the invoice.
+// The data part of an invoice consists of 5-bit groups: 7 for the timestamp, then the tagged fields and finally 104 for the signature.
+// Each tagged field consists of 1 group for the type, 2 groups for the data length and the data.
+// The returned fields consist of the group for the type and the groups of the data.
+func decodeInvoiceData(invoice string) (int64, [][]byte, error) {
+	_, data, err := bech32.DecodeNoLimit(strings.ToLower(invoice))
+	if err != nil {
+		return 0, nil, err
+	}
+	const timestampLength = 7
+	const signatureLength = 104
+	if len(data) < timestampLength+signatureLength {
+		return 0, nil, errors.New("the invoice is too short")
+	}
+	timestamp := decodeInvoiceInt(data[:timestampLength])
+	var fields [][]byte
+	remaining := data[timestampLength : len(data)-signatureLength]
+	for len(remaining) >= 3 {
+		fieldLength := int(remaining[1])<<5 | int(remaining[2])
+		if len(remaining) < 3+fieldLength {
+			return 0, nil, errors.New("the invoice contains an invalid tagged field")
+		}
+		fields = append(fields, append([]byte{remaining[0]}, remaining[3:3+fieldLength]...))
+		remaining = remaining[3+fieldLength:]
+	}
+	return timestamp, fields, nil
+}
+
+// decodeInvoiceInt decodes a big-endian integer from 5-bit groups, like the timestamp and the expiry of an invoice.
+func decodeInvoiceInt(groups []byte) int64 {
+	var result int64
+	for _, group := range groups {
+		result = result<<5 | int64(group)
+	}
+	return result
+}
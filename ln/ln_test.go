@@ -0,0 +1,73 @@
+package ln_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+)
+
+// TestHashPreimageEncodings tests if the Base64 and the hex encoding of a preimage lead to the same payment hash.
+func TestHashPreimageEncodings(t *testing.T) {
+	base64Preimage, expectedHash, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedPreimage, err := base64.StdEncoding.DecodeString(base64Preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, preimage := range []string{
+		base64Preimage,
+		hex.EncodeToString(decodedPreimage),
+		// Hex is case-insensitive
+		hex.EncodeToString(decodedPreimage)[:32] + strings.ToUpper(hex.EncodeToString(decodedPreimage)[32:]),
+	} {
+		hash, err := ln.HashPreimage(preimage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != expectedHash {
+			t.Errorf("Expected hash %v for preimage %v, but was %v", expectedHash, preimage, hash)
+		}
+	}
+
+	if _, err = ln.HashPreimage("not a preimage"); err == nil {
+		t.Error("Expected an error for an invalid preimage, but was nil")
+	}
+}
+
+// TestExpiryFromInvoice tests if the expiry is read from an invoice with an expiry field
+// and if the default expiry is used for an invoice without one.
+func TestExpiryFromInvoice(t *testing.T) {
+	// Example from BOLT11 with the timestamp 1496314658 and an expiry of 60 seconds
+	invoice := "lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpuaztrnwngzn3kdzw5hydlzf03qdgm2hdq27cqv3agm2awhz5se903vruatfhq77w3ls4evs3ch9zw97j25emudupq63nyw24cg27h2rspfj9srp"
+	expiry, err := ln.ExpiryFromInvoice(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry.Unix() != 1496314658+60 {
+		t.Errorf("Expected the expiry %v, but was %v", 1496314658+60, expiry.Unix())
+	}
+	// The payment hash is still found after refactoring the parsing of the tagged fields
+	paymentHash, err := ln.PaymentHashFromInvoice(invoice)
+	if err != nil || hex.EncodeToString(paymentHash) != "0001020304050607080900010203040506070809000102030405060708090102" {
+		t.Errorf("Expected the payment hash of the example, but was %x (error: %v)", paymentHash, err)
+	}
+
+	// Fake invoices don't contain an expiry
+	invoice, err = ln.NewFakeClient().GenerateInvoice(1, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, err = ln.ExpiryFromInvoice(invoice)
+	if err != nil || expiry.Unix() != 1496314658+3600 {
+		t.Errorf("Expected the default expiry %v, but was %v (error: %v)", 1496314658+3600, expiry.Unix(), err)
+	}
+	if _, err = ln.ExpiryFromInvoice("invalid"); err == nil {
+		t.Error("Expected an error for an invalid invoice, but was nil")
+	}
+}
@@ -0,0 +1,177 @@
+package ln
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// LNbitsClient is an implementation of the wall.LNclient interface for LNbits (https://lnbits.com).
+// LNbits is a wallet and accounts system that runs on top of a Lightning Network node,
+// so you can use the paywall without running your own node by using an LNbits instance someone else runs.
+type LNbitsClient struct {
+	address    string
+	apiKey     string
+	httpClient *http.Client
+	logger     Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo.
+// LNbits doesn't support amountless invoices, so an amount of 0 leads to an error.
+func (c LNbitsClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	if amount == 0 {
+		return "", errors.New("LNbits doesn't support amountless invoices")
+	}
+	// Create the request and send it
+	payment := lnbitsCreatePayment{
+		Out:    false,
+		Amount: amount,
+		Memo:   memo,
+	}
+	reqBody, err := json.Marshal(payment)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	res := lnbitsCreatePaymentResponse{}
+	err = c.do("POST", "/api/v1/payments", reqBody, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.PaymentRequest, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// An error is returned if the preimage contains invalid Base64 characters.
+// ErrInvoiceNotFound is returned if no corresponding invoice was found.
+// ErrInsufficientAmount is returned if less than the expected amount was paid.
+// False is returned if the invoice isn't settled.
+func (c LNbitsClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding invoice to check if it's settled
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the invoice for that hash.
+	// The hash must be hex encoded in the URL path.
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	res := lnbitsPaymentStatus{}
+	err = c.do("GET", "/api/v1/payments/"+hex.EncodeToString(hashSlice), nil, &res)
+	if apiErr, ok := err.(lnbitsError); ok && apiErr.statusCode == http.StatusNotFound {
+		// LNbits responds with 404 for unknown payment hashes
+		return false, ErrInvoiceNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	// Check if invoice was settled
+	if !res.Paid {
+		return false, nil
+	}
+	// Check if enough was paid
+	if res.Details.Amount < expectedAmount*1000 {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// do sends a request to the given endpoint of the LNbits API
+// and decodes the JSON response into the given result object.
+func (c LNbitsClient) do(method string, endpoint string, reqBody []byte, result interface{}) error {
+	req, err := http.NewRequest(method, c.address+endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", c.apiKey)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return lnbitsError{statusCode: res.StatusCode, endpoint: endpoint, body: string(resBody)}
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// lnbitsError is the error for a response of the LNbits API with a status other than 200 and 201.
+// A 404 only means that the payment doesn't exist for lookups, for other endpoints it means that the address is wrong.
+type lnbitsError struct {
+	statusCode int
+	endpoint   string
+	body       string
+}
+
+func (e lnbitsError) Error() string {
+	return fmt.Sprintf("LNbits responded with status %v to %v: %s", e.statusCode, e.endpoint, e.body)
+}
+
+// NewLNbitsClient creates a new LNbitsClient instance.
+func NewLNbitsClient(lnbitsOptions LNbitsOptions) LNbitsClient {
+	// Set default values
+	if lnbitsOptions.Address == "" {
+		lnbitsOptions.Address = DefaultLNbitsOptions.Address
+	}
+	if lnbitsOptions.Logger == nil {
+		lnbitsOptions.Logger = NoopLogger{}
+	}
+
+	return LNbitsClient{
+		address:    strings.TrimSuffix(lnbitsOptions.Address, "/"),
+		apiKey:     lnbitsOptions.APIKey,
+		httpClient: http.DefaultClient,
+		logger:     lnbitsOptions.Logger,
+	}
+}
+
+// LNbitsOptions are the options for the connection to the LNbits instance.
+type LNbitsOptions struct {
+	// Base URL of the LNbits instance, including the scheme and port (if it's not the default port of the scheme).
+	// Optional ("http://localhost:5000" by default).
+	Address string
+	// API key of the LNbits wallet.
+	// The "Invoice/read key" is sufficient, there's no need to use the "Admin key".
+	APIKey string
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultLNbitsOptions provides default values for LNbitsOptions.
+var DefaultLNbitsOptions = LNbitsOptions{
+	Address: "http://localhost:5000",
+}
+
+type lnbitsCreatePayment struct {
+	Out    bool   `json:"out"`
+	Amount int64  `json:"amount"`
+	Memo   string `json:"memo"`
+}
+
+type lnbitsCreatePaymentResponse struct {
+	PaymentHash    string `json:"payment_hash"`
+	PaymentRequest string `json:"payment_request"`
+}
+
+type lnbitsPaymentStatus struct {
+	Paid    bool `json:"paid"`
+	Details struct {
+		// Amount in millisatoshis
+		Amount int64 `json:"amount"`
+	} `json:"details"`
+}
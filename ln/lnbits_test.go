@@ -0,0 +1,115 @@
+package ln_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestLNbitsClientImpl tests if LNbitsClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestLNbitsClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.LNbitsClient{}
+}
+
+// TestLNbitsClient tests if the LNbitsClient sends the API key, creates invoices
+// and maps the responses of "/api/v1/payments/{payment_hash}" to the results of CheckInvoice.
+func TestLNbitsClient(t *testing.T) {
+	preimages := map[string]string{}
+	// Hex encoded payment hash -> body of the lookup response
+	payments := map[string]string{}
+	addPayment := func(name string, body string) {
+		preimage, hash, err := ln.NewPreimage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashBytes, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preimages[name] = preimage
+		payments[hex.EncodeToString(hashBytes)] = body
+	}
+	addPayment("paid", `{"paid":true,"preimage":"00","details":{"amount":10000}}`)
+	addPayment("underpaid", `{"paid":true,"preimage":"00","details":{"amount":9999}}`)
+	addPayment("unpaid", `{"paid":false,"details":{"amount":10000}}`)
+	unknownPreimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimages["unknown"] = unknownPreimage
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"detail":"Invalid key"}`)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/v1/payments":
+			var payment map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&payment); err != nil || payment["out"] != false || payment["amount"] != float64(10) || payment["memo"] != "API call" {
+				t.Errorf("Unexpected payment in the request: %v (error: %v)", payment, err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"payment_hash":"00","payment_request":"lnbcrt100n1"}`)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/payments/"):
+			body, ok := payments[strings.TrimPrefix(r.URL.Path, "/api/v1/payments/")]
+			if !ok {
+				// LNbits' response for an unknown payment hash
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"detail":"Payment does not exist."}`)
+				return
+			}
+			fmt.Fprint(w, body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"detail":"Not Found"}`)
+		}
+	}))
+	defer server.Close()
+	c := ln.NewLNbitsClient(ln.LNbitsOptions{Address: server.URL, APIKey: "secret"})
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil || invoice != "lnbcrt100n1" {
+		t.Errorf("Expected the invoice lnbcrt100n1, but was %q (error: %v)", invoice, err)
+	}
+	if _, err = c.GenerateInvoice(0, "API call"); err == nil {
+		t.Error("Expected an error for an amountless invoice, but was nil")
+	}
+	testCases := []struct {
+		name            string
+		expectedSettled bool
+		expectedErr     error
+	}{
+		{"paid", true, nil},
+		{"underpaid", false, ln.ErrInsufficientAmount},
+		{"unpaid", false, nil},
+		{"unknown", false, ln.ErrInvoiceNotFound},
+	}
+	for _, testCase := range testCases {
+		settled, err := c.CheckInvoice(preimages[testCase.name], 10)
+		if settled != testCase.expectedSettled || err != testCase.expectedErr {
+			t.Errorf("Expected %v and error %v for the %v payment, but was %v and %v", testCase.expectedSettled, testCase.expectedErr, testCase.name, settled, err)
+		}
+	}
+
+	wrongKeyClient := ln.NewLNbitsClient(ln.LNbitsOptions{Address: server.URL, APIKey: "wrong"})
+	if _, err = wrongKeyClient.CheckInvoice(preimages["paid"], 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a wrong API key, but was %v", err)
+	}
+	// A 404 for the invoice creation means a wrong address, not an unknown payment
+	wrongAddressClient := ln.NewLNbitsClient(ln.LNbitsOptions{Address: server.URL + "/wrong", APIKey: "secret"})
+	if _, err = wrongAddressClient.GenerateInvoice(10, "API call"); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a wrong address, but was %v", err)
+	}
+}
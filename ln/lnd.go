@@ -1,132 +1,934 @@
 package ln
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/net/proxy"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 )
 
 // LNDclient is an implementation of the wall.Client interface for the lnd Lightning Network node implementation.
 type LNDclient struct {
 	lndClient lnrpc.LightningClient
-	ctx       context.Context
-	conn      *grpc.ClientConn
+	// For hold invoices
+	invoicesClient invoicesrpc.InvoicesClient
+	ctx            context.Context
+	conn           *grpc.ClientConn
+	cancel         context.CancelFunc
+	expiry         int64
+	logger         Logger
+	// Leads to route hints for private channels in generated invoices
+	privateRouteHints bool
+	// Returns the on-chain fallback address for generated invoices, nil if there's none
+	fallbackAddress func() string
+	// For WaitForSettlement
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+	// Only set when the invoice subscription is enabled
+	settledInvoices *settledInvoices
+	// Only set when keysend payments are enabled
+	keysend *keysend
+	// Duration before the start of the invoice subscription in which settled invoices are loaded
+	reconcileWindow time.Duration
+	// Only set when the inbound liquidity check is enabled
+	inboundLiquidity *inboundLiquidity
+	// Deduplicates concurrent lookups of the same invoice
+	lookupGroup *singleflight.Group
+	// Only set when the cache of settled invoices is enabled
+	settledCache *settledCache
 }
 
 // GenerateInvoice generates an invoice with the given price and memo.
+// An amount of 0 leads to an amountless invoice, for which the payer chooses the amount.
+// Use CheckInvoicePaid to find out how much was paid then.
+// ErrMemoTooLong is returned if the memo is longer than MaxMemoLength, see TrimMemo.
 func (c LNDclient) GenerateInvoice(amount int64, memo string) (string, error) {
+	return c.GenerateInvoiceCtx(c.ctx, amount, memo)
+}
+
+// GenerateInvoiceCtx does the same as GenerateInvoice, but uses the given context for the requests to lnd,
+// so they're canceled when the context is canceled or its deadline is exceeded.
+// The macaroon is added to the context automatically.
+// The middlewares use it with the context of the incoming request.
+func (c LNDclient) GenerateInvoiceCtx(ctx context.Context, amount int64, memo string) (string, error) {
+	invoice, err := c.generateInvoiceDetailed(c.withMacaroon(ctx), amount*1000, memo, nil)
+	if err != nil {
+		return "", err
+	}
+	return invoice.PaymentRequest, nil
+}
+
+// GenerateInvoiceMsat generates an invoice with the given price in millisatoshis and memo,
+// for prices that need sub-Satoshi precision, like 100 msat per API call.
+// Use CheckInvoiceMsat to check such invoices, because CheckInvoice only compares whole Satoshis.
+//
+// BOLT11 invoices can contain millisatoshi amounts, but not all wallets can pay them:
+// Most wallets round up to the next full Satoshi, which lnd accepts as an overpayment,
+// but some refuse to pay the invoice. So prefer prices in whole Satoshis for wallets you don't know.
+// The inbound liquidity check (see CheckInboundLiquidity) rounds up to the next full Satoshi as well.
+func (c LNDclient) GenerateInvoiceMsat(amountMsat int64, memo string) (string, error) {
+	invoice, err := c.generateInvoiceDetailed(c.ctx, amountMsat, memo, nil)
+	if err != nil {
+		return "", err
+	}
+	return invoice.PaymentRequest, nil
+}
+
+// GenerateInvoiceDetailed generates an invoice with the given price and memo.
+// In contrast to GenerateInvoice it doesn't only return the payment request,
+// but also the payment hash and amount, which is useful for logging and reconciliation for example.
+// ErrInsufficientInboundLiquidity is returned if CheckInboundLiquidity is enabled and the invoice couldn't be paid.
+func (c LNDclient) GenerateInvoiceDetailed(amount int64, memo string) (Invoice, error) {
+	return c.generateInvoiceDetailed(c.ctx, amount*1000, memo, nil)
+}
+
+// GenerateInvoiceWithDescriptionHash generates an invoice with the given price and the SHA-256 hash of a description
+// instead of a memo (the "h" tag of BOLT11), for example to bind the payment to a document or terms
+// that are too long for a memo. The payer must get the description itself out-of-band to verify the hash,
+// see DescriptionHash for creating it.
+// An error is returned if the description hash doesn't have 32 bytes.
+func (c LNDclient) GenerateInvoiceWithDescriptionHash(amount int64, descriptionHash []byte) (Invoice, error) {
+	if len(descriptionHash) != sha256.Size {
+		return Invoice{}, fmt.Errorf("the description hash must have %v bytes, but has %v", sha256.Size, len(descriptionHash))
+	}
+	return c.generateInvoiceDetailed(c.ctx, amount*1000, "", descriptionHash)
+}
+
+// generateInvoiceDetailed generates an invoice for the given amount in millisatoshis. ctx must already contain the macaroon.
+// Only one of memo and descriptionHash may be set.
+func (c LNDclient) generateInvoiceDetailed(ctx context.Context, amountMsat int64, memo string, descriptionHash []byte) (Invoice, error) {
+	// lnd would only fail with a generic error
+	if len(memo) > MaxMemoLength {
+		return Invoice{}, ErrMemoTooLong
+	}
+	if memo != "" && descriptionHash != nil {
+		return Invoice{}, errors.New("an invoice can either have a memo or a description hash, not both")
+	}
+	if c.inboundLiquidity != nil {
+		if err := c.checkInboundLiquidity(ctx, (amountMsat+999)/1000); err != nil {
+			return Invoice{}, err
+		}
+	}
 	// Create the request and send it
 	invoice := lnrpc.Invoice{
-		Memo:  memo,
-		Value: amount,
+		Memo:            memo,
+		DescriptionHash: descriptionHash,
+		ValueMsat:       amountMsat,
+		Expiry:          c.expiry,
+		Private:         c.privateRouteHints,
 	}
-	log.Println("Creating invoice for a new API request")
-	res, err := c.lndClient.AddInvoice(c.ctx, &invoice)
+	if c.fallbackAddress != nil {
+		invoice.FallbackAddr = c.fallbackAddress()
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	res, err := c.lndClient.AddInvoice(ctx, &invoice)
 	if err != nil {
-		return "", err
+		return Invoice{}, err
 	}
 
-	return res.GetPaymentRequest(), nil
+	return Invoice{
+		PaymentRequest: res.GetPaymentRequest(),
+		RHash:          hex.EncodeToString(res.GetRHash()),
+		Value:          amountMsat / 1000,
+	}, nil
 }
 
 // CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
-// and checks if the invoice was settled.
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// Hex encoded preimages are accepted as well, see DecodePreimage.
 // An error is returned if the preimage contains invalid Base64 characters or if no corresponding invoice was found.
+// ErrInsufficientAmount is returned if less than the expected amount was paid.
 // False is returned if the invoice isn't settled.
-func (c LNDclient) CheckInvoice(preimage string) (bool, error) {
+func (c LNDclient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	return c.CheckInvoiceCtx(c.ctx, preimage, expectedAmount)
+}
+
+// CheckInvoiceCtx does the same as CheckInvoice, but uses the given context for the request to lnd,
+// so it's canceled when the context is canceled or its deadline is exceeded.
+// The macaroon is added to the context automatically.
+// The middlewares use it with the context of the incoming request.
+func (c LNDclient) CheckInvoiceCtx(ctx context.Context, preimage string, expectedAmount int64) (bool, error) {
+	return c.checkInvoice(ctx, preimage, expectedAmount*1000)
+}
+
+// CheckInvoiceMsat does the same as CheckInvoice, but with the expected amount in millisatoshis,
+// for invoices that were generated with GenerateInvoiceMsat.
+// Payments that a wallet rounded up to the next full Satoshi are accepted, because more than the expected amount was paid.
+func (c LNDclient) CheckInvoiceMsat(preimage string, expectedAmountMsat int64) (bool, error) {
+	return c.checkInvoice(c.ctx, preimage, expectedAmountMsat)
+}
+
+// checkInvoice checks if the invoice of the preimage was settled and if at least the expected amount (in millisatoshis) was paid.
+func (c LNDclient) checkInvoice(ctx context.Context, preimage string, expectedAmountMsat int64) (bool, error) {
+	settled, amtPaidMsat, err := c.checkInvoicePaid(ctx, preimage)
+	if err != nil || !settled {
+		return false, err
+	}
+	// Check if enough was paid
+	if amtPaidMsat < expectedAmountMsat {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// checkInvoicePaid checks if the invoice of the preimage was settled and returns how much was paid (in millisatoshis).
+func (c LNDclient) checkInvoicePaid(ctx context.Context, preimage string) (settled bool, amtPaidMsat int64, err error) {
 	// Hash the preimage so we can get the corresponding invoice to check if it's settled
-	decodedPreimage, err := base64.StdEncoding.DecodeString(preimage)
+	hashSlice, err := decodeAndHashPreimage(preimage)
 	if err != nil {
-		return false, err
+		return false, 0, err
 	}
-	hash := sha256.Sum256([]byte(decodedPreimage))
-	hashSlice := hash[:]
 
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	// When the invoice subscription is enabled we might already know that the invoice was settled.
+	// Otherwise (or if the invoice was settled before the subscription was started) we ask lnd.
+	if c.settledInvoices != nil {
+		if amtPaidMsat, ok := c.settledInvoices.pop(hashSlice); ok {
+			return true, amtPaidMsat, nil
+		}
+	}
 	// Get the invoice for that hash
+	invoice, err := c.lookupInvoice(c.withMacaroon(ctx), hashSlice)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Make sure lnd returned the invoice we asked for
+	if !bytes.Equal(invoice.GetRHash(), hashSlice) {
+		return false, 0, fmt.Errorf("the payment hash of the invoice returned by lnd doesn't match the hash of the preimage")
+	}
+
+	// Check if invoice was settled
+	if !invoice.GetSettled() {
+		if getInvoiceState(invoice) == InvoiceStateCanceled {
+			return false, 0, ErrInvoiceCanceled
+		}
+		return false, 0, nil
+	}
+	return true, getAmtPaidMsat(invoice), nil
+}
+
+// getAmtPaidMsat returns the amount that was paid for the invoice in millisatoshis.
+// lnd always sets AmtPaidMsat, but clients injected via NewLNDclientWithRPC (like mocks) might only set AmtPaidSat.
+func getAmtPaidMsat(invoice *lnrpc.Invoice) int64 {
+	if invoice.GetAmtPaidMsat() == 0 {
+		return invoice.GetAmtPaidSat() * 1000
+	}
+	return invoice.GetAmtPaidMsat()
+}
+
+// CheckInvoicePaid takes a Base64 encoded preimage, fetches the corresponding invoice
+// and returns if it was settled and how much was paid (in Satoshis).
+// In contrast to the amount of the invoice (Invoice.Value) the paid amount is what the payer actually sent,
+// which can be more than the amount of the invoice, and for amountless invoices it's the only amount there is.
+// An error is returned if the preimage contains invalid Base64 characters or if no corresponding invoice was found.
+func (c LNDclient) CheckInvoicePaid(preimage string) (settled bool, amountPaid int64, err error) {
+	return c.CheckInvoicePaidCtx(c.ctx, preimage)
+}
+
+// CheckInvoicePaidCtx does the same as CheckInvoicePaid, but uses the given context for the request to lnd,
+// like CheckInvoiceCtx. The middlewares use it with the context of the incoming request.
+func (c LNDclient) CheckInvoicePaidCtx(ctx context.Context, preimage string) (settled bool, amountPaid int64, err error) {
+	settled, amtPaidMsat, err := c.checkInvoicePaid(ctx, preimage)
+	return settled, amtPaidMsat / 1000, err
+}
+
+// CheckInvoiceState takes a Base64 encoded preimage, fetches the corresponding invoice and returns its state.
+// In contrast to CheckInvoice it doesn't only tell if the invoice was settled,
+// but also if it can still be paid or if it was canceled or has expired.
+// An error is returned if the preimage contains invalid Base64 characters or if no corresponding invoice was found.
+func (c LNDclient) CheckInvoiceState(preimage string) (InvoiceState, error) {
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return "", err
+	}
+	invoice, err := c.lookupInvoice(c.ctx, hashSlice)
+	if err != nil {
+		return "", err
+	}
+	return getInvoiceState(invoice), nil
+}
+
+// lookupInvoice gets the invoice with the given payment hash from lnd.
+// Concurrent lookups of the same invoice (for example when a client retries a request many times)
+// share a single request to lnd and its result, including an error. Results aren't cached after the request is done,
+// except for settled invoices when CacheSettledInvoices is enabled.
+// The shared request keeps the values of the context of the first lookup, but not its cancellation,
+// so a canceled lookup only returns the error of its own context and doesn't let the other lookups fail.
+func (c LNDclient) lookupInvoice(ctx context.Context, hash []byte) (*lnrpc.Invoice, error) {
 	paymentHash := lnrpc.PaymentHash{
-		RHash: hashSlice,
+		RHash: hash,
 		// Hex encoded, must be exactly 32 byte
-		RHashStr: hex.EncodeToString(hashSlice),
+		RHashStr: hex.EncodeToString(hash),
 	}
-	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
-	log.Printf("Checking invoice for hash %v\n", encodedHash)
-	invoice, err := c.lndClient.LookupInvoice(c.ctx, &paymentHash)
+	if c.settledCache != nil {
+		if invoice, ok := c.settledCache.get(paymentHash.RHashStr); ok {
+			return invoice, nil
+		}
+	}
+	lookup := func(ctx context.Context) (interface{}, error) {
+		invoice, err := c.lndClient.LookupInvoice(ctx, &paymentHash)
+		if err != nil {
+			return nil, err
+		}
+		if c.settledCache != nil {
+			c.settledCache.add(paymentHash.RHashStr, invoice)
+		}
+		return invoice, nil
+	}
+	if c.lookupGroup == nil {
+		invoice, err := lookup(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return invoice.(*lnrpc.Invoice), nil
+	}
+	// The lookup is shared by all concurrent callers, so it must not be canceled when the caller that started it
+	// is canceled, for example because its client disconnected. Each caller only stops waiting for its own context.
+	resChan := c.lookupGroup.DoChan(paymentHash.RHashStr, func() (interface{}, error) {
+		lookupCtx, cancel := context.WithTimeout(detachedContext{ctx}, sharedLookupTimeout)
+		defer cancel()
+		return lookup(lookupCtx)
+	})
+	select {
+	case res := <-resChan:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*lnrpc.Invoice), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sharedLookupTimeout is the maximum duration of an invoice lookup that's shared by concurrent callers,
+// because it isn't bound to the deadline of any of them.
+const sharedLookupTimeout = 30 * time.Second
+
+// detachedContext is a context with the values of its parent context, like the macaroon metadata,
+// but without its deadline and cancellation, like context.WithoutCancel(...) of Go 1.21.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// getInvoiceState maps the state of an lnd invoice to an InvoiceState.
+// lnd cancels expired invoices only periodically, so open invoices that have expired are reported as canceled as well.
+func getInvoiceState(invoice *lnrpc.Invoice) InvoiceState {
+	switch invoice.GetState() {
+	case lnrpc.Invoice_SETTLED:
+		return InvoiceStateSettled
+	case lnrpc.Invoice_ACCEPTED:
+		return InvoiceStateAccepted
+	case lnrpc.Invoice_CANCELED:
+		return InvoiceStateCanceled
+	}
+	if invoice.GetCreationDate()+invoice.GetExpiry() < time.Now().Unix() {
+		return InvoiceStateCanceled
+	}
+	return InvoiceStateOpen
+}
+
+// WaitForSettlement waits until the invoice with the given hex encoded payment hash is settled,
+// for example the RHash of an invoice that was generated with GenerateInvoiceDetailed.
+// If the LNDclient was created with NewLNDclient(...), it subscribes to the invoice via the SubscribeSingleInvoice RPC
+// of lnd's invoices sub-server, so it returns as soon as lnd settles the invoice.
+// Otherwise, or if lnd was built without the sub-server, the invoice is looked up every PollInterval,
+// so you can balance the latency against the load on lnd.
+// ErrSettlementTimeout is returned if the invoice isn't settled within PollTimeout,
+// ErrInvoiceCanceled if it was canceled or has expired,
+// and the error of the context if it's done before that.
+func (c LNDclient) WaitForSettlement(ctx context.Context, paymentHash string) error {
+	hashSlice, err := hex.DecodeString(paymentHash)
 	if err != nil {
-		return false, err
+		return err
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.pollTimeout)
+	defer cancel()
+	if c.invoicesClient != nil {
+		err = c.subscribeSettlement(timeoutCtx, hashSlice)
+		if status.Code(err) == codes.Unimplemented {
+			c.logger.Printf("The invoices sub-server of lnd isn't available, polling the invoice instead: %v\n", err)
+			err = c.pollSettlement(timeoutCtx, hashSlice)
+		}
+	} else {
+		err = c.pollSettlement(timeoutCtx, hashSlice)
+	}
+	// gRPC wraps the error of the context, but it's more useful for the caller unwrapped
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil && timeoutCtx.Err() != nil {
+		return ErrSettlementTimeout
 	}
+	return err
+}
 
-	// Check if invoice was settled
-	if !invoice.GetSettled() {
-		return false, nil
+// subscribeSettlement waits until lnd reports via the invoice subscription that the invoice is settled or canceled.
+// lnd sends the current state of the invoice first, so an invoice that's already settled leads to an immediate return.
+func (c LNDclient) subscribeSettlement(ctx context.Context, hash []byte) error {
+	stream, err := c.invoicesClient.SubscribeSingleInvoice(c.withMacaroon(ctx), &invoicesrpc.SubscribeSingleInvoiceRequest{
+		RHash: hash,
+	})
+	if err != nil {
+		return err
 	}
-	return true, nil
+	for {
+		invoice, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch getInvoiceState(invoice) {
+		case InvoiceStateSettled:
+			return nil
+		case InvoiceStateCanceled:
+			return ErrInvoiceCanceled
+		}
+	}
+}
+
+// pollSettlement looks up the invoice every PollInterval until it's settled or canceled, or until the context is done.
+func (c LNDclient) pollSettlement(ctx context.Context, hash []byte) error {
+	paymentHashReq := lnrpc.PaymentHash{
+		RHash:    hash,
+		RHashStr: hex.EncodeToString(hash),
+	}
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		invoice, err := c.lndClient.LookupInvoice(c.withMacaroon(ctx), &paymentHashReq)
+		if err != nil {
+			return err
+		}
+		if invoice.GetSettled() {
+			return nil
+		} else if getInvoiceState(invoice) == InvoiceStateCanceled {
+			return ErrInvoiceCanceled
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// DecodeInvoice decodes the given BOLT-11 payment request, for example to double-check an invoice before paying it.
+// The invoice doesn't need to be generated by the lnd node.
+func (c LNDclient) DecodeInvoice(payReq string) (DecodedInvoice, error) {
+	res, err := c.lndClient.DecodePayReq(c.ctx, &lnrpc.PayReqString{
+		PayReq: payReq,
+	})
+	if err != nil {
+		return DecodedInvoice{}, err
+	}
+	return DecodedInvoice{
+		PaymentHash: res.GetPaymentHash(),
+		Amount:      res.GetNumSatoshis(),
+		Description: res.GetDescription(),
+		Destination: res.GetDestination(),
+		CreatedAt:   time.Unix(res.GetTimestamp(), 0),
+		Expiry:      time.Duration(res.GetExpiry()) * time.Second,
+		RouteHints:  len(res.GetRouteHints()),
+	}, nil
+}
+
+// PayInvoice pays the given BOLT11 invoice and returns the Base64 encoded preimage
+// as well as the paid amount in Satoshis, including routing fees.
+// Note: This requires a macaroon with the "offchain:write" permission, like the "admin.macaroon",
+// which the "invoice.macaroon" doesn't have.
+func (c LNDclient) PayInvoice(invoice string) (string, int64, error) {
+	c.logger.Printf("Paying invoice %v\n", invoice)
+	res, err := c.lndClient.SendPaymentSync(c.ctx, &lnrpc.SendRequest{
+		PaymentRequest: invoice,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	// lnd reports failed payments in the response instead of as error
+	if res.GetPaymentError() != "" {
+		return "", 0, errors.New(res.GetPaymentError())
+	}
+	preimage := base64.StdEncoding.EncodeToString(res.GetPaymentPreimage())
+	// Round up, because for the payer a fraction of a Satoshi is as good as a whole one
+	amountPaid := (res.GetPaymentRoute().GetTotalAmtMsat() + 999) / 1000
+	return preimage, amountPaid, nil
+}
+
+// GetInfo returns general information about the lnd node,
+// which is useful for example for verifying that the client is connected to the right node and that the node is synced.
+// Note: This requires a macaroon with the "info:read" permission, which the "invoice.macaroon" doesn't have.
+// You can use the "readonly.macaroon" or bake a macaroon with both permissions.
+func (c LNDclient) GetInfo() (NodeInfo, error) {
+	res, err := c.lndClient.GetInfo(c.ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{
+		IdentityPubkey: res.GetIdentityPubkey(),
+		Alias:          res.GetAlias(),
+		BlockHeight:    res.GetBlockHeight(),
+		SyncedToChain:  res.GetSyncedToChain(),
+	}, nil
+}
+
+// Ping checks if the lnd node can be reached and accepts the macaroon.
+// It's meant to be used for health checks / readiness probes.
+// The given context is used for the request, so you can set a deadline.
+// In contrast to GetInfo() it works with the "invoice.macaroon".
+func (c LNDclient) Ping(ctx context.Context) error {
+	req := lnrpc.ListInvoiceRequest{
+		NumMaxInvoices: 1,
+	}
+	_, err := c.lndClient.ListInvoices(c.withMacaroon(ctx), &req)
+	return err
+}
+
+// withMacaroon returns a copy of the given context that contains the macaroon metadata of the client.
+func (c LNDclient) withMacaroon(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(c.ctx)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// Raw returns the underlying lnrpc.LightningClient, for making calls that the LNDclient doesn't provide,
+// like ListInvoices or ChannelBalance.
+// The calls bypass the logic of this package. For example the macaroon isn't sent automatically,
+// so you need to add it to the context of each call yourself, which you can do with
+// metadata.AppendToOutgoingContext(ctx, "macaroon", macaroonHex) from the package google.golang.org/grpc/metadata.
+// Note that the "invoice.macaroon" only grants access to a few calls.
+func (c LNDclient) Raw() lnrpc.LightningClient {
+	return c.lndClient
+}
+
+// Conn returns the underlying gRPC connection to the lnd node,
+// for example for creating clients for lnd's sub-servers like the router.
+// The same as for Raw() applies: The macaroon must be added to the context of each call.
+// Don't close the connection, call Close() on the LNDclient instead.
+func (c LNDclient) Conn() *grpc.ClientConn {
+	return c.conn
+}
+
+// Close cancels all ongoing requests, stops the invoice subscription (if it's enabled)
+// and closes the connection to the lnd node.
+// The client can't be used anymore afterwards.
+func (c LNDclient) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
 }
 
 // NewLNDclient creates a new LNDclient instance.
+// Before connecting to lnd it checks that the address contains a port and that the cert and macaroon files
+// exist and are readable (unless CertPEM or MacaroonHex are used), so that the error names the offending option.
+// Call Close() when you don't need the client anymore, for example when the web service shuts down.
 func NewLNDclient(lndOptions LNDoptions) (LNDclient, error) {
 	result := LNDclient{}
 
 	lndOptions = assignDefaultValues(lndOptions)
+	if err := validateLNDoptions(lndOptions); err != nil {
+		return result, err
+	}
 
-	// Set up a connection to the server.
-	creds, err := credentials.NewClientTLSFromFile(lndOptions.CertFile, "")
+	// Get the macaroon before setting up the connection, so we don't need to close the connection in case of an error
+	macaroonHex, err := getMacaroonHex(lndOptions)
 	if err != nil {
 		return result, err
 	}
-	conn, err := grpc.Dial(lndOptions.Address, grpc.WithTransportCredentials(creds))
+
+	// Set up a connection to the server.
+	var creds credentials.TransportCredentials
+	if lndOptions.CertPEM != "" {
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM([]byte(lndOptions.CertPEM)) {
+			return result, errors.New("the CertPEM option doesn't contain a valid PEM encoded certificate")
+		}
+		creds = credentials.NewClientTLSFromCert(certPool, "")
+	} else {
+		creds, err = credentials.NewClientTLSFromFile(lndOptions.CertFile, "")
+		if err != nil {
+			return result, err
+		}
+	}
+	var dialOptions []grpc.DialOption
+	target := lndOptions.Address
+	network, address := parseAddress(lndOptions.Address)
+	if network == "unix" {
+		// The dialer ignores the target and always connects to the socket.
+		// "localhost" is used as target because it's what the TLS cert of lnd contains by default.
+		target = "localhost"
+		dialOptions = append(dialOptions, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", address)
+		}))
+	} else if lndOptions.ProxyAddress != "" {
+		proxyDialer, err := getProxyDialer(lndOptions.ProxyAddress)
+		if err != nil {
+			return result, err
+		}
+		dialOptions = append(dialOptions, grpc.WithContextDialer(proxyDialer))
+	}
+	dialCtx := context.Background()
+	if !lndOptions.LazyConnect {
+		// Block until the connection is established, so that a wrong address or TLS cert leads to an error now
+		// instead of with the first request
+		dialOptions = append(dialOptions, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeout(dialCtx, lndOptions.ConnectionTimeout)
+		defer cancelDial()
+	}
+	dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                lndOptions.KeepaliveTime,
+		Timeout:             lndOptions.KeepaliveTimeout,
+		PermitWithoutStream: lndOptions.KeepalivePermitWithoutStream,
+	}))
+	if lndOptions.ReconnectRetries > 0 {
+		dialOptions = append(dialOptions, grpc.WithChainUnaryInterceptor(reconnectInterceptor(lndOptions.ReconnectRetries, lndOptions.ReconnectBackoff)))
+	}
+	dialOptions = append(dialOptions, lndOptions.DialOptions...)
+	// Later options override earlier ones, so the credentials come last to make sure the TLS cert is used
+	dialOptions = append(dialOptions, grpc.WithTransportCredentials(creds))
+	conn, err := grpc.DialContext(dialCtx, target, dialOptions...)
 	if err != nil {
-		return result, err
+		return result, fmt.Errorf("couldn't connect to lnd at %v: %v", lndOptions.Address, err)
 	}
 	c := lnrpc.NewLightningClient(conn)
+	invoicesClient := invoicesrpc.NewInvoicesClient(conn)
 
 	// Add the macaroon to the outgoing context
 
-	macaroon, err := ioutil.ReadFile(lndOptions.MacaroonFile)
-	if err != nil {
-		return result, err
-	}
-	// Value must be the hex representation of the file content
-	macaroonHex := fmt.Sprintf("%X", string(macaroon))
-	ctx := context.Background()
+	// The context is cancelled when the client is closed
+	ctx, cancel := context.WithCancel(context.Background())
 	ctx = metadata.AppendToOutgoingContext(ctx, "macaroon", macaroonHex)
 
 	result = LNDclient{
-		conn:      conn,
-		ctx:       ctx,
-		lndClient: c,
+		conn:              conn,
+		ctx:               ctx,
+		cancel:            cancel,
+		lndClient:         c,
+		invoicesClient:    invoicesClient,
+		expiry:            lndOptions.Expiry,
+		logger:            lndOptions.Logger,
+		privateRouteHints: lndOptions.PrivateRouteHints,
+		fallbackAddress:   getFallbackAddressFunc(lndOptions),
+		pollInterval:      lndOptions.PollInterval,
+		pollTimeout:       lndOptions.PollTimeout,
+		lookupGroup:       &singleflight.Group{},
+	}
+
+	if lndOptions.CheckInboundLiquidity {
+		result.inboundLiquidity = &inboundLiquidity{
+			cacheDuration: lndOptions.InboundLiquidityCacheDuration,
+			lock:          &sync.Mutex{},
+		}
+	}
+	if lndOptions.CacheSettledInvoices {
+		result.settledCache = newSettledCache(lndOptions.SettledCacheSize, lndOptions.SettledCacheTTL)
+	}
+	if lndOptions.SubscribeInvoices {
+		result.settledInvoices = newSettledInvoices(maxSettledInvoices)
+	}
+	if lndOptions.KeysendTLVType > 0 {
+		result.keysend = newKeysend(lndOptions.KeysendTLVType)
+	}
+	if lndOptions.SubscribeInvoices || lndOptions.KeysendTLVType > 0 {
+		result.reconcileWindow = lndOptions.ReconcileWindow
+		go result.startInvoiceSubscription(ctx)
 	}
 
 	return result, nil
 }
 
+// parseAddress returns the network and the address for dialing the lnd node.
+// Addresses with the "unix://" scheme lead to the network "unix" and the socket path as address,
+// for example "unix:///var/run/lnd.sock" leads to "/var/run/lnd.sock". All other addresses lead to the network "tcp".
+func parseAddress(address string) (network string, parsedAddress string) {
+	if strings.HasPrefix(address, "unix://") {
+		return "unix", strings.TrimPrefix(address, "unix://")
+	}
+	return "tcp", address
+}
+
+// NewLNDclientWithRPC creates a new LNDclient instance that uses the given lnrpc.LightningClient instead of
+// connecting to an lnd node on its own. This is useful for dependency injection, for example of a mock in unit tests.
+// The context is used for all calls, so if the client connects to an lnd node it must contain the macaroon,
+// which you can add with metadata.AppendToOutgoingContext(ctx, "macaroon", macaroonHex).
+// The default values of DefaultLNDoptions are used for the expiry of invoices and for WaitForSettlement(...).
+// The invoice subscription isn't started and the hold invoice methods can't be used.
+// Close() doesn't close the given client.
+func NewLNDclientWithRPC(client lnrpc.LightningClient, ctx context.Context) LNDclient {
+	lndOptions := assignDefaultValues(LNDoptions{})
+	return LNDclient{
+		lndClient:       client,
+		ctx:             ctx,
+		expiry:          lndOptions.Expiry,
+		logger:          lndOptions.Logger,
+		pollInterval:    lndOptions.PollInterval,
+		pollTimeout:     lndOptions.PollTimeout,
+		reconcileWindow: lndOptions.ReconcileWindow,
+		lookupGroup:     &singleflight.Group{},
+	}
+}
+
+// getFallbackAddressFunc returns the function that returns the on-chain fallback address for generated invoices.
+// The FallbackAddressFunc option is preferred over the FallbackAddress option.
+// nil is returned if neither is set.
+func getFallbackAddressFunc(lndOptions LNDoptions) func() string {
+	if lndOptions.FallbackAddressFunc != nil {
+		return lndOptions.FallbackAddressFunc
+	}
+	if lndOptions.FallbackAddress != "" {
+		return func() string {
+			return lndOptions.FallbackAddress
+		}
+	}
+	return nil
+}
+
+// getProxyDialer returns a function that connects to the given address via the SOCKS5 proxy at proxyAddress.
+// The address is passed to the proxy without being resolved first, so .onion addresses work with Tor.
+func getProxyDialer(proxyAddress string) (func(context.Context, string) (net.Conn, error), error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddress, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("the SOCKS5 dialer doesn't support contexts")
+	}
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		return contextDialer.DialContext(ctx, "tcp", address)
+	}, nil
+}
+
+// getMacaroonHex returns the hex representation of the macaroon, which is the format lnd expects in the gRPC metadata.
+// The MacaroonHex option is preferred over the MacaroonFile option.
+func getMacaroonHex(lndOptions LNDoptions) (string, error) {
+	if lndOptions.MacaroonHex != "" {
+		_, err := hex.DecodeString(lndOptions.MacaroonHex)
+		if err != nil {
+			return "", fmt.Errorf("the MacaroonHex option isn't a valid hex string: %v", err)
+		}
+		return lndOptions.MacaroonHex, nil
+	}
+	macaroon, err := ioutil.ReadFile(lndOptions.MacaroonFile)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(macaroon), nil
+}
+
 // LNDoptions are the options for the connection to the lnd node.
 type LNDoptions struct {
 	// Address of your LND node, including the port.
+	// An onion address like "xyz...onion:10009" is possible as well when setting ProxyAddress to the address of Tor.
+	// For a Unix domain socket use the "unix://" scheme, for example "unix:///var/run/lnd.sock".
+	// lnd still uses TLS on the socket, so the TLS cert is required as well. It must be valid for "localhost",
+	// which is the case for the cert that lnd generates by default.
 	// Optional ("localhost:10009" by default).
 	Address string
 	// Path to the "tls.cert" file that your LND node uses.
 	// Optional ("tls.cert" by default).
 	CertFile string
+	// PEM encoded content of the "tls.cert" file that's used instead of CertFile when set.
+	// Useful for deployments where secrets are injected via environment variables instead of files.
+	// Optional ("" by default).
+	CertPEM string
 	// Path to the "invoice.macaroon" file that your LND node uses.
 	// Optional ("invoice.macaroon" by default).
 	MacaroonFile string
+	// Hex representation of the macaroon that's used instead of MacaroonFile when set.
+	// Useful for deployments where secrets are injected via environment variables instead of files.
+	// You can create it with "xxd -p -c 1000 invoice.macaroon" for example.
+	// Optional ("" by default).
+	MacaroonHex string
+	// Expiry of generated invoices in seconds.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (3600 by default, which is the same as lnd's default).
+	Expiry int64
+	// Flag for including route hints for private (unannounced) channels in generated invoices.
+	// Without route hints, invoices of a node that only has private channels can't be paid,
+	// because the payer can't find a route to the node. lnd only adds hints for channels that are active
+	// and have enough inbound liquidity, and it doesn't reveal the channels in invoices without this flag.
+	// Nodes with public channels don't need it, since their channels are known to the whole network.
+	// You can check if an invoice contains route hints with DecodeInvoice(...) (DecodedInvoice.RouteHints).
+	// Optional (false by default).
+	PrivateRouteHints bool
+	// On-chain Bitcoin address that's included in generated invoices as fallback,
+	// for payers who prefer to pay on-chain, for example for larger amounts.
+	// Note that on-chain payments to the address aren't tracked by lnd: The invoice doesn't become settled by them,
+	// so CheckInvoice(...) still returns false and the paywall doesn't let the request through.
+	// You need to verify on-chain payments yourself.
+	// Also note that a static address is reused for all invoices, which is bad for the privacy of the payers
+	// and makes it impossible to assign payments to invoices. Consider FallbackAddressFunc instead.
+	// Optional ("" by default, which means invoices don't contain a fallback address).
+	FallbackAddress string
+	// Function that returns an on-chain fallback address for each generated invoice,
+	// for example a fresh address derived from an xpub. When set, it overrides FallbackAddress.
+	// An empty result leads to an invoice without fallback address.
+	// The same as for FallbackAddress applies: On-chain payments don't settle the invoice.
+	// Optional (nil by default).
+	FallbackAddressFunc func() string
+	// Flag for subscribing to lnd's invoice events.
+	// When enabled, the client keeps track of settled invoices, so checking an invoice
+	// of a request doesn't require a request to lnd in most cases.
+	// Invoices that were settled before the subscription was started are loaded when it starts (see ReconcileWindow)
+	// or otherwise still looked up on lnd.
+	// The client remembers up to 100,000 settled invoices that weren't checked yet, and looks up older ones on lnd.
+	// Optional (false by default).
+	SubscribeInvoices bool
+	// Duration before the start of the invoice subscription in which settled invoices are loaded from lnd,
+	// so that invoices that were settled shortly before a restart of the web service are known without a lookup.
+	// Also applies to the keysend payments (see KeysendTLVType), which can't be looked up otherwise.
+	// Only relevant if SubscribeInvoices is enabled or KeysendTLVType is set.
+	// Negative values disable the reconciliation.
+	// Optional (1 hour by default).
+	ReconcileWindow time.Duration
+	// Type of the TLV record in which keysend payments contain the nonce that the middleware issued,
+	// for wall.InvoiceOptions.Keysend. It must be at least MinKeysendTLVType (65536).
+	// When set, the client subscribes to lnd's invoice events (like with SubscribeInvoices) to keep track of
+	// the received keysend payments. lnd must be started with "accept-keysend=true".
+	// Note: The middleware also needs the pubkey of the node, which requires a macaroon with the "info:read" permission,
+	// which the "invoice.macaroon" doesn't have. You can bake a macaroon with both permissions.
+	// Optional (0 by default, which means keysend payments aren't supported).
+	KeysendTLVType uint64
+	// Maximum time to wait for the connection to the lnd node to be established when creating the client.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (10 seconds by default).
+	ConnectionTimeout time.Duration
+	// Flag for not waiting for the connection to be established when creating the client.
+	// When enabled, a wrong address or TLS cert only leads to an error with the first request to lnd.
+	// Optional (false by default).
+	LazyConnect bool
+	// Address of a SOCKS5 proxy through which the connection to the lnd node is established,
+	// for example "localhost:9050" for Tor. The proxy resolves the address of the lnd node, so .onion addresses work.
+	// The TLS certificate of lnd must contain the onion address then, which you can achieve with lnd's "tlsextradomain" option.
+	// Connecting via Tor can take a while, so you might need to increase the ConnectionTimeout.
+	// Optional ("" by default, which means no proxy is used).
+	ProxyAddress string
+	// Flag for checking the inbound liquidity of the lnd node before generating an invoice.
+	// When enabled, no invoice is generated if the sum of the remote balances of all channels is lower than
+	// the amount of the invoice, because the invoice couldn't be paid. ErrInsufficientInboundLiquidity
+	// is returned instead, which the middlewares turn into a response with the status code 503.
+	// Note: This requires a macaroon with the "offchain:read" permission, which the "invoice.macaroon" doesn't have.
+	// You can bake a macaroon with the permissions of the "invoice.macaroon" and "offchain:read".
+	// Optional (false by default).
+	CheckInboundLiquidity bool
+	// Duration for which the inbound liquidity is cached when CheckInboundLiquidity is enabled,
+	// so that not every generated invoice leads to an additional request to lnd.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (30 seconds by default).
+	InboundLiquidityCacheDuration time.Duration
+	// Flag for caching settled invoices in memory when they're looked up,
+	// so that checking the same invoice again (e.g. with CheckInvoiceState or when a client retries a request)
+	// doesn't lead to another request to lnd. A settled invoice never becomes unsettled, so this is safe.
+	// This is independent of the storage client for the preimages, which still prevents their reuse.
+	// Optional (false by default).
+	CacheSettledInvoices bool
+	// Maximum number of invoices in the cache of settled invoices when CacheSettledInvoices is enabled.
+	// When the cache is full, the oldest invoice is removed.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (10000 by default).
+	SettledCacheSize int
+	// Duration for which settled invoices are cached when CacheSettledInvoices is enabled.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (the value of Expiry by default).
+	SettledCacheTTL time.Duration
+	// Interval in which the client sends keepalive pings to lnd when there's no activity on the connection,
+	// so that NAT gateways and load balancers don't drop the idle connection and dead connections are detected
+	// before the next request fails. lnd rejects pings that are sent more often than every 5 seconds,
+	// and gRPC doesn't allow intervals below 10 seconds anyway.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (30 seconds by default).
+	KeepaliveTime time.Duration
+	// Time the client waits for the response to a keepalive ping before it considers the connection dead
+	// and reconnects.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (20 seconds by default).
+	KeepaliveTimeout time.Duration
+	// Flag for sending keepalive pings even when there are no active requests or streams.
+	// Without it, pings are only sent during requests and while the invoice subscription (SubscribeInvoices) is active,
+	// so an idle connection can still be dropped silently. lnd permits such pings.
+	// Optional (false by default).
+	KeepalivePermitWithoutStream bool
+	// Maximum number of retries of a request that failed because the connection to lnd was unavailable,
+	// for example after a network blip or a restart of lnd.
+	// Before each retry the connection is re-dialed and the client waits until it's ready again,
+	// but at most ReconnectBackoff, which doubles with each retry.
+	// Requests that lead to payments, like PayInvoice(...), are never retried, so that nothing is paid twice.
+	// 0 leads to the default value, negative values disable the retries.
+	// Optional (1 by default).
+	ReconnectRetries int
+	// Maximum time to wait for the connection to be re-established before the first retry.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (1 second by default).
+	ReconnectBackoff time.Duration
+	// Additional options for the gRPC connection to the lnd node, for example for interceptors.
+	// They're applied after the options that result from the other fields (like ProxyAddress or LazyConnect),
+	// so they take precedence over them. The only exception are the transport credentials,
+	// which are always applied last, so that the TLS certificate can't be overridden accidentally.
+	// Optional (nil by default).
+	DialOptions []grpc.DialOption
+	// Interval in which WaitForSettlement(...) checks if an invoice is settled.
+	// A shorter interval leads to a lower latency, but to more requests to lnd.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (500 milliseconds by default).
+	PollInterval time.Duration
+	// Maximum time WaitForSettlement(...) waits for an invoice to be settled.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (60 seconds by default).
+	PollTimeout time.Duration
+	// Logger for info messages, like the creation of an invoice, and for errors of the invoice subscription.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
 }
 
 // DefaultLNDoptions provides default values for LNDoptions.
 var DefaultLNDoptions = LNDoptions{
-	Address:      "localhost:10009",
-	CertFile:     "tls.cert",
-	MacaroonFile: "invoice.macaroon",
+	Address:                       "localhost:10009",
+	CertFile:                      "tls.cert",
+	MacaroonFile:                  "invoice.macaroon",
+	Expiry:                        3600,
+	ConnectionTimeout:             10 * time.Second,
+	KeepaliveTime:                 30 * time.Second,
+	KeepaliveTimeout:              20 * time.Second,
+	ReconnectRetries:              1,
+	ReconnectBackoff:              time.Second,
+	PollInterval:                  500 * time.Millisecond,
+	InboundLiquidityCacheDuration: 30 * time.Second,
+	SettledCacheSize:              10000,
+	PollTimeout:                   60 * time.Second,
+	ReconcileWindow:               time.Hour,
+	// No need to set PrivateRouteHints, FallbackAddress, SubscribeInvoices, KeysendTLVType, LazyConnect, CheckInboundLiquidity, CacheSettledInvoices, KeepalivePermitWithoutStream, ProxyAddress or DialOptions, since their Go zero values are fine for that
+	// SettledCacheTTL depends on Expiry, so it's set in assignDefaultValues
 }
 
 func assignDefaultValues(lndOptions LNDoptions) LNDoptions {
@@ -140,6 +942,46 @@ func assignDefaultValues(lndOptions LNDoptions) LNDoptions {
 	if lndOptions.MacaroonFile == "" {
 		lndOptions.MacaroonFile = DefaultLNDoptions.MacaroonFile
 	}
+	if lndOptions.Expiry <= 0 {
+		lndOptions.Expiry = DefaultLNDoptions.Expiry
+	}
+	if lndOptions.ConnectionTimeout <= 0 {
+		lndOptions.ConnectionTimeout = DefaultLNDoptions.ConnectionTimeout
+	}
+	if lndOptions.KeepaliveTime <= 0 {
+		lndOptions.KeepaliveTime = DefaultLNDoptions.KeepaliveTime
+	}
+	if lndOptions.KeepaliveTimeout <= 0 {
+		lndOptions.KeepaliveTimeout = DefaultLNDoptions.KeepaliveTimeout
+	}
+	if lndOptions.ReconnectRetries == 0 {
+		lndOptions.ReconnectRetries = DefaultLNDoptions.ReconnectRetries
+	}
+	if lndOptions.ReconnectBackoff <= 0 {
+		lndOptions.ReconnectBackoff = DefaultLNDoptions.ReconnectBackoff
+	}
+	if lndOptions.InboundLiquidityCacheDuration <= 0 {
+		lndOptions.InboundLiquidityCacheDuration = DefaultLNDoptions.InboundLiquidityCacheDuration
+	}
+	if lndOptions.SettledCacheSize <= 0 {
+		lndOptions.SettledCacheSize = DefaultLNDoptions.SettledCacheSize
+	}
+	if lndOptions.SettledCacheTTL <= 0 {
+		lndOptions.SettledCacheTTL = time.Duration(lndOptions.Expiry) * time.Second
+	}
+	if lndOptions.PollInterval <= 0 {
+		lndOptions.PollInterval = DefaultLNDoptions.PollInterval
+	}
+	if lndOptions.PollTimeout <= 0 {
+		lndOptions.PollTimeout = DefaultLNDoptions.PollTimeout
+	}
+	// Negative values are okay, they disable the reconciliation.
+	if lndOptions.ReconcileWindow == 0 {
+		lndOptions.ReconcileWindow = DefaultLNDoptions.ReconcileWindow
+	}
+	if lndOptions.Logger == nil {
+		lndOptions.Logger = NoopLogger{}
+	}
 
 	return lndOptions
 }
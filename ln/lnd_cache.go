@@ -0,0 +1,91 @@
+package ln
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// settledCache caches settled invoices by their hex encoded payment hash,
+// so that checking a settled invoice again doesn't lead to another request to lnd.
+// A settled invoice never becomes unsettled, so the only reason for removing entries is memory usage:
+// Entries expire after the TTL, and when the cache is full the oldest entry is removed.
+// All entries have the same TTL, so the insertion order is also the order of expiry.
+type settledCache struct {
+	m       map[string]*list.Element
+	order   *list.List
+	maxSize int
+	ttl     time.Duration
+	lock    *sync.Mutex
+}
+
+// settledCacheEntry is the value of the elements in the order list of the settledCache.
+type settledCacheEntry struct {
+	hash      string
+	invoice   *lnrpc.Invoice
+	expiresAt time.Time
+}
+
+// newSettledCache creates a new settledCache with the given maximum number of entries and TTL.
+func newSettledCache(maxSize int, ttl time.Duration) *settledCache {
+	return &settledCache{
+		m:       make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// get returns the cached invoice with the given hex encoded payment hash.
+// False is returned if the cache doesn't contain the invoice or if the entry has expired.
+func (c *settledCache) get(hash string) (*lnrpc.Invoice, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeExpired()
+	element, ok := c.m[hash]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(settledCacheEntry).invoice, true
+}
+
+// add adds the invoice to the cache if it's settled. Invoices that aren't settled are ignored.
+func (c *settledCache) add(hash string, invoice *lnrpc.Invoice) {
+	if !invoice.GetSettled() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeExpired()
+	if _, ok := c.m[hash]; ok {
+		return
+	}
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Front())
+	}
+	c.m[hash] = c.order.PushBack(settledCacheEntry{
+		hash:      hash,
+		invoice:   invoice,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+}
+
+// removeExpired removes all expired entries. The lock must be held by the caller.
+func (c *settledCache) removeExpired() {
+	now := time.Now()
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		if element.Value.(settledCacheEntry).expiresAt.After(now) {
+			return
+		}
+		c.remove(element)
+	}
+}
+
+// remove removes the given element from the list and the map. The lock must be held by the caller.
+func (c *settledCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.m, element.Value.(settledCacheEntry).hash)
+}
@@ -0,0 +1,85 @@
+package ln
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Names of the environment variables that NewLNDclientFromEnv(...) reads.
+const (
+	// EnvLNDAddress is the name of the environment variable with the address of the lnd node (LNDoptions.Address).
+	EnvLNDAddress = "LND_ADDRESS"
+	// EnvLNDCert is the name of the environment variable with the PEM encoded TLS cert (LNDoptions.CertPEM).
+	EnvLNDCert = "LND_CERT"
+	// EnvLNDCertPath is the name of the environment variable with the path to the "tls.cert" file (LNDoptions.CertFile).
+	EnvLNDCertPath = "LND_CERT_PATH"
+	// EnvLNDMacaroon is the name of the environment variable with the hex encoded macaroon (LNDoptions.MacaroonHex).
+	EnvLNDMacaroon = "LND_MACAROON"
+	// EnvLNDMacaroonPath is the name of the environment variable with the path to the macaroon file (LNDoptions.MacaroonFile).
+	EnvLNDMacaroonPath = "LND_MACAROON_PATH"
+)
+
+// NewLNDclientFromEnv creates a new LNDclient instance with the connection details from environment variables,
+// which is how secrets are usually injected into containers:
+//
+// - LND_ADDRESS: The address of the lnd node, including the port (required)
+//
+// - LND_CERT or LND_CERT_PATH: The PEM encoded TLS cert or the path to the "tls.cert" file (one of them is required)
+//
+// - LND_MACAROON or LND_MACAROON_PATH: The hex encoded macaroon or the path to the macaroon file (one of them is required)
+//
+// If both the value and the path are set, the value is used.
+// Empty variables count as missing. An error that lists all missing variables is returned if any are missing.
+// The functional options are applied after the values of the environment variables,
+// so they can set all other options, for example:
+//
+//	lnClient, err := ln.NewLNDclientFromEnv(ln.WithSubscribeInvoices())
+func NewLNDclientFromEnv(opts ...LNDoption) (LNDclient, error) {
+	lndOptions, err := lndOptionsFromEnv(os.Getenv, opts)
+	if err != nil {
+		return LNDclient{}, err
+	}
+	return NewLNDclient(lndOptions)
+}
+
+// lndOptionsFromEnv creates the LNDoptions for NewLNDclientFromEnv(...) with the given function for reading
+// an environment variable, so it can be tested without changing the environment.
+func lndOptionsFromEnv(getenv func(key string) string, opts []LNDoption) (LNDoptions, error) {
+	var missing []string
+	address := getenv(EnvLNDAddress)
+	if address == "" {
+		missing = append(missing, EnvLNDAddress)
+	}
+	cert, certPath := getenv(EnvLNDCert), getenv(EnvLNDCertPath)
+	if cert == "" && certPath == "" {
+		missing = append(missing, EnvLNDCert+" or "+EnvLNDCertPath)
+	}
+	macaroon, macaroonPath := getenv(EnvLNDMacaroon), getenv(EnvLNDMacaroonPath)
+	if macaroon == "" && macaroonPath == "" {
+		missing = append(missing, EnvLNDMacaroon+" or "+EnvLNDMacaroonPath)
+	}
+	if len(missing) > 0 {
+		return LNDoptions{}, fmt.Errorf("missing environment variables for the lnd client: %v", strings.Join(missing, ", "))
+	}
+
+	lndOptions := LNDoptions{
+		Address: address,
+	}
+	// The values take precedence over the paths in NewLNDclient(...) anyway,
+	// but only setting one of them makes the options unambiguous
+	if cert != "" {
+		lndOptions.CertPEM = cert
+	} else {
+		lndOptions.CertFile = certPath
+	}
+	if macaroon != "" {
+		lndOptions.MacaroonHex = macaroon
+	} else {
+		lndOptions.MacaroonFile = macaroonPath
+	}
+	for _, opt := range opts {
+		opt(&lndOptions)
+	}
+	return lndOptions, nil
+}
@@ -0,0 +1,81 @@
+package ln
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+)
+
+// Hold invoices are invoices for which lnd doesn't settle the payment on its own, because it doesn't know the preimage.
+// The payment is only accepted and the funds are locked until the invoice is either settled with the preimage
+// or canceled, in which case the payer gets the funds back.
+// This enables pay-for-result flows, where a request is only paid for if it succeeds.
+//
+// The methods require lnd's invoices sub-server, which is included in the release binaries of lnd,
+// and a macaroon with the "invoices:write" permission, like the "invoice.macaroon".
+// They can't be used with an LNDclient that was created with NewLNDclientWithRPC(...).
+
+// errNoInvoicesClient is returned by the hold invoice methods if the LNDclient was created with NewLNDclientWithRPC(...).
+var errNoInvoicesClient = errors.New("hold invoices require an LNDclient that was created with NewLNDclient(...)")
+
+// GenerateHoldInvoice generates a hold invoice for the given payment hash, price and memo.
+// The hash must be the SHA-256 hash of a preimage that only you know until you call SettleInvoice(...).
+// NewPreimage() returns a suitable pair of preimage and hash, with the hash in Base64.
+func (c LNDclient) GenerateHoldInvoice(hash []byte, amount int64, memo string) (string, error) {
+	if c.invoicesClient == nil {
+		return "", errNoInvoicesClient
+	}
+	if len(hash) != 32 {
+		return "", errors.New("the payment hash must be 32 bytes long")
+	}
+	req := invoicesrpc.AddHoldInvoiceRequest{
+		Hash:    hash,
+		Value:   amount,
+		Memo:    memo,
+		Expiry:  c.expiry,
+		Private: c.privateRouteHints,
+	}
+	if c.fallbackAddress != nil {
+		req.FallbackAddr = c.fallbackAddress()
+	}
+	c.logger.Printf("Creating hold invoice for a new API request")
+	res, err := c.invoicesClient.AddHoldInvoice(c.ctx, &req)
+	if err != nil {
+		return "", err
+	}
+	return res.GetPaymentRequest(), nil
+}
+
+// SettleInvoice settles the accepted hold invoice that belongs to the given Base64 encoded preimage,
+// which means the payment is completed and the payer can't get the funds back anymore.
+func (c LNDclient) SettleInvoice(preimage string) error {
+	if c.invoicesClient == nil {
+		return errNoInvoicesClient
+	}
+	decodedPreimage, err := DecodePreimage(preimage)
+	if err != nil {
+		return err
+	}
+	_, err = c.invoicesClient.SettleInvoice(c.ctx, &invoicesrpc.SettleInvoiceMsg{
+		Preimage: decodedPreimage,
+	})
+	return err
+}
+
+// CancelInvoice cancels the invoice with the given hex encoded payment hash.
+// If the invoice is a hold invoice whose payment was already accepted, the payer gets the funds back.
+// Open invoices can be canceled as well, they can't be paid anymore afterwards.
+func (c LNDclient) CancelInvoice(hash string) error {
+	if c.invoicesClient == nil {
+		return errNoInvoicesClient
+	}
+	hashSlice, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	_, err = c.invoicesClient.CancelInvoice(c.ctx, &invoicesrpc.CancelInvoiceMsg{
+		PaymentHash: hashSlice,
+	})
+	return err
+}
@@ -0,0 +1,93 @@
+package ln
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// MinKeysendTLVType is the lowest type of a TLV record that lnd accepts as custom record of a payment.
+const MinKeysendTLVType = 65536
+
+// keysendMaxPayments is the number of keysend payments the LNDclient remembers.
+const keysendMaxPayments = 100000
+
+// keysend keeps track of the received keysend payments with a nonce in the custom record of the TLV type.
+type keysend struct {
+	tlvType uint64
+	// Maps the hex encoded nonces to keysendPayments
+	payments *boundedMap
+	// Cached pubkey of the node, empty until it was fetched
+	pubkey *string
+	lock   *sync.Mutex
+}
+
+// keysendPayment is a received keysend payment.
+type keysendPayment struct {
+	// Base64 encoded
+	preimage   string
+	amountPaid int64
+}
+
+func newKeysend(tlvType uint64) *keysend {
+	return &keysend{
+		tlvType:  tlvType,
+		payments: newBoundedMap(keysendMaxPayments),
+		pubkey:   new(string),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// add remembers the given invoice if it's a settled keysend payment with a nonce.
+func (k *keysend) add(invoice *lnrpc.Invoice) {
+	if !invoice.GetIsKeysend() || invoice.GetState() != lnrpc.Invoice_SETTLED {
+		return
+	}
+	for _, htlc := range invoice.GetHtlcs() {
+		if nonce, ok := htlc.GetCustomRecords()[k.tlvType]; ok && len(nonce) > 0 {
+			k.payments.add(hex.EncodeToString(nonce), keysendPayment{
+				preimage:   base64.StdEncoding.EncodeToString(invoice.GetRPreimage()),
+				amountPaid: invoice.GetAmtPaidSat(),
+			})
+			return
+		}
+	}
+}
+
+// KeysendDestination returns the pubkey of the lnd node and the TLV type of the custom record
+// in which keysend payments must contain the nonce, see LNDoptions.KeysendTLVType.
+// The pubkey is fetched with GetInfo() once, which requires a macaroon with the "info:read" permission.
+func (c LNDclient) KeysendDestination() (pubkey string, tlvType uint64, err error) {
+	if c.keysend == nil {
+		return "", 0, errors.New("keysend payments aren't enabled, see LNDoptions.KeysendTLVType")
+	}
+	c.keysend.lock.Lock()
+	defer c.keysend.lock.Unlock()
+	if *c.keysend.pubkey == "" {
+		info, err := c.GetInfo()
+		if err != nil {
+			return "", 0, err
+		}
+		*c.keysend.pubkey = info.IdentityPubkey
+	}
+	return *c.keysend.pubkey, c.keysend.tlvType, nil
+}
+
+// KeysendPayment returns the Base64 encoded preimage and the amount in Satoshis of the keysend payment
+// that contained the given hex encoded nonce in the custom record of the TLV type.
+// ErrInvoiceNotFound is returned if no such payment was received (yet).
+// Only payments that were received while the invoice subscription was running
+// and within the ReconcileWindow before are found.
+func (c LNDclient) KeysendPayment(nonce string) (preimage string, amountPaid int64, err error) {
+	if c.keysend == nil {
+		return "", 0, errors.New("keysend payments aren't enabled, see LNDoptions.KeysendTLVType")
+	}
+	payment, ok := c.keysend.payments.get(nonce)
+	if !ok {
+		return "", 0, ErrInvoiceNotFound
+	}
+	return payment.(keysendPayment).preimage, payment.(keysendPayment).amountPaid, nil
+}
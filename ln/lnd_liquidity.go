@@ -0,0 +1,40 @@
+package ln
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// inboundLiquidity caches the inbound liquidity of the lnd node,
+// so that not every generated invoice leads to an additional request to lnd.
+type inboundLiquidity struct {
+	sat           int64
+	fetchedAt     time.Time
+	cacheDuration time.Duration
+	lock          *sync.Mutex
+}
+
+// checkInboundLiquidity returns ErrInsufficientInboundLiquidity if the inbound liquidity of the lnd node
+// is lower than the given amount, which means that an invoice for the amount can't be paid.
+// The inbound liquidity is the sum of the remote balances of all channels.
+// ctx must already contain the macaroon.
+func (c LNDclient) checkInboundLiquidity(ctx context.Context, amount int64) error {
+	c.inboundLiquidity.lock.Lock()
+	defer c.inboundLiquidity.lock.Unlock()
+
+	if c.inboundLiquidity.fetchedAt.IsZero() || time.Since(c.inboundLiquidity.fetchedAt) >= c.inboundLiquidity.cacheDuration {
+		res, err := c.lndClient.ChannelBalance(ctx, &lnrpc.ChannelBalanceRequest{})
+		if err != nil {
+			return err
+		}
+		c.inboundLiquidity.sat = int64(res.GetRemoteBalance().GetSat())
+		c.inboundLiquidity.fetchedAt = time.Now()
+	}
+	if c.inboundLiquidity.sat < amount {
+		return ErrInsufficientInboundLiquidity
+	}
+	return nil
+}
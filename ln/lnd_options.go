@@ -0,0 +1,201 @@
+package ln
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// LNDoption is a functional option for NewLNDclientWithOptions(...).
+// Each option sets one or more fields of the LNDoptions, see there for the details and default values.
+type LNDoption func(*LNDoptions)
+
+// NewLNDclientWithOptions creates a new LNDclient instance for the lnd node with the given address,
+// configured with functional options instead of an LNDoptions struct, for example:
+//
+//	lnClient, err := ln.NewLNDclientWithOptions("localhost:10009",
+//		ln.WithMacaroonHex(os.Getenv("LND_MACAROON")),
+//		ln.WithTimeout(30*time.Second),
+//	)
+//
+// An empty address leads to the default address ("localhost:10009").
+// The result is the same as with NewLNDclient(...) and an LNDoptions struct with the corresponding fields.
+func NewLNDclientWithOptions(address string, opts ...LNDoption) (LNDclient, error) {
+	return NewLNDclient(newLNDoptions(address, opts))
+}
+
+// newLNDoptions applies the functional options to an LNDoptions struct with the given address.
+func newLNDoptions(address string, opts []LNDoption) LNDoptions {
+	lndOptions := LNDoptions{
+		Address: address,
+	}
+	for _, opt := range opts {
+		opt(&lndOptions)
+	}
+	return lndOptions
+}
+
+// WithCertFile sets the path to the "tls.cert" file of the lnd node (LNDoptions.CertFile).
+func WithCertFile(certFile string) LNDoption {
+	return func(o *LNDoptions) {
+		o.CertFile = certFile
+	}
+}
+
+// WithCertPEM sets the PEM encoded content of the "tls.cert" file of the lnd node (LNDoptions.CertPEM).
+func WithCertPEM(certPEM string) LNDoption {
+	return func(o *LNDoptions) {
+		o.CertPEM = certPEM
+	}
+}
+
+// WithMacaroonFile sets the path to the macaroon file (LNDoptions.MacaroonFile).
+func WithMacaroonFile(macaroonFile string) LNDoption {
+	return func(o *LNDoptions) {
+		o.MacaroonFile = macaroonFile
+	}
+}
+
+// WithMacaroonHex sets the hex representation of the macaroon (LNDoptions.MacaroonHex).
+func WithMacaroonHex(macaroonHex string) LNDoption {
+	return func(o *LNDoptions) {
+		o.MacaroonHex = macaroonHex
+	}
+}
+
+// WithExpiry sets the expiry of generated invoices (LNDoptions.Expiry).
+func WithExpiry(expiry time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.Expiry = int64(expiry / time.Second)
+	}
+}
+
+// WithPrivateRouteHints leads to route hints for private channels in generated invoices (LNDoptions.PrivateRouteHints).
+func WithPrivateRouteHints() LNDoption {
+	return func(o *LNDoptions) {
+		o.PrivateRouteHints = true
+	}
+}
+
+// WithFallbackAddress sets the on-chain fallback address for generated invoices (LNDoptions.FallbackAddress).
+func WithFallbackAddress(address string) LNDoption {
+	return func(o *LNDoptions) {
+		o.FallbackAddress = address
+	}
+}
+
+// WithFallbackAddressFunc sets the function that returns an on-chain fallback address for each generated invoice
+// (LNDoptions.FallbackAddressFunc).
+func WithFallbackAddressFunc(fallbackAddressFunc func() string) LNDoption {
+	return func(o *LNDoptions) {
+		o.FallbackAddressFunc = fallbackAddressFunc
+	}
+}
+
+// WithTimeout sets the maximum time to wait for the connection to be established (LNDoptions.ConnectionTimeout).
+func WithTimeout(timeout time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.ConnectionTimeout = timeout
+	}
+}
+
+// WithLazyConnect leads to the client not waiting for the connection to be established (LNDoptions.LazyConnect).
+func WithLazyConnect() LNDoption {
+	return func(o *LNDoptions) {
+		o.LazyConnect = true
+	}
+}
+
+// WithProxy sets the address of a SOCKS5 proxy like Tor (LNDoptions.ProxyAddress).
+func WithProxy(proxyAddress string) LNDoption {
+	return func(o *LNDoptions) {
+		o.ProxyAddress = proxyAddress
+	}
+}
+
+// WithSubscribeInvoices enables the subscription to lnd's invoice events (LNDoptions.SubscribeInvoices).
+func WithSubscribeInvoices() LNDoption {
+	return func(o *LNDoptions) {
+		o.SubscribeInvoices = true
+	}
+}
+
+// WithReconcileWindow sets the duration before the start of the invoice subscription in which settled invoices are loaded (LNDoptions.ReconcileWindow).
+func WithReconcileWindow(window time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.ReconcileWindow = window
+	}
+}
+
+// WithKeysend enables keysend payments with the nonce in the custom record of the given TLV type (LNDoptions.KeysendTLVType).
+func WithKeysend(tlvType uint64) LNDoption {
+	return func(o *LNDoptions) {
+		o.KeysendTLVType = tlvType
+	}
+}
+
+// WithInboundLiquidityCheck enables the inbound liquidity check before generating an invoice
+// (LNDoptions.CheckInboundLiquidity), with the given cache duration (LNDoptions.InboundLiquidityCacheDuration).
+// A cache duration of 0 leads to the default value.
+func WithInboundLiquidityCheck(cacheDuration time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.CheckInboundLiquidity = true
+		o.InboundLiquidityCacheDuration = cacheDuration
+	}
+}
+
+// WithSettledCache enables the cache of settled invoices (LNDoptions.CacheSettledInvoices),
+// with the given maximum size (LNDoptions.SettledCacheSize) and TTL (LNDoptions.SettledCacheTTL).
+// Values of 0 lead to the default values.
+func WithSettledCache(size int, ttl time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.CacheSettledInvoices = true
+		o.SettledCacheSize = size
+		o.SettledCacheTTL = ttl
+	}
+}
+
+// WithKeepalive sets the interval and the timeout of keepalive pings (LNDoptions.KeepaliveTime and LNDoptions.KeepaliveTimeout)
+// and whether they're sent without active requests or streams (LNDoptions.KeepalivePermitWithoutStream).
+// Values of 0 lead to the default values.
+func WithKeepalive(interval time.Duration, timeout time.Duration, permitWithoutStream bool) LNDoption {
+	return func(o *LNDoptions) {
+		o.KeepaliveTime = interval
+		o.KeepaliveTimeout = timeout
+		o.KeepalivePermitWithoutStream = permitWithoutStream
+	}
+}
+
+// WithReconnect sets the maximum number of retries of requests that failed because the connection was unavailable
+// (LNDoptions.ReconnectRetries) and the backoff before the first retry (LNDoptions.ReconnectBackoff).
+// Values of 0 lead to the default values, a negative number of retries disables them.
+func WithReconnect(retries int, backoff time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.ReconnectRetries = retries
+		o.ReconnectBackoff = backoff
+	}
+}
+
+// WithDialOptions adds options for the gRPC connection (LNDoptions.DialOptions).
+// It can be used multiple times, the options are appended.
+func WithDialOptions(dialOptions ...grpc.DialOption) LNDoption {
+	return func(o *LNDoptions) {
+		o.DialOptions = append(o.DialOptions, dialOptions...)
+	}
+}
+
+// WithPolling sets the interval and the timeout of WaitForSettlement(...)
+// (LNDoptions.PollInterval and LNDoptions.PollTimeout). Values of 0 lead to the default values.
+func WithPolling(interval time.Duration, timeout time.Duration) LNDoption {
+	return func(o *LNDoptions) {
+		o.PollInterval = interval
+		o.PollTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger for info messages and errors (LNDoptions.Logger).
+func WithLogger(logger Logger) LNDoption {
+	return func(o *LNDoptions) {
+		o.Logger = logger
+	}
+}
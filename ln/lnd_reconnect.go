@@ -0,0 +1,73 @@
+package ln
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// nonRetryableMethodPrefixes are the prefixes of gRPC methods that mustn't be retried,
+// because lnd might have received the request before the connection dropped and it would pay twice.
+var nonRetryableMethodPrefixes = []string{
+	"/lnrpc.Lightning/SendPayment",
+	"/lnrpc.Lightning/SendToRoute",
+	"/routerrpc.Router/SendPayment",
+	"/routerrpc.Router/SendToRoute",
+}
+
+// reconnectInterceptor returns a gRPC interceptor that retries requests that failed because the connection to lnd
+// is unavailable, for example after a network blip or a restart of lnd.
+// Before each retry it makes the connection re-dial immediately instead of waiting for gRPC's own backoff,
+// and waits until the connection is ready again, but at most the backoff, which doubles with each retry.
+// Requests that lead to payments are never retried.
+func reconnectInterceptor(maxRetries int, backoff time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if !isRetryableMethod(method) {
+			return err
+		}
+		for retry := 0; retry < maxRetries && status.Code(err) == codes.Unavailable; retry++ {
+			if waitErr := waitForReconnect(ctx, cc, backoff<<uint(retry)); waitErr != nil {
+				return err
+			}
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return err
+	}
+}
+
+// isRetryableMethod returns false for the gRPC methods in nonRetryableMethodPrefixes.
+func isRetryableMethod(method string) bool {
+	for _, prefix := range nonRetryableMethodPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForReconnect makes the connection re-dial and waits until it's ready or until the timeout is reached.
+// An error is only returned if the context is done.
+func waitForReconnect(ctx context.Context, cc *grpc.ClientConn, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if cc == nil {
+		<-waitCtx.Done()
+		return ctx.Err()
+	}
+	cc.ResetConnectBackoff()
+	for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+		if state == connectivity.Idle {
+			cc.Connect()
+		}
+		if !cc.WaitForStateChange(waitCtx, state) {
+			break
+		}
+	}
+	return ctx.Err()
+}
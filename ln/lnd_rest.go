@@ -0,0 +1,252 @@
+package ln
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LNDRestClient is an implementation of the wall.LNclient interface for the lnd Lightning Network node implementation.
+// In contrast to the LNDclient it doesn't use lnd's gRPC interface, but its REST interface.
+type LNDRestClient struct {
+	address     string
+	macaroonHex string
+	httpClient  *http.Client
+	logger      Logger
+	// Leads to route hints for private channels in generated invoices
+	privateRouteHints bool
+}
+
+// GenerateInvoice generates an invoice with the given price and memo.
+// An amount of 0 leads to an amountless invoice.
+func (c LNDRestClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	// Create the request and send it
+	invoice := lndRestInvoice{
+		Memo: memo,
+		// int64 values are encoded as JSON strings by lnd's REST interface
+		Value:   strconv.FormatInt(amount, 10),
+		Private: c.privateRouteHints,
+	}
+	reqBody, err := json.Marshal(invoice)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	res := lndRestAddInvoiceResponse{}
+	err = c.do("POST", "/v1/invoices", reqBody, &res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.PaymentRequest, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding invoice,
+// and checks if the invoice was settled and if at least the expected amount (in Satoshis) was paid.
+// An error is returned if the preimage contains invalid Base64 characters.
+// ErrInvoiceNotFound is returned if no corresponding invoice was found
+// and ErrInvoiceCanceled if the invoice was canceled.
+// ErrInsufficientAmount is returned if less than the expected amount was paid.
+// False is returned if the invoice isn't settled.
+func (c LNDRestClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding invoice to check if it's settled
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the invoice for that hash.
+	// The hash must be hex encoded in the URL path.
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	invoice := lndRestInvoice{}
+	err = c.do("GET", "/v1/invoice/"+hex.EncodeToString(hashSlice), nil, &invoice)
+	if apiErr, ok := err.(lndRestError); ok && apiErr.isNotFound() {
+		return false, ErrInvoiceNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	// Check if invoice was settled
+	if !invoice.Settled {
+		if invoice.State == "CANCELED" {
+			return false, ErrInvoiceCanceled
+		}
+		return false, nil
+	}
+	// Check if enough was paid
+	amtPaidSat, err := strconv.ParseInt(invoice.AmtPaidSat, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if amtPaidSat < expectedAmount {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// do sends a request to the given endpoint of lnd's REST interface
+// and decodes the JSON response into the given result object.
+func (c LNDRestClient) do(method string, endpoint string, reqBody []byte, result interface{}) error {
+	req, err := http.NewRequest(method, c.address+endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", c.macaroonHex)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		apiErr := lndRestError{statusCode: res.StatusCode, endpoint: endpoint, body: string(resBody)}
+		// The body contains the gRPC status code and error message from lnd, like "unable to locate invoice".
+		// Older versions of lnd use the "error" field for the message.
+		var errRes struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		if json.Unmarshal(resBody, &errRes) == nil {
+			apiErr.grpcCode = errRes.Code
+			apiErr.message = errRes.Message
+			if apiErr.message == "" {
+				apiErr.message = errRes.Error
+			}
+		}
+		return apiErr
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// lndRestError is the error for a response of lnd's REST interface with a status other than 200.
+type lndRestError struct {
+	statusCode int
+	endpoint   string
+	body       string
+	// The gRPC status code and message from the JSON body, if it contains them
+	grpcCode int
+	message  string
+}
+
+func (e lndRestError) Error() string {
+	return fmt.Sprintf("lnd responded with status %v to %v: %s", e.statusCode, e.endpoint, e.body)
+}
+
+// isNotFound returns true if lnd doesn't know the requested invoice.
+// Since v0.15 lnd responds with 404 and the gRPC code 5 (NotFound) then,
+// older versions with 500 and the gRPC code 2 (Unknown), so the message is checked as well.
+// It's only meaningful for lookups, because for other endpoints a 404 means that the address is wrong.
+func (e lndRestError) isNotFound() bool {
+	return e.statusCode == http.StatusNotFound || e.grpcCode == 5 || e.message == ErrInvoiceNotFound.Error()
+}
+
+// NewLNDRestClient creates a new LNDRestClient instance.
+func NewLNDRestClient(lndRestOptions LNDRestOptions) (LNDRestClient, error) {
+	result := LNDRestClient{}
+
+	// Set default values
+	if lndRestOptions.Address == "" {
+		lndRestOptions.Address = DefaultLNDRestOptions.Address
+	}
+	if lndRestOptions.CertFile == "" {
+		lndRestOptions.CertFile = DefaultLNDRestOptions.CertFile
+	}
+	if lndRestOptions.MacaroonFile == "" {
+		lndRestOptions.MacaroonFile = DefaultLNDRestOptions.MacaroonFile
+	}
+	if lndRestOptions.Logger == nil {
+		lndRestOptions.Logger = NoopLogger{}
+	}
+
+	// Set up an HTTP client that trusts the TLS cert of the lnd node
+	cert, err := ioutil.ReadFile(lndRestOptions.CertFile)
+	if err != nil {
+		return result, err
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(cert) {
+		return result, errors.New("couldn't parse the TLS cert file " + lndRestOptions.CertFile)
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certPool,
+			},
+		},
+	}
+
+	// Read the macaroon, which gets sent with every request
+	macaroon, err := ioutil.ReadFile(lndRestOptions.MacaroonFile)
+	if err != nil {
+		return result, err
+	}
+
+	result = LNDRestClient{
+		address: strings.TrimSuffix(lndRestOptions.Address, "/"),
+		// Value must be the hex representation of the file content
+		macaroonHex:       hex.EncodeToString(macaroon),
+		httpClient:        httpClient,
+		logger:            lndRestOptions.Logger,
+		privateRouteHints: lndRestOptions.PrivateRouteHints,
+	}
+
+	return result, nil
+}
+
+// LNDRestOptions are the options for the connection to the REST interface of the lnd node.
+type LNDRestOptions struct {
+	// Address of the REST interface of your LND node, including the scheme and port.
+	// Optional ("https://localhost:8080" by default).
+	Address string
+	// Path to the "tls.cert" file that your LND node uses.
+	// Optional ("tls.cert" by default).
+	CertFile string
+	// Path to the "invoice.macaroon" file that your LND node uses.
+	// Optional ("invoice.macaroon" by default).
+	MacaroonFile string
+	// Flag for including route hints for private (unannounced) channels in generated invoices.
+	// See LNDoptions.PrivateRouteHints for details.
+	// Optional (false by default).
+	PrivateRouteHints bool
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultLNDRestOptions provides default values for LNDRestOptions.
+var DefaultLNDRestOptions = LNDRestOptions{
+	Address:      "https://localhost:8080",
+	CertFile:     "tls.cert",
+	MacaroonFile: "invoice.macaroon",
+}
+
+// lndRestInvoice contains the fields we need from lnd's JSON representation of an invoice.
+type lndRestInvoice struct {
+	Memo    string `json:"memo,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Settled bool   `json:"settled,omitempty"`
+	// "OPEN", "SETTLED", "CANCELED" or "ACCEPTED", only set in responses
+	State string `json:"state,omitempty"`
+	// Private is only set in requests
+	Private bool `json:"private,omitempty"`
+	// AmtPaidSat is only set in responses
+	AmtPaidSat string `json:"amt_paid_sat,omitempty"`
+}
+
+type lndRestAddInvoiceResponse struct {
+	PaymentRequest string `json:"payment_request"`
+}
@@ -0,0 +1,157 @@
+package ln_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestLNDRestClientImpl tests if LNDRestClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestLNDRestClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.LNDRestClient{}
+}
+
+// TestLNDRestClient tests if the LNDRestClient sends the macaroon, creates invoices
+// and maps the responses of "/v1/invoice/{r_hash_str}" to the results of CheckInvoice.
+func TestLNDRestClient(t *testing.T) {
+	macaroon := []byte("macaroon")
+	preimages := map[string]string{}
+	// Hex encoded payment hash -> status code and body of the lookup response
+	responses := map[string]struct {
+		statusCode int
+		body       string
+	}{}
+	addInvoice := func(name string, statusCode int, body string) {
+		preimage, hash, err := ln.NewPreimage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashBytes, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preimages[name] = preimage
+		responses[hex.EncodeToString(hashBytes)] = struct {
+			statusCode int
+			body       string
+		}{statusCode, body}
+	}
+	addInvoice("settled", http.StatusOK, `{"settled":true,"state":"SETTLED","amt_paid_sat":"10"}`)
+	addInvoice("underpaid", http.StatusOK, `{"settled":true,"state":"SETTLED","amt_paid_sat":"9"}`)
+	addInvoice("open", http.StatusOK, `{"state":"OPEN","amt_paid_sat":"0"}`)
+	addInvoice("canceled", http.StatusOK, `{"state":"CANCELED","amt_paid_sat":"0"}`)
+	// Older versions of lnd
+	addInvoice("not found legacy", http.StatusInternalServerError, `{"error":"unable to locate invoice","code":2,"message":"unable to locate invoice"}`)
+	addInvoice("other error", http.StatusInternalServerError, `{"code":2,"message":"database is locked"}`)
+	unknownPreimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimages["unknown"] = unknownPreimage
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != hex.EncodeToString(macaroon) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"code":2,"message":"verification failed: signature mismatch after caveat verification"}`)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/invoices":
+			var invoice map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&invoice); err != nil || invoice["value"] != "10" || invoice["memo"] != "API call" {
+				t.Errorf("Unexpected invoice in the request: %v (error: %v)", invoice, err)
+			}
+			fmt.Fprint(w, `{"payment_request":"lnbcrt100n1"}`)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/invoice/"):
+			response, ok := responses[strings.TrimPrefix(r.URL.Path, "/v1/invoice/")]
+			if !ok {
+				// lnd's response for an unknown payment hash since v0.15
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"code":5,"message":"unable to locate invoice","details":[]}`)
+				return
+			}
+			w.WriteHeader(response.statusCode)
+			fmt.Fprint(w, response.body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "tls.cert")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = ioutil.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	macaroonFile := filepath.Join(dir, "invoice.macaroon")
+	if err = ioutil.WriteFile(macaroonFile, macaroon, 0600); err != nil {
+		t.Fatal(err)
+	}
+	lndRestOptions := ln.LNDRestOptions{
+		Address:      server.URL,
+		CertFile:     certFile,
+		MacaroonFile: macaroonFile,
+	}
+	c, err := ln.NewLNDRestClient(lndRestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil || invoice != "lnbcrt100n1" {
+		t.Errorf("Expected the invoice lnbcrt100n1, but was %q (error: %v)", invoice, err)
+	}
+	testCases := []struct {
+		name            string
+		expectedSettled bool
+		expectedErr     error
+	}{
+		{"settled", true, nil},
+		{"underpaid", false, ln.ErrInsufficientAmount},
+		{"open", false, nil},
+		{"canceled", false, ln.ErrInvoiceCanceled},
+		{"not found legacy", false, ln.ErrInvoiceNotFound},
+		{"unknown", false, ln.ErrInvoiceNotFound},
+	}
+	for _, testCase := range testCases {
+		settled, err := c.CheckInvoice(preimages[testCase.name], 10)
+		if settled != testCase.expectedSettled || err != testCase.expectedErr {
+			t.Errorf("Expected %v and error %v for the %v invoice, but was %v and %v", testCase.expectedSettled, testCase.expectedErr, testCase.name, settled, err)
+		}
+	}
+
+	// Other errors must not be mistaken for an unknown invoice
+	if _, err = c.CheckInvoice(preimages["other error"], 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for a failing node, but was %v", err)
+	}
+	// Another macaroon, for example of another node
+	if err = ioutil.WriteFile(macaroonFile, []byte("other macaroon"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	otherMacaroonClient, err := ln.NewLNDRestClient(lndRestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = otherMacaroonClient.CheckInvoice(preimages["settled"], 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected a generic error for another macaroon, but was %v", err)
+	}
+}
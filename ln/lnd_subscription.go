@@ -0,0 +1,161 @@
+package ln
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// subscriptionRetryDelay is the time to wait before reconnecting when the invoice subscription was interrupted.
+const subscriptionRetryDelay = 5 * time.Second
+
+// reconcilePageSize is the number of invoices that are requested at once from lnd during the reconciliation.
+const reconcilePageSize = 1000
+
+// reconcileMaxInvoices is the maximum number of invoices that are requested from lnd during the reconciliation,
+// so that the start of the client doesn't take forever for nodes with a huge number of invoices.
+const reconcileMaxInvoices = 100000
+
+// maxSettledInvoices is the number of settled invoices the settled set holds at most.
+// All invoices of the node are added, including the ones of other applications that are never checked by the client,
+// so without a limit the set would grow for the whole lifetime of the process.
+const maxSettledInvoices = reconcileMaxInvoices
+
+// settledInvoices is a concurrency-safe set of hex encoded payment hashes of settled invoices,
+// with the amount that was paid for each invoice in millisatoshis.
+// When it's full, the oldest invoice is evicted. An evicted invoice is still found by looking it up on lnd.
+type settledInvoices struct {
+	m *boundedMap
+}
+
+func newSettledInvoices(maxSize int) *settledInvoices {
+	return &settledInvoices{
+		m: newBoundedMap(maxSize),
+	}
+}
+
+// add adds the settled invoice to the set.
+func (s settledInvoices) add(invoice *lnrpc.Invoice) {
+	s.m.add(hex.EncodeToString(invoice.GetRHash()), getAmtPaidMsat(invoice))
+}
+
+// pop removes the invoice with the given payment hash from the set and returns the paid amount in millisatoshis.
+// The invoice doesn't need to stay in the set after it was checked,
+// because the middleware stores the preimage as used and doesn't check the invoice again.
+// False is returned if the set doesn't contain the invoice.
+func (s settledInvoices) pop(hash []byte) (int64, bool) {
+	amtPaidMsat, ok := s.m.pop(hex.EncodeToString(hash))
+	if !ok {
+		return 0, false
+	}
+	return amtPaidMsat.(int64), true
+}
+
+// startInvoiceSubscription starts the invoice subscription, after loading the invoices that were settled
+// within the ReconcileWindow. It only returns when the context is cancelled.
+func (c LNDclient) startInvoiceSubscription(ctx context.Context) {
+	settleIndex := c.reconcileInvoices(ctx)
+	c.subscribeInvoices(ctx, settleIndex)
+}
+
+// reconcileInvoices adds the invoices that were settled within the ReconcileWindow to the settled set
+// and to the keysend payments, so that they're not lost when the web service restarts.
+// lnd can only list invoices in the order in which they were added, so the invoices are requested
+// from the newest to the oldest, until one expired before the window started.
+// Returns the highest settle index, from which the invoice subscription can continue.
+// Errors are only logged, because the subscription works without the reconciliation.
+func (c LNDclient) reconcileInvoices(ctx context.Context) uint64 {
+	if c.reconcileWindow <= 0 {
+		return 0
+	}
+	windowStart := time.Now().Add(-c.reconcileWindow).Unix()
+	var settleIndex uint64
+	var indexOffset uint64
+	var added int
+	for requested := 0; requested < reconcileMaxInvoices; requested += reconcilePageSize {
+		res, err := c.lndClient.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+			IndexOffset:    indexOffset,
+			NumMaxInvoices: reconcilePageSize,
+			Reversed:       true,
+		})
+		if err != nil {
+			c.logger.Printf("Couldn't load the recently settled invoices: %v\n", err)
+			return settleIndex
+		}
+		for _, invoice := range res.GetInvoices() {
+			if invoice.GetSettleIndex() > settleIndex {
+				settleIndex = invoice.GetSettleIndex()
+			}
+			if !invoice.GetSettled() || invoice.GetSettleDate() < windowStart {
+				continue
+			}
+			if c.settledInvoices != nil {
+				c.settledInvoices.add(invoice)
+			}
+			if c.keysend != nil {
+				c.keysend.add(invoice)
+			}
+			added++
+		}
+		// Invoices are listed from the newest to the oldest, so the oldest one of the page is the first
+		invoices := res.GetInvoices()
+		if len(invoices) < reconcilePageSize || res.GetFirstIndexOffset() <= 1 ||
+			invoices[0].GetCreationDate()+invoices[0].GetExpiry() < windowStart {
+			break
+		}
+		indexOffset = res.GetFirstIndexOffset()
+	}
+	c.logger.Printf("Loaded %v invoices that were settled within the last %v\n", added, c.reconcileWindow)
+	return settleIndex
+}
+
+// subscribeInvoices keeps an invoice subscription open and adds all settled invoices to the settled set
+// and to the keysend payments.
+// When the subscription is interrupted, it reconnects after a delay.
+// It only returns when the context is cancelled.
+func (c LNDclient) subscribeInvoices(ctx context.Context, settleIndex uint64) {
+	for {
+		var err error
+		settleIndex, err = c.receiveInvoices(ctx, settleIndex)
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.Printf("The invoice subscription was interrupted, reconnecting in %v: %v\n", subscriptionRetryDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(subscriptionRetryDelay):
+		}
+	}
+}
+
+// receiveInvoices opens an invoice subscription and receives invoices until an error occurs.
+// Only invoices that were settled after the given settle index are sent by lnd,
+// so no invoices get lost between two subscriptions.
+// Returns the settle index of the last received settled invoice.
+func (c LNDclient) receiveInvoices(ctx context.Context, settleIndex uint64) (uint64, error) {
+	req := lnrpc.InvoiceSubscription{
+		SettleIndex: settleIndex,
+	}
+	stream, err := c.lndClient.SubscribeInvoices(ctx, &req)
+	if err != nil {
+		return settleIndex, err
+	}
+	for {
+		invoice, err := stream.Recv()
+		if err != nil {
+			return settleIndex, err
+		}
+		if invoice.GetSettled() {
+			if c.settledInvoices != nil {
+				c.settledInvoices.add(invoice)
+			}
+			if c.keysend != nil {
+				c.keysend.add(invoice)
+			}
+			settleIndex = invoice.GetSettleIndex()
+		}
+	}
+}
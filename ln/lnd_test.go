@@ -0,0 +1,1260 @@
+package ln
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+)
+
+// TestGetMacaroonHex tests if the hex representation of the macaroon that's sent to lnd
+// can be decoded to the original macaroon file content.
+func TestGetMacaroonHex(t *testing.T) {
+	// Contains bytes that aren't valid UTF-8
+	macaroon := []byte{0x02, 0x01, 0x03, 0x6c, 0x6e, 0x64, 0xff, 0xfe, 0x80, 0x00}
+	macaroonFile, err := ioutil.TempFile("", "invoice.macaroon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(macaroonFile.Name())
+	_, err = macaroonFile.Write(macaroon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	macaroonFile.Close()
+
+	macaroonHex, err := getMacaroonHex(LNDoptions{MacaroonFile: macaroonFile.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedMacaroon, err := hex.DecodeString(macaroonHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedMacaroon, macaroon) {
+		t.Errorf("Expected %x, but was %x", macaroon, decodedMacaroon)
+	}
+}
+
+// TestParseAddress tests if addresses with and without the "unix://" scheme lead to the correct network and address.
+func TestParseAddress(t *testing.T) {
+	testCases := []struct {
+		address         string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{"unix:///var/run/lnd.sock", "unix", "/var/run/lnd.sock"},
+		{"unix://lnd.sock", "unix", "lnd.sock"},
+		{"localhost:10009", "tcp", "localhost:10009"},
+		{"expyuzz4wqqyqhjn.onion:10009", "tcp", "expyuzz4wqqyqhjn.onion:10009"},
+	}
+	for _, testCase := range testCases {
+		network, address := parseAddress(testCase.address)
+		if network != testCase.expectedNetwork || address != testCase.expectedAddress {
+			t.Errorf("Expected %v and %v for %v, but was %v and %v", testCase.expectedNetwork, testCase.expectedAddress, testCase.address, network, address)
+		}
+	}
+}
+
+// TestValidateLNDoptions tests if invalid options lead to errors that name the offending option
+// and if files aren't checked when their content is passed directly.
+func TestValidateLNDoptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "tls.cert")
+	macaroonFile := filepath.Join(dir, "invoice.macaroon")
+	for _, file := range []string{certFile, macaroonFile} {
+		if err = ioutil.WriteFile(file, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missingFile := filepath.Join(dir, "missing")
+
+	testCases := []struct {
+		lndOptions  LNDoptions
+		expectedErr string
+	}{
+		{LNDoptions{CertFile: certFile, MacaroonFile: macaroonFile}, ""},
+		{LNDoptions{Address: "unix:///var/run/lnd.sock", CertFile: certFile, MacaroonFile: macaroonFile}, ""},
+		{LNDoptions{CertFile: missingFile, CertPEM: "pem", MacaroonFile: missingFile, MacaroonHex: "0201"}, ""},
+		{LNDoptions{Address: "localhost", CertFile: certFile, MacaroonFile: macaroonFile}, `invalid Address option: "localhost" doesn't contain a port`},
+		{LNDoptions{Address: "localhost:", CertFile: certFile, MacaroonFile: macaroonFile}, "invalid Address option"},
+		{LNDoptions{Address: "unix://", CertFile: certFile, MacaroonFile: macaroonFile}, "invalid Address option"},
+		{LNDoptions{Address: "unix:///var/run/lnd.sock", ProxyAddress: "localhost:9050", CertFile: certFile, MacaroonFile: macaroonFile}, "ProxyAddress"},
+		{LNDoptions{CertFile: missingFile, MacaroonFile: macaroonFile}, fmt.Sprintf("invalid CertFile option: cert file %q not found", missingFile)},
+		{LNDoptions{CertFile: certFile, MacaroonFile: missingFile}, fmt.Sprintf("invalid MacaroonFile option: macaroon file %q not found", missingFile)},
+		{LNDoptions{CertFile: certFile, MacaroonFile: dir}, "is a directory"},
+		{LNDoptions{CertFile: "missing.cert", MacaroonFile: macaroonFile}, "relative to the working directory"},
+		{LNDoptions{CertFile: certFile, MacaroonFile: macaroonFile, KeysendTLVType: MinKeysendTLVType}, ""},
+		{LNDoptions{CertFile: certFile, MacaroonFile: macaroonFile, KeysendTLVType: 100}, "invalid KeysendTLVType option"},
+	}
+	for _, testCase := range testCases {
+		err := validateLNDoptions(assignDefaultValues(testCase.lndOptions))
+		if testCase.expectedErr == "" && err != nil {
+			t.Errorf("Expected no error for %+v, but was %v", testCase.lndOptions, err)
+		} else if testCase.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), testCase.expectedErr)) {
+			t.Errorf("Expected an error containing %q for %+v, but was %v", testCase.expectedErr, testCase.lndOptions, err)
+		}
+	}
+}
+
+// TestGetProxyDialer tests if the proxy dialer passes .onion addresses to the SOCKS5 proxy
+// as domain names, without trying to resolve them locally.
+func TestGetProxyDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Minimal SOCKS5 server that accepts one connection and reports the requested address
+	requestedAddress := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			requestedAddress <- err.Error()
+			return
+		}
+		defer conn.Close()
+		requestedAddress <- readSOCKS5Request(conn)
+	}()
+
+	dialer, err := getProxyDialer(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onionAddress := "expyuzz4wqqyqhjn.onion:10009"
+	conn, err := dialer(context.Background(), onionAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if actual := <-requestedAddress; actual != onionAddress {
+		t.Errorf("Expected the proxy to be asked for %v, but was %v", onionAddress, actual)
+	}
+}
+
+// readSOCKS5Request handles the SOCKS5 handshake without authentication
+// and returns the address a client wants to connect to, or a description of the error.
+func readSOCKS5Request(conn net.Conn) string {
+	// Version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err.Error()
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return err.Error()
+	}
+	// Version 5, no authentication
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err.Error()
+	}
+	// Version, command, reserved, address type
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return err.Error()
+	}
+	// 3 is the address type for domain names
+	if request[3] != 3 {
+		return fmt.Sprintf("address type %v instead of a domain name", request[3])
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return err.Error()
+	}
+	hostAndPort := make([]byte, int(length[0])+2)
+	if _, err := io.ReadFull(conn, hostAndPort); err != nil {
+		return err.Error()
+	}
+	host := string(hostAndPort[:length[0]])
+	port := binary.BigEndian.Uint16(hostAndPort[length[0]:])
+	// Success, bound to 0.0.0.0:0
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%v:%v", host, port)
+}
+
+// fakeLightningClient is an lnrpc.LightningClient that reports invoices as settled after a given number of lookups.
+// All other methods panic, because the embedded interface is nil.
+type fakeLightningClient struct {
+	lnrpc.LightningClient
+	lookups      *int32
+	settledAfter int32
+	amtPaidSat   int64
+	amtPaidMsat  int64
+	// For the inbound liquidity check
+	channelBalanceCalls *int32
+	remoteBalance       int64
+	// Called with the context of each lookup, if set
+	onLookup func(ctx context.Context)
+	// Called with each invoice that's added, if set
+	onAddInvoice func(in *lnrpc.Invoice)
+}
+
+func (c fakeLightningClient) ChannelBalance(ctx context.Context, in *lnrpc.ChannelBalanceRequest, opts ...grpc.CallOption) (*lnrpc.ChannelBalanceResponse, error) {
+	atomic.AddInt32(c.channelBalanceCalls, 1)
+	return &lnrpc.ChannelBalanceResponse{
+		RemoteBalance: &lnrpc.Amount{Sat: uint64(c.remoteBalance)},
+	}, nil
+}
+
+func (c fakeLightningClient) DecodePayReq(ctx context.Context, in *lnrpc.PayReqString, opts ...grpc.CallOption) (*lnrpc.PayReq, error) {
+	return &lnrpc.PayReq{
+		PaymentHash: hex.EncodeToString(make([]byte, 32)),
+		NumSatoshis: 10,
+		Description: "API call",
+		Timestamp:   1496314658,
+		Expiry:      3600,
+		RouteHints: []*lnrpc.RouteHint{{
+			HopHints: []*lnrpc.HopHint{{NodeId: "02", ChanId: 1}},
+		}},
+	}, nil
+}
+
+func (c fakeLightningClient) AddInvoice(ctx context.Context, in *lnrpc.Invoice, opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	if c.onAddInvoice != nil {
+		c.onAddInvoice(in)
+	}
+	return &lnrpc.AddInvoiceResponse{
+		PaymentRequest: "lnbc1",
+	}, nil
+}
+
+func (c fakeLightningClient) LookupInvoice(ctx context.Context, in *lnrpc.PaymentHash, opts ...grpc.CallOption) (*lnrpc.Invoice, error) {
+	lookups := atomic.AddInt32(c.lookups, 1)
+	if c.onLookup != nil {
+		c.onLookup(ctx)
+	}
+	// Like a real gRPC client
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &lnrpc.Invoice{
+		RHash:        in.GetRHash(),
+		Settled:      lookups >= c.settledAfter,
+		AmtPaidSat:   c.amtPaidSat,
+		AmtPaidMsat:  c.amtPaidMsat,
+		CreationDate: time.Now().Unix(),
+		Expiry:       3600,
+	}, nil
+}
+
+// TestNewLNDclientWithRPC tests if an LNDclient with an injected lnrpc.LightningClient uses that client.
+func TestNewLNDclientWithRPC(t *testing.T) {
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 1,
+		amtPaidSat:   10,
+	}, context.Background())
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settled, err := c.CheckInvoice(preimage, 10)
+	if err != nil || !settled {
+		t.Errorf("Expected the invoice to be settled, but was %v (error: %v)", settled, err)
+	}
+	_, err = c.CheckInvoice(preimage, 11)
+	if err != ErrInsufficientAmount {
+		t.Errorf("Expected error %v, but was %v", ErrInsufficientAmount, err)
+	}
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups, but was %v", lookups)
+	}
+}
+
+// TestCheckInvoiceCtx tests if the context that's passed to CheckInvoiceCtx is used for the request to lnd
+// and contains the macaroon.
+func TestCheckInvoiceCtx(t *testing.T) {
+	type ctxKey struct{}
+	var lookupCtx context.Context
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 1,
+		amtPaidSat:   10,
+		onLookup: func(ctx context.Context) {
+			lookupCtx = ctx
+		},
+	}, metadata.AppendToOutgoingContext(context.Background(), "macaroon", "0201"))
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	settled, err := c.CheckInvoiceCtx(ctx, preimage, 10)
+	if err != nil || !settled {
+		t.Errorf("Expected the invoice to be settled, but was %v (error: %v)", settled, err)
+	}
+	if lookupCtx == nil || lookupCtx.Value(ctxKey{}) != "request" {
+		t.Error("Expected the given context to be used for the lookup, but it wasn't")
+	}
+	md, _ := metadata.FromOutgoingContext(lookupCtx)
+	if macaroon := md.Get("macaroon"); len(macaroon) != 1 || macaroon[0] != "0201" {
+		t.Errorf("Expected the macaroon to be added to the context, but the metadata was %v", md)
+	}
+}
+
+// TestCheckInvoiceConcurrently tests if concurrent checks of the same invoice lead to only one lookup in lnd,
+// and if the lookup isn't cached after it's done.
+func TestCheckInvoiceConcurrently(t *testing.T) {
+	lookups := int32(0)
+	release := make(chan struct{})
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 1,
+		amtPaidSat:   10,
+		onLookup: func(ctx context.Context) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+		},
+	}, context.Background())
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first lookup is canceled while the others wait for it, for example because its client disconnected
+	ctx, cancel := context.WithCancel(context.Background())
+	canceledErr := make(chan error, 1)
+	go func() {
+		_, err := c.CheckInvoiceCtx(ctx, preimage, 10)
+		canceledErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			settled, err := c.CheckInvoice(preimage, 10)
+			if err != nil || !settled {
+				t.Errorf("Expected the invoice to be settled, but was %v (error: %v)", settled, err)
+			}
+		}()
+	}
+	// Give the goroutines time to join the in-flight lookup
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-canceledErr; err != context.Canceled {
+		t.Errorf("Expected error %v for the canceled lookup, but was %v", context.Canceled, err)
+	}
+	close(release)
+	waitGroup.Wait()
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, but was %v", lookups)
+	}
+
+	// After the lookup is done, the next check must lead to a new lookup
+	if _, err = c.CheckInvoice(preimage, 10); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups, but was %v", lookups)
+	}
+}
+
+// TestCheckInvoicePaid tests if CheckInvoicePaid returns the amount that was paid.
+func TestCheckInvoicePaid(t *testing.T) {
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 2,
+		amtPaidSat:   42,
+	}, context.Background())
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not settled in the first lookup
+	for _, expectedAmount := range []int64{0, 42} {
+		settled, amountPaid, err := c.CheckInvoicePaid(preimage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settled != (expectedAmount > 0) || amountPaid != expectedAmount {
+			t.Errorf("Expected settled to be %v and the paid amount to be %v, but were %v and %v", expectedAmount > 0, expectedAmount, settled, amountPaid)
+		}
+	}
+}
+
+// TestCheckInvoicePaidCtx tests if CheckInvoicePaidCtx uses the given context with the macaroon for the request to lnd
+// and uses the invoices that the subscription reported as settled without a request to lnd.
+func TestCheckInvoicePaidCtx(t *testing.T) {
+	type ctxKey struct{}
+	// The lookup of the canceled check continues in the background, so the contexts are sent via a channel
+	lookupCtxs := make(chan context.Context, 2)
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 1,
+		amtPaidMsat:  42000,
+		onLookup: func(ctx context.Context) {
+			lookupCtxs <- ctx
+		},
+	}, metadata.AppendToOutgoingContext(context.Background(), "macaroon", "0201"))
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	settled, amountPaid, err := c.CheckInvoicePaidCtx(ctx, preimage)
+	if err != nil || !settled || amountPaid != 42 {
+		t.Errorf("Expected the invoice to be settled with 42 Satoshis, but was %v with %v (error: %v)", settled, amountPaid, err)
+	}
+	lookupCtx := <-lookupCtxs
+	if lookupCtx.Value(ctxKey{}) != "request" {
+		t.Error("Expected the given context to be used for the lookup, but it wasn't")
+	}
+	md, _ := metadata.FromOutgoingContext(lookupCtx)
+	if macaroon := md.Get("macaroon"); len(macaroon) != 1 || macaroon[0] != "0201" {
+		t.Errorf("Expected the macaroon to be added to the context, but the metadata was %v", md)
+	}
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = c.CheckInvoicePaidCtx(canceledCtx, preimage); err != context.Canceled {
+		t.Errorf("Expected error %v for a canceled context, but was %v", context.Canceled, err)
+	}
+	// Wait for the lookup of the canceled check, which isn't canceled because it could be shared
+	<-lookupCtxs
+
+	hash, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.settledInvoices = newSettledInvoices(maxSettledInvoices)
+	c.settledInvoices.add(&lnrpc.Invoice{RHash: hash, Settled: true, AmtPaidMsat: 50000})
+	atomic.StoreInt32(&lookups, 0)
+	settled, amountPaid, err = c.CheckInvoicePaidCtx(ctx, preimage)
+	if err != nil || !settled || amountPaid != 50 {
+		t.Errorf("Expected the settled invoice of the subscription with 50 Satoshis, but was %v with %v (error: %v)", settled, amountPaid, err)
+	}
+	if lookups := atomic.LoadInt32(&lookups); lookups != 0 {
+		t.Errorf("Expected no lookup for an invoice that the subscription reported as settled, but was %v", lookups)
+	}
+}
+
+// TestWaitForSettlement tests if WaitForSettlement polls until the invoice is settled
+// and returns ErrSettlementTimeout if that takes longer than the poll timeout.
+func TestWaitForSettlement(t *testing.T) {
+	paymentHash := hex.EncodeToString(make([]byte, 32))
+	testCases := []struct {
+		settledAfter int32
+		expectedErr  error
+	}{
+		{1, nil},
+		{3, nil},
+		{1000, ErrSettlementTimeout},
+	}
+	for _, testCase := range testCases {
+		lookups := int32(0)
+		c := LNDclient{
+			lndClient: fakeLightningClient{
+				lookups:      &lookups,
+				settledAfter: testCase.settledAfter,
+			},
+			ctx:          context.Background(),
+			pollInterval: time.Millisecond,
+			pollTimeout:  100 * time.Millisecond,
+		}
+		err := c.WaitForSettlement(context.Background(), paymentHash)
+		if err != testCase.expectedErr {
+			t.Errorf("Expected error %v when the invoice is settled after %v lookups, but was %v", testCase.expectedErr, testCase.settledAfter, err)
+		}
+		if testCase.expectedErr == nil && lookups != testCase.settledAfter {
+			t.Errorf("Expected %v lookups, but was %v", testCase.settledAfter, lookups)
+		}
+	}
+
+	// Cancelled context
+	lookups := int32(0)
+	c := LNDclient{
+		lndClient:    fakeLightningClient{lookups: &lookups, settledAfter: 1000},
+		ctx:          context.Background(),
+		pollInterval: time.Millisecond,
+		pollTimeout:  time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitForSettlement(ctx, paymentHash); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, but was %v", context.DeadlineExceeded, err)
+	}
+}
+
+// fakeInvoicesClient is an invoicesrpc.InvoicesClient whose invoice subscription sends the given states.
+// All other methods panic, because the embedded interface is nil.
+type fakeInvoicesClient struct {
+	invoicesrpc.InvoicesClient
+	states []lnrpc.Invoice_InvoiceState
+	// Returned by SubscribeSingleInvoice if set
+	err error
+}
+
+func (c fakeInvoicesClient) SubscribeSingleInvoice(ctx context.Context, in *invoicesrpc.SubscribeSingleInvoiceRequest, opts ...grpc.CallOption) (invoicesrpc.Invoices_SubscribeSingleInvoiceClient, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &fakeInvoiceStream{ctx: ctx, states: c.states}, nil
+}
+
+// fakeInvoiceStream sends one invoice per state and then blocks until the context is done.
+type fakeInvoiceStream struct {
+	grpc.ClientStream
+	ctx    context.Context
+	states []lnrpc.Invoice_InvoiceState
+}
+
+func (s *fakeInvoiceStream) Recv() (*lnrpc.Invoice, error) {
+	if len(s.states) == 0 {
+		<-s.ctx.Done()
+		return nil, status.FromContextError(s.ctx.Err()).Err()
+	}
+	state := s.states[0]
+	s.states = s.states[1:]
+	return &lnrpc.Invoice{
+		State:        state,
+		Settled:      state == lnrpc.Invoice_SETTLED,
+		CreationDate: time.Now().Unix(),
+		Expiry:       3600,
+	}, nil
+}
+
+// TestWaitForSettlementSubscription tests if WaitForSettlement uses the invoice subscription when the invoices client is set,
+// and if it falls back to polling when lnd doesn't provide the invoices sub-server.
+func TestWaitForSettlementSubscription(t *testing.T) {
+	paymentHash := hex.EncodeToString(make([]byte, 32))
+	testCases := []struct {
+		states      []lnrpc.Invoice_InvoiceState
+		expectedErr error
+	}{
+		{[]lnrpc.Invoice_InvoiceState{lnrpc.Invoice_OPEN, lnrpc.Invoice_ACCEPTED, lnrpc.Invoice_SETTLED}, nil},
+		{[]lnrpc.Invoice_InvoiceState{lnrpc.Invoice_OPEN, lnrpc.Invoice_CANCELED}, ErrInvoiceCanceled},
+		{[]lnrpc.Invoice_InvoiceState{lnrpc.Invoice_OPEN}, ErrSettlementTimeout},
+	}
+	for _, testCase := range testCases {
+		lookups := int32(0)
+		c := LNDclient{
+			// Lookups would lead to a settled invoice, so the test fails if the client polls
+			lndClient:      fakeLightningClient{lookups: &lookups, settledAfter: 1},
+			invoicesClient: fakeInvoicesClient{states: testCase.states},
+			ctx:            context.Background(),
+			logger:         NoopLogger{},
+			pollInterval:   time.Millisecond,
+			pollTimeout:    100 * time.Millisecond,
+		}
+		err := c.WaitForSettlement(context.Background(), paymentHash)
+		if err != testCase.expectedErr {
+			t.Errorf("Expected error %v for the states %v, but was %v", testCase.expectedErr, testCase.states, err)
+		}
+		if lookups != 0 {
+			t.Errorf("Expected no lookups, but was %v", lookups)
+		}
+	}
+
+	lookups := int32(0)
+	c := LNDclient{
+		lndClient:      fakeLightningClient{lookups: &lookups, settledAfter: 2},
+		invoicesClient: fakeInvoicesClient{err: status.Error(codes.Unimplemented, "unknown service invoicesrpc.Invoices")},
+		ctx:            context.Background(),
+		logger:         NoopLogger{},
+		pollInterval:   time.Millisecond,
+		pollTimeout:    100 * time.Millisecond,
+	}
+	if err := c.WaitForSettlement(context.Background(), paymentHash); err != nil || lookups != 2 {
+		t.Errorf("Expected the client to poll twice without error, but it polled %v times with error %v", lookups, err)
+	}
+}
+
+// TestSettledCache tests if settled invoices are only looked up once when the cache is enabled,
+// while unsettled invoices are looked up every time.
+func TestSettledCache(t *testing.T) {
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:      &lookups,
+		settledAfter: 2,
+		amtPaidSat:   10,
+	}, context.Background())
+	c.settledCache = newSettledCache(10, time.Minute)
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not settled in the first lookup
+	for i, expected := range []bool{false, true, true, true} {
+		settled, err := c.CheckInvoice(preimage, 10)
+		if err != nil || settled != expected {
+			t.Errorf("Expected check %v to return %v, but was %v (error: %v)", i, expected, settled, err)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups, but was %v", lookups)
+	}
+	// The cached invoice must still be checked against the expected amount
+	if _, err = c.CheckInvoice(preimage, 11); err != ErrInsufficientAmount {
+		t.Errorf("Expected error %v, but was %v", ErrInsufficientAmount, err)
+	}
+}
+
+// TestSettledCacheEviction tests if the cache of settled invoices removes the oldest entries when it's full
+// and removes expired entries.
+func TestSettledCacheEviction(t *testing.T) {
+	settled := &lnrpc.Invoice{Settled: true}
+	cache := newSettledCache(2, time.Minute)
+	cache.add("a", settled)
+	cache.add("b", settled)
+	cache.add("c", settled)
+	cache.add("d", &lnrpc.Invoice{})
+	for hash, expected := range map[string]bool{"a": false, "b": true, "c": true, "d": false} {
+		if _, ok := cache.get(hash); ok != expected {
+			t.Errorf("Expected the cache to contain %v: %v, but was %v", hash, expected, ok)
+		}
+	}
+
+	cache = newSettledCache(2, 10*time.Millisecond)
+	cache.add("a", settled)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.get("a"); ok {
+		t.Error("Expected the entry to be expired, but it wasn't")
+	}
+	if cache.order.Len() != 0 || len(cache.m) != 0 {
+		t.Errorf("Expected the expired entry to be removed, but the cache has %v entries", cache.order.Len())
+	}
+}
+
+// BenchmarkCheckInvoiceSettled benchmarks checking the same settled invoice with and without the cache of settled invoices.
+// The number of lookups in lnd is logged, so run it with "-v" to see the reduction.
+func BenchmarkCheckInvoiceSettled(b *testing.B) {
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, withCache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", withCache), func(b *testing.B) {
+			lookups := int32(0)
+			c := NewLNDclientWithRPC(fakeLightningClient{
+				lookups:      &lookups,
+				settledAfter: 1,
+				amtPaidSat:   10,
+			}, context.Background())
+			if withCache {
+				c.settledCache = newSettledCache(10, time.Minute)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.CheckInvoice(preimage, 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.Logf("%v lookups in lnd for %v checks", lookups, b.N)
+		})
+	}
+}
+
+// TestCheckInboundLiquidity tests if no invoice is generated when the inbound liquidity is too low
+// and if the inbound liquidity is cached.
+func TestCheckInboundLiquidity(t *testing.T) {
+	channelBalanceCalls := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		channelBalanceCalls: &channelBalanceCalls,
+		remoteBalance:       100,
+	}, context.Background())
+	c.inboundLiquidity = &inboundLiquidity{
+		cacheDuration: time.Minute,
+		lock:          &sync.Mutex{},
+	}
+
+	if _, err := c.GenerateInvoice(100, "API call"); err != nil {
+		t.Errorf("Expected no error, but was %v", err)
+	}
+	if _, err := c.GenerateInvoice(101, "API call"); err != ErrInsufficientInboundLiquidity {
+		t.Errorf("Expected error %v, but was %v", ErrInsufficientInboundLiquidity, err)
+	}
+	if channelBalanceCalls != 1 {
+		t.Errorf("Expected the inbound liquidity to be fetched once, but was fetched %v times", channelBalanceCalls)
+	}
+}
+
+// TestDecodeInvoice tests if the payment request details from lnd are converted correctly.
+func TestDecodeInvoice(t *testing.T) {
+	c := NewLNDclientWithRPC(fakeLightningClient{}, context.Background())
+	decodedInvoice, err := c.DecodeInvoice("lnbc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DecodedInvoice{
+		PaymentHash: hex.EncodeToString(make([]byte, 32)),
+		Amount:      10,
+		Description: "API call",
+		CreatedAt:   time.Unix(1496314658, 0),
+		Expiry:      time.Hour,
+		RouteHints:  1,
+	}
+	if decodedInvoice != expected {
+		t.Errorf("Expected %+v, but was %+v", expected, decodedInvoice)
+	}
+}
+
+// fakeLightningServer is an lnrpc.LightningServer that only implements GetInfo.
+type fakeLightningServer struct {
+	lnrpc.UnimplementedLightningServer
+}
+
+func (s fakeLightningServer) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest) (*lnrpc.GetInfoResponse, error) {
+	return &lnrpc.GetInfoResponse{Alias: "fake"}, nil
+}
+
+// startFakeLightningServer starts a gRPC server with the fakeLightningServer on the given address.
+func startFakeLightningServer(t *testing.T, address string) (*grpc.Server, string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	lnrpc.RegisterLightningServer(server, fakeLightningServer{})
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+// TestReconnect tests if a request is retried after the connection to lnd dropped and was re-established.
+// The server is only started again after the first attempt failed, so the request can only succeed with a retry.
+func TestReconnect(t *testing.T) {
+	server, address := startFakeLightningServer(t, "127.0.0.1:0")
+	attempts := int32(0)
+	restarted := make(chan *grpc.Server, 1)
+	// Is called for each attempt, because it comes after the reconnect interceptor
+	restartAfterFailure := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		atomic.AddInt32(&attempts, 1)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil && len(restarted) == 0 {
+			newServer, _ := startFakeLightningServer(t, address)
+			restarted <- newServer
+		}
+		return err
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithChainUnaryInterceptor(reconnectInterceptor(1, 5*time.Second), restartAfterFailure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewLNDclientWithRPC(lnrpc.NewLightningClient(conn), context.Background())
+
+	if _, err = c.GetInfo(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a connection drop
+	server.Stop()
+	info, err := c.GetInfo()
+	if err != nil {
+		t.Fatalf("Expected the request to succeed after reconnecting, but the error was %v", err)
+	}
+	if info.Alias != "fake" {
+		t.Errorf("Expected the alias %v, but was %v", "fake", info.Alias)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts (1 before and 2 after the connection drop), but were %v", attempts)
+	}
+	(<-restarted).Stop()
+}
+
+// TestReconnectPayment tests if requests that lead to payments aren't retried.
+func TestReconnectPayment(t *testing.T) {
+	attempts := 0
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		attempts++
+		return status.Error(codes.Unavailable, "connection refused")
+	}
+	interceptor := reconnectInterceptor(3, time.Millisecond)
+	for method, expectedAttempts := range map[string]int{
+		"/lnrpc.Lightning/LookupInvoice":   4,
+		"/lnrpc.Lightning/SendPaymentSync": 1,
+	} {
+		attempts = 0
+		err := interceptor(context.Background(), method, nil, nil, nil, invoker)
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected the error code %v, but was %v", codes.Unavailable, status.Code(err))
+		}
+		if attempts != expectedAttempts {
+			t.Errorf("Expected %v attempts for %v, but were %v", expectedAttempts, method, attempts)
+		}
+	}
+}
+
+// TestPrivateRouteHints tests if invoices are only created with route hints for private channels when it's enabled.
+func TestPrivateRouteHints(t *testing.T) {
+	for _, privateRouteHints := range []bool{false, true} {
+		var private bool
+		c := NewLNDclientWithRPC(fakeLightningClient{
+			onAddInvoice: func(in *lnrpc.Invoice) {
+				private = in.GetPrivate()
+			},
+		}, context.Background())
+		c.privateRouteHints = privateRouteHints
+		if _, err := c.GenerateInvoice(10, "API call"); err != nil {
+			t.Fatal(err)
+		}
+		if private != privateRouteHints {
+			t.Errorf("Expected Private to be %v, but was %v", privateRouteHints, private)
+		}
+	}
+}
+
+// TestMemoTooLong tests if a memo that's longer than MaxMemoLength leads to ErrMemoTooLong without a request to lnd,
+// and if TrimMemo trims it to a length that's accepted.
+func TestMemoTooLong(t *testing.T) {
+	var called bool
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		onAddInvoice: func(in *lnrpc.Invoice) {
+			called = true
+		},
+	}, context.Background())
+	// 2 bytes per character, so the limit is in the middle of a character
+	memo := strings.Repeat("ü", 1024)
+	if _, err := c.GenerateInvoice(10, memo); err != ErrMemoTooLong {
+		t.Errorf("Expected error %v, but was %v", ErrMemoTooLong, err)
+	}
+	if called {
+		t.Error("Expected no request to lnd")
+	}
+
+	trimmed := TrimMemo(memo)
+	if len(trimmed) != 638 || !utf8.ValidString(trimmed) {
+		t.Errorf("Expected a valid UTF-8 memo with 638 bytes, but it had %v bytes", len(trimmed))
+	}
+	if _, err := c.GenerateInvoice(10, trimmed); err != nil {
+		t.Error(err)
+	}
+	if !called {
+		t.Error("Expected a request to lnd")
+	}
+}
+
+// TestDescriptionHash tests if the description hash is sent to lnd instead of a memo
+// and if invalid hashes are rejected without a request to lnd.
+func TestDescriptionHash(t *testing.T) {
+	var added []*lnrpc.Invoice
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		onAddInvoice: func(in *lnrpc.Invoice) {
+			added = append(added, in)
+		},
+	}, context.Background())
+	descriptionHash := DescriptionHash("Terms of service v2")
+	if _, err := c.GenerateInvoiceWithDescriptionHash(10, descriptionHash); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || !bytes.Equal(added[0].GetDescriptionHash(), descriptionHash) || added[0].GetMemo() != "" {
+		t.Errorf("Expected the description hash %x without memo, but was %+v", descriptionHash, added)
+	}
+	if _, err := c.GenerateInvoiceWithDescriptionHash(10, descriptionHash[:31]); err == nil {
+		t.Error("Expected an error for a description hash with 31 bytes, but was nil")
+	}
+	if len(added) != 1 {
+		t.Error("Expected no request to lnd for an invalid description hash")
+	}
+}
+
+// TestGenerateInvoiceMsat tests if millisatoshi amounts are sent to lnd unchanged
+// and if paid amounts are compared in millisatoshis.
+func TestGenerateInvoiceMsat(t *testing.T) {
+	var added []*lnrpc.Invoice
+	lookups := int32(0)
+	c := NewLNDclientWithRPC(fakeLightningClient{
+		lookups:     &lookups,
+		amtPaidMsat: 100,
+		onAddInvoice: func(in *lnrpc.Invoice) {
+			added = append(added, in)
+		},
+	}, context.Background())
+	if _, err := c.GenerateInvoiceMsat(100, "API call"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateInvoice(10, "API call"); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || added[0].GetValueMsat() != 100 || added[1].GetValueMsat() != 10000 {
+		t.Errorf("Expected invoices for 100 and 10000 msat, but were %+v", added)
+	}
+
+	preimage, _, err := NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		expectedAmount  string
+		check           func() (bool, error)
+		expectedSettled bool
+		expectedErr     error
+	}{
+		{"100 msat", func() (bool, error) { return c.CheckInvoiceMsat(preimage, 100) }, true, nil},
+		{"101 msat", func() (bool, error) { return c.CheckInvoiceMsat(preimage, 101) }, false, ErrInsufficientAmount},
+		{"0 sat", func() (bool, error) { return c.CheckInvoice(preimage, 0) }, true, nil},
+		// 100 msat are less than 1 Satoshi
+		{"1 sat", func() (bool, error) { return c.CheckInvoice(preimage, 1) }, false, ErrInsufficientAmount},
+	}
+	for _, testCase := range testCases {
+		settled, err := testCase.check()
+		if settled != testCase.expectedSettled || err != testCase.expectedErr {
+			t.Errorf("Expected %v, %v for an expected amount of %v, but was %v, %v", testCase.expectedSettled, testCase.expectedErr, testCase.expectedAmount, settled, err)
+		}
+	}
+}
+
+// TestFallbackAddress tests if generated invoices contain the on-chain fallback address
+// and if the FallbackAddressFunc is preferred over the FallbackAddress.
+func TestFallbackAddress(t *testing.T) {
+	testCases := []struct {
+		lndOptions LNDoptions
+		expected   string
+	}{
+		{LNDoptions{}, ""},
+		{LNDoptions{FallbackAddress: "bc1qstatic"}, "bc1qstatic"},
+		{LNDoptions{FallbackAddress: "bc1qstatic", FallbackAddressFunc: func() string { return "bc1qfresh" }}, "bc1qfresh"},
+	}
+	for _, testCase := range testCases {
+		var fallbackAddr string
+		c := NewLNDclientWithRPC(fakeLightningClient{
+			onAddInvoice: func(in *lnrpc.Invoice) {
+				fallbackAddr = in.GetFallbackAddr()
+			},
+		}, context.Background())
+		c.fallbackAddress = getFallbackAddressFunc(testCase.lndOptions)
+		if _, err := c.GenerateInvoice(10, "API call"); err != nil {
+			t.Fatal(err)
+		}
+		if fallbackAddr != testCase.expected {
+			t.Errorf("Expected the fallback address %q, but was %q", testCase.expected, fallbackAddr)
+		}
+	}
+}
+
+// TestNewLNDoptions tests if the functional options set the corresponding fields of the LNDoptions.
+func TestNewLNDoptions(t *testing.T) {
+	logger := NoopLogger{}
+	lndOptions := newLNDoptions("example.com:10009", []LNDoption{
+		WithCertFile("my.cert"),
+		WithMacaroonHex("0201"),
+		WithExpiry(10 * time.Minute),
+		WithTimeout(30 * time.Second),
+		WithPrivateRouteHints(),
+		WithFallbackAddress("bc1qstatic"),
+		WithProxy("localhost:9050"),
+		WithKeysend(696969),
+		WithReconcileWindow(time.Minute),
+		WithInboundLiquidityCheck(time.Minute),
+		WithSettledCache(100, time.Hour),
+		WithKeepalive(time.Minute, 10*time.Second, true),
+		WithReconnect(3, 2*time.Second),
+		WithDialOptions(grpc.WithUserAgent("a")),
+		WithDialOptions(grpc.WithUserAgent("b")),
+		WithLogger(logger),
+	})
+	expected := LNDoptions{
+		Address:                       "example.com:10009",
+		CertFile:                      "my.cert",
+		MacaroonHex:                   "0201",
+		Expiry:                        600,
+		ConnectionTimeout:             30 * time.Second,
+		PrivateRouteHints:             true,
+		FallbackAddress:               "bc1qstatic",
+		ProxyAddress:                  "localhost:9050",
+		KeysendTLVType:                696969,
+		ReconcileWindow:               time.Minute,
+		CheckInboundLiquidity:         true,
+		InboundLiquidityCacheDuration: time.Minute,
+		CacheSettledInvoices:          true,
+		SettledCacheSize:              100,
+		SettledCacheTTL:               time.Hour,
+		KeepaliveTime:                 time.Minute,
+		KeepaliveTimeout:              10 * time.Second,
+		KeepalivePermitWithoutStream:  true,
+		ReconnectRetries:              3,
+		ReconnectBackoff:              2 * time.Second,
+		Logger:                        logger,
+	}
+	if len(lndOptions.DialOptions) != 2 {
+		t.Errorf("Expected 2 dial options, but were %v", len(lndOptions.DialOptions))
+	}
+	lndOptions.DialOptions = nil
+	if !reflect.DeepEqual(lndOptions, expected) {
+		t.Errorf("Expected %+v, but was %+v", expected, lndOptions)
+	}
+}
+
+// TestLNDoptionsFromEnv tests if the options are read from the environment variables,
+// if values are preferred over paths and if all missing variables are listed in the error.
+func TestLNDoptionsFromEnv(t *testing.T) {
+	testCases := []struct {
+		env             map[string]string
+		expectedOptions LNDoptions
+		expectedErr     string
+	}{
+		{
+			map[string]string{"LND_ADDRESS": "lnd:10009", "LND_CERT": "pem", "LND_CERT_PATH": "tls.cert", "LND_MACAROON": "0201", "LND_MACAROON_PATH": "invoice.macaroon"},
+			LNDoptions{Address: "lnd:10009", CertPEM: "pem", MacaroonHex: "0201", SubscribeInvoices: true},
+			"",
+		},
+		{
+			map[string]string{"LND_ADDRESS": "lnd:10009", "LND_CERT_PATH": "tls.cert", "LND_MACAROON_PATH": "invoice.macaroon"},
+			LNDoptions{Address: "lnd:10009", CertFile: "tls.cert", MacaroonFile: "invoice.macaroon", SubscribeInvoices: true},
+			"",
+		},
+		{
+			map[string]string{"LND_CERT": "pem", "LND_MACAROON": ""},
+			LNDoptions{},
+			"missing environment variables for the lnd client: LND_ADDRESS, LND_MACAROON or LND_MACAROON_PATH",
+		},
+		{
+			map[string]string{},
+			LNDoptions{},
+			"missing environment variables for the lnd client: LND_ADDRESS, LND_CERT or LND_CERT_PATH, LND_MACAROON or LND_MACAROON_PATH",
+		},
+	}
+	for _, testCase := range testCases {
+		getenv := func(key string) string {
+			return testCase.env[key]
+		}
+		lndOptions, err := lndOptionsFromEnv(getenv, []LNDoption{WithSubscribeInvoices()})
+		if testCase.expectedErr != "" {
+			if err == nil || err.Error() != testCase.expectedErr {
+				t.Errorf("Expected error %q for %v, but was %v", testCase.expectedErr, testCase.env, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %v, but was %v", testCase.env, err)
+		}
+		if !reflect.DeepEqual(lndOptions, testCase.expectedOptions) {
+			t.Errorf("Expected %+v for %v, but was %+v", testCase.expectedOptions, testCase.env, lndOptions)
+		}
+	}
+}
+
+// fakeKeysendClient is an lnrpc.LightningClient that returns one keysend payment from ListInvoices
+// and sends one via the invoice subscription.
+type fakeKeysendClient struct {
+	lnrpc.LightningClient
+	listed     *lnrpc.Invoice
+	subscribed *lnrpc.Invoice
+	// Settle index of the subscription request
+	settleIndex chan uint64
+}
+
+func (c fakeKeysendClient) GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest, opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+	return &lnrpc.GetInfoResponse{IdentityPubkey: "02abc"}, nil
+}
+
+func (c fakeKeysendClient) ListInvoices(ctx context.Context, in *lnrpc.ListInvoiceRequest, opts ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
+	return &lnrpc.ListInvoiceResponse{Invoices: []*lnrpc.Invoice{c.listed}}, nil
+}
+
+func (c fakeKeysendClient) SubscribeInvoices(ctx context.Context, in *lnrpc.InvoiceSubscription, opts ...grpc.CallOption) (lnrpc.Lightning_SubscribeInvoicesClient, error) {
+	c.settleIndex <- in.GetSettleIndex()
+	return &fakeSubscriptionStream{ctx: ctx, invoices: []*lnrpc.Invoice{c.subscribed}}, nil
+}
+
+// fakeSubscriptionStream sends the invoices and then blocks until the context is done.
+type fakeSubscriptionStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	invoices []*lnrpc.Invoice
+}
+
+func (s *fakeSubscriptionStream) Recv() (*lnrpc.Invoice, error) {
+	if len(s.invoices) == 0 {
+		<-s.ctx.Done()
+		return nil, status.FromContextError(s.ctx.Err()).Err()
+	}
+	invoice := s.invoices[0]
+	s.invoices = s.invoices[1:]
+	return invoice, nil
+}
+
+// newKeysendInvoice returns a settled keysend invoice with the given nonce in the custom record of the TLV type.
+func newKeysendInvoice(tlvType uint64, nonce []byte, preimage []byte, settleIndex uint64) *lnrpc.Invoice {
+	return &lnrpc.Invoice{
+		RPreimage:   preimage,
+		AmtPaidSat:  10,
+		Settled:     true,
+		State:       lnrpc.Invoice_SETTLED,
+		SettleIndex: settleIndex,
+		SettleDate:  time.Now().Unix(),
+		IsKeysend:   true,
+		Htlcs: []*lnrpc.InvoiceHTLC{{
+			CustomRecords: map[uint64][]byte{
+				5482373484: preimage,
+				tlvType:    nonce,
+			},
+		}},
+	}
+}
+
+// TestKeysend tests if keysend payments from before the subscription and from the subscription are found by their nonce,
+// and if the subscription continues after the settle index of the recent invoices.
+func TestKeysend(t *testing.T) {
+	tlvType := uint64(696969)
+	listedNonce := bytes.Repeat([]byte{1}, 16)
+	subscribedNonce := bytes.Repeat([]byte{2}, 16)
+	listedPreimage := bytes.Repeat([]byte{3}, 32)
+	subscribedPreimage := bytes.Repeat([]byte{4}, 32)
+	fake := fakeKeysendClient{
+		listed:      newKeysendInvoice(tlvType, listedNonce, listedPreimage, 7),
+		subscribed:  newKeysendInvoice(tlvType, subscribedNonce, subscribedPreimage, 8),
+		settleIndex: make(chan uint64, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewLNDclientWithRPC(fake, ctx)
+	if _, _, err := c.KeysendDestination(); err == nil {
+		t.Error("Expected an error when keysend payments aren't enabled, but was nil")
+	}
+	c.keysend = newKeysend(tlvType)
+	go c.startInvoiceSubscription(ctx)
+	if settleIndex := <-fake.settleIndex; settleIndex != 7 {
+		t.Errorf("Expected the subscription to start after settle index 7, but was %v", settleIndex)
+	}
+
+	pubkey, actualTLVType, err := c.KeysendDestination()
+	if err != nil || pubkey != "02abc" || actualTLVType != tlvType {
+		t.Errorf("Expected pubkey 02abc and TLV type %v, but was %v and %v (error: %v)", tlvType, pubkey, actualTLVType, err)
+	}
+	for nonce, expectedPreimage := range map[string][]byte{
+		hex.EncodeToString(listedNonce):     listedPreimage,
+		hex.EncodeToString(subscribedNonce): subscribedPreimage,
+	} {
+		var preimage string
+		var amountPaid int64
+		// The subscription runs concurrently
+		for i := 0; i < 100; i++ {
+			if preimage, amountPaid, err = c.KeysendPayment(nonce); err != ErrInvoiceNotFound {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil || preimage != base64.StdEncoding.EncodeToString(expectedPreimage) || amountPaid != 10 {
+			t.Errorf("Expected the keysend payment with nonce %v to be found, but was %v, %v (error: %v)", nonce, preimage, amountPaid, err)
+		}
+	}
+	if _, _, err = c.KeysendPayment(hex.EncodeToString(bytes.Repeat([]byte{5}, 16))); err != ErrInvoiceNotFound {
+		t.Errorf("Expected error %v for an unknown nonce, but was %v", ErrInvoiceNotFound, err)
+	}
+}
+
+// fakeListInvoicesClient is an lnrpc.LightningClient that lists the invoices like lnd does, with pagination.
+type fakeListInvoicesClient struct {
+	lnrpc.LightningClient
+	// Ordered by add index, starting with 1
+	invoices []*lnrpc.Invoice
+	requests *int
+}
+
+func (c fakeListInvoicesClient) ListInvoices(ctx context.Context, in *lnrpc.ListInvoiceRequest, opts ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
+	*c.requests++
+	// Only reversed requests are supported: The offset is exclusive, 0 means from the newest
+	end := uint64(len(c.invoices))
+	if in.GetIndexOffset() > 0 {
+		end = in.GetIndexOffset() - 1
+	}
+	start := uint64(0)
+	if end > in.GetNumMaxInvoices() {
+		start = end - in.GetNumMaxInvoices()
+	}
+	return &lnrpc.ListInvoiceResponse{
+		Invoices:         c.invoices[start:end],
+		FirstIndexOffset: start + 1,
+		LastIndexOffset:  end,
+	}, nil
+}
+
+// TestSettledInvoicesEviction tests if the oldest invoice is evicted from a full settled set,
+// and if popped invoices don't count towards the limit.
+func TestSettledInvoicesEviction(t *testing.T) {
+	s := newSettledInvoices(2)
+	for i := byte(1); i <= 3; i++ {
+		s.add(&lnrpc.Invoice{RHash: []byte{i}, AmtPaidMsat: int64(i) * 1000})
+	}
+	if _, ok := s.pop([]byte{1}); ok {
+		t.Error("Expected the oldest invoice to be evicted")
+	}
+	for i := byte(2); i <= 3; i++ {
+		if amtPaidMsat, ok := s.pop([]byte{i}); !ok || amtPaidMsat != int64(i)*1000 {
+			t.Errorf("Expected invoice %v with %v msat, but was %v, %v", i, int64(i)*1000, amtPaidMsat, ok)
+		}
+	}
+	if _, ok := s.pop([]byte{3}); ok {
+		t.Error("Expected a popped invoice to be removed")
+	}
+	if len(s.m.m) != 0 {
+		t.Errorf("Expected an empty set, but it had %v entries", len(s.m.m))
+	}
+}
+
+// TestReconcileInvoices tests if the invoices that were settled within the window are added to the settled set,
+// if the highest settle index is returned, and if older pages aren't requested once an invoice expired before the window.
+func TestReconcileInvoices(t *testing.T) {
+	now := time.Now().Unix()
+	var invoices []*lnrpc.Invoice
+	// Expired long before the window, then settled before the window, then settled within the window
+	for i := 0; i < 2*reconcilePageSize; i++ {
+		invoices = append(invoices, &lnrpc.Invoice{RHash: []byte{0, byte(i >> 8), byte(i)}, CreationDate: now - 10000, Expiry: 3600})
+	}
+	invoices = append(invoices, &lnrpc.Invoice{RHash: []byte{1}, CreationDate: now - 5000, Expiry: 3600, Settled: true, SettleDate: now - 4000, SettleIndex: 1})
+	for i := 0; i < reconcilePageSize; i++ {
+		invoices = append(invoices, &lnrpc.Invoice{RHash: []byte{2, byte(i >> 8), byte(i)}, CreationDate: now - 100, Expiry: 3600, Settled: true, SettleDate: now - 50, SettleIndex: uint64(i + 2), AmtPaidSat: 10})
+	}
+	requests := 0
+	c := NewLNDclientWithRPC(fakeListInvoicesClient{invoices: invoices, requests: &requests}, context.Background())
+	c.reconcileWindow = time.Hour
+	c.settledInvoices = newSettledInvoices(maxSettledInvoices)
+
+	settleIndex := c.reconcileInvoices(context.Background())
+	if settleIndex != reconcilePageSize+1 {
+		t.Errorf("Expected the settle index %v, but was %v", reconcilePageSize+1, settleIndex)
+	}
+	if len(c.settledInvoices.m.m) != reconcilePageSize {
+		t.Errorf("Expected %v settled invoices, but were %v", reconcilePageSize, len(c.settledInvoices.m.m))
+	}
+	if _, ok := c.settledInvoices.pop([]byte{1}); ok {
+		t.Error("Expected the invoice that was settled before the window not to be added")
+	}
+	if amtPaidMsat, ok := c.settledInvoices.pop([]byte{2, 0, 0}); !ok || amtPaidMsat != 10000 {
+		t.Errorf("Expected the invoice that was settled within the window to be added, but was %v, %v", amtPaidMsat, ok)
+	}
+	// The second page contains invoices that expired before the window, so the third isn't requested
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, but were %v", requests)
+	}
+}
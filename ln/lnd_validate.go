@@ -0,0 +1,67 @@
+package ln
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// validateLNDoptions checks the options that would otherwise lead to cryptic errors deep inside gRPC or TLS.
+// It must be called after assignDefaultValues(...).
+// The returned error names the offending option.
+func validateLNDoptions(lndOptions LNDoptions) error {
+	network, address := parseAddress(lndOptions.Address)
+	if network == "unix" {
+		if address == "" {
+			return fmt.Errorf("invalid Address option: the Unix domain socket path in %q is empty", lndOptions.Address)
+		}
+		if lndOptions.ProxyAddress != "" {
+			return errors.New("the ProxyAddress option can't be used with a Unix domain socket")
+		}
+	} else if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		return fmt.Errorf("invalid Address option: %q doesn't contain a port, for example \"localhost:10009\"", address)
+	}
+	if lndOptions.KeysendTLVType > 0 && lndOptions.KeysendTLVType < MinKeysendTLVType {
+		return fmt.Errorf("invalid KeysendTLVType option: %v is lower than %v, the lowest type lnd accepts for custom records", lndOptions.KeysendTLVType, MinKeysendTLVType)
+	}
+	// File-based options are only used if their content isn't passed directly
+	if lndOptions.CertPEM == "" {
+		if err := checkReadableFile(lndOptions.CertFile, "CertFile", "cert file"); err != nil {
+			return err
+		}
+	}
+	if lndOptions.MacaroonHex == "" {
+		if err := checkReadableFile(lndOptions.MacaroonFile, "MacaroonFile", "macaroon file"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReadableFile returns an error that names the option if the file doesn't exist, isn't readable or is a directory.
+// For relative paths the error contains the working directory, because that's a common source of confusion.
+func checkReadableFile(path string, option string, description string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		msg := fmt.Sprintf("invalid %v option: %v %q not found", option, description, path)
+		if wd, wdErr := os.Getwd(); wdErr == nil && !filepath.IsAbs(path) {
+			msg += fmt.Sprintf(" (relative to the working directory %q)", wd)
+		}
+		return errors.New(msg)
+	} else if os.IsPermission(err) {
+		return fmt.Errorf("invalid %v option: %v %q isn't readable, check its permissions", option, description, path)
+	} else if err != nil {
+		return fmt.Errorf("invalid %v option: couldn't open %v %q: %v", option, description, path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("invalid %v option: couldn't open %v %q: %v", option, description, path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("invalid %v option: %v %q is a directory, not a file", option, description, path)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package ln
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// multiClientMaxInvoices is the number of invoices for which the MultiClient remembers which client generated them.
+const multiClientMaxInvoices = 100000
+
+// Client is an abstraction of an LN client, like the ones of this package.
+// It's the same as wall.LNclient, which can't be used here, because the wall package imports this one.
+type Client interface {
+	GenerateInvoice(amount int64, memo string) (string, error)
+	CheckInvoice(preimage string, expectedAmount int64) (bool, error)
+}
+
+// MultiClientStrategy determines which client of a MultiClient generates an invoice.
+type MultiClientStrategy string
+
+const (
+	// MultiClientFailover leads to the first client generating all invoices,
+	// and to the next one only being used when the previous one returns an error.
+	MultiClientFailover MultiClientStrategy = "failover"
+	// MultiClientRoundRobin leads to the clients taking turns in generating invoices, which spreads the load,
+	// with the failover to the next client when one returns an error.
+	MultiClientRoundRobin MultiClientStrategy = "roundrobin"
+)
+
+// MultiClient is an LN client that wraps multiple LN clients, for example for two lnd nodes,
+// so that the payment layer doesn't have a single point of failure.
+// It implements the wall.LNclient interface.
+//
+// When a client returns an error for generating an invoice, the next one is tried.
+// The MultiClient remembers which client generated an invoice, up to multiClientMaxInvoices (100,000) in memory,
+// so that the preimage is checked with the same client.
+// For invoices it doesn't know, for example after a restart, all clients are asked in order,
+// until one of them knows the invoice.
+// Use the same storage for all nodes as usual, so that a preimage can't be used twice.
+type MultiClient struct {
+	clients  []Client
+	strategy MultiClientStrategy
+	// Index of the client that generates the next invoice with MultiClientRoundRobin
+	next *uint32
+	// Maps the hex encoded payment hashes of the generated invoices to the indexes of the clients
+	clientIndexes *boundedMap
+	logger        Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo with one of the clients, depending on the strategy.
+// If a client returns an error, the next one is tried. If all of them fail, the error of the last one is returned.
+// ErrMemoTooLong isn't passed on to the next client, because all of them would fail.
+func (c MultiClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	start := 0
+	if c.strategy == MultiClientRoundRobin {
+		start = int(atomic.AddUint32(c.next, 1)-1) % len(c.clients)
+	}
+	var err error
+	for i := 0; i < len(c.clients); i++ {
+		index := (start + i) % len(c.clients)
+		var invoice string
+		invoice, err = c.clients[index].GenerateInvoice(amount, memo)
+		if err == ErrMemoTooLong {
+			return "", err
+		} else if err != nil {
+			c.logger.Printf("Client %v couldn't generate the invoice, trying the next one: %v\n", index, err)
+			continue
+		}
+		if paymentHash, hashErr := PaymentHashFromInvoice(invoice); hashErr == nil {
+			c.clientIndexes.add(hex.EncodeToString(paymentHash), index)
+		}
+		return invoice, nil
+	}
+	return "", err
+}
+
+// CheckInvoice takes a Base64 encoded preimage and checks the corresponding invoice with the client that generated it.
+// If that's unknown, the clients are asked in order, and the result of the first one that knows the invoice is returned.
+// ErrInvoiceNotFound is returned if none of them knows it. If a client returns another error,
+// the next one is asked anyway, and the error is returned if none of the others knows the invoice.
+func (c MultiClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+	if index, ok := c.clientIndexes.get(hex.EncodeToString(hashSlice)); ok {
+		return c.clients[index.(int)].CheckInvoice(preimage, expectedAmount)
+	}
+
+	var lastErr error
+	for index, client := range c.clients {
+		settled, err := client.CheckInvoice(preimage, expectedAmount)
+		if isInvoiceNotFound(err) {
+			continue
+		} else if err != nil && err != ErrInsufficientAmount && err != ErrInvoiceCanceled {
+			c.logger.Printf("Client %v couldn't check the invoice, asking the next one: %v\n", index, err)
+			lastErr = err
+			continue
+		}
+		return settled, err
+	}
+	if lastErr != nil {
+		return false, lastErr
+	}
+	return false, ErrInvoiceNotFound
+}
+
+// isInvoiceNotFound returns true if the error means that the invoice doesn't exist.
+// lnd returns its gRPC error with the same message as ErrInvoiceNotFound instead of ErrInvoiceNotFound itself.
+func isInvoiceNotFound(err error) bool {
+	return err != nil && (err == ErrInvoiceNotFound || strings.Contains(err.Error(), ErrInvoiceNotFound.Error()))
+}
+
+// MultiClientOptions are the options for the MultiClient.
+type MultiClientOptions struct {
+	// Determines which client generates an invoice, see MultiClientFailover and MultiClientRoundRobin.
+	// Optional (MultiClientFailover by default).
+	Strategy MultiClientStrategy
+	// Logger for info messages, like the failover to the next client.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultMultiClientOptions provides default values for MultiClientOptions.
+var DefaultMultiClientOptions = MultiClientOptions{
+	Strategy: MultiClientFailover,
+}
+
+// NewMultiClient creates a new MultiClient with the given clients.
+// With MultiClientFailover the order of the clients determines which one is used first.
+// An error is returned if no client is passed or the strategy is unknown.
+func NewMultiClient(clients []Client, multiClientOptions MultiClientOptions) (MultiClient, error) {
+	result := MultiClient{}
+
+	// Set default values
+	if multiClientOptions.Strategy == "" {
+		multiClientOptions.Strategy = DefaultMultiClientOptions.Strategy
+	}
+	if multiClientOptions.Logger == nil {
+		multiClientOptions.Logger = NoopLogger{}
+	}
+
+	if len(clients) == 0 {
+		return result, errors.New("at least one client is required")
+	}
+	if multiClientOptions.Strategy != MultiClientFailover && multiClientOptions.Strategy != MultiClientRoundRobin {
+		return result, errors.New("unknown strategy: " + string(multiClientOptions.Strategy))
+	}
+
+	result = MultiClient{
+		clients:       clients,
+		strategy:      multiClientOptions.Strategy,
+		next:          new(uint32),
+		clientIndexes: newBoundedMap(multiClientMaxInvoices),
+		logger:        multiClientOptions.Logger,
+	}
+	return result, nil
+}
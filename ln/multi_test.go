@@ -0,0 +1,87 @@
+package ln_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestMultiClientImpl tests if MultiClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestMultiClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.MultiClient{}
+}
+
+// failingClient is an LN client whose node is down.
+type failingClient struct{}
+
+func (c failingClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func (c failingClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// TestMultiClient tests if the MultiClient fails over to the next client
+// and checks the preimages with the client that generated the invoice.
+func TestMultiClient(t *testing.T) {
+	node1 := ln.NewFakeClient()
+	node2 := ln.NewFakeClient()
+	testCases := []struct {
+		name     string
+		clients  []ln.Client
+		strategy ln.MultiClientStrategy
+		// Nodes that are expected to generate three invoices in a row
+		expectedNodes []ln.FakeClient
+	}{
+		{"failover", []ln.Client{node1, node2}, ln.MultiClientFailover, []ln.FakeClient{node1, node1, node1}},
+		{"failover after error", []ln.Client{failingClient{}, node2}, ln.MultiClientFailover, []ln.FakeClient{node2, node2, node2}},
+		{"round robin", []ln.Client{node1, node2}, ln.MultiClientRoundRobin, []ln.FakeClient{node1, node2, node1}},
+		{"round robin after error", []ln.Client{node1, failingClient{}}, ln.MultiClientRoundRobin, []ln.FakeClient{node1, node1, node1}},
+	}
+	for _, testCase := range testCases {
+		c, err := ln.NewMultiClient(testCase.clients, ln.MultiClientOptions{Strategy: testCase.strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// After a restart the MultiClient doesn't know which client generated the invoice
+		restarted, _ := ln.NewMultiClient(testCase.clients, ln.MultiClientOptions{Strategy: testCase.strategy})
+		for i, expectedNode := range testCase.expectedNodes {
+			invoice, err := c.GenerateInvoice(10, "API call")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the node that generated the invoice knows it
+			preimage, err := expectedNode.Pay(invoice)
+			if err != nil {
+				t.Errorf("%v: Expected invoice %v to be generated by the other node: %v", testCase.name, i, err)
+				continue
+			}
+			for _, client := range []ln.MultiClient{c, restarted} {
+				if settled, err := client.CheckInvoice(preimage, 10); !settled || err != nil {
+					t.Errorf("%v: Expected invoice %v to be settled, but was %v and error %v", testCase.name, i, settled, err)
+				}
+			}
+		}
+	}
+
+	// Unknown preimages
+	c, _ := ln.NewMultiClient([]ln.Client{node1, node2}, ln.MultiClientOptions{})
+	preimage, _, _ := ln.NewPreimage()
+	if _, err := c.CheckInvoice(preimage, 10); err != ln.ErrInvoiceNotFound {
+		t.Errorf("Expected error %v, but was %v", ln.ErrInvoiceNotFound, err)
+	}
+	// The error of a failing client is returned if no other client knows the invoice
+	c, _ = ln.NewMultiClient([]ln.Client{node1, failingClient{}}, ln.MultiClientOptions{})
+	if _, err := c.CheckInvoice(preimage, 10); err == nil || err == ln.ErrInvoiceNotFound {
+		t.Errorf("Expected the error of the failing client, but was %v", err)
+	}
+
+	if _, err := ln.NewMultiClient(nil, ln.MultiClientOptions{}); err == nil {
+		t.Error("Expected an error without clients, but was nil")
+	}
+}
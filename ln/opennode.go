@@ -0,0 +1,253 @@
+package ln
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OpenNodeEnvironment is the environment of OpenNode that the OpenNodeClient uses.
+type OpenNodeEnvironment string
+
+const (
+	// OpenNodeLive is OpenNode's production environment with real Bitcoin.
+	OpenNodeLive OpenNodeEnvironment = "live"
+	// OpenNodeDev is OpenNode's development environment with testnet Bitcoin.
+	// It requires an API key that was created on https://app.dev.opennode.com.
+	OpenNodeDev OpenNodeEnvironment = "dev"
+)
+
+// openNodeAddresses are the base URLs of OpenNode's API for each environment.
+var openNodeAddresses = map[OpenNodeEnvironment]string{
+	OpenNodeLive: "https://api.opennode.com",
+	OpenNodeDev:  "https://dev-api.opennode.com",
+}
+
+// openNodeMaxChargeIDs is the number of charge IDs the OpenNodeClient remembers, see OpenNodeClient.
+const openNodeMaxChargeIDs = 10000
+
+// OpenNodeClient is an implementation of the wall.LNclient interface for OpenNode (https://www.opennode.com),
+// a custodial service that receives the payments for you, so you don't need to run any node.
+// It uses OpenNode's charges API: Each invoice is the Lightning invoice of a charge.
+//
+// OpenNode doesn't provide a way to look up a charge by its payment hash, so the client remembers the IDs
+// of the charges it created, up to openNodeMaxChargeIDs (10,000) in memory.
+// For charges it doesn't know, for example after a restart or when multiple instances of a web service
+// share the API key, CheckInvoice(...) searches the list of paid charges, which takes longer.
+type OpenNodeClient struct {
+	address    string
+	apiKey     string
+	chargeIDs  *boundedMap
+	httpClient *http.Client
+	logger     Logger
+}
+
+// GenerateInvoice generates an invoice with the given price and memo by creating a charge.
+// OpenNode charges always have an amount, so an amount of 0 leads to an error.
+func (c OpenNodeClient) GenerateInvoice(amount int64, memo string) (string, error) {
+	if amount == 0 {
+		return "", errors.New("OpenNode doesn't support amountless invoices")
+	}
+	// Create the request and send it.
+	// Without a currency the amount is in Satoshis.
+	reqBody, err := json.Marshal(openNodeCreateCharge{
+		Amount:      amount,
+		Description: memo,
+	})
+	if err != nil {
+		return "", err
+	}
+	c.logger.Printf("Creating invoice for a new API request")
+	res := openNodeChargeResponse{}
+	err = c.do("POST", "/v1/charges", reqBody, &res)
+	if err != nil {
+		return "", err
+	}
+	invoice := res.Data.LightningInvoice.PayReq
+	if invoice == "" {
+		return "", fmt.Errorf("the OpenNode charge %v doesn't contain a Lightning invoice", res.Data.ID)
+	}
+
+	// Remember the charge, so that we can find it when we get the preimage
+	paymentHash, err := PaymentHashFromInvoice(invoice)
+	if err != nil {
+		return "", err
+	}
+	c.chargeIDs.add(hex.EncodeToString(paymentHash), res.Data.ID)
+
+	return invoice, nil
+}
+
+// CheckInvoice takes a Base64 encoded preimage, fetches the corresponding charge,
+// and checks if it was paid and if at least the expected amount (in Satoshis) was paid.
+// Only the OpenNode status "paid" counts as paid.
+// An error is returned if the preimage contains invalid Base64 characters or if no corresponding charge was found.
+// ErrInsufficientAmount is returned for the status "underpaid" and if the amount of the charge is lower than the expected amount.
+// ErrInvoiceCanceled is returned for the statuses "expired" and "refunded".
+// False is returned if the charge isn't paid yet ("unpaid" or "processing").
+func (c OpenNodeClient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	// Hash the preimage so we can get the corresponding charge to check if it's paid
+	hashSlice, err := decodeAndHashPreimage(preimage)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the charge for that hash
+	encodedHash := base64.StdEncoding.EncodeToString(hashSlice)
+	c.logger.Printf("Checking invoice for hash %v\n", encodedHash)
+	charge, err := c.getCharge(hex.EncodeToString(hashSlice))
+	if err != nil {
+		return false, err
+	}
+
+	// Check if the charge was paid
+	switch charge.Status {
+	case "paid":
+	case "underpaid":
+		return false, ErrInsufficientAmount
+	case "expired", "refunded":
+		return false, ErrInvoiceCanceled
+	default:
+		return false, nil
+	}
+	// Check if enough was paid
+	if charge.Amount < expectedAmount {
+		return false, ErrInsufficientAmount
+	}
+	return true, nil
+}
+
+// getCharge returns the charge with the given hex encoded payment hash.
+// If the client doesn't know the ID of the charge, it searches the list of paid charges.
+func (c OpenNodeClient) getCharge(paymentHash string) (openNodeCharge, error) {
+	if id, ok := c.chargeIDs.get(paymentHash); ok {
+		res := openNodeChargeResponse{}
+		err := c.do("GET", "/v1/charge/"+url.PathEscape(id.(string)), nil, &res)
+		return res.Data, err
+	}
+	c.logger.Printf("Unknown charge, searching the paid charges for hash %v\n", paymentHash)
+	res := openNodeChargesResponse{}
+	err := c.do("GET", "/v1/charges", nil, &res)
+	if err != nil {
+		return openNodeCharge{}, err
+	}
+	for _, charge := range res.Data {
+		if hash, err := PaymentHashFromInvoice(charge.LightningInvoice.PayReq); err == nil && hex.EncodeToString(hash) == paymentHash {
+			return charge, nil
+		}
+	}
+	return openNodeCharge{}, ErrInvoiceNotFound
+}
+
+// do sends a request to the given endpoint of the OpenNode API
+// and decodes the JSON response into the given result object.
+func (c OpenNodeClient) do(method string, endpoint string, reqBody []byte, result interface{}) error {
+	req, err := http.NewRequest(method, c.address+endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.apiKey)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrInvoiceNotFound
+	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("OpenNode responded with status %v to %v: %s", res.StatusCode, endpoint, resBody)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// NewOpenNodeClient creates a new OpenNodeClient instance.
+// An error is returned if the API key is missing or the environment is unknown.
+func NewOpenNodeClient(openNodeOptions OpenNodeOptions) (OpenNodeClient, error) {
+	result := OpenNodeClient{}
+
+	// Set default values
+	if openNodeOptions.Environment == "" {
+		openNodeOptions.Environment = DefaultOpenNodeOptions.Environment
+	}
+	if openNodeOptions.Logger == nil {
+		openNodeOptions.Logger = NoopLogger{}
+	}
+
+	if openNodeOptions.APIKey == "" {
+		return result, errors.New("the APIKey option is required for OpenNode")
+	}
+	address := openNodeOptions.Address
+	if address == "" {
+		var ok bool
+		if address, ok = openNodeAddresses[openNodeOptions.Environment]; !ok {
+			return result, fmt.Errorf("unknown OpenNode environment %q, use %q or %q", openNodeOptions.Environment, OpenNodeLive, OpenNodeDev)
+		}
+	}
+
+	result = OpenNodeClient{
+		address:    strings.TrimSuffix(address, "/"),
+		apiKey:     openNodeOptions.APIKey,
+		chargeIDs:  newBoundedMap(openNodeMaxChargeIDs),
+		httpClient: http.DefaultClient,
+		logger:     openNodeOptions.Logger,
+	}
+	return result, nil
+}
+
+// OpenNodeOptions are the options for the connection to OpenNode.
+type OpenNodeOptions struct {
+	// API key of your OpenNode account. A key with the "Invoices" permission is sufficient.
+	APIKey string
+	// Environment of OpenNode, OpenNodeLive or OpenNodeDev. The API key must belong to the same environment.
+	// Optional (OpenNodeLive by default).
+	Environment OpenNodeEnvironment
+	// Base URL of the OpenNode API, which overrides the one of the Environment.
+	// Only required for tests or proxies.
+	// Optional ("" by default).
+	Address string
+	// Logger for info messages, like the creation of an invoice.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (NoopLogger by default, which means nothing is logged).
+	Logger Logger
+}
+
+// DefaultOpenNodeOptions provides default values for OpenNodeOptions.
+var DefaultOpenNodeOptions = OpenNodeOptions{
+	Environment: OpenNodeLive,
+}
+
+type openNodeCreateCharge struct {
+	// Amount in Satoshis
+	Amount      int64  `json:"amount"`
+	Description string `json:"description,omitempty"`
+}
+
+type openNodeCharge struct {
+	ID string `json:"id"`
+	// "unpaid", "processing", "paid", "underpaid", "expired" or "refunded"
+	Status string `json:"status"`
+	// Amount in Satoshis
+	Amount           int64 `json:"amount"`
+	LightningInvoice struct {
+		PayReq string `json:"payreq"`
+	} `json:"lightning_invoice"`
+}
+
+type openNodeChargeResponse struct {
+	Data openNodeCharge `json:"data"`
+}
+
+type openNodeChargesResponse struct {
+	Data []openNodeCharge `json:"data"`
+}
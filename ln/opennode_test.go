@@ -0,0 +1,129 @@
+package ln_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestOpenNodeClientImpl tests if OpenNodeClient implements the wall.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestOpenNodeClientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ wall.LNclient = ln.OpenNodeClient{}
+}
+
+// TestOpenNodeClient tests the payment flow of the OpenNodeClient with a fake charges API:
+// Creating a charge and checking it with the preimage, by its ID and by searching the paid charges.
+func TestOpenNodeClient(t *testing.T) {
+	fakeClient := ln.NewFakeClient()
+	bolt11, err := fakeClient.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := "unpaid"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		charge := map[string]interface{}{
+			"id":                "charge1",
+			"status":            status,
+			"amount":            10,
+			"lightning_invoice": map[string]string{"payreq": bolt11},
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/charges":
+			var body struct {
+				Amount int64 `json:"amount"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Amount != 10 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": charge})
+		case "GET /v1/charge/charge1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": charge})
+		case "GET /v1/charges":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": []interface{}{charge}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	openNodeOptions := ln.OpenNodeOptions{
+		APIKey:  "secret",
+		Address: server.URL,
+	}
+	c, err := ln.NewOpenNodeClient(openNodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoice, err := c.GenerateInvoice(10, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice != bolt11 {
+		t.Errorf("Expected the invoice %v, but was %v", bolt11, invoice)
+	}
+	preimage, err := fakeClient.Pay(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new client doesn't know the charge ID, like after a restart
+	restartedClient, err := ln.NewOpenNodeClient(openNodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		status         string
+		expectedAmount int64
+		expected       bool
+		expectedErr    error
+	}{
+		{"unpaid", 10, false, nil},
+		{"processing", 10, false, nil},
+		{"paid", 10, true, nil},
+		{"paid", 11, false, ln.ErrInsufficientAmount},
+		{"underpaid", 10, false, ln.ErrInsufficientAmount},
+		{"expired", 10, false, ln.ErrInvoiceCanceled},
+	}
+	for _, client := range []ln.OpenNodeClient{c, restartedClient} {
+		for _, testCase := range testCases {
+			status = testCase.status
+			settled, err := client.CheckInvoice(preimage, testCase.expectedAmount)
+			if settled != testCase.expected || err != testCase.expectedErr {
+				t.Errorf("Expected %v and error %v for status %v, but was %v and %v", testCase.expected, testCase.expectedErr, testCase.status, settled, err)
+			}
+		}
+	}
+
+	// A preimage of another invoice must not match
+	otherInvoice, _ := fakeClient.GenerateInvoice(10, "API call")
+	otherPreimage, _ := fakeClient.Pay(otherInvoice)
+	if _, err = c.CheckInvoice(otherPreimage, 10); err != ln.ErrInvoiceNotFound {
+		t.Errorf("Expected error %v, but was %v", ln.ErrInvoiceNotFound, err)
+	}
+}
+
+// TestNewOpenNodeClientErrors tests if NewOpenNodeClient returns errors for invalid options.
+func TestNewOpenNodeClientErrors(t *testing.T) {
+	if _, err := ln.NewOpenNodeClient(ln.OpenNodeOptions{}); err == nil {
+		t.Error("Expected an error for a missing API key, but was nil")
+	}
+	if _, err := ln.NewOpenNodeClient(ln.OpenNodeOptions{APIKey: "secret", Environment: "test"}); err == nil {
+		t.Error("Expected an error for an unknown environment, but was nil")
+	}
+	if _, err := ln.NewOpenNodeClient(ln.OpenNodeOptions{APIKey: "secret", Environment: ln.OpenNodeDev}); err != nil {
+		t.Error(err)
+	}
+}
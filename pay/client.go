@@ -0,0 +1,244 @@
+package pay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrMaxAmountExceeded is returned when the amount of an invoice is higher than the configured maximum amount.
+// The invoice isn't paid in this case.
+var ErrMaxAmountExceeded = errors.New("the amount of the invoice is higher than the maximum amount")
+
+// LNclient is an abstraction of a client that connects to a Lightning Network node implementation
+// and pays invoices.
+// ln.LNDclient implements it, as well as ln.FakeClient for tests.
+type LNclient interface {
+	// PayInvoice pays the given BOLT11 invoice and returns the Base64 encoded preimage
+	// as well as the paid amount in Satoshis.
+	PayInvoice(invoice string) (preimage string, amountPaid int64, err error)
+}
+
+// Client sends HTTP requests and automatically pays for them if the server responds with "402 Payment Required".
+type Client struct {
+	httpClient *http.Client
+	lnClient   LNclient
+	maxAmount  int64
+	headerName string
+}
+
+// Do sends the request and returns the response, like http.Client.Do(...).
+// If the server responds with "402 Payment Required", the invoice from the response is paid
+// and the request is sent again, with the preimage in the preimage header, or in the Authorization header
+// if the server uses the L402 mode. The response of the second request is returned in this case,
+// as well as the paid amount in Satoshis. Only one payment is made per call, so if the second request
+// leads to a 402 as well, that response is returned.
+// Invoices with an amount above the maximum amount aren't paid, and ErrMaxAmountExceeded is returned instead.
+func (c Client) Do(req *http.Request) (*http.Response, int64, error) {
+	// The body must be sent twice, so it's read into memory if it can't be obtained again otherwise
+	if req.Body != nil && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != http.StatusPaymentRequired {
+		return res, 0, nil
+	}
+
+	invoice, macaroon, err := getInvoice(res)
+	res.Body.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	amount, err := getAmount(invoice)
+	if err != nil {
+		return nil, 0, err
+	}
+	if amount > c.maxAmount {
+		return nil, 0, ErrMaxAmountExceeded
+	}
+	preimage, amountPaid, err := c.lnClient.PayInvoice(invoice)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	retry := req.WithContext(req.Context())
+	retry.Header = cloneHeader(req.Header)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, amountPaid, err
+		}
+	}
+	if macaroon != "" {
+		preimageBytes, err := base64.StdEncoding.DecodeString(preimage)
+		if err != nil {
+			return nil, amountPaid, err
+		}
+		retry.Header.Set("Authorization", "L402 "+macaroon+":"+hex.EncodeToString(preimageBytes))
+	} else {
+		retry.Header.Set(c.headerName, preimage)
+	}
+	res, err = c.httpClient.Do(retry)
+	if err != nil {
+		return nil, amountPaid, err
+	}
+	return res, amountPaid, nil
+}
+
+// Options are the options for the Client.
+type Options struct {
+	// HTTP client that's used for sending the requests.
+	// Optional (http.DefaultClient by default).
+	HTTPClient *http.Client
+	// Maximum amount in Satoshis that's paid for a single request, not including routing fees.
+	// Invoices above this amount aren't paid.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (100 by default).
+	MaxAmount int64
+	// Name of the header in which the preimage is sent, which must be the same as the one of the paywall.
+	// Optional ("X-Preimage" by default).
+	HeaderName string
+}
+
+// DefaultOptions provides default values for Options.
+var DefaultOptions = Options{
+	HTTPClient: http.DefaultClient,
+	MaxAmount:  100,
+	HeaderName: "X-Preimage",
+}
+
+// NewClient creates a new Client.
+func NewClient(lnClient LNclient, options Options) Client {
+	// Set default values
+	if options.HTTPClient == nil {
+		options.HTTPClient = DefaultOptions.HTTPClient
+	}
+	if options.MaxAmount <= 0 {
+		options.MaxAmount = DefaultOptions.MaxAmount
+	}
+	if options.HeaderName == "" {
+		options.HeaderName = DefaultOptions.HeaderName
+	}
+
+	return Client{
+		httpClient: options.HTTPClient,
+		lnClient:   lnClient,
+		maxAmount:  options.MaxAmount,
+		headerName: options.HeaderName,
+	}
+}
+
+var (
+	macaroonRegexp = regexp.MustCompile(`macaroon="([^"]+)"`)
+	invoiceRegexp  = regexp.MustCompile(`invoice="([^"]+)"`)
+)
+
+// getInvoice extracts the invoice from a response with the status code 402.
+// The macaroon is only non-empty if the server uses the L402 mode.
+func getInvoice(res *http.Response) (invoice string, macaroon string, err error) {
+	// L402 mode
+	if authHeader := res.Header.Get("WWW-Authenticate"); strings.HasPrefix(strings.ToUpper(authHeader), "L402 ") {
+		macaroonMatch := macaroonRegexp.FindStringSubmatch(authHeader)
+		invoiceMatch := invoiceRegexp.FindStringSubmatch(authHeader)
+		if macaroonMatch != nil && invoiceMatch != nil {
+			return invoiceMatch[1], macaroonMatch[1], nil
+		}
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var jsonBody struct {
+			Invoice string `json:"invoice"`
+		}
+		if err = json.Unmarshal(body, &jsonBody); err != nil {
+			return "", "", err
+		}
+		invoice = jsonBody.Invoice
+	} else {
+		invoice = strings.TrimSpace(string(body))
+	}
+	if invoice == "" {
+		return "", "", errors.New("the response doesn't contain an invoice")
+	}
+	return invoice, "", nil
+}
+
+// amountRegexp matches the human-readable part of a BOLT11 invoice,
+// for example "lnbc2500u", with the network, the amount and the multiplier.
+var amountRegexp = regexp.MustCompile(`^ln([a-z]+?)([0-9]+)?([munp])?$`)
+
+// getAmount returns the amount of the BOLT11 invoice in Satoshis, rounded up.
+// The invoice isn't validated, the amount is only read from the human-readable part.
+func getAmount(invoice string) (int64, error) {
+	invoice = strings.ToLower(invoice)
+	separatorIndex := strings.LastIndex(invoice, "1")
+	if separatorIndex < 0 {
+		return 0, errors.New("the invoice isn't a valid BOLT11 invoice")
+	}
+	match := amountRegexp.FindStringSubmatch(invoice[:separatorIndex])
+	if match == nil {
+		return 0, errors.New("the invoice isn't a valid BOLT11 invoice")
+	}
+	if match[2] == "" {
+		return 0, errors.New("the invoice doesn't contain an amount")
+	}
+	amount, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// Tenths of Millisatoshis per unit of the amount, so that pico-bitcoin can be represented as well
+	var deciMsatPerUnit int64
+	switch match[3] {
+	case "":
+		deciMsatPerUnit = 1e12
+	case "m":
+		deciMsatPerUnit = 1e9
+	case "u":
+		deciMsatPerUnit = 1e6
+	case "n":
+		deciMsatPerUnit = 1e3
+	case "p":
+		deciMsatPerUnit = 1
+	}
+	if amount > (1<<63-1)/deciMsatPerUnit {
+		return 0, fmt.Errorf("the amount of the invoice is too high: %v", invoice[:separatorIndex])
+	}
+	deciMsat := amount * deciMsatPerUnit
+	// 1 Satoshi is 10,000 deci-Millisatoshis
+	return (deciMsat + 9999) / 10000, nil
+}
+
+// cloneHeader returns a copy of the header, so the header of the original request isn't modified.
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package pay_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/pay"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestLNclientImpl tests if the LN clients implement the pay.LNclient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestLNclientImpl(t *testing.T) {
+	t.SkipNow()
+	var _ pay.LNclient = ln.LNDclient{}
+	var _ pay.LNclient = ln.NewFakeClient()
+}
+
+// TestClientDo tests if the client pays for requests to a paywall in all of its response formats,
+// including the L402 mode, and if the original request including its body is sent again.
+func TestClientDo(t *testing.T) {
+	testCases := []wall.InvoiceOptions{
+		{Price: 10},
+		{Price: 10, ResponseFormat: wall.ResponseFormatJSON},
+		{Price: 10, L402: true},
+	}
+	for _, invoiceOptions := range testCases {
+		fakeClient := ln.NewFakeClient()
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		})
+		handler := wall.NewHandlerMiddleware(invoiceOptions, fakeClient, storage.NewGoMap())(next)
+		server := httptest.NewServer(handler)
+
+		client := pay.NewClient(fakeClient, pay.DefaultOptions)
+		req, err := http.NewRequest("POST", server.URL, ioutil.NopCloser(strings.NewReader("foo")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, amountPaid, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "foo" {
+			t.Errorf("Expected status code %v and body foo for %+v, but was %v and %s", http.StatusOK, invoiceOptions, res.StatusCode, body)
+		}
+		if amountPaid != 10 {
+			t.Errorf("Expected the paid amount to be 10, but was %v", amountPaid)
+		}
+		server.Close()
+	}
+}
+
+// TestClientMaxAmount tests if invoices above the maximum amount aren't paid.
+func TestClientMaxAmount(t *testing.T) {
+	fakeClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{Price: 101}, fakeClient, storage.NewGoMap())(next)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := pay.NewClient(fakeClient, pay.Options{MaxAmount: 100})
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, amountPaid, err := client.Do(req)
+	if err != pay.ErrMaxAmountExceeded {
+		t.Errorf("Expected error %v, but was %v", pay.ErrMaxAmountExceeded, err)
+	}
+	if amountPaid != 0 {
+		t.Errorf("Expected nothing to be paid, but was %v", amountPaid)
+	}
+}
@@ -0,0 +1,8 @@
+/*
+Package pay contains a client for consuming APIs that are protected by ln-paywall.
+
+The client sends a request and, if the API responds with "402 Payment Required",
+pays the invoice from the response via your Lightning Network node and sends the request again with the preimage.
+This is useful for testing and scripting against paywalled APIs.
+*/
+package pay
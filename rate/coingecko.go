@@ -0,0 +1,138 @@
+package rate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+)
+
+// CoinGeckoClient is an implementation of the wall.RateProvider interface for the public CoinGecko API.
+// It caches the exchange rate, so the API is only called once per cache duration and not for every request.
+type CoinGeckoClient struct {
+	address       string
+	httpClient    *http.Client
+	cacheDuration time.Duration
+	useStaleRate  bool
+	cache         *cache
+	logger        ln.Logger
+}
+
+type cache struct {
+	satsPerUSD int64
+	fetchedAt  time.Time
+	lock       *sync.Mutex
+}
+
+// SatsPerUSD returns how many Satoshis one US dollar is worth.
+// The cached rate is returned if it's not older than the cache duration.
+// If fetching a new rate fails and UseStaleRate is true, the outdated cached rate is returned instead of an error.
+func (c CoinGeckoClient) SatsPerUSD() (int64, error) {
+	c.cache.lock.Lock()
+	defer c.cache.lock.Unlock()
+
+	if c.cache.satsPerUSD > 0 && time.Since(c.cache.fetchedAt) < c.cacheDuration {
+		return c.cache.satsPerUSD, nil
+	}
+	satsPerUSD, err := c.fetch()
+	if err != nil {
+		if c.useStaleRate && c.cache.satsPerUSD > 0 {
+			c.logger.Printf("Couldn't fetch the exchange rate, using the one from %v instead: %v\n", c.cache.fetchedAt, err)
+			return c.cache.satsPerUSD, nil
+		}
+		return 0, err
+	}
+	c.cache.satsPerUSD = satsPerUSD
+	c.cache.fetchedAt = time.Now()
+	return satsPerUSD, nil
+}
+
+// fetch gets the current exchange rate from the CoinGecko API.
+func (c CoinGeckoClient) fetch() (int64, error) {
+	res, err := c.httpClient.Get(c.address + "/simple/price?ids=bitcoin&vs_currencies=usd")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return 0, fmt.Errorf("the CoinGecko API responded with status %v: %s", res.StatusCode, body)
+	}
+	// Example: {"bitcoin":{"usd":6543.21}}
+	var prices map[string]map[string]float64
+	err = json.NewDecoder(res.Body).Decode(&prices)
+	if err != nil {
+		return 0, err
+	}
+	usdPerBTC := prices["bitcoin"]["usd"]
+	if usdPerBTC <= 0 {
+		return 0, errors.New("the CoinGecko API response doesn't contain a valid BTC price in USD")
+	}
+	return int64(math.Round(1e8 / usdPerBTC)), nil
+}
+
+// NewCoinGeckoClient creates a new CoinGeckoClient instance.
+func NewCoinGeckoClient(coinGeckoOptions CoinGeckoOptions) CoinGeckoClient {
+	// Set default values
+	if coinGeckoOptions.Address == "" {
+		coinGeckoOptions.Address = DefaultCoinGeckoOptions.Address
+	}
+	if coinGeckoOptions.CacheDuration <= 0 {
+		coinGeckoOptions.CacheDuration = DefaultCoinGeckoOptions.CacheDuration
+	}
+	if coinGeckoOptions.Logger == nil {
+		coinGeckoOptions.Logger = ln.NoopLogger{}
+	}
+	if coinGeckoOptions.HTTPClient == nil {
+		coinGeckoOptions.HTTPClient = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+	}
+
+	return CoinGeckoClient{
+		address:       strings.TrimSuffix(coinGeckoOptions.Address, "/"),
+		httpClient:    coinGeckoOptions.HTTPClient,
+		cacheDuration: coinGeckoOptions.CacheDuration,
+		useStaleRate:  coinGeckoOptions.UseStaleRate,
+		cache: &cache{
+			lock: &sync.Mutex{},
+		},
+		logger: coinGeckoOptions.Logger,
+	}
+}
+
+// CoinGeckoOptions are the options for the CoinGeckoClient.
+type CoinGeckoOptions struct {
+	// Address of the CoinGecko API, including the scheme and the "/api/v3" path.
+	// Optional ("https://api.coingecko.com/api/v3" by default).
+	Address string
+	// Duration for which a fetched exchange rate is used before a new one is fetched.
+	// Optional (5 minutes by default).
+	CacheDuration time.Duration
+	// Use the last fetched exchange rate when fetching a new one fails.
+	// If false, an error is returned, which leads to the request being rejected with an "internal server error".
+	// If no exchange rate was fetched before, an error is returned in both cases.
+	// Optional (false by default).
+	UseStaleRate bool
+	// HTTP client to use for the requests to the CoinGecko API.
+	// Optional (an http.Client with a timeout of 10 seconds by default).
+	HTTPClient *http.Client
+	// Logger for errors that don't lead to an error being returned, like using the stale rate.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (ln.NoopLogger by default, which means nothing is logged).
+	Logger ln.Logger
+}
+
+// DefaultCoinGeckoOptions provides default values for CoinGeckoOptions.
+var DefaultCoinGeckoOptions = CoinGeckoOptions{
+	Address:       "https://api.coingecko.com/api/v3",
+	CacheDuration: 5 * time.Minute,
+}
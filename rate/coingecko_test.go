@@ -0,0 +1,79 @@
+package rate_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philippgille/ln-paywall/rate"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestCoinGeckoClient tests if the CoinGeckoClient struct implements the RateProvider interface.
+// This doesn't happen at runtime, but at compile time.
+func TestCoinGeckoClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	invoiceOptions.RateProvider = rate.CoinGeckoClient{}
+}
+
+// TestCoinGeckoClientCache tests if the exchange rate is converted correctly and cached,
+// and if the stale rate is used and the error is logged when the API fails.
+func TestCoinGeckoClientCache(t *testing.T) {
+	requestCount := 0
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if failing {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"bitcoin":{"usd":5000}}`)
+	}))
+	defer server.Close()
+
+	coinGeckoOptions := rate.CoinGeckoOptions{
+		Address:      server.URL,
+		UseStaleRate: true,
+	}
+	client := rate.NewCoinGeckoClient(coinGeckoOptions)
+	for i := 0; i < 2; i++ {
+		satsPerUSD, err := client.SatsPerUSD()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 100,000,000 Satoshis are 5000 USD
+		if satsPerUSD != 20000 {
+			t.Errorf("Expected 20000 Satoshis per USD, but was %v", satsPerUSD)
+		}
+	}
+	if requestCount != 1 {
+		t.Errorf("Expected 1 request to the API because of the cache, but was %v", requestCount)
+	}
+
+	// With an expired cache the stale rate must be used when the API fails
+	var logs bytes.Buffer
+	coinGeckoOptions.CacheDuration = time.Nanosecond
+	coinGeckoOptions.Logger = log.New(&logs, "", 0)
+	client = rate.NewCoinGeckoClient(coinGeckoOptions)
+	client.SatsPerUSD()
+	failing = true
+	satsPerUSD, err := client.SatsPerUSD()
+	if err != nil || satsPerUSD != 20000 {
+		t.Errorf("Expected the stale rate 20000 without error, but was %v and %v", satsPerUSD, err)
+	}
+	if !strings.Contains(logs.String(), "Couldn't fetch the exchange rate") {
+		t.Errorf("Expected the error to be logged with the given logger, but the logs were %q", logs.String())
+	}
+
+	// Without cached rate the error must be returned
+	_, err = rate.NewCoinGeckoClient(coinGeckoOptions).SatsPerUSD()
+	if err == nil {
+		t.Error("Expected an error when the API fails and there's no cached rate, but was nil")
+	}
+}
@@ -0,0 +1,5 @@
+/*
+Package rate contains implementations of the wall.RateProvider interface,
+which provide the exchange rate for prices in US dollars.
+*/
+package rate
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/philippgille/ln-paywall/ln"
+)
+
+// badgerGCinterval is the interval in which the garbage collection of Badger's value log runs.
+const badgerGCinterval = 10 * time.Minute
+
+// BadgerClient is a StorageClient implementation for BadgerDB (https://github.com/dgraph-io/badger).
+// Like bbolt it's an embedded DB that persists the data in a local directory,
+// but it's optimized for a high write throughput and has a native TTL for each entry,
+// so expired preimages are deleted automatically without a sweep over all preimages.
+type BadgerClient struct {
+	db        *badger.DB
+	ttl       time.Duration
+	stopGC    chan struct{}
+	closeOnce *sync.Once
+	logger    ln.Logger
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c BadgerClient) WasUsed(preimage string) (bool, error) {
+	err := c.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(preimage))
+		return err
+	})
+	// Expired preimages aren't found either
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c BadgerClient) SetUsed(preimage string) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(c.newEntry(preimage))
+	})
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically,
+// because Badger detects conflicting transactions, in which case the check is repeated.
+// wasNew is true if the preimage wasn't used before.
+func (c BadgerClient) SetIfNotUsed(preimage string) (bool, error) {
+	for {
+		var wasNew bool
+		err := c.db.Update(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(preimage))
+			if err == nil {
+				return nil
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			wasNew = true
+			return txn.SetEntry(c.newEntry(preimage))
+		})
+		// Another transaction stored the preimage in the meantime
+		if err == badger.ErrConflict {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		return wasNew, nil
+	}
+}
+
+// newEntry creates the entry for the given preimage, with the TTL if one is set.
+// The value is empty, because only the existence of the key matters.
+func (c BadgerClient) newEntry(preimage string) *badger.Entry {
+	entry := badger.NewEntry([]byte(preimage), nil)
+	if c.ttl > 0 {
+		entry = entry.WithTTL(c.ttl)
+	}
+	return entry
+}
+
+// ForEach calls fn for each stored preimage that didn't expire yet, in ascending order.
+// It stops and returns the error if fn returns one.
+func (c BadgerClient) ForEach(fn func(preimage string) error) error {
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		var batch []string
+		err := c.db.View(func(txn *badger.Txn) error {
+			iteratorOptions := badger.DefaultIteratorOptions
+			// Only the keys are required
+			iteratorOptions.PrefetchValues = false
+			it := txn.NewIterator(iteratorOptions)
+			defer it.Close()
+			it.Seek([]byte(after))
+			// Seek returns the given key if it exists, but that's the last key of the previous batch
+			if it.Valid() && string(it.Item().Key()) == after {
+				it.Next()
+			}
+			for ; it.Valid() && len(batch) < limit; it.Next() {
+				batch = append(batch, string(it.Item().KeyCopy(nil)))
+			}
+			return nil
+		})
+		return batch, err
+	}, fn)
+}
+
+// Close stops the garbage collection, flushes all pending writes to disk and closes the DB,
+// which releases the lock on the DB directory.
+func (c BadgerClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stopGC)
+		err = c.db.Close()
+	})
+	return err
+}
+
+// BadgerOptions are the options for the BadgerClient.
+type BadgerOptions struct {
+	// Duration after which a stored preimage expires.
+	// 0 means preimages are stored forever.
+	// Badger doesn't return expired preimages anymore and deletes them automatically during its compactions.
+	// Warning: The LN node still reports the invoice of an expired preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// Optional (0 by default).
+	TTL time.Duration
+	// Defines whether writes are acknowledged before they're synced to disk.
+	// This increases the write throughput, but preimages that were stored shortly before a crash
+	// of the machine can be lost, so they could be used again.
+	// Optional (false by default).
+	AsyncWrites bool
+	// Logger for errors that occur in the background, like a failing garbage collection.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (ln.NoopLogger by default, which means nothing is logged).
+	Logger ln.Logger
+}
+
+// DefaultBadgerPath is the path of the DB directory that's used when an empty path is passed to NewBadgerClient(...).
+const DefaultBadgerPath = "ln-paywall-badger"
+
+// DefaultBadgerOptions is a BadgerOptions object with default values.
+// TTL: 0, AsyncWrites: false, Logger: ln.NoopLogger{}
+var DefaultBadgerOptions = BadgerOptions{
+	Logger: ln.NoopLogger{},
+	// No need to set TTL or AsyncWrites, since their Go zero values are fine for that
+}
+
+// NewBadgerClient creates a new BadgerClient with the DB in the given directory.
+// The directory is created if it doesn't exist yet. If the path is empty, DefaultBadgerPath is used.
+// Badger locks the directory, so it can't be used by multiple processes at the same time.
+// Close the BadgerClient when your web service shuts down, so that all writes are flushed to disk.
+// Badger's own log messages are discarded.
+func NewBadgerClient(path string, badgerOptions BadgerOptions) (BadgerClient, error) {
+	result := BadgerClient{}
+
+	// Set default values
+	if path == "" {
+		path = DefaultBadgerPath
+	}
+	if badgerOptions.Logger == nil {
+		badgerOptions.Logger = DefaultBadgerOptions.Logger
+	}
+
+	// Open DB
+	opts := badger.DefaultOptions(path).
+		WithSyncWrites(!badgerOptions.AsyncWrites).
+		WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return result, err
+	}
+
+	result = BadgerClient{
+		db:        db,
+		ttl:       badgerOptions.TTL,
+		stopGC:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+		logger:    badgerOptions.Logger,
+	}
+
+	go result.runGC()
+
+	return result, nil
+}
+
+// runGC periodically runs the garbage collection of Badger's value log,
+// which frees the disk space of deleted and expired preimages.
+func (c BadgerClient) runGC() {
+	ticker := time.NewTicker(badgerGCinterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopGC:
+			return
+		case <-ticker.C:
+			// Each call rewrites at most one file, so repeat it until there's nothing left to collect
+			var err error
+			for err == nil {
+				err = c.db.RunValueLogGC(0.5)
+			}
+			// ErrRejected means that another garbage collection is running
+			if err != badger.ErrNoRewrite && err != badger.ErrRejected {
+				c.logger.Printf("Couldn't run the garbage collection of the Badger DB: %v\n", err)
+			}
+		}
+	}
+}
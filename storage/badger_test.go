@@ -0,0 +1,76 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestBadgerClient tests if the BadgerClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestBadgerClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	badgerClient, _ := storage.NewBadgerClient("", storage.DefaultBadgerOptions)
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, badgerClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, badgerClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, badgerClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, badgerClient, nil)
+}
+
+// TestBadgerClientSetIfNotUsed tests if only one of many concurrent calls of SetIfNotUsed succeeds.
+func TestBadgerClientSetIfNotUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	badgerClient, err := storage.NewBadgerClient(dir, storage.DefaultBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer badgerClient.Close()
+
+	testSetIfNotUsedConcurrently(t, badgerClient)
+}
+
+// TestBadgerClientTTL tests if preimages expire after the TTL and can be stored again afterwards,
+// and if they're still stored after the DB is closed and opened again.
+func TestBadgerClientTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Badger stores the expiry time in seconds
+	badgerOptions := storage.BadgerOptions{TTL: time.Second}
+	badgerClient, err := storage.NewBadgerClient(dir, badgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badgerClient.SetUsed("123")
+	badgerClient.Close()
+
+	badgerClient, err = storage.NewBadgerClient(dir, badgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer badgerClient.Close()
+	if wasUsed, err := badgerClient.WasUsed("123"); err != nil || !wasUsed {
+		t.Fatalf("Expected the preimage to be stored after reopening the DB, but was %v (error: %v)", wasUsed, err)
+	}
+
+	time.Sleep(2 * time.Second)
+	if wasUsed, _ := badgerClient.WasUsed("123"); wasUsed {
+		t.Error("Expected the preimage to be expired, but it was still stored")
+	}
+	if wasNew, _ := badgerClient.SetIfNotUsed("123"); !wasNew {
+		t.Error("Expected an expired preimage to be stored again")
+	}
+}
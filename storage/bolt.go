@@ -1,24 +1,36 @@
 package storage
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
+
+	"github.com/philippgille/ln-paywall/ln"
 )
 
-var bucketName = "ln-paywall"
+// maxSweepInterval is the maximum interval in which expired preimages are deleted from the DB.
+const maxSweepInterval = time.Minute
 
 // BoltClient is a StorageClient implementation for bbolt (formerly known as Bolt / Bolt DB).
+// It also implements wall.PaymentStorageClient, so it can be used for revenue reports.
 type BoltClient struct {
-	db   *bolt.DB
-	lock *sync.Mutex
+	db        *bolt.DB
+	bucket    []byte
+	lock      *sync.Mutex
+	stopSweep chan struct{}
+	closeOnce *sync.Once
+	logger    ln.Logger
 }
 
 // WasUsed checks if the preimage was used for a previous payment already.
 func (c BoltClient) WasUsed(preimage string) (bool, error) {
 	var result bool
 	err := c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
+		b := tx.Bucket(c.bucket)
 		v := b.Get([]byte(preimage))
 		if v != nil {
 			result = true
@@ -37,8 +49,9 @@ func (c BoltClient) SetUsed(preimage string) error {
 	defer c.lock.Unlock()
 
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		err := b.Put([]byte(preimage), []byte("1"))
+		b := tx.Bucket(c.bucket)
+		// The value is the time when the preimage was stored, which is required for the TTL
+		err := b.Put([]byte(preimage), []byte(time.Now().UTC().Format(time.RFC3339)))
 		return err
 	})
 	if err != nil {
@@ -47,17 +60,146 @@ func (c BoltClient) SetUsed(preimage string) error {
 	return nil
 }
 
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically.
+// wasNew is true if the preimage wasn't used before.
+func (c BoltClient) SetIfNotUsed(preimage string) (bool, error) {
+	return c.setIfNotUsed(preimage, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// SetPaymentIfNotUsed does the same as SetIfNotUsed, but also stores the amount (in Satoshis) of the payment,
+// which is used for Revenue(...). The time of the payment is stored anyway.
+func (c BoltClient) SetPaymentIfNotUsed(preimage string, amount int64, paidAt time.Time) (bool, error) {
+	return c.setIfNotUsed(preimage, []byte(paidAt.UTC().Format(time.RFC3339)+" "+strconv.FormatInt(amount, 10)))
+}
+
+func (c BoltClient) setIfNotUsed(preimage string, value []byte) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var wasNew bool
+	// Check and put within the same read-write transaction
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b.Get([]byte(preimage)) != nil {
+			return nil
+		}
+		wasNew = true
+		return b.Put([]byte(preimage), value)
+	})
+	if err != nil {
+		return false, err
+	}
+	return wasNew, nil
+}
+
+// Revenue returns the number of payments and their total amount (in Satoshis) in the given time window,
+// including from and excluding to.
+// Only payments that were stored with SetPaymentIfNotUsed(...) are included.
+// All stored preimages are read, so for big DBs with a long TTL this can take a while.
+func (c BoltClient) Revenue(from, to time.Time) (count int64, total int64, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucket).ForEach(func(k, v []byte) error {
+			storedAt, amount, isPayment := parseBoltValue(v)
+			if isPayment && !storedAt.Before(from) && storedAt.Before(to) {
+				count++
+				total += amount
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, total, nil
+}
+
+// parseBoltValue parses the value of a stored preimage, which is the time when the preimage was stored,
+// followed by a space and the amount for preimages that were stored with SetPaymentIfNotUsed.
+// Preimages that were stored by previous versions don't have a timestamp, in which case the time is zero.
+func parseBoltValue(v []byte) (storedAt time.Time, amount int64, isPayment bool) {
+	parts := strings.SplitN(string(v), " ", 2)
+	storedAt, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if len(parts) == 2 {
+		if amount, err = strconv.ParseInt(parts[1], 10, 64); err == nil {
+			isPayment = true
+		}
+	}
+	return storedAt, amount, isPayment
+}
+
+// ForEach calls fn for each stored preimage, in ascending order.
+// It stops and returns the error if fn returns one.
+func (c BoltClient) ForEach(fn func(preimage string) error) error {
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		var batch []string
+		err := c.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(c.bucket).Cursor()
+			k, _ := cursor.Seek([]byte(after))
+			// Seek returns the given key if it exists, but that's the last key of the previous batch
+			if k != nil && string(k) == after {
+				k, _ = cursor.Next()
+			}
+			for ; k != nil && len(batch) < limit; k, _ = cursor.Next() {
+				batch = append(batch, string(k))
+			}
+			return nil
+		})
+		return batch, err
+	}, fn)
+}
+
+// Close stops the deletion of expired preimages (if a TTL is set) and closes the DB,
+// which releases the lock on the DB file.
+func (c BoltClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stopSweep)
+		err = c.db.Close()
+	})
+	return err
+}
+
 // BoltOptions are the options for the BoltClient.
 type BoltOptions struct {
 	// Path of the DB file.
 	// Optional ("ln-paywall.db" by default).
 	Path string
+	// Name of the bucket in which the preimages are stored.
+	// Different bucket names make it possible to store the preimages of different web services in the same DB file,
+	// as long as they don't use it at the same time, because Bolt locks the DB file while it's open.
+	// Optional ("ln-paywall" by default).
+	BucketName string
+	// Maximum time to wait for the lock on the DB file when opening the DB.
+	// Bolt uses an exclusive lock, so if another process has opened the DB, NewBoltClient returns an error after this time.
+	// Values below 1 are automatically changed to the default value.
+	// Optional (1 second by default).
+	Timeout time.Duration
+	// Duration after which a stored preimage is deleted.
+	// 0 means preimages are stored forever.
+	// Expired preimages are deleted in the background every minute (or in the interval of the TTL if it's shorter).
+	// Warning: The LN node still reports the invoice of a deleted preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// Optional (0 by default).
+	TTL time.Duration
+	// Logger for errors that occur in the background, like failing to delete expired preimages.
+	// *log.Logger from the standard library implements the interface.
+	// Optional (ln.NoopLogger by default, which means nothing is logged).
+	Logger ln.Logger
 }
 
 // DefaultBoltOptions is a BoltOptions object with default values.
-// Path: "ln-paywall.db"
+// Path: "ln-paywall.db", BucketName: "ln-paywall", Timeout: 1 second, TTL: 0, Logger: ln.NoopLogger{}
 var DefaultBoltOptions = BoltOptions{
-	Path: "ln-paywall.db",
+	Path:       "ln-paywall.db",
+	BucketName: "ln-paywall",
+	Timeout:    time.Second,
+	Logger:     ln.NoopLogger{},
+	// No need to set TTL, since its Go zero value is fine for that
 }
 
 // NewBoltClient creates a new BoltClient.
@@ -71,8 +213,8 @@ var DefaultBoltOptions = BoltOptions{
 //  defer boltClient.Close()
 //  r.Use(wall.NewGinMiddleware(invoiceOptions, lndOptions, boltClient))
 //  // ...
-// Also don't worry about closing the Bolt DB, the middleware opens it once and uses it for the duration of its lifetime.
-// When the web service is stopped, the DB file lock is released automatically.
+// The middleware uses the DB for the duration of its lifetime. When the web service is stopped,
+// the DB file lock is released automatically, but it's good practice to close the BoltClient anyway.
 func NewBoltClient(boltOptions BoltOptions) (BoltClient, error) {
 	result := BoltClient{}
 
@@ -80,30 +222,101 @@ func NewBoltClient(boltOptions BoltOptions) (BoltClient, error) {
 	if boltOptions.Path == "" {
 		boltOptions.Path = DefaultBoltOptions.Path
 	}
+	if boltOptions.BucketName == "" {
+		boltOptions.BucketName = DefaultBoltOptions.BucketName
+	}
+	if boltOptions.Timeout <= 0 {
+		boltOptions.Timeout = DefaultBoltOptions.Timeout
+	}
+	if boltOptions.Logger == nil {
+		boltOptions.Logger = DefaultBoltOptions.Logger
+	}
 
 	// Open DB
-	db, err := bolt.Open(boltOptions.Path, 0600, nil)
-	if err != nil {
+	db, err := bolt.Open(boltOptions.Path, 0600, &bolt.Options{Timeout: boltOptions.Timeout})
+	if err == bolt.ErrTimeout {
+		return result, fmt.Errorf("couldn't open the Bolt DB file %v within %v, it's probably opened by another process", boltOptions.Path, boltOptions.Timeout)
+	} else if err != nil {
 		return result, err
 	}
 
 	// Create a bucket if it doesn't exist yet.
 	// In Bolt key/value pairs are stored to and read from buckets.
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		_, err := tx.CreateBucketIfNotExists([]byte(boltOptions.BucketName))
 		if err != nil {
 			return err
 		}
 		return nil
 	})
 	if err != nil {
+		db.Close()
 		return result, err
 	}
 
 	result = BoltClient{
-		db:   db,
-		lock: &sync.Mutex{},
+		db:        db,
+		bucket:    []byte(boltOptions.BucketName),
+		lock:      &sync.Mutex{},
+		stopSweep: make(chan struct{}),
+		closeOnce: &sync.Once{},
+		logger:    boltOptions.Logger,
+	}
+
+	if boltOptions.TTL > 0 {
+		go result.sweep(boltOptions.TTL)
 	}
 
 	return result, nil
 }
+
+// sweep periodically deletes preimages that were stored longer ago than the TTL.
+func (c BoltClient) sweep(ttl time.Duration) {
+	interval := maxSweepInterval
+	if ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopSweep:
+			return
+		case <-ticker.C:
+			err := c.deleteExpired(ttl)
+			if err != nil {
+				c.logger.Printf("Couldn't delete expired preimages from the Bolt DB: %v\n", err)
+			}
+		}
+	}
+}
+
+// deleteExpired deletes all preimages that were stored longer ago than the TTL.
+func (c BoltClient) deleteExpired(ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		var expiredKeys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			storedAt, _, _ := parseBoltValue(v)
+			// Preimages that were stored by previous versions don't have a timestamp, so they never expire
+			if !storedAt.IsZero() && time.Since(storedAt) > ttl {
+				expiredKeys = append(expiredKeys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys must not be deleted during the iteration
+		for _, k := range expiredKeys {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
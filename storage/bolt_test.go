@@ -1,7 +1,11 @@
 package storage_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/philippgille/ln-paywall/ln"
 	"github.com/philippgille/ln-paywall/storage"
@@ -20,3 +24,135 @@ func TestBoltClient(t *testing.T) {
 	wall.NewGinMiddleware(invoiceOptions, lnClient, boltClient)
 	wall.NewEchoMiddleware(invoiceOptions, lnClient, boltClient, nil)
 }
+
+// TestBoltClientSetIfNotUsed tests if only one of many concurrent calls of SetIfNotUsed succeeds.
+func TestBoltClientSetIfNotUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltOptions := storage.BoltOptions{
+		Path: filepath.Join(dir, "ln-paywall.db"),
+	}
+	boltClient, err := storage.NewBoltClient(boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltClient.Close()
+
+	testSetIfNotUsedConcurrently(t, boltClient)
+}
+
+// TestBoltClientRevenue tests if the BoltClient reports the revenue of the stored payments.
+func TestBoltClientRevenue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltClient, err := storage.NewBoltClient(storage.BoltOptions{Path: filepath.Join(dir, "ln-paywall.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltClient.Close()
+
+	testRevenue(t, boltClient)
+}
+
+// TestBoltClientBucketName tests if preimages that are stored in one bucket aren't found in another bucket
+// of the same DB file.
+func TestBoltClientBucketName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ln-paywall.db")
+
+	wasUsedInBucket := func(bucketName string, preimage string) bool {
+		boltClient, err := storage.NewBoltClient(storage.BoltOptions{Path: path, BucketName: bucketName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer boltClient.Close()
+		wasUsed, err := boltClient.WasUsed(preimage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wasUsed
+	}
+
+	boltClient, err := storage.NewBoltClient(storage.BoltOptions{Path: path, BucketName: "custom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = boltClient.SetIfNotUsed("123"); err != nil {
+		t.Fatal(err)
+	}
+	boltClient.Close()
+
+	if !wasUsedInBucket("custom", "123") {
+		t.Error("Expected the preimage to be found in the custom bucket, but it wasn't")
+	}
+	if wasUsedInBucket(storage.DefaultBoltOptions.BucketName, "123") {
+		t.Error("Expected the preimage not to be found in the default bucket, but it was")
+	}
+}
+
+// TestBoltClientTimeout tests if opening a DB file that's already opened leads to an error after the timeout.
+func TestBoltClientTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltOptions := storage.BoltOptions{
+		Path:    filepath.Join(dir, "ln-paywall.db"),
+		Timeout: 100 * time.Millisecond,
+	}
+	boltClient, err := storage.NewBoltClient(boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltClient.Close()
+
+	_, err = storage.NewBoltClient(boltOptions)
+	if err == nil {
+		t.Error("Expected an error, but was nil")
+	}
+}
+
+// TestBoltClientTTL tests if expired preimages are deleted in the background, even if they're never read again,
+// and can be stored again afterwards.
+func TestBoltClientTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltOptions := storage.BoltOptions{
+		Path: filepath.Join(dir, "ln-paywall.db"),
+		TTL:  200 * time.Millisecond,
+	}
+	boltClient, err := storage.NewBoltClient(boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltClient.Close()
+	if err = boltClient.SetUsed("123"); err != nil {
+		t.Fatal(err)
+	}
+	if wasUsed, err := boltClient.WasUsed("123"); err != nil || !wasUsed {
+		t.Fatalf("Expected the preimage to be stored, but was %v (error: %v)", wasUsed, err)
+	}
+
+	// The time when a preimage was stored has a granularity of seconds
+	time.Sleep(1500 * time.Millisecond)
+	if wasUsed, _ := boltClient.WasUsed("123"); wasUsed {
+		t.Error("Expected the preimage to be deleted, but it was still stored")
+	}
+	if wasNew, _ := boltClient.SetIfNotUsed("123"); !wasNew {
+		t.Error("Expected an expired preimage to be stored again")
+	}
+}
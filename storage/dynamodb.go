@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// dynamoDBExpiryAttribute is the name of the attribute that contains the time (in Unix seconds) after which a preimage expires.
+const dynamoDBExpiryAttribute = "expiresAt"
+
+// DynamoDBClient is a StorageClient implementation for Amazon DynamoDB.
+type DynamoDBClient struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+	ttl   time.Duration
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c DynamoDBClient) WasUsed(preimage string) (bool, error) {
+	res, err := c.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(c.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"preimage": {S: aws.String(preimage)},
+		},
+		// Otherwise a preimage that was just stored might not be found
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(res.Item) == 0 {
+		return false, nil
+	}
+	// DynamoDB deletes expired items only within a few days, so they must be treated as deleted until then
+	if expiry, ok := res.Item[dynamoDBExpiryAttribute]; ok && expiry.N != nil {
+		expiresAt, err := strconv.ParseInt(*expiry.N, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		return time.Now().Unix() < expiresAt, nil
+	}
+	return true, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c DynamoDBClient) SetUsed(preimage string) error {
+	_, err := c.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(c.table),
+		Item:      c.newItem(preimage),
+	})
+	return err
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically,
+// because the item is only put if no item with the preimage exists (or if the existing one has expired).
+// wasNew is true if the preimage wasn't used before.
+func (c DynamoDBClient) SetIfNotUsed(preimage string) (bool, error) {
+	_, err := c.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(c.table),
+		Item:                c.newItem(preimage),
+		ConditionExpression: aws.String("attribute_not_exists(preimage) OR #expiresAt < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expiresAt": aws.String(dynamoDBExpiryAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ForEach calls fn for each stored preimage that didn't expire yet, in no particular order.
+// It scans the whole table, which consumes read capacity for all items.
+// It stops and returns the error if fn returns one.
+func (c DynamoDBClient) ForEach(fn func(preimage string) error) error {
+	var fnErr error
+	err := c.svc.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(c.table),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("preimage, #expiresAt"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expiresAt": aws.String(dynamoDBExpiryAttribute),
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		now := time.Now().Unix()
+		for _, item := range page.Items {
+			// DynamoDB deletes expired items only within a few days, see WasUsed(...)
+			if expiry, ok := item[dynamoDBExpiryAttribute]; ok && expiry.N != nil {
+				expiresAt, err := strconv.ParseInt(*expiry.N, 10, 64)
+				if err != nil {
+					fnErr = err
+					return false
+				}
+				if now >= expiresAt {
+					continue
+				}
+			}
+			if preimage, ok := item["preimage"]; ok && preimage.S != nil {
+				if fnErr = fn(*preimage.S); fnErr != nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// newItem creates the item for the given preimage, with the expiry time if a TTL is set.
+func (c DynamoDBClient) newItem(preimage string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"preimage": {S: aws.String(preimage)},
+	}
+	if c.ttl > 0 {
+		expiresAt := time.Now().Add(c.ttl).Unix()
+		item[dynamoDBExpiryAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiresAt, 10))}
+	}
+	return item
+}
+
+// Close does nothing, because the DynamoDB client doesn't keep any connections open that need to be closed.
+func (c DynamoDBClient) Close() error {
+	return nil
+}
+
+// DynamoDBOptions are the options for DynamoDB.
+type DynamoDBOptions struct {
+	// Name of the table in which the preimages are stored.
+	// The table must exist, with the partition key "preimage" of type string.
+	// Optional ("ln-paywall" by default).
+	TableName string
+	// AWS session that's used for the DynamoDB client, which contains the region and the credentials.
+	// Optional (a session with the configuration from the environment and the shared config files by default,
+	// which works out of the box with the environment of AWS Lambda for example).
+	Session *session.Session
+	// Duration after which a stored preimage expires.
+	// 0 means preimages are stored forever.
+	// The expiry time is stored in the attribute "expiresAt". To let DynamoDB delete expired items automatically,
+	// enable TTL for the table with that attribute, for example with:
+	// aws dynamodb update-time-to-live --table-name ln-paywall --time-to-live-specification "Enabled=true, AttributeName=expiresAt"
+	// Warning: The LN node still reports the invoice of an expired preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// Optional (0 by default).
+	TTL time.Duration
+}
+
+// DefaultDynamoDBOptions is a DynamoDBOptions object with default values.
+// TableName: "ln-paywall", Session: nil, TTL: 0
+var DefaultDynamoDBOptions = DynamoDBOptions{
+	TableName: "ln-paywall",
+	// No need to set Session or TTL, since their Go zero values are fine for that
+}
+
+// NewDynamoDBClient creates a new DynamoDBClient.
+// The table isn't created, because that requires decisions about its capacity mode etc.,
+// but it's checked that it exists.
+func NewDynamoDBClient(dynamoDBOptions DynamoDBOptions) (DynamoDBClient, error) {
+	result := DynamoDBClient{}
+
+	// Set default values
+	if dynamoDBOptions.TableName == "" {
+		dynamoDBOptions.TableName = DefaultDynamoDBOptions.TableName
+	}
+	if dynamoDBOptions.Session == nil {
+		sess, err := session.NewSession()
+		if err != nil {
+			return result, err
+		}
+		dynamoDBOptions.Session = sess
+	}
+
+	svc := dynamodb.New(dynamoDBOptions.Session)
+	// Make sure the table exists and we can connect to DynamoDB
+	_, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(dynamoDBOptions.TableName),
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result = DynamoDBClient{
+		svc:   svc,
+		table: dynamoDBOptions.TableName,
+		ttl:   dynamoDBOptions.TTL,
+	}
+
+	return result, nil
+}
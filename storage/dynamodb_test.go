@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestDynamoDBClient tests if the DynamoDBClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestDynamoDBClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	dynamoDBClient := storage.DynamoDBClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, dynamoDBClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, dynamoDBClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, dynamoDBClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, dynamoDBClient, nil)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdClient is a StorageClient implementation for etcd (v3 API).
+// etcd is strongly consistent, so it can be used with a horizontally scaled web service,
+// which is useful if you already run etcd, for example for Kubernetes.
+type EtcdClient struct {
+	c         *clientv3.Client
+	keyPrefix string
+	ttl       time.Duration
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c EtcdClient) WasUsed(preimage string) (bool, error) {
+	res, err := c.c.Get(context.Background(), c.keyPrefix+preimage, clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return res.Count > 0, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c EtcdClient) SetUsed(preimage string) error {
+	ctx := context.Background()
+	opts, err := c.leaseOpts(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.Put(ctx, c.keyPrefix+preimage, "1", opts...)
+	return err
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically
+// in a transaction that only stores the key if it doesn't exist yet.
+// wasNew is true if the preimage wasn't used before.
+func (c EtcdClient) SetIfNotUsed(preimage string) (bool, error) {
+	ctx := context.Background()
+	opts, err := c.leaseOpts(ctx)
+	if err != nil {
+		return false, err
+	}
+	key := c.keyPrefix + preimage
+	// A key that doesn't exist has the create revision 0
+	res, err := c.c.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "1", opts...)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return res.Succeeded, nil
+}
+
+// leaseOpts returns the options for storing a preimage with the TTL.
+// etcd expires keys via leases, so a lease is granted for each preimage.
+// If the preimage isn't stored because it already exists, the unused lease just expires.
+func (c EtcdClient) leaseOpts(ctx context.Context) ([]clientv3.OpOption, error) {
+	if c.ttl <= 0 {
+		return nil, nil
+	}
+	// Leases have a granularity of seconds, so round up to not expire a preimage too early
+	lease, err := c.c.Grant(ctx, int64(math.Ceil(c.ttl.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease.ID)}, nil
+}
+
+// ForEach calls fn for each stored preimage, in ascending order.
+// It stops and returns the error if fn returns one.
+func (c EtcdClient) ForEach(fn func(preimage string) error) error {
+	rangeEnd := clientv3.GetPrefixRangeEnd(c.keyPrefix)
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		start := c.keyPrefix
+		if after != "" {
+			// The smallest key that's greater than the last one
+			start = c.keyPrefix + after + "\x00"
+		}
+		res, err := c.c.Get(context.Background(), start,
+			clientv3.WithRange(rangeEnd),
+			clientv3.WithLimit(int64(limit)),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+			clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		for _, kv := range res.Kvs {
+			batch = append(batch, strings.TrimPrefix(string(kv.Key), c.keyPrefix))
+		}
+		return batch, nil
+	}, fn)
+}
+
+// Close closes the connections to the etcd cluster.
+func (c EtcdClient) Close() error {
+	return c.c.Close()
+}
+
+// EtcdOptions are the options for the etcd cluster.
+type EtcdOptions struct {
+	// Prefix of the keys under which the preimages are stored,
+	// so that the etcd cluster can be shared with other applications.
+	// Optional ("ln-paywall/preimages/" by default).
+	KeyPrefix string
+	// Username for the etcd cluster, if authentication is enabled.
+	// Optional ("" by default).
+	Username string
+	// Password for the etcd cluster, if authentication is enabled.
+	// Optional ("" by default).
+	Password string
+	// TLS configuration for the connection to the etcd cluster.
+	// Required for clusters with client certificate authentication,
+	// in which case the tls.Config must contain the client certificate.
+	// Optional (nil by default, which means no TLS is used).
+	TLSConfig *tls.Config
+	// Timeout for establishing the connection to the etcd cluster.
+	// Optional (5s by default).
+	DialTimeout time.Duration
+	// Duration after which a stored preimage is deleted.
+	// 0 means preimages are stored forever.
+	// Warning: The LN node still reports the invoice of a deleted preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// etcd leases have a granularity of seconds, so the TTL is rounded up to full seconds.
+	// Optional (0 by default).
+	TTL time.Duration
+}
+
+// DefaultEtcdOptions is an EtcdOptions object with default values.
+// KeyPrefix: "ln-paywall/preimages/", Username: "", Password: "", TLSConfig: nil, DialTimeout: 5s, TTL: 0
+var DefaultEtcdOptions = EtcdOptions{
+	KeyPrefix:   "ln-paywall/preimages/",
+	DialTimeout: 5 * time.Second,
+	// No need to set Username, Password, TLSConfig or TTL, since their Go zero values are fine for that
+}
+
+// NewEtcdClient creates a new EtcdClient.
+// Not all endpoints of the cluster are required, but passing all of them allows the client to fail over.
+// An error is returned if no endpoint is passed or if the cluster can't be reached or rejects the credentials.
+func NewEtcdClient(endpoints []string, etcdOptions EtcdOptions) (EtcdClient, error) {
+	result := EtcdClient{}
+
+	if len(endpoints) == 0 {
+		return result, errors.New("at least one etcd endpoint is required")
+	}
+	// Set default values
+	if etcdOptions.KeyPrefix == "" {
+		etcdOptions.KeyPrefix = DefaultEtcdOptions.KeyPrefix
+	}
+	if etcdOptions.DialTimeout == 0 {
+		etcdOptions.DialTimeout = DefaultEtcdOptions.DialTimeout
+	}
+
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    etcdOptions.Username,
+		Password:    etcdOptions.Password,
+		TLS:         etcdOptions.TLSConfig,
+		DialTimeout: etcdOptions.DialTimeout,
+	})
+	if err != nil {
+		return result, fmt.Errorf("couldn't connect to etcd at %v: %v", strings.Join(endpoints, ","), err)
+	}
+
+	// The client connects in the background, so make sure the connection works
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOptions.DialTimeout)
+	defer cancel()
+	_, err = c.Get(ctx, etcdOptions.KeyPrefix, clientv3.WithCountOnly())
+	if err != nil {
+		c.Close()
+		return result, fmt.Errorf("couldn't connect to etcd at %v: %v", strings.Join(endpoints, ","), err)
+	}
+
+	result = EtcdClient{
+		c:         c,
+		keyPrefix: etcdOptions.KeyPrefix,
+		ttl:       etcdOptions.TTL,
+	}
+
+	return result, nil
+}
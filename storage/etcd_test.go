@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestEtcdClient tests if the EtcdClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestEtcdClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	etcdClient := storage.EtcdClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, etcdClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, etcdClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, etcdClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, etcdClient, nil)
+}
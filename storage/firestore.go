@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// firestoreExpiryField is the name of the field that contains the time after which a preimage expires.
+const firestoreExpiryField = "expiresAt"
+
+// FirestoreClient is a StorageClient implementation for Google Cloud Firestore.
+// Each preimage is stored as a document in a collection.
+// Base64 can contain slashes, which aren't allowed in document IDs,
+// so the ID of a document is the hex encoded preimage, and the preimage itself is stored in the field "preimage".
+type FirestoreClient struct {
+	c          *firestore.Client
+	collection *firestore.CollectionRef
+	ttl        time.Duration
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c FirestoreClient) WasUsed(preimage string) (bool, error) {
+	doc, err := c.doc(preimage).Get(context.Background())
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !isExpiredFirestoreDoc(doc), nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c FirestoreClient) SetUsed(preimage string) error {
+	_, err := c.doc(preimage).Set(context.Background(), c.newData(preimage))
+	return err
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before (or if the stored one has expired).
+// The check and the storing happen atomically in a transaction, which Firestore retries in case of a conflict
+// with a concurrent transaction.
+// wasNew is true if the preimage wasn't used before.
+func (c FirestoreClient) SetIfNotUsed(preimage string) (bool, error) {
+	var wasNew bool
+	err := c.c.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		// The transaction function can be called multiple times
+		wasNew = false
+		docRef := c.doc(preimage)
+		doc, err := tx.Get(docRef)
+		if err == nil && !isExpiredFirestoreDoc(doc) {
+			return nil
+		} else if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		wasNew = true
+		return tx.Set(docRef, c.newData(preimage))
+	})
+	if err != nil {
+		return false, err
+	}
+	return wasNew, nil
+}
+
+// ForEach calls fn for each stored preimage that didn't expire yet, in ascending order of the document IDs.
+// It stops and returns the error if fn returns one.
+func (c FirestoreClient) ForEach(fn func(preimage string) error) error {
+	// Expired preimages are skipped, but a batch must only be shorter than the limit if it's the last one,
+	// so the batches contain them and fn isn't called for them
+	expired := map[string]bool{}
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		query := c.collection.OrderBy(firestore.DocumentID, firestore.Asc).Limit(limit)
+		if after != "" {
+			query = query.StartAfter(hex.EncodeToString([]byte(after)))
+		}
+		docs, err := query.Documents(context.Background()).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		expired = map[string]bool{}
+		var batch []string
+		for _, doc := range docs {
+			preimage, err := hex.DecodeString(doc.Ref.ID)
+			if err != nil {
+				// Not a document of the FirestoreClient
+				continue
+			}
+			batch = append(batch, string(preimage))
+			expired[string(preimage)] = isExpiredFirestoreDoc(doc)
+		}
+		return batch, nil
+	}, func(preimage string) error {
+		if expired[preimage] {
+			return nil
+		}
+		return fn(preimage)
+	})
+}
+
+// doc returns the reference to the document of the given preimage.
+func (c FirestoreClient) doc(preimage string) *firestore.DocumentRef {
+	return c.collection.Doc(hex.EncodeToString([]byte(preimage)))
+}
+
+// newData creates the data of the document for the given preimage, with the expiry time if a TTL is set.
+func (c FirestoreClient) newData(preimage string) map[string]interface{} {
+	data := map[string]interface{}{
+		"preimage": preimage,
+	}
+	if c.ttl > 0 {
+		data[firestoreExpiryField] = time.Now().Add(c.ttl)
+	}
+	return data
+}
+
+// isExpiredFirestoreDoc returns true if the document has an expiry time that has passed.
+// Firestore deletes expired documents only within a few days, so they must be treated as deleted until then.
+func isExpiredFirestoreDoc(doc *firestore.DocumentSnapshot) bool {
+	expiry, err := doc.DataAt(firestoreExpiryField)
+	if err != nil {
+		return false
+	}
+	expiresAt, ok := expiry.(time.Time)
+	return ok && !time.Now().Before(expiresAt)
+}
+
+// Close closes the connection to Firestore.
+func (c FirestoreClient) Close() error {
+	return c.c.Close()
+}
+
+// FirestoreOptions are the options for the FirestoreClient.
+type FirestoreOptions struct {
+	// Duration after which a stored preimage expires.
+	// 0 means preimages are stored forever.
+	// The expiry time is stored in the timestamp field "expiresAt". To let Firestore delete expired documents automatically,
+	// create a TTL policy for the collection with that field, for example with:
+	// gcloud firestore fields ttls update expiresAt --collection-group=ln-paywall --enable-ttl
+	// Warning: The LN node still reports the invoice of an expired preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// Optional (0 by default).
+	TTL time.Duration
+}
+
+// DefaultFirestoreCollection is the collection that's used when an empty collection is passed to NewFirestoreClient(...).
+const DefaultFirestoreCollection = "ln-paywall"
+
+// DefaultFirestoreOptions is a FirestoreOptions object with default values.
+// TTL: 0
+var DefaultFirestoreOptions = FirestoreOptions{
+	// No need to set TTL, since its Go zero value is fine for that
+}
+
+// NewFirestoreClient creates a new FirestoreClient that stores the preimages in the given collection
+// of the Firestore database of the given GCP project.
+// It uses the default GCP credentials, i.e. the ones of the service account on GCP (for example on Cloud Run or Cloud Functions)
+// or the ones that GOOGLE_APPLICATION_CREDENTIALS points to.
+// If the collection is empty, DefaultFirestoreCollection is used. Firestore creates the collection with the first document.
+func NewFirestoreClient(projectID string, collection string, firestoreOptions FirestoreOptions) (FirestoreClient, error) {
+	result := FirestoreClient{}
+
+	// Set default values
+	if collection == "" {
+		collection = DefaultFirestoreCollection
+	}
+
+	c, err := firestore.NewClient(context.Background(), projectID)
+	if err != nil {
+		return result, err
+	}
+
+	result = FirestoreClient{
+		c:          c,
+		collection: c.Collection(collection),
+		ttl:        firestoreOptions.TTL,
+	}
+	return result, nil
+}
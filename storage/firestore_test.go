@@ -0,0 +1,21 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestFirestoreClient tests if the FirestoreClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestFirestoreClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	firestoreClient := storage.FirestoreClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, firestoreClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, firestoreClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, firestoreClient)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultMaxEntries is the capacity of a MemoryLRU that's used when the passed capacity is below 1.
+// With preimages being 44 characters long (Base64 of 32 bytes) this leads to roughly 100 MB of memory usage.
+const DefaultMaxEntries = 1000000
+
+// MemoryLRU is a StorageClient implementation for a local in-memory cache with a maximum number of entries.
+// When the cache is full, the least recently used preimage is evicted.
+// In contrast to the GoMap the memory usage is bounded, which makes it safe for long-running web services.
+// The tradeoff is that an evicted preimage is treated as unused,
+// so it could be replayed if a client still has it.
+// Choose the capacity large enough so that this is unlikely, for example by multiplying the
+// expected number of requests per hour with the number of hours you want to protect preimages for.
+type MemoryLRU struct {
+	maxEntries int
+	// Front is the most recently used element
+	l    *list.List
+	m    map[string]*list.Element
+	lock *sync.Mutex
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c MemoryLRU) WasUsed(preimage string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.m[preimage]
+	if ok {
+		c.l.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c MemoryLRU) SetUsed(preimage string) error {
+	_, err := c.SetIfNotUsed(preimage)
+	return err
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically.
+// wasNew is true if the preimage wasn't used before.
+func (c MemoryLRU) SetIfNotUsed(preimage string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.m[preimage]; ok {
+		c.l.MoveToFront(e)
+		return false, nil
+	}
+	c.m[preimage] = c.l.PushFront(preimage)
+	if c.l.Len() > c.maxEntries {
+		oldest := c.l.Back()
+		c.l.Remove(oldest)
+		delete(c.m, oldest.Value.(string))
+	}
+	return true, nil
+}
+
+// ForEach calls fn for each stored preimage, from the least to the most recently used one,
+// so that migrating to another MemoryLRU keeps the order of eviction.
+// It stops and returns the error if fn returns one.
+func (c MemoryLRU) ForEach(fn func(preimage string) error) error {
+	// Copy the preimages, so that fn can use the cache
+	c.lock.Lock()
+	preimages := make([]string, 0, c.l.Len())
+	for e := c.l.Back(); e != nil; e = e.Prev() {
+		preimages = append(preimages, e.Value.(string))
+	}
+	c.lock.Unlock()
+
+	for _, preimage := range preimages {
+		if err := fn(preimage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op, because there's nothing to close for an in-memory cache.
+// It only exists to implement the StorageClient interface.
+func (c MemoryLRU) Close() error {
+	return nil
+}
+
+// NewMemoryLRU creates a new MemoryLRU with the given capacity.
+// If maxEntries is below 1, DefaultMaxEntries is used.
+func NewMemoryLRU(maxEntries int) MemoryLRU {
+	if maxEntries < 1 {
+		maxEntries = DefaultMaxEntries
+	}
+	return MemoryLRU{
+		maxEntries: maxEntries,
+		l:          list.New(),
+		m:          make(map[string]*list.Element),
+		lock:       &sync.Mutex{},
+	}
+}
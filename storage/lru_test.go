@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestMemoryLRU tests if the MemoryLRU struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestMemoryLRU(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	memoryLRU := storage.MemoryLRU{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, memoryLRU)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, memoryLRU)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, memoryLRU)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, memoryLRU, nil)
+}
+
+// TestMemoryLRUeviction tests if the least recently used preimage is evicted when the capacity is exceeded.
+func TestMemoryLRUeviction(t *testing.T) {
+	memoryLRU := storage.NewMemoryLRU(2)
+	memoryLRU.SetUsed("a")
+	memoryLRU.SetUsed("b")
+	// Makes "b" the least recently used preimage
+	memoryLRU.WasUsed("a")
+	memoryLRU.SetUsed("c")
+
+	for preimage, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		wasUsed, _ := memoryLRU.WasUsed(preimage)
+		if wasUsed != expected {
+			t.Errorf("Expected WasUsed(%v) to be %v, but was %v", preimage, expected, wasUsed)
+		}
+	}
+}
+
+// TestMemoryLRUsetIfNotUsed tests if only one of many concurrent calls of SetIfNotUsed succeeds.
+func TestMemoryLRUsetIfNotUsed(t *testing.T) {
+	testSetIfNotUsedConcurrently(t, storage.NewMemoryLRU(0))
+}
+
+// The following benchmarks show that the duration of SetUsed and WasUsed doesn't depend on the number of entries.
+
+func BenchmarkMemoryLRU_SetUsed_1000(b *testing.B)    { benchmarkMemoryLRUsetUsed(b, 1000) }
+func BenchmarkMemoryLRU_SetUsed_1000000(b *testing.B) { benchmarkMemoryLRUsetUsed(b, 1000000) }
+func BenchmarkMemoryLRU_WasUsed_1000(b *testing.B)    { benchmarkMemoryLRUwasUsed(b, 1000) }
+func BenchmarkMemoryLRU_WasUsed_1000000(b *testing.B) { benchmarkMemoryLRUwasUsed(b, 1000000) }
+
+func benchmarkMemoryLRUsetUsed(b *testing.B, maxEntries int) {
+	memoryLRU := fillMemoryLRU(maxEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Leads to an eviction with every call, because the LRU is full
+		memoryLRU.SetUsed("new" + strconv.Itoa(i))
+	}
+}
+
+func benchmarkMemoryLRUwasUsed(b *testing.B, maxEntries int) {
+	memoryLRU := fillMemoryLRU(maxEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		memoryLRU.WasUsed(strconv.Itoa(i % maxEntries))
+	}
+}
+
+func fillMemoryLRU(maxEntries int) storage.MemoryLRU {
+	memoryLRU := storage.NewMemoryLRU(maxEntries)
+	for i := 0; i < maxEntries; i++ {
+		memoryLRU.SetUsed(strconv.Itoa(i))
+	}
+	return memoryLRU
+}
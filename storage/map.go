@@ -2,29 +2,209 @@ package storage
 
 import (
 	"sync"
+	"time"
 )
 
+// counterSweepInterval is the number of increments after which the GoMap deletes all expired counters,
+// so that counters of clients that don't come back don't stay in memory forever.
+const counterSweepInterval = 1000
+
+// preimageSweepInterval is the number of stored preimages after which the GoMap deletes all expired preimages,
+// so that preimages that aren't read again don't stay in memory forever.
+const preimageSweepInterval = 1000
+
 // GoMap is a StorageClient implementation for a simple Go sync.Map.
+// It also implements wall.PaymentStorageClient, so it can be used for revenue reports,
+// and wall.CounterStorageClient, so it can be used for free requests.
 type GoMap struct {
-	m *sync.Map
+	m   *sync.Map
+	ttl time.Duration
+	// Guards the check and store in SetIfNotUsed and the deletion of expired entries
+	lock *sync.Mutex
+	// Counters are stored separately, so they're not included in ForEach(...)
+	counters map[string]counterEntry
+	// Number of increments since the last deletion of expired counters, guarded by the lock
+	increments *int
+	// Number of stored preimages since the last deletion of expired preimages, guarded by the lock
+	writes *int
 }
 
 // WasUsed checks if the preimage was used for a previous payment already.
 func (m GoMap) WasUsed(preimage string) (bool, error) {
-	// We don't need the value. "ok" contains whether a value was found.
-	_, ok := m.m.Load(preimage)
-	return ok, nil
+	// "ok" contains whether a value was found
+	v, ok := m.m.Load(preimage)
+	if !ok {
+		return false, nil
+	}
+	if isExpired(v.(mapEntry).expiry) {
+		m.lock.Lock()
+		// The entry might have been replaced by SetIfNotUsed in the meantime
+		if v, ok := m.m.Load(preimage); ok && isExpired(v.(mapEntry).expiry) {
+			m.m.Delete(preimage)
+		}
+		m.lock.Unlock()
+		return false, nil
+	}
+	return true, nil
 }
 
 // SetUsed stores the information that a preimage has been used for a payment.
 func (m GoMap) SetUsed(preimage string) error {
-	m.m.Store(preimage, true)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.m.Store(preimage, mapEntry{expiry: m.newExpiry()})
+	m.countWrite()
+	return nil
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically.
+// wasNew is true if the preimage wasn't used before.
+func (m GoMap) SetIfNotUsed(preimage string) (bool, error) {
+	return m.setIfNotUsed(preimage, mapEntry{expiry: m.newExpiry()})
+}
+
+// SetPaymentIfNotUsed does the same as SetIfNotUsed, but also stores the amount (in Satoshis) and time of the payment,
+// which are used for Revenue(...).
+func (m GoMap) SetPaymentIfNotUsed(preimage string, amount int64, paidAt time.Time) (bool, error) {
+	return m.setIfNotUsed(preimage, mapEntry{expiry: m.newExpiry(), amount: amount, paidAt: paidAt, isPayment: true})
+}
+
+func (m GoMap) setIfNotUsed(preimage string, entry mapEntry) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if v, ok := m.m.Load(preimage); ok && !isExpired(v.(mapEntry).expiry) {
+		return false, nil
+	}
+	m.m.Store(preimage, entry)
+	m.countWrite()
+	return true, nil
+}
+
+// countWrite counts a stored preimage and deletes all expired preimages every preimageSweepInterval writes.
+// The lock must be held by the caller.
+func (m GoMap) countWrite() {
+	*m.writes++
+	if m.ttl <= 0 || *m.writes%preimageSweepInterval != 0 {
+		return
+	}
+	m.m.Range(func(k, v interface{}) bool {
+		if isExpired(v.(mapEntry).expiry) {
+			m.m.Delete(k)
+		}
+		return true
+	})
+}
+
+// Revenue returns the number of payments and their total amount (in Satoshis) in the given time window,
+// including from and excluding to.
+// Only payments that were stored with SetPaymentIfNotUsed(...) and didn't expire are included.
+func (m GoMap) Revenue(from, to time.Time) (count int64, total int64, err error) {
+	m.m.Range(func(_, v interface{}) bool {
+		entry := v.(mapEntry)
+		if entry.isPayment && !isExpired(entry.expiry) && !entry.paidAt.Before(from) && entry.paidAt.Before(to) {
+			count++
+			total += entry.amount
+		}
+		return true
+	})
+	return count, total, nil
+}
+
+// mapEntry is the value of a stored preimage.
+type mapEntry struct {
+	// The time when the entry expires. The zero value means the entry never expires.
+	expiry time.Time
+	// Only set for entries that were stored with SetPaymentIfNotUsed
+	isPayment bool
+	amount    int64
+	paidAt    time.Time
+}
+
+// newExpiry returns the expiry time for a newly stored preimage.
+// The zero value means the entry never expires.
+func (m GoMap) newExpiry() time.Time {
+	var expiry time.Time
+	if m.ttl > 0 {
+		expiry = time.Now().Add(m.ttl)
+	}
+	return expiry
+}
+
+func isExpired(expiry time.Time) bool {
+	return !expiry.IsZero() && time.Now().After(expiry)
+}
+
+// ForEach calls fn for each stored preimage that didn't expire yet, in no particular order.
+// It stops and returns the error if fn returns one.
+func (m GoMap) ForEach(fn func(preimage string) error) error {
+	var err error
+	m.m.Range(func(k, v interface{}) bool {
+		if isExpired(v.(mapEntry).expiry) {
+			return true
+		}
+		err = fn(k.(string))
+		return err == nil
+	})
+	return err
+}
+
+// Increment increases the counter of the given key by one and returns the new count.
+// If the counter doesn't exist yet or has expired, it starts at 1 and expires after the given TTL.
+// The TTL of the GoMap doesn't apply to counters.
+func (m GoMap) Increment(key string, ttl time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*m.increments++
+	if *m.increments%counterSweepInterval == 0 {
+		for k, entry := range m.counters {
+			if isExpired(entry.expiry) {
+				delete(m.counters, k)
+			}
+		}
+	}
+	entry, ok := m.counters[key]
+	if !ok || isExpired(entry.expiry) {
+		entry = counterEntry{expiry: time.Now().Add(ttl)}
+	}
+	entry.count++
+	m.counters[key] = entry
+	return entry.count, nil
+}
+
+// counterEntry is the value of a counter.
+type counterEntry struct {
+	count  int64
+	expiry time.Time
+}
+
+// Close is a no-op, because there's nothing to close for a Go map.
+// It only exists to implement the StorageClient interface.
+func (m GoMap) Close() error {
 	return nil
 }
 
 // NewGoMap creates a new GoMap.
 func NewGoMap() GoMap {
+	return NewGoMapWithTTL(0)
+}
+
+// NewGoMapWithTTL creates a new GoMap in which preimages expire after the given duration.
+// 0 means preimages are stored forever.
+// Expired preimages are deleted when they're read and after every 1000 stored preimages.
+// Warning: The LN node still reports the invoice of a deleted preimage as settled,
+// so after the TTL a preimage can be used again for a request!
+// Only set a TTL if that's acceptable for your web service.
+func NewGoMapWithTTL(ttl time.Duration) GoMap {
 	return GoMap{
-		m: &sync.Map{},
+		m:          &sync.Map{},
+		ttl:        ttl,
+		lock:       &sync.Mutex{},
+		counters:   make(map[string]counterEntry),
+		increments: new(int),
+		writes:     new(int),
 	}
 }
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestGoMapSweep tests if expired preimages are deleted after preimageSweepInterval stored preimages,
+// even if they're never read again.
+func TestGoMapSweep(t *testing.T) {
+	goMap := NewGoMapWithTTL(100 * time.Millisecond)
+	if _, err := goMap.SetIfNotUsed("expired"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	for i := 1; i < preimageSweepInterval; i++ {
+		if err := goMap.SetUsed(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := goMap.m.Load("expired"); ok {
+		t.Error("Expected the expired preimage to be deleted")
+	}
+	if _, ok := goMap.m.Load("1"); !ok {
+		t.Error("Expected the preimages that didn't expire yet to be kept")
+	}
+}
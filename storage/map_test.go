@@ -1,7 +1,9 @@
 package storage_test
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/philippgille/ln-paywall/ln"
 	"github.com/philippgille/ln-paywall/storage"
@@ -19,3 +21,66 @@ func TestGoMap(t *testing.T) {
 	wall.NewHandlerMiddleware(invoiceOptions, lnClient, goMap)
 	wall.NewGinMiddleware(invoiceOptions, lnClient, goMap)
 }
+
+// TestGoMapSetIfNotUsed tests if only one of many concurrent calls of SetIfNotUsed succeeds.
+func TestGoMapSetIfNotUsed(t *testing.T) {
+	testSetIfNotUsedConcurrently(t, storage.NewGoMap())
+}
+
+// TestGoMapRevenue tests if the GoMap reports the revenue of the stored payments.
+func TestGoMapRevenue(t *testing.T) {
+	testRevenue(t, storage.NewGoMap())
+}
+
+// TestGoMapIncrement tests if the counters of the GoMap start at 1, are increased atomically and expire after the TTL.
+func TestGoMapIncrement(t *testing.T) {
+	var _ wall.CounterStorageClient = storage.GoMap{}
+
+	goMap := storage.NewGoMap()
+	ttl := 100 * time.Millisecond
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := goMap.Increment("key", ttl); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if count, _ := goMap.Increment("key", ttl); count != 101 {
+		t.Errorf("Expected count 101, but was %v", count)
+	}
+	if count, _ := goMap.Increment("other", ttl); count != 1 {
+		t.Errorf("Expected count 1 for another key, but was %v", count)
+	}
+	// Counters aren't preimages
+	if used, _ := goMap.WasUsed("key"); used {
+		t.Error("Expected the counter not to be a used preimage")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if count, _ := goMap.Increment("key", ttl); count != 1 {
+		t.Errorf("Expected count 1 after the TTL, but was %v", count)
+	}
+}
+
+// TestGoMapTTL tests if preimages expire after the TTL and can be stored again afterwards.
+func TestGoMapTTL(t *testing.T) {
+	goMap := storage.NewGoMapWithTTL(100 * time.Millisecond)
+	if err := goMap.SetUsed("123"); err != nil {
+		t.Fatal(err)
+	}
+	if wasUsed, err := goMap.WasUsed("123"); err != nil || !wasUsed {
+		t.Fatalf("Expected the preimage to be stored, but was %v (error: %v)", wasUsed, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if wasUsed, _ := goMap.WasUsed("123"); wasUsed {
+		t.Error("Expected the preimage to be expired, but it was still stored")
+	}
+	if wasNew, _ := goMap.SetIfNotUsed("123"); !wasNew {
+		t.Error("Expected an expired preimage to be stored again")
+	}
+}
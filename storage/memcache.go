@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memcacheMaxRelativeExpiration is the longest expiration that memcached interprets as relative to the current time.
+// Longer expirations must be set as Unix timestamp.
+const memcacheMaxRelativeExpiration = 30 * 24 * time.Hour
+
+// MemcacheClient is a StorageClient implementation for memcached (https://memcached.org).
+// It's an option if you already run memcached for caching and don't want to run Redis just for the preimages.
+// It also implements wall.CounterStorageClient, so it can be used for free requests.
+//
+// Warning: memcached is a cache, so it evicts items when it runs out of memory, even if they don't have an expiration.
+// A preimage that was evicted can be used again for a request, because the LN node still reports its invoice as settled!
+// Give memcached enough memory for all preimages (or for the preimages of the TTL) or use a separate memcached instance,
+// so that other cached data doesn't lead to the eviction of preimages. memcached also loses all items when it restarts.
+//
+// memcached doesn't support iterating over all keys, so MemcacheClient doesn't implement wall.IterableStorageClient
+// and can't be the source of MigrateStorage(...).
+type MemcacheClient struct {
+	c   *memcache.Client
+	ttl time.Duration
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c MemcacheClient) WasUsed(preimage string) (bool, error) {
+	_, err := c.c.Get(preimage)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c MemcacheClient) SetUsed(preimage string) error {
+	return c.c.Set(c.newItem(preimage))
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically via memcached's "add" command,
+// which fails if the key exists.
+// wasNew is true if the preimage wasn't used before.
+func (c MemcacheClient) SetIfNotUsed(preimage string) (bool, error) {
+	err := c.c.Add(c.newItem(preimage))
+	if err == memcache.ErrNotStored {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// newItem creates the item for the given preimage, with the expiration if a TTL is set.
+// The value only needs to exist, its content doesn't matter.
+func (c MemcacheClient) newItem(preimage string) *memcache.Item {
+	return &memcache.Item{
+		Key:        preimage,
+		Value:      []byte("1"),
+		Expiration: toMemcacheExpiration(c.ttl),
+	}
+}
+
+// Increment increases the counter of the given key by one and returns the new count.
+// If the counter doesn't exist yet or has expired, it starts at 1 and expires after the given TTL.
+// memcached's expirations have a resolution of seconds, so TTLs are rounded up to full seconds.
+// The TTL of the MemcacheClient doesn't apply to counters.
+func (c MemcacheClient) Increment(key string, ttl time.Duration) (int64, error) {
+	for {
+		// "add" only creates the counter if it doesn't exist, so later increments don't extend the TTL
+		err := c.c.Add(&memcache.Item{
+			Key:        key,
+			Value:      []byte("1"),
+			Expiration: toMemcacheExpiration(ttl),
+		})
+		if err == nil {
+			return 1, nil
+		} else if err != memcache.ErrNotStored {
+			return 0, err
+		}
+		count, err := c.c.Increment(key, 1)
+		// The counter expired in the meantime
+		if err == memcache.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return int64(count), nil
+	}
+}
+
+// Close closes the idle connections to the memcached servers.
+func (c MemcacheClient) Close() error {
+	return c.c.Close()
+}
+
+// toMemcacheExpiration converts a TTL to memcached's expiration in seconds.
+// 0 means the item doesn't expire.
+func toMemcacheExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcacheMaxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	// Round up, because 0 would mean no expiration
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+// MemcacheOptions are the options for the MemcacheClient.
+type MemcacheOptions struct {
+	// Duration after which a stored preimage expires.
+	// 0 means preimages are stored until memcached evicts them, see the warning of MemcacheClient.
+	// Warning: The LN node still reports the invoice of an expired preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// memcached's expirations have a resolution of seconds, so the TTL is rounded up to full seconds.
+	// Optional (0 by default).
+	TTL time.Duration
+	// Timeout for reading from and writing to a memcached server.
+	// Optional (500ms by default).
+	Timeout time.Duration
+}
+
+// DefaultMemcacheServer is the server that's used when no servers are passed to NewMemcacheClient(...).
+const DefaultMemcacheServer = "localhost:11211"
+
+// DefaultMemcacheOptions is a MemcacheOptions object with default values.
+// TTL: 0, Timeout: 500ms
+var DefaultMemcacheOptions = MemcacheOptions{
+	Timeout: memcache.DefaultTimeout,
+	// No need to set TTL, since its Go zero value is fine for that
+}
+
+// NewMemcacheClient creates a new MemcacheClient for the given memcached servers, including the port.
+// With multiple servers the preimages are distributed among them, so each preimage is only stored on one server.
+// If no servers are passed, DefaultMemcacheServer is used.
+// An error is returned if one of the servers can't be reached.
+func NewMemcacheClient(servers []string, memcacheOptions MemcacheOptions) (MemcacheClient, error) {
+	result := MemcacheClient{}
+
+	// Set default values
+	if len(servers) == 0 {
+		servers = []string{DefaultMemcacheServer}
+	}
+	if memcacheOptions.Timeout <= 0 {
+		memcacheOptions.Timeout = DefaultMemcacheOptions.Timeout
+	}
+
+	c := memcache.New(servers...)
+	c.Timeout = memcacheOptions.Timeout
+	// Ping checks all servers
+	if err := c.Ping(); err != nil {
+		return result, err
+	}
+
+	result = MemcacheClient{
+		c:   c,
+		ttl: memcacheOptions.TTL,
+	}
+	return result, nil
+}
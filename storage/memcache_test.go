@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestMemcacheClient tests if the MemcacheClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestMemcacheClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	memcacheClient := storage.MemcacheClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, memcacheClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, memcacheClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, memcacheClient)
+	var _ wall.CounterStorageClient = memcacheClient
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// iterationBatchSize is the number of preimages that are read from a DB at once when iterating over all preimages.
+const iterationBatchSize = 1000
+
+// ErrNotIterable is returned by MigrateStorage(...) if the source storage client doesn't implement wall.IterableStorageClient.
+var ErrNotIterable = errors.New("the source storage client doesn't support iterating over the stored preimages")
+
+// MigrateStorage copies all used preimages from one storage client to another,
+// for example when switching from a local Bolt DB to Redis for running multiple instances of a web service.
+// The source must implement wall.IterableStorageClient, which all storage clients of this package except MemcacheClient do.
+// Preimages that already exist in the destination are skipped, so a migration can be repeated after an error.
+// Stop all web services that use the source before migrating, otherwise preimages that are used
+// during the migration might not be copied.
+//
+// Notes:
+//
+// - The preimages are stored in the destination as if they were just used,
+// so a TTL of the destination starts from the time of the migration and the amounts of payments aren't copied.
+//
+// - The in-memory storage clients (GoMap and MemoryLRU) lose all preimages when the process ends,
+// so they can only be migrated from within the running web service, not after a restart.
+func MigrateStorage(src, dst wall.StorageClient) error {
+	iterableSrc, ok := src.(wall.IterableStorageClient)
+	if !ok {
+		return ErrNotIterable
+	}
+	return iterableSrc.ForEach(func(preimage string) error {
+		if _, err := dst.SetIfNotUsed(preimage); err != nil {
+			return fmt.Errorf("couldn't store the preimage in the destination: %v", err)
+		}
+		return nil
+	})
+}
+
+// forEachInBatches calls fn for all preimages that getBatch returns.
+// getBatch must return up to limit preimages in ascending order that are greater than after,
+// with the empty string meaning the first batch.
+// Reading in batches means that no transaction or cursor is open while fn is called,
+// so fn can use the same DB.
+func forEachInBatches(getBatch func(after string, limit int) ([]string, error), fn func(preimage string) error) error {
+	after := ""
+	for {
+		batch, err := getBatch(after, iterationBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, preimage := range batch {
+			if err = fn(preimage); err != nil {
+				return err
+			}
+		}
+		if len(batch) < iterationBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1]
+	}
+}
@@ -0,0 +1,114 @@
+package storage_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestIterableStorageClients tests if the storage clients implement the wall.IterableStorageClient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestIterableStorageClients(t *testing.T) {
+	t.SkipNow()
+	var _ wall.IterableStorageClient = storage.GoMap{}
+	var _ wall.IterableStorageClient = storage.MemoryLRU{}
+	var _ wall.IterableStorageClient = storage.BoltClient{}
+	var _ wall.IterableStorageClient = storage.BadgerClient{}
+	var _ wall.IterableStorageClient = storage.RedisClient{}
+	var _ wall.IterableStorageClient = storage.PostgresClient{}
+	var _ wall.IterableStorageClient = storage.SQLiteClient{}
+	var _ wall.IterableStorageClient = storage.SQLClient{}
+	var _ wall.IterableStorageClient = storage.MongoClient{}
+	var _ wall.IterableStorageClient = storage.DynamoDBClient{}
+	var _ wall.IterableStorageClient = storage.FirestoreClient{}
+	var _ wall.IterableStorageClient = storage.EtcdClient{}
+}
+
+// TestMigrateStorage tests if all preimages are migrated from a GoMap to a BoltClient and back,
+// with more preimages than the Bolt DB returns in one batch.
+func TestMigrateStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltClient, err := storage.NewBoltClient(storage.BoltOptions{
+		Path: filepath.Join(dir, "ln-paywall.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltClient.Close()
+
+	goMap := storage.NewGoMap()
+	preimageCount := 2500
+	for i := 0; i < preimageCount; i++ {
+		goMap.SetUsed(strconv.Itoa(i))
+	}
+	// Preimages that already exist in the destination must be skipped
+	boltClient.SetUsed("0")
+
+	err = storage.MigrateStorage(goMap, boltClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backToMap := storage.NewGoMap()
+	err = storage.MigrateStorage(boltClient, backToMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < preimageCount; i++ {
+		if wasUsed, _ := backToMap.WasUsed(strconv.Itoa(i)); !wasUsed {
+			t.Fatalf("Expected preimage %v to be migrated", i)
+		}
+	}
+	count := 0
+	backToMap.ForEach(func(preimage string) error {
+		count++
+		return nil
+	})
+	if count != preimageCount {
+		t.Errorf("Expected %v preimages, but was %v", preimageCount, count)
+	}
+}
+
+// TestMigrateStorageErrors tests if MigrateStorage returns an error for a source that's not iterable
+// and stops if the destination returns an error.
+func TestMigrateStorageErrors(t *testing.T) {
+	err := storage.MigrateStorage(nonIterableStorage{}, storage.NewGoMap())
+	if err != storage.ErrNotIterable {
+		t.Errorf("Expected error %v, but was %v", storage.ErrNotIterable, err)
+	}
+
+	src := storage.NewMemoryLRU(10)
+	src.SetUsed("1")
+	src.SetUsed("2")
+	dst := &failingStorage{}
+	err = storage.MigrateStorage(src, dst)
+	if err == nil {
+		t.Error("Expected an error, but was nil")
+	}
+	if dst.calls != 1 {
+		t.Errorf("Expected the migration to stop after the first error, but SetIfNotUsed was called %v times", dst.calls)
+	}
+}
+
+type nonIterableStorage struct {
+	wall.StorageClient
+}
+
+type failingStorage struct {
+	wall.StorageClient
+	calls int
+}
+
+func (s *failingStorage) SetIfNotUsed(string) (bool, error) {
+	s.calls++
+	return false, errors.New("unavailable")
+}
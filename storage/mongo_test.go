@@ -0,0 +1,32 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestMongoClient tests if the MongoClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestMongoClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	mongoClient := storage.MongoClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, mongoClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, mongoClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, mongoClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, mongoClient, nil)
+}
+
+// TestNewMongoClientTTL tests if a TTL that's shorter than MongoDB's granularity of seconds leads to an error.
+// The options are checked before connecting, so no MongoDB server is required.
+func TestNewMongoClientTTL(t *testing.T) {
+	_, err := storage.NewMongoClient(storage.MongoOptions{TTL: 500 * time.Millisecond})
+	if err == nil {
+		t.Error("Expected an error for a TTL below 1 second, but was nil")
+	}
+}
@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestPostgresClient tests if the PostgresClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestPostgresClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	postgresClient := storage.PostgresClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, postgresClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, postgresClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, postgresClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, postgresClient, nil)
+}
@@ -1,12 +1,23 @@
 package storage
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-redis/redis"
+	"github.com/philippgille/ln-paywall/wall"
 )
 
 // RedisClient is a StorageClient implementation for Redis.
+// It supports a single Redis server (see NewRedisClient), Redis Cluster (see NewRedisClusterClient)
+// and Redis Sentinel, which monitors a master with replicas and fails over to a replica if the master is down (see NewRedisSentinelClient).
 type RedisClient struct {
-	c *redis.Client
+	c   redis.UniversalClient
+	ttl time.Duration
 }
 
 // WasUsed checks if the preimage was used for a previous payment already.
@@ -23,13 +34,90 @@ func (c RedisClient) WasUsed(preimage string) (bool, error) {
 
 // SetUsed stores the information that a preimage has been used for a payment.
 func (c RedisClient) SetUsed(preimage string) error {
-	err := c.c.Set(preimage, true, 0).Err()
+	err := c.c.Set(preimage, true, c.ttl).Err()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically via SETNX.
+// wasNew is true if the preimage wasn't used before.
+func (c RedisClient) SetIfNotUsed(preimage string) (bool, error) {
+	return c.c.SetNX(preimage, true, c.ttl).Result()
+}
+
+// ForEach calls fn for each key in the Redis DB, in no particular order.
+// Redis doesn't distinguish preimages from other keys, so use a DB that only contains preimages.
+// Only the counters of wall.InvoiceOptions.FreeRequests are skipped.
+// Keys that are stored or deleted during the iteration might be skipped and keys might be returned more than once,
+// which is fine for MigrateStorage(...).
+// For Redis Cluster all master nodes are scanned concurrently, but fn is never called concurrently.
+// It stops and returns the error if fn returns one.
+func (c RedisClient) ForEach(fn func(preimage string) error) error {
+	fn = skipCounters(fn)
+	if clusterClient, ok := c.c.(*redis.ClusterClient); ok {
+		lock := sync.Mutex{}
+		var fnErr error
+		return clusterClient.ForEachMaster(func(master *redis.Client) error {
+			return forEachRedisKey(master, func(key string) error {
+				lock.Lock()
+				defer lock.Unlock()
+				// Stop the scans of the other masters as well
+				if fnErr == nil {
+					fnErr = fn(key)
+				}
+				return fnErr
+			})
+		})
+	}
+	return forEachRedisKey(c.c, fn)
+}
+
+// skipCounters wraps fn so that it isn't called for keys of counters.
+func skipCounters(fn func(preimage string) error) func(preimage string) error {
+	return func(key string) error {
+		if strings.HasPrefix(key, wall.FreeRequestsKeyPrefix) {
+			return nil
+		}
+		return fn(key)
+	}
+}
+
+// forEachRedisKey calls fn for each key of the Redis server.
+func forEachRedisKey(c redis.Cmdable, fn func(key string) error) error {
+	iterator := c.Scan(0, "", iterationBatchSize).Iterator()
+	for iterator.Next() {
+		if err := fn(iterator.Val()); err != nil {
+			return err
+		}
+	}
+	return iterator.Err()
+}
+
+// incrementScript increments a counter and sets its TTL (in milliseconds) only when it's created,
+// so that the window is fixed. A script is executed atomically, so the counter can't be left without TTL.
+var incrementScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Increment increases the counter of the given key by one and returns the new count.
+// If the counter doesn't exist yet or has expired, it starts at 1 and expires after the given TTL.
+// The TTL of the RedisClient doesn't apply to counters.
+func (c RedisClient) Increment(key string, ttl time.Duration) (int64, error) {
+	return incrementScript.Run(c.c, []string{key}, int64(ttl/time.Millisecond)).Int64()
+}
+
+// Close closes the connection(s) to the Redis server(s).
+func (c RedisClient) Close() error {
+	return c.c.Close()
+}
+
 // RedisOptions are the options for the Redis DB.
 type RedisOptions struct {
 	// Address of the Redis server, including the port.
@@ -41,26 +129,99 @@ type RedisOptions struct {
 	// DB to use.
 	// Optional (0 by default).
 	DB int
+	// TLS configuration for the connection to the Redis server.
+	// Required by most managed Redis services, like Amazon ElastiCache with in-transit encryption.
+	// An empty tls.Config{} is enough for servers with a certificate that's signed by a trusted CA.
+	// Optional (nil by default, which means no TLS is used).
+	TLSConfig *tls.Config
+	// Duration after which a stored preimage is deleted.
+	// 0 means preimages are stored forever.
+	// Warning: The LN node still reports the invoice of a deleted preimage as settled,
+	// so after the TTL a preimage can be used again for a request!
+	// Only set a TTL if that's acceptable for your web service.
+	// Optional (0 by default).
+	TTL time.Duration
 }
 
 // DefaultRedisOptions is a RedisOptions object with default values.
-// Address: "localhost:6379", Password: "", DB: 0
+// Address: "localhost:6379", Password: "", DB: 0, TLSConfig: nil, TTL: 0
 var DefaultRedisOptions = RedisOptions{
 	Address: "localhost:6379",
-	// No need to set Password or DB, since their Go zero values are fine for that
+	// No need to set Password, DB, TLSConfig or TTL, since their Go zero values are fine for that
 }
 
 // NewRedisClient creates a new RedisClient.
-func NewRedisClient(redisOptions RedisOptions) RedisClient {
+// An error is returned if the Redis server can't be reached or rejects the password.
+func NewRedisClient(redisOptions RedisOptions) (RedisClient, error) {
 	// Set default values
 	if redisOptions.Address == "" {
 		redisOptions.Address = DefaultRedisOptions.Address
 	}
-	return RedisClient{
-		c: redis.NewClient(&redis.Options{
-			Addr:     redisOptions.Address,
-			Password: redisOptions.Password,
-			DB:       redisOptions.DB,
-		}),
+	c := redis.NewClient(&redis.Options{
+		Addr:      redisOptions.Address,
+		Password:  redisOptions.Password,
+		DB:        redisOptions.DB,
+		TLSConfig: redisOptions.TLSConfig,
+	})
+
+	return newRedisClient(c, redisOptions.Address, redisOptions.TTL)
+}
+
+// NewRedisClusterClient creates a new RedisClient for a Redis Cluster.
+// The Address field of the RedisOptions is ignored, the addresses of the cluster nodes are passed instead.
+// Not all nodes are required, the client discovers the other nodes automatically.
+// Redis Cluster only supports DB 0, so an error is returned if a different DB is configured.
+// An error is also returned if the cluster can't be reached or rejects the password.
+func NewRedisClusterClient(addresses []string, redisOptions RedisOptions) (RedisClient, error) {
+	if len(addresses) == 0 {
+		return RedisClient{}, errors.New("at least one address of a Redis Cluster node is required")
 	}
+	if redisOptions.DB != 0 {
+		return RedisClient{}, errors.New("Redis Cluster only supports DB 0")
+	}
+	c := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:     addresses,
+		Password:  redisOptions.Password,
+		TLSConfig: redisOptions.TLSConfig,
+	})
+
+	return newRedisClient(c, strings.Join(addresses, ","), redisOptions.TTL)
+}
+
+// NewRedisSentinelClient creates a new RedisClient for a Redis master that's monitored by Redis Sentinel.
+// The Address field of the RedisOptions is ignored, the addresses of the Sentinel servers are passed instead,
+// as well as the name of the master. The other options are used for the connection to the master.
+// An error is returned if the master can't be reached or rejects the password.
+func NewRedisSentinelClient(masterName string, sentinelAddresses []string, redisOptions RedisOptions) (RedisClient, error) {
+	if len(sentinelAddresses) == 0 {
+		return RedisClient{}, errors.New("at least one address of a Redis Sentinel server is required")
+	}
+	c := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddresses,
+		Password:      redisOptions.Password,
+		DB:            redisOptions.DB,
+		TLSConfig:     redisOptions.TLSConfig,
+	})
+
+	return newRedisClient(c, masterName+" via "+strings.Join(sentinelAddresses, ","), redisOptions.TTL)
+}
+
+// newRedisClient makes sure the connection works and creates the RedisClient.
+// The address is only used in the error message.
+func newRedisClient(c redis.UniversalClient, address string, ttl time.Duration) (RedisClient, error) {
+	result := RedisClient{}
+
+	err := c.Ping().Err()
+	if err != nil {
+		c.Close()
+		return result, fmt.Errorf("couldn't connect to Redis at %v: %v", address, err)
+	}
+
+	result = RedisClient{
+		c:   c,
+		ttl: ttl,
+	}
+
+	return result, nil
 }
@@ -19,3 +19,10 @@ func TestRedisClient(t *testing.T) {
 	wall.NewHandlerMiddleware(invoiceOptions, lnClient, redisClient)
 	wall.NewGinMiddleware(invoiceOptions, lnClient, redisClient)
 }
+
+// TestRedisClientCounter tests if the RedisClient implements the CounterStorageClient interface.
+// This doesn't need to be executed as a proper test, as the compiler already checks it.
+func TestRedisClientCounter(t *testing.T) {
+	t.SkipNow()
+	var _ wall.CounterStorageClient = storage.RedisClient{}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SQLDialect contains the parts of the SQL statements of the SQLClient that differ between databases.
+// SQLDialectPostgres, SQLDialectMySQL and SQLDialectSQLite are built in.
+// For other databases you can create your own, as long as the database supports inserting a row
+// only if its primary key doesn't exist yet in a single statement, without an error in that case.
+type SQLDialect struct {
+	// Name of the dialect, only used in error messages.
+	Name string
+	// Function that returns the placeholder for the argument at the given position (starting at 1),
+	// for example "$1" for PostgreSQL and "?" for MySQL and SQLite.
+	Placeholder func(position int) string
+	// Function that quotes an identifier like the table name, so it can be used in a statement.
+	QuoteIdentifier func(name string) string
+	// Statement that creates the table if it doesn't exist yet, with "%[1]v" for the quoted table name.
+	// The table must have the column "preimage" as primary key. Preimages are case-sensitive.
+	CreateTable string
+	// Statement that inserts a preimage only if it doesn't exist yet, with "%[1]v" for the quoted table name
+	// and "%[2]v" for the placeholder of the preimage. It must affect no row if the preimage already exists.
+	InsertIfNotExists string
+}
+
+// SQLDialectPostgres is the SQLDialect for PostgreSQL, for example with the driver github.com/lib/pq
+// or github.com/jackc/pgx/v5/stdlib.
+var SQLDialectPostgres = SQLDialect{
+	Name: "PostgreSQL",
+	Placeholder: func(position int) string {
+		return "$" + strconv.Itoa(position)
+	},
+	QuoteIdentifier: pq.QuoteIdentifier,
+	CreateTable: `CREATE TABLE IF NOT EXISTS %[1]v (
+		preimage TEXT PRIMARY KEY,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	InsertIfNotExists: "INSERT INTO %[1]v (preimage) VALUES (%[2]v) ON CONFLICT (preimage) DO NOTHING",
+}
+
+// SQLDialectMySQL is the SQLDialect for MySQL and MariaDB, for example with the driver github.com/go-sql-driver/mysql.
+// The preimage column uses a binary collation, because the default collations of MySQL are case-insensitive,
+// which would lead to different Base64 encoded preimages being treated as the same.
+var SQLDialectMySQL = SQLDialect{
+	Name: "MySQL",
+	Placeholder: func(position int) string {
+		return "?"
+	},
+	QuoteIdentifier: func(name string) string {
+		return "`" + strings.Replace(name, "`", "``", -1) + "`"
+	},
+	CreateTable: `CREATE TABLE IF NOT EXISTS %[1]v (
+		preimage VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	InsertIfNotExists: "INSERT IGNORE INTO %[1]v (preimage) VALUES (%[2]v)",
+}
+
+// SQLDialectSQLite is the SQLDialect for SQLite, for example with the driver github.com/mattn/go-sqlite3.
+// SQLite only allows one writer at a time, so you should call SetMaxOpenConns(1) on the *sql.DB,
+// like NewSQLiteClient(...) does.
+var SQLDialectSQLite = SQLDialect{
+	Name: "SQLite",
+	Placeholder: func(position int) string {
+		return "?"
+	},
+	QuoteIdentifier: quoteSQLiteIdentifier,
+	CreateTable: `CREATE TABLE IF NOT EXISTS %[1]v (
+		preimage TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	InsertIfNotExists: "INSERT OR IGNORE INTO %[1]v (preimage) VALUES (%[2]v)",
+}
+
+// SQLClient is a StorageClient implementation for any SQL database that's supported by database/sql,
+// with the driver and connection pool of your choice. The differences between the databases are covered by an SQLDialect.
+type SQLClient struct {
+	db *sql.DB
+	// Statements with the table name and placeholders
+	wasUsedQuery           string
+	insertIfNotExistsQuery string
+	forEachQuery           string
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c SQLClient) WasUsed(preimage string) (bool, error) {
+	var result bool
+	err := c.db.QueryRow(c.wasUsedQuery, preimage).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically.
+// wasNew is true if the preimage wasn't used before.
+func (c SQLClient) SetIfNotUsed(preimage string) (bool, error) {
+	res, err := c.db.Exec(c.insertIfNotExistsQuery, preimage)
+	if err != nil {
+		return false, err
+	}
+	// No row is inserted if the preimage already existed
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// ForEach calls fn for each stored preimage, in ascending order.
+// It stops and returns the error if fn returns one.
+func (c SQLClient) ForEach(fn func(preimage string) error) error {
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		return queryPreimages(c.db, c.forEachQuery, after, limit)
+	}, fn)
+}
+
+// Close closes the *sql.DB that was passed to NewSQLClient(...).
+func (c SQLClient) Close() error {
+	return c.db.Close()
+}
+
+// SQLOptions are the options for the SQL database.
+type SQLOptions struct {
+	// Name of the table in which the preimages are stored.
+	// It's created if it doesn't exist yet.
+	// Optional ("ln_paywall" by default).
+	TableName string
+}
+
+// DefaultSQLOptions is an SQLOptions object with default values.
+// TableName: "ln_paywall"
+var DefaultSQLOptions = SQLOptions{
+	TableName: "ln_paywall",
+}
+
+// NewSQLClient creates a new SQLClient that uses the given DB, which you open with the driver of your choice
+// and whose connection pool you can configure as you like.
+// The table for the preimages is created if it doesn't exist yet.
+func NewSQLClient(db *sql.DB, dialect SQLDialect, sqlOptions SQLOptions) (SQLClient, error) {
+	result := SQLClient{}
+
+	// Set default values
+	if sqlOptions.TableName == "" {
+		sqlOptions.TableName = DefaultSQLOptions.TableName
+	}
+
+	if db == nil {
+		return result, errors.New("the DB must not be nil")
+	}
+	if dialect.Placeholder == nil || dialect.QuoteIdentifier == nil || dialect.CreateTable == "" || dialect.InsertIfNotExists == "" {
+		return result, fmt.Errorf("the SQL dialect %q is incomplete", dialect.Name)
+	}
+
+	// Create the table if it doesn't exist yet.
+	// This also makes sure we can connect to the DB.
+	table := dialect.QuoteIdentifier(sqlOptions.TableName)
+	_, err := db.Exec(fmt.Sprintf(dialect.CreateTable, table))
+	if err != nil {
+		return result, err
+	}
+
+	result = SQLClient{
+		db:                     db,
+		wasUsedQuery:           fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %v WHERE preimage = %v)", table, dialect.Placeholder(1)),
+		insertIfNotExistsQuery: fmt.Sprintf(dialect.InsertIfNotExists, table, dialect.Placeholder(1)),
+		forEachQuery:           fmt.Sprintf("SELECT preimage FROM %v WHERE preimage > %v ORDER BY preimage LIMIT %v", table, dialect.Placeholder(1), dialect.Placeholder(2)),
+	}
+
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestSQLClient tests if the SQLClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestSQLClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	sqlClient := storage.SQLClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, sqlClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, sqlClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, sqlClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, sqlClient, nil)
+}
+
+// TestSQLClientSQLite tests if only one of many concurrent calls of SetIfNotUsed succeeds
+// and if all preimages are iterated, with the SQLite dialect.
+func TestSQLClientSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "ln-paywall.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	sqlClient, err := storage.NewSQLClient(db, storage.SQLDialectSQLite, storage.SQLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlClient.Close()
+
+	testSetIfNotUsedConcurrently(t, sqlClient)
+
+	for _, preimage := range []string{"b", "A", "a"} {
+		if wasNew, err := sqlClient.SetIfNotUsed(preimage); err != nil || !wasNew {
+			t.Errorf("Expected %q to be new, but was %v (error: %v)", preimage, wasNew, err)
+		}
+	}
+	var preimages []string
+	err = sqlClient.ForEach(func(preimage string) error {
+		preimages = append(preimages, preimage)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wasUsed, err := sqlClient.WasUsed("a"); err != nil || !wasUsed {
+		t.Errorf("Expected the preimage to be used, but was %v (error: %v)", wasUsed, err)
+	}
+	// The preimage of the concurrency test and the three above
+	if len(preimages) != 4 || preimages[1] != "A" || preimages[2] != "a" {
+		t.Errorf("Expected 4 preimages in ascending order, but were %v", preimages)
+	}
+}
+
+// TestNewSQLClientErrors tests if an incomplete dialect leads to an error.
+func TestNewSQLClientErrors(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = storage.NewSQLClient(db, storage.SQLDialect{Name: "custom"}, storage.SQLOptions{}); err == nil {
+		t.Error("Expected an error for an incomplete dialect, but was nil")
+	}
+}
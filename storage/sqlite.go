@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// Registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteClient is a StorageClient implementation for SQLite.
+type SQLiteClient struct {
+	db    *sql.DB
+	table string
+}
+
+// WasUsed checks if the preimage was used for a previous payment already.
+func (c SQLiteClient) WasUsed(preimage string) (bool, error) {
+	var result bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %v WHERE preimage = ?)", c.table)
+	err := c.db.QueryRow(query, preimage).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// SetUsed stores the information that a preimage has been used for a payment.
+func (c SQLiteClient) SetUsed(preimage string) error {
+	// Storing the same preimage twice isn't an error, the preimage is used in both cases
+	query := fmt.Sprintf("INSERT OR IGNORE INTO %v (preimage) VALUES (?)", c.table)
+	_, err := c.db.Exec(query, preimage)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetIfNotUsed stores the information that a preimage has been used for a payment,
+// but only if it wasn't stored before. The check and the storing happen atomically.
+// wasNew is true if the preimage wasn't used before.
+func (c SQLiteClient) SetIfNotUsed(preimage string) (bool, error) {
+	query := fmt.Sprintf("INSERT OR IGNORE INTO %v (preimage) VALUES (?)", c.table)
+	res, err := c.db.Exec(query, preimage)
+	if err != nil {
+		return false, err
+	}
+	// No row is inserted if the preimage already existed
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// ForEach calls fn for each stored preimage, in ascending order.
+// It stops and returns the error if fn returns one.
+func (c SQLiteClient) ForEach(fn func(preimage string) error) error {
+	query := fmt.Sprintf("SELECT preimage FROM %v WHERE preimage > ? ORDER BY preimage LIMIT ?", c.table)
+	return forEachInBatches(func(after string, limit int) ([]string, error) {
+		return queryPreimages(c.db, query, after, limit)
+	}, fn)
+}
+
+// queryPreimages runs the query with the given arguments and returns the preimages of the result rows.
+func queryPreimages(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var preimages []string
+	for rows.Next() {
+		var preimage string
+		if err = rows.Scan(&preimage); err != nil {
+			return nil, err
+		}
+		preimages = append(preimages, preimage)
+	}
+	return preimages, rows.Err()
+}
+
+// Close closes the DB.
+func (c SQLiteClient) Close() error {
+	return c.db.Close()
+}
+
+// SQLiteOptions are the options for the SQLite DB.
+type SQLiteOptions struct {
+	// Path of the DB file. It's created if it doesn't exist yet.
+	// Optional ("ln-paywall.sqlite" by default).
+	Path string
+	// Name of the table in which the preimages are stored.
+	// It's created if it doesn't exist yet.
+	// Optional ("ln_paywall" by default).
+	TableName string
+}
+
+// DefaultSQLiteOptions is a SQLiteOptions object with default values.
+// Path: "ln-paywall.sqlite", TableName: "ln_paywall"
+var DefaultSQLiteOptions = SQLiteOptions{
+	Path:      "ln-paywall.sqlite",
+	TableName: "ln_paywall",
+}
+
+// NewSQLiteClient creates a new SQLiteClient.
+// The table for the preimages is created if it doesn't exist yet.
+// Note: The SQLite driver uses cgo, so a C compiler is required for building your web service.
+func NewSQLiteClient(sqliteOptions SQLiteOptions) (SQLiteClient, error) {
+	result := SQLiteClient{}
+
+	// Set default values
+	if sqliteOptions.Path == "" {
+		sqliteOptions.Path = DefaultSQLiteOptions.Path
+	}
+	if sqliteOptions.TableName == "" {
+		sqliteOptions.TableName = DefaultSQLiteOptions.TableName
+	}
+
+	db, err := sql.Open("sqlite3", sqliteOptions.Path)
+	if err != nil {
+		return result, err
+	}
+	// SQLite only allows one writer at a time and returns "database is locked" errors for concurrent writes
+	// from other connections, so all queries go through a single connection.
+	db.SetMaxOpenConns(1)
+
+	// Create the table if it doesn't exist yet.
+	// This also makes sure the DB file can be opened.
+	table := quoteSQLiteIdentifier(sqliteOptions.TableName)
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v (
+		preimage TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`, table)
+	_, err = db.Exec(query)
+	if err != nil {
+		db.Close()
+		return result, err
+	}
+
+	result = SQLiteClient{
+		db:    db,
+		table: table,
+	}
+
+	return result, nil
+}
+
+// quoteSQLiteIdentifier quotes an identifier like a table name, so it can be used in a query.
+func quoteSQLiteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,44 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestSQLiteClient tests if the SQLiteClient struct implements the StorageClient interface.
+// This doesn't happen at runtime, but at compile time.
+func TestSQLiteClient(t *testing.T) {
+	t.SkipNow()
+	invoiceOptions := wall.InvoiceOptions{}
+	lnClient := ln.LNDclient{}
+	sqliteClient := storage.SQLiteClient{}
+	wall.NewHandlerFuncMiddleware(invoiceOptions, lnClient, sqliteClient)
+	wall.NewHandlerMiddleware(invoiceOptions, lnClient, sqliteClient)
+	wall.NewGinMiddleware(invoiceOptions, lnClient, sqliteClient)
+	wall.NewEchoMiddleware(invoiceOptions, lnClient, sqliteClient, nil)
+}
+
+// TestSQLiteClientSetIfNotUsed tests if only one of many concurrent calls of SetIfNotUsed succeeds.
+func TestSQLiteClientSetIfNotUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ln-paywall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqliteOptions := storage.SQLiteOptions{
+		Path: filepath.Join(dir, "ln-paywall.sqlite"),
+	}
+	sqliteClient, err := storage.NewSQLiteClient(sqliteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteClient.Close()
+
+	testSetIfNotUsedConcurrently(t, sqliteClient)
+}
@@ -0,0 +1,108 @@
+package storage_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// testSetIfNotUsedConcurrently calls SetIfNotUsed with the same preimage from many goroutines
+// and checks that exactly one call reports the preimage as new.
+func testSetIfNotUsedConcurrently(t *testing.T, storageClient wall.StorageClient) {
+	goroutineCount := 100
+	preimage := "123"
+
+	start := make(chan struct{})
+	results := make(chan bool, goroutineCount)
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(goroutineCount)
+	for i := 0; i < goroutineCount; i++ {
+		go func() {
+			defer waitGroup.Done()
+			// Let all goroutines start at the same time to increase the chance of a race
+			<-start
+			wasNew, err := storageClient.SetIfNotUsed(preimage)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- wasNew
+		}()
+	}
+	close(start)
+	waitGroup.Wait()
+	close(results)
+
+	newCount := 0
+	for wasNew := range results {
+		if wasNew {
+			newCount++
+		}
+	}
+	if newCount != 1 {
+		t.Errorf("Expected exactly 1 call to SetIfNotUsed to report the preimage as new, but it was %v", newCount)
+	}
+
+	wasUsed, err := storageClient.WasUsed(preimage)
+	if err != nil {
+		t.Error(err)
+	}
+	if !wasUsed {
+		t.Error("Expected the preimage to be stored as used, but it wasn't")
+	}
+}
+
+// testRevenue stores payments at different times and checks if Revenue(...) only includes the ones in the time window,
+// and that preimages that were stored without payment aren't included.
+func testRevenue(t *testing.T, storageClient interface {
+	wall.StorageClient
+	wall.PaymentStorageClient
+}) {
+	now := time.Now().Truncate(time.Second)
+	payments := []struct {
+		preimage string
+		amount   int64
+		paidAt   time.Time
+	}{
+		{"1", 10, now.Add(-2 * time.Hour)},
+		{"2", 20, now.Add(-time.Hour)},
+		{"3", 30, now},
+	}
+	for _, payment := range payments {
+		wasNew, err := storageClient.SetPaymentIfNotUsed(payment.preimage, payment.amount, payment.paidAt)
+		if err != nil || !wasNew {
+			t.Fatalf("Expected the payment to be stored, but wasNew was %v (error: %v)", wasNew, err)
+		}
+	}
+	// Already stored
+	if wasNew, err := storageClient.SetPaymentIfNotUsed("1", 10, now); err != nil || wasNew {
+		t.Errorf("Expected the payment not to be stored again, but wasNew was %v (error: %v)", wasNew, err)
+	}
+	if _, err := storageClient.SetIfNotUsed("4"); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		from          time.Time
+		to            time.Time
+		expectedCount int64
+		expectedTotal int64
+	}{
+		{now.Add(-3 * time.Hour), now.Add(time.Hour), 3, 60},
+		{now.Add(-time.Hour), now.Add(time.Hour), 2, 50},
+		// "to" is excluded
+		{now.Add(-2 * time.Hour), now, 2, 30},
+		{now.Add(time.Hour), now.Add(2 * time.Hour), 0, 0},
+	}
+	for _, testCase := range testCases {
+		count, total, err := storageClient.Revenue(testCase.from, testCase.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != testCase.expectedCount || total != testCase.expectedTotal {
+			t.Errorf("Expected %v payments with a total of %v between %v and %v, but were %v and %v",
+				testCase.expectedCount, testCase.expectedTotal, testCase.from, testCase.to, count, total)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package wall
+
+import (
+	"context"
+	"net/http"
+)
+
+// amountPaidKey is the context key for the amount that was paid for a request.
+// It's of an unexported type, so it can't collide with keys of other packages.
+type amountPaidKey struct{}
+
+// AmountPaid returns the amount in Satoshis that was paid for the request,
+// for handlers that are called by one of the middlewares and want to tailor the response to the amount,
+// for example to return more data for a bigger tip with AmountlessInvoices.
+// Without AmountlessInvoices or if the LN client doesn't implement AmountPaidLNclient it's the price of the request.
+// 0 is returned if the request didn't need to be paid for, for example because of a session token,
+// a whitelisted IP address or an API key.
+// For Fiber use AmountPaidFromContext(...) with ctx.UserContext().
+func AmountPaid(r *http.Request) int64 {
+	return AmountPaidFromContext(r.Context())
+}
+
+// AmountPaidFromContext returns the amount in Satoshis that was paid for the request with the given context.
+// See AmountPaid(...) for details. It's meant for the gRPC interceptor and the Fiber middleware,
+// in which case the context is the one that's passed to the gRPC handler or ctx.UserContext() respectively.
+func AmountPaidFromContext(ctx context.Context) int64 {
+	amount, _ := ctx.Value(amountPaidKey{}).(int64)
+	return amount
+}
+
+// withAmountPaid returns a context with the paid amount of the result,
+// or the given context if nothing was paid.
+func withAmountPaid(ctx context.Context, res result) context.Context {
+	if res.amountPaid == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, amountPaidKey{}, res.amountPaid)
+}
+
+// requestWithAmountPaid returns a shallow copy of the request with the paid amount of the result in its context,
+// or the given request if nothing was paid.
+func requestWithAmountPaid(r *http.Request, res result) *http.Request {
+	if res.amountPaid == 0 {
+		return r
+	}
+	return r.WithContext(withAmountPaid(r.Context(), res))
+}
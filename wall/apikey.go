@@ -0,0 +1,36 @@
+package wall
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// apiKeys contains the SHA-256 hashes of the API keys of trusted callers that don't need to pay.
+// Comparing hashes instead of the keys themselves makes the comparison independent of the length of the keys.
+type apiKeys [][sha256.Size]byte
+
+func newAPIKeys(keys []string) apiKeys {
+	var result apiKeys
+	for _, key := range keys {
+		// Empty keys would match requests without the header
+		if key != "" {
+			result = append(result, sha256.Sum256([]byte(key)))
+		}
+	}
+	return result
+}
+
+// contains returns true if the given key is one of the API keys.
+// The key is compared to all API keys in constant time, so the duration doesn't reveal
+// if or which key matched, or how many bytes of a key were correct.
+func (a apiKeys) contains(key string) bool {
+	if key == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(key))
+	found := 0
+	for _, apiKey := range a {
+		found |= subtle.ConstantTimeCompare(hash[:], apiKey[:])
+	}
+	return found == 1
+}
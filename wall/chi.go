@@ -0,0 +1,13 @@
+package wall
+
+import (
+	"net/http"
+)
+
+// NewChiMiddleware returns a function which you can pass to chi's Router.Use(...) or Router.With(...).
+// chi uses the standard http.Handler, so the middleware behaves exactly like the one returned by NewHandlerMiddleware.
+func NewChiMiddleware(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(createHandlerFunc(invoiceOptions, lnClient, storageClient, next.ServeHTTP))
+	}
+}
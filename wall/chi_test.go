@@ -0,0 +1,24 @@
+package wall_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestChiMiddleware tests the payment flow of the middleware from NewChiMiddleware.
+func TestChiMiddleware(t *testing.T) {
+	testPaymentRoundTrip(t, func(invoiceOptions wall.InvoiceOptions, lnClient wall.LNclient, storageClient wall.StorageClient) http.Handler {
+		r := chi.NewRouter()
+		r.Use(wall.NewChiMiddleware(invoiceOptions, lnClient, storageClient))
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, wall.AmountPaid(r))
+		}
+		r.Get("/", handler)
+		r.Get("/expensive", handler)
+		return r
+	})
+}
@@ -0,0 +1,65 @@
+package wall
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/sony/gobreaker"
+)
+
+// newCircuitBreaker returns a circuit breaker for the calls to the LN client,
+// which opens after the given number of consecutive failed calls and half-opens after the timeout.
+// State changes are logged and reported to the metrics.
+func newCircuitBreaker(threshold uint32, timeout time.Duration, metrics *Metrics, logger ln.Logger) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: "LNclient",
+		// Only one probe is let through in the half-open state
+		MaxRequests: 1,
+		Timeout:     timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= threshold
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			logger.Printf("The circuit breaker for the LN client changed from %v to %v\n", from, to)
+			metrics.circuitBreakerStateChanged(to)
+		},
+		IsSuccessful: func(err error) bool {
+			return !isLNclientFailure(err)
+		},
+	})
+}
+
+// callLN calls the given function, which calls the LN client, through the circuit breaker if it's enabled.
+// When the circuit breaker is open, the function isn't called and gobreaker.ErrOpenState is returned,
+// which is handled like any other error of the LN client, so the FailurePolicy applies.
+func (p paywall) callLN(fn func() error) error {
+	if p.breaker == nil {
+		return fn()
+	}
+	_, err := p.breaker.Execute(func() (interface{}, error) {
+		return nil, fn()
+	})
+	return err
+}
+
+// isLNclientFailure returns true if the error of an LN client call indicates a problem with the LN node.
+// Errors that are caused by the request, like a preimage whose invoice was canceled or wasn't found,
+// and requests that were canceled by the client don't count as failures.
+func isLNclientFailure(err error) bool {
+	switch {
+	case err == nil,
+		err == ln.ErrInvoiceCanceled,
+		err == ln.ErrInvoiceNotFound,
+		err == ln.ErrInsufficientAmount,
+		err == ln.ErrInsufficientInboundLiquidity,
+		err == ln.ErrMemoTooLong,
+		err == context.Canceled,
+		reflect.TypeOf(err).Name() == "CorruptInputError",
+		strings.Contains(err.Error(), "unable to locate invoice"):
+		return false
+	}
+	return true
+}
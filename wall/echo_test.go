@@ -0,0 +1,24 @@
+package wall_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestEchoMiddleware tests the payment flow of the middleware from NewEchoMiddleware.
+func TestEchoMiddleware(t *testing.T) {
+	testPaymentRoundTrip(t, func(invoiceOptions wall.InvoiceOptions, lnClient wall.LNclient, storageClient wall.StorageClient) http.Handler {
+		e := echo.New()
+		e.Use(wall.NewEchoMiddleware(invoiceOptions, lnClient, storageClient, nil))
+		handler := func(ctx echo.Context) error {
+			return ctx.String(http.StatusOK, strconv.FormatInt(wall.AmountPaid(ctx.Request()), 10))
+		}
+		e.GET("/", handler)
+		e.GET("/expensive", handler)
+		return e
+	})
+}
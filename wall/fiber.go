@@ -0,0 +1,49 @@
+package wall
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// NewFiberMiddleware returns a Fiber middleware in the form of a fiber.Handler.
+func NewFiberMiddleware(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) fiber.Handler {
+	p := newPaywall(invoiceOptions, lnClient, storageClient)
+	return func(ctx *fiber.Ctx) error {
+		r, err := getFiberRequest(p.invoiceOptions, ctx)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't convert the request: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			return ctx.Status(http.StatusInternalServerError).SendString(errorMsg)
+		}
+		// Fiber reuses the memory of values it returns after the handler returns,
+		// so the header values must be copied, because the preimage gets stored.
+		getHeader := func(key string) string {
+			return utils.CopyString(ctx.Get(key))
+		}
+		getQueryParam := func(key string) string {
+			return utils.CopyString(ctx.Query(key))
+		}
+		res := p.handleRequest(ctx.UserContext(), getHeader, getQueryParam, ctx.Method(), ctx.Path(), ctx.Context().RemoteAddr().String(), r)
+		for key := range res.header {
+			ctx.Set(key, res.header.Get(key))
+		}
+		if res.ok {
+			ctx.SetUserContext(withAmountPaid(ctx.UserContext(), res))
+			return ctx.Next()
+		}
+		return ctx.Status(res.statusCode).SendString(res.body)
+	}
+}
+
+// getFiberRequest converts the request to an *http.Request for the PriceFunc, MemoFunc and OnPaid function.
+// It returns nil if none of them is set, because the conversion isn't necessary then.
+func getFiberRequest(invoiceOptions InvoiceOptions, ctx *fiber.Ctx) (*http.Request, error) {
+	if invoiceOptions.PriceFunc == nil && invoiceOptions.MemoFunc == nil && invoiceOptions.OnPaid == nil {
+		return nil, nil
+	}
+	return adaptor.ConvertRequest(ctx, false)
+}
@@ -0,0 +1,39 @@
+package wall_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/philippgille/ln-paywall/wall"
+)
+
+// TestFiberMiddleware tests the payment flow of the middleware from NewFiberMiddleware.
+// The PriceFunc of the test requires the conversion of the request, and the paid amount is passed on via the user context.
+func TestFiberMiddleware(t *testing.T) {
+	testPaymentRoundTrip(t, func(invoiceOptions wall.InvoiceOptions, lnClient wall.LNclient, storageClient wall.StorageClient) http.Handler {
+		app := fiber.New()
+		app.Use(wall.NewFiberMiddleware(invoiceOptions, lnClient, storageClient))
+		handler := func(ctx *fiber.Ctx) error {
+			return ctx.SendString(strconv.FormatInt(wall.AmountPaidFromContext(ctx.UserContext()), 10))
+		}
+		app.Get("/", handler)
+		app.Get("/expensive", handler)
+		// Fiber doesn't implement http.Handler, so the requests are sent via app.Test(...)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := app.Test(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			for key, values := range res.Header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(res.StatusCode)
+			body, _ := ioutil.ReadAll(res.Body)
+			w.Write(body)
+		})
+	})
+}
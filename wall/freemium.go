@@ -0,0 +1,91 @@
+package wall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FreeRequestsKeyPrefix is the prefix of the keys of the counters of free requests in the storage.
+// The colon isn't part of the Base64 alphabet, so the keys can't collide with preimages.
+const FreeRequestsKeyPrefix = "free-requests:"
+
+// CounterStorageClient is an optional extension of StorageClient for storage clients
+// that can count events per key in a time window, which is required for the FreeRequests option.
+// Increment must increase the counter of the given key by one and return the new count.
+// If the counter doesn't exist yet or has expired, it must start at 1 and expire after the given TTL.
+// Later increments must not extend the TTL, so that the window is fixed.
+// The increment must happen atomically, so that concurrent requests can't exceed the quota.
+// storage.GoMap, storage.RedisClient and storage.MemcacheClient implement it.
+type CounterStorageClient interface {
+	Increment(key string, ttl time.Duration) (count int64, err error)
+}
+
+// freemium counts the free requests of each client IP.
+type freemium struct {
+	counter CounterStorageClient
+	quota   int64
+	window  time.Duration
+}
+
+// newFreemium returns a freemium for the FreeRequests option.
+// A storage client that doesn't implement CounterStorageClient leads to a panic, because it's a configuration error
+// and ignoring it would lead to clients unexpectedly having to pay.
+func newFreemium(storageClient StorageClient, quota int64, window time.Duration) freemium {
+	counter, ok := storageClient.(CounterStorageClient)
+	if !ok {
+		panic(fmt.Sprintf("The FreeRequests option requires a storage client that implements CounterStorageClient, but %T doesn't", storageClient))
+	}
+	return freemium{
+		counter: counter,
+		quota:   quota,
+		window:  window,
+	}
+}
+
+// use counts a request of the given client IP and returns the number of free requests that are left after it.
+// isFree is false if the client has used up its quota, in which case remaining is 0.
+// Requests whose client IP is unknown are never free, because they can't be counted.
+func (f freemium) use(clientIP net.IP) (isFree bool, remaining int64, err error) {
+	if clientIP == nil {
+		return false, 0, nil
+	}
+	count, err := f.counter.Increment(FreeRequestsKeyPrefix+clientIP.String(), f.window)
+	if err != nil {
+		return false, 0, err
+	}
+	if count > f.quota {
+		return false, 0, nil
+	}
+	return true, f.quota - count, nil
+}
+
+// handleFreeRequest counts the request as free request of the client
+// and returns the result to pass it on to the next handler, if the client has free requests left.
+// Otherwise ok is false and the header with the remaining free requests (0) is returned,
+// for adding it to the response with the invoice.
+// If the counter can't be incremented, the request must be paid for, unless the FailurePolicy is FailOpen
+// and the context of the request isn't canceled or expired.
+func (p paywall) handleFreeRequest(ctx context.Context, clientIP net.IP) (res result, ok bool) {
+	isFree, remaining, err := p.freemium.use(clientIP)
+	if err != nil {
+		p.metrics.error("storage")
+		p.logger.Printf("Couldn't count the free requests of the client IP %v: %v\n", clientIP, err)
+		// Canceled or expired requests aren't let through, but lead to an invoice like with FailClosed
+		if res := p.applyFailurePolicy(ctx, result{}); res.ok {
+			return res, true
+		}
+		return result{}, false
+	}
+	res.header = http.Header{}
+	res.header.Set(p.invoiceOptions.FreeRequestsHeaderName, strconv.FormatInt(remaining, 10))
+	if !isFree {
+		return res, false
+	}
+	p.logger.Printf("The client IP %v has %v free requests left. Continuing to the next handler.\n", clientIP, remaining)
+	res.ok = true
+	return res, true
+}
@@ -0,0 +1,119 @@
+package wall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorInfoReason is the reason in the errdetails.ErrorInfo of the gRPC status
+// that the interceptor returns when the request doesn't contain a preimage.
+const ErrorInfoReason = "PAYMENT_REQUIRED"
+
+// ErrorInfoDomain is the domain in the errdetails.ErrorInfo of the gRPC status
+// that the interceptor returns when the request doesn't contain a preimage.
+const ErrorInfoDomain = "ln-paywall"
+
+// NewUnaryServerInterceptor returns a gRPC interceptor in the form of a grpc.UnaryServerInterceptor,
+// which you can pass to grpc.NewServer(...) via grpc.UnaryInterceptor(...).
+//
+// The preimage is read from the metadata of the incoming request,
+// with the lowercase HeaderName of the InvoiceOptions as key ("x-preimage" by default).
+// If it's missing, the interceptor returns a status with the code FailedPrecondition.
+// Its details contain an errdetails.ErrorInfo with the reason ErrorInfoReason
+// and the invoice as value of the "invoice" key in its metadata.
+// Use InvoiceFromError(...) on the client side to extract it.
+// After paying the invoice the client sends the request again, this time with the preimage in the metadata:
+//
+//	ctx = metadata.AppendToOutgoingContext(ctx, "x-preimage", preimage)
+//	res, err := client.SomeMethod(ctx, req)
+//
+// In L402 mode the metadata of the ErrorInfo also contains the macaroon as value of the "macaroon" key,
+// and the client can send the token in the "authorization" metadata instead.
+// An invalid preimage leads to the code InvalidArgument, an invalid L402 token to the code Unauthenticated
+// and an error during the check to the code Internal.
+// The PriceFunc and MemoFunc of the InvoiceOptions aren't used, because there's no HTTP request,
+// but RoutePrices can be used with full method names as keys.
+func NewUnaryServerInterceptor(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) grpc.UnaryServerInterceptor {
+	p := newPaywall(invoiceOptions, lnClient, storageClient)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		getHeader := func(key string) string {
+			// The keys of gRPC metadata are always lowercase, md.Get(...) takes care of that
+			if values := md.Get(key); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		}
+		var remoteAddr string
+		if pr, ok := peer.FromContext(ctx); ok {
+			remoteAddr = pr.Addr.String()
+		}
+		res := p.handleRequest(ctx, getHeader, noQueryParams, "", info.FullMethod, remoteAddr, nil)
+		if res.ok {
+			if len(res.header) > 0 {
+				header := metadata.MD{}
+				for key, values := range res.header {
+					header.Append(key, values...)
+				}
+				if err := grpc.SetHeader(ctx, header); err != nil {
+					p.logger.Printf("Couldn't set the gRPC header: %v\n", err)
+				}
+			}
+			return handler(withAmountPaid(ctx, res), req)
+		}
+		switch res.statusCode {
+		case http.StatusPaymentRequired:
+			errorInfo := &errdetails.ErrorInfo{
+				Reason: ErrorInfoReason,
+				Domain: ErrorInfoDomain,
+				Metadata: map[string]string{
+					"invoice": res.invoice,
+				},
+			}
+			if res.macaroon != "" {
+				errorInfo.Metadata["macaroon"] = res.macaroon
+			}
+			s, err := status.New(codes.FailedPrecondition, "Payment required").WithDetails(errorInfo)
+			if err != nil {
+				errorMsg := fmt.Sprintf("Couldn't add the invoice to the gRPC status: %+v", err)
+				p.logger.Printf("%v\n", errorMsg)
+				return nil, status.Error(codes.Internal, errorMsg)
+			}
+			return nil, s.Err()
+		case http.StatusBadRequest:
+			return nil, status.Error(codes.InvalidArgument, res.body)
+		case http.StatusUnauthorized:
+			return nil, status.Error(codes.Unauthenticated, res.body)
+		case http.StatusServiceUnavailable:
+			return nil, status.Error(codes.Unavailable, res.body)
+		default:
+			return nil, status.Error(codes.Internal, res.body)
+		}
+	}
+}
+
+// InvoiceFromError extracts the invoice from an error that a gRPC client received from a server
+// that uses the interceptor returned by NewUnaryServerInterceptor(...).
+// ok is false if the error doesn't contain an invoice.
+func InvoiceFromError(err error) (invoice string, ok bool) {
+	s, isStatus := status.FromError(err)
+	if !isStatus {
+		return "", false
+	}
+	for _, detail := range s.Details() {
+		if errorInfo, isErrorInfo := detail.(*errdetails.ErrorInfo); isErrorInfo &&
+			errorInfo.Reason == ErrorInfoReason && errorInfo.Domain == ErrorInfoDomain {
+			invoice, ok = errorInfo.Metadata["invoice"]
+			return invoice, ok
+		}
+	}
+	return "", false
+}
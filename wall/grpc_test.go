@@ -0,0 +1,94 @@
+package wall_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// amountPaidHealthServer is a gRPC health server that sends the paid amount of each request to the channel.
+type amountPaidHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	amountsPaid chan int64
+}
+
+func (s amountPaidHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	s.amountsPaid <- wall.AmountPaidFromContext(ctx)
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+// TestUnaryServerInterceptor tests the payment flow of a gRPC service with the interceptor:
+// Getting the invoice from the error, getting an error for an invalid preimage
+// and calling the service with the preimage of the paid invoice.
+func TestUnaryServerInterceptor(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	interceptor := wall.NewUnaryServerInterceptor(wall.InvoiceOptions{Price: 10}, lnClient, storage.NewGoMap())
+	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	amountsPaid := make(chan int64, 1)
+	grpc_health_v1.RegisterHealthServer(server, amountPaidHealthServer{amountsPaid: amountsPaid})
+	listener := bufconn.Listen(1024 * 1024)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	check := func(preimage string) error {
+		ctx := context.Background()
+		if preimage != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-preimage", preimage)
+		}
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+
+	err = check("")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected the code %v without preimage, but was %v (error: %v)", codes.FailedPrecondition, status.Code(err), err)
+	}
+	invoice, ok := wall.InvoiceFromError(err)
+	if !ok || invoice == "" {
+		t.Fatalf("Expected the error to contain an invoice, but it didn't: %v", err)
+	}
+	if _, err := ln.PaymentHashFromInvoice(invoice); err != nil {
+		t.Errorf("Expected a valid invoice in the error, but was %q (error: %v)", invoice, err)
+	}
+
+	err = check("invalid preimage")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected the code %v for an invalid preimage, but was %v (error: %v)", codes.InvalidArgument, status.Code(err), err)
+	}
+	if _, ok := wall.InvoiceFromError(err); ok {
+		t.Error("Expected the error for an invalid preimage not to contain an invoice")
+	}
+	if _, ok := wall.InvoiceFromError(errors.New("payment required")); ok {
+		t.Error("Expected an error that isn't a gRPC status not to contain an invoice")
+	}
+
+	preimage, err := lnClient.Pay(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = check(preimage); err != nil {
+		t.Fatalf("Expected the request with the preimage to succeed, but got the error %v", err)
+	}
+	if amountPaid := <-amountsPaid; amountPaid != 10 {
+		t.Errorf("Expected the paid amount 10 in the context of the handler, but was %v", amountPaid)
+	}
+}
@@ -0,0 +1,58 @@
+package wall
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// NewInvoiceHandler returns an http.HandlerFunc that only generates invoices, without protecting a resource.
+// This is useful for single-page apps that fetch an invoice from a dedicated endpoint like "/invoice",
+// display it, and send the request to the protected resource with the preimage after the user paid.
+// The protected resource must use a middleware with the same LN client and InvoiceOptions.
+//
+// A GET request leads to a response with the status code 200 and the invoice as JSON, for example:
+// {"invoice":"lnbc1...","amount":10,"payment_hash":"8d2c...","memo":"API call","expires_at":1700003600}
+// The expiry is a Unix timestamp in seconds, which is also contained in the header with the name InvoiceExpiryHeaderName.
+// Other methods are rejected with the status code 405.
+//
+// The price is determined the same way as in the middlewares. For RoutePrices the path of the protected resource
+// can be passed with the query parameter "path", for example "/invoice?path=/api/data",
+// otherwise the path of the request to this handler is used. The PriceFunc and MemoFunc get the request to this handler.
+// In L402 mode the response also contains the WWW-Authenticate header with the macaroon.
+// Errors always lead to the status code 500, no matter the FailurePolicy, because there's no resource to pass the request on to.
+func NewInvoiceHandler(invoiceOptions InvoiceOptions, lnClient LNclient) http.HandlerFunc {
+	invoiceOptions.FailurePolicy = FailClosed
+	// There's no resource that could be free
+	invoiceOptions.FreeRequests = 0
+	// The storage client is only required for checking preimages
+	p := newPaywall(invoiceOptions, lnClient, nil)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = r.URL.Path
+		}
+		price, _, err := getPrice(p.invoiceOptions, r.Method, path, r)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't determine the price: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			http.Error(w, errorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		res := p.generateInvoice(r.Context(), price, getMemo(p.invoiceOptions, r), ResponseFormatJSON)
+		if res.statusCode != http.StatusPaymentRequired {
+			writeResult(w, res)
+			return
+		}
+		// The response isn't a 402, so there's nothing to retry
+		res.header.Del("Retry-After")
+		setHeader(w, res)
+		w.Write([]byte(res.body))
+	}
+}
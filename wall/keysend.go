@@ -0,0 +1,138 @@
+package wall
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/philippgille/ln-paywall/ln"
+)
+
+// keysendNonces issues and verifies the nonces for keysend payments.
+// A nonce consists of 16 random bytes and the first 16 bytes of an HMAC-SHA256 of them, encoded as hex.
+// This way the middleware only accepts nonces it issued itself, without having to store them,
+// and not ones chosen by the client, which could belong to keysend payments that were made to the node
+// for another purpose, like a donation with a message in the same TLV record.
+type keysendNonces struct {
+	key []byte
+}
+
+const (
+	keysendRandomLength = 16
+	keysendNonceLength  = keysendRandomLength + 16
+)
+
+func newKeysendNonces(key []byte) keysendNonces {
+	if len(key) == 0 {
+		key = newRandomKey()
+	}
+	return keysendNonces{
+		key: key,
+	}
+}
+
+// issue returns a new hex encoded nonce.
+func (k keysendNonces) issue() (string, error) {
+	nonce := make([]byte, keysendRandomLength, keysendNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	nonce = append(nonce, k.sign(nonce)...)
+	return hex.EncodeToString(nonce), nil
+}
+
+// verify returns true if the hex encoded nonce was issued with the same key.
+func (k keysendNonces) verify(encodedNonce string) bool {
+	nonce, err := hex.DecodeString(encodedNonce)
+	if err != nil || len(nonce) != keysendNonceLength {
+		return false
+	}
+	// Constant time comparison to prevent timing attacks
+	return hmac.Equal(nonce[keysendRandomLength:], k.sign(nonce[:keysendRandomLength]))
+}
+
+func (k keysendNonces) sign(random []byte) []byte {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(random)
+	return mac.Sum(nil)[:keysendNonceLength-keysendRandomLength]
+}
+
+// KeysendLNclient is an optional extension of LNclient for clients that can receive keysend payments,
+// which is required for the Keysend option.
+// KeysendDestination must return the pubkey of the node and the type of the TLV record
+// in which the payer must send the nonce.
+// KeysendPayment must return the Base64 encoded preimage and the amount in Satoshis of the settled keysend payment
+// that contained the given hex encoded nonce in that TLV record, and ln.ErrInvoiceNotFound if there's no such payment.
+// ln.LNDclient implements it when its KeysendTLVType option is set.
+type KeysendLNclient interface {
+	KeysendDestination() (pubkey string, tlvType uint64, err error)
+	KeysendPayment(nonce string) (preimage string, amountPaid int64, err error)
+}
+
+// checkKeysendLNclient panics if the LN client doesn't implement KeysendLNclient,
+// because it's a configuration error and ignoring it would lead to clients paying for nothing.
+func checkKeysendLNclient(lnClient LNclient) KeysendLNclient {
+	keysendClient, ok := lnClient.(KeysendLNclient)
+	if !ok {
+		panic(fmt.Sprintf("The Keysend option requires an LN client that implements KeysendLNclient, but %T doesn't", lnClient))
+	}
+	return keysendClient
+}
+
+// setKeysendHeaders sets the headers with which a client can pay for the request with a keysend payment
+// instead of paying the invoice.
+func (p paywall) setKeysendHeaders(header http.Header, price int64) error {
+	pubkey, tlvType, err := p.lnClient.(KeysendLNclient).KeysendDestination()
+	if err != nil {
+		return err
+	}
+	nonce, err := p.keysend.issue()
+	if err != nil {
+		return err
+	}
+	header.Set(p.invoiceOptions.KeysendHeaderName, nonce)
+	header.Set("X-Keysend-Pubkey", pubkey)
+	header.Set("X-Keysend-TLV-Type", strconv.FormatUint(tlvType, 10))
+	header.Set("X-Keysend-Amount", strconv.FormatInt(price, 10))
+	return nil
+}
+
+// handleKeysend checks if the nonce was issued by the middleware and if a keysend payment with it was received,
+// and stores the preimage of the payment as used.
+// Returns the preimage of the payment, the paid amount, a string and an error.
+// The string contains detailed info about the result in case the nonce is invalid or no payment was received.
+// The error is only non-nil if an error occurs during the check, like in handlePreimage(...).
+func (p paywall) handleKeysend(ctx context.Context, nonce string, expectedAmount int64) (string, int64, string, error) {
+	if !p.keysend.verify(nonce) {
+		p.metrics.preimageRejected("invalid")
+		return "", 0, "The provided keysend nonce is invalid. It must be the nonce from the response with the invoice", nil
+	}
+	preimage, amountPaid, err := p.lnClient.(KeysendLNclient).KeysendPayment(strings.ToLower(nonce))
+	if err == ln.ErrInvoiceNotFound {
+		p.metrics.preimageRejected("not_found")
+		return "", 0, "No keysend payment was received for the provided nonce", nil
+	} else if err != nil {
+		p.metrics.error("ln")
+		return "", 0, "", err
+	}
+	if amountPaid < expectedAmount {
+		p.metrics.preimageRejected("insufficient_amount")
+		return "", 0, "The keysend payment for the provided nonce has a lower amount than the price of this endpoint", nil
+	}
+	wasNew, err := p.storePreimage(ctx, preimage, amountPaid)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if !wasNew {
+		p.metrics.preimageRejected("reused")
+		return "", 0, "The keysend payment for the provided nonce was already used in a previous request", nil
+	}
+	p.metrics.paymentVerified()
+	return preimage, amountPaid, "", nil
+}
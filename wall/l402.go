@@ -0,0 +1,121 @@
+package wall
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/philippgille/ln-paywall/ln"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// l402Location is the location of the macaroons that are minted in L402 mode.
+const l402Location = "ln-paywall"
+
+// l402IdentifierVersion is the version of the macaroon identifier.
+// The identifier has the same format as the one of Aperture:
+// 2 bytes version, 32 bytes payment hash, 32 bytes token ID.
+const l402IdentifierVersion = 0
+
+const l402IdentifierLength = 2 + sha256.Size + 32
+
+// l402 mints and verifies the macaroons of the L402 mode.
+type l402 struct {
+	rootKey []byte
+}
+
+func newL402(rootKey []byte) l402 {
+	if len(rootKey) == 0 {
+		rootKey = newRandomKey()
+	}
+	return l402{
+		rootKey: rootKey,
+	}
+}
+
+// mint creates a macaroon that's bound to the payment hash of the given invoice
+// and returns it in its Base64 encoded binary form.
+func (l l402) mint(invoice string) (string, error) {
+	paymentHash, err := ln.PaymentHashFromInvoice(invoice)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, l402IdentifierLength)
+	binary.BigEndian.PutUint16(id, l402IdentifierVersion)
+	copy(id[2:], paymentHash)
+	// A random token ID makes sure that two invoices with the same payment hash don't lead to the same macaroon
+	if _, err = rand.Read(id[2+sha256.Size:]); err != nil {
+		return "", err
+	}
+	m, err := macaroon.New(l.rootKey, id, l402Location, macaroon.LatestVersion)
+	if err != nil {
+		return "", err
+	}
+	macBytes, err := m.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(macBytes), nil
+}
+
+// verify checks the value of an "Authorization: L402 <macaroon>:<preimage>" header.
+// It returns the preimage in Base64, the way handlePreimage expects it.
+// The string is only non-empty if the token is invalid, in which case it contains the reason.
+// Whether the invoice is settled is not checked here, but in handlePreimage.
+func (l l402) verify(authHeader string) (preimage string, invalidTokenMsg string) {
+	token := strings.TrimSpace(authHeader[strings.Index(authHeader, " ")+1:])
+	parts := strings.Split(token, ":")
+	if len(parts) != 2 {
+		return "", "The L402 token must have the format <macaroon>:<preimage>"
+	}
+
+	macBytes, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		macBytes, err = base64.URLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return "", "The macaroon of the L402 token isn't valid Base64"
+		}
+	}
+	m := &macaroon.Macaroon{}
+	if err = m.UnmarshalBinary(macBytes); err != nil {
+		return "", "The macaroon of the L402 token can't be decoded"
+	}
+	// The minted macaroons don't contain any caveats, so all caveats that a client added are unknown.
+	// Caveats are restrictions, which is why unknown ones must lead to the macaroon being rejected.
+	err = m.Verify(l.rootKey, func(caveat string) error {
+		return fmt.Errorf("unsupported caveat: %v", caveat)
+	}, nil)
+	if err != nil {
+		return "", "The macaroon of the L402 token is invalid"
+	}
+	id := m.Id()
+	if len(id) != l402IdentifierLength || binary.BigEndian.Uint16(id) != l402IdentifierVersion {
+		return "", "The macaroon of the L402 token has an unknown identifier format"
+	}
+
+	preimageBytes, err := hex.DecodeString(parts[1])
+	if err != nil || len(preimageBytes) != 32 {
+		return "", "The preimage of the L402 token must be 32 bytes in hex"
+	}
+	hash := sha256.Sum256(preimageBytes)
+	if !bytes.Equal(hash[:], id[2:2+sha256.Size]) {
+		return "", "The preimage of the L402 token doesn't match the payment hash of the macaroon"
+	}
+	return base64.StdEncoding.EncodeToString(preimageBytes), ""
+}
+
+// isL402Header returns true if the given Authorization header value uses the L402 or the legacy LSAT scheme.
+func isL402Header(authHeader string) bool {
+	scheme := strings.ToUpper(strings.SplitN(authHeader, " ", 2)[0])
+	return (scheme == "L402" || scheme == "LSAT") && strings.Contains(authHeader, " ")
+}
+
+// l402Challenge returns the value for the WWW-Authenticate header.
+func l402Challenge(mac string, invoice string) string {
+	return fmt.Sprintf(`L402 macaroon="%v", invoice="%v"`, mac, invoice)
+}
@@ -0,0 +1,141 @@
+package wall
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+)
+
+// Metrics contains Prometheus collectors for the activity of the paywall.
+// Create it with NewMetrics(...), register it with your Prometheus registry
+// and pass it to the middleware via the Metrics field of the InvoiceOptions.
+// Metrics implements the prometheus.Collector interface, so it can be registered as a whole:
+//
+//	metrics := wall.NewMetrics("myservice")
+//	prometheus.MustRegister(metrics)
+//	invoiceOptions.Metrics = metrics
+type Metrics struct {
+	// Number of generated invoices
+	InvoicesGenerated prometheus.Counter
+	// Number of requests with a valid preimage
+	PaymentsVerified prometheus.Counter
+	// Number of requests with a rejected preimage, partitioned by the reason:
+	// "reused", "invalid", "not_found", "not_settled", "canceled" and "insufficient_amount"
+	PreimagesRejected *prometheus.CounterVec
+	// Number of errors when talking to the LN node or the storage, partitioned by the source: "ln" and "storage"
+	Errors *prometheus.CounterVec
+	// Duration of LNclient.CheckInvoice(...) calls in seconds
+	CheckInvoiceDuration prometheus.Histogram
+	// State of the circuit breaker around the LN client calls: 0 (closed), 1 (half-open) or 2 (open).
+	// Always 0 if the circuit breaker isn't enabled, see CircuitBreakerThreshold.
+	CircuitBreakerState prometheus.Gauge
+}
+
+// NewMetrics creates the collectors for the paywall metrics.
+// The namespace is the prefix of the metric names, for example "myservice" leads to "myservice_paywall_invoices_generated_total".
+// It can be empty.
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		InvoicesGenerated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "invoices_generated_total",
+			Help:      "Number of generated invoices",
+		}),
+		PaymentsVerified: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "payments_verified_total",
+			Help:      "Number of requests with a valid preimage",
+		}),
+		PreimagesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "preimages_rejected_total",
+			Help:      "Number of requests with a rejected preimage",
+		}, []string{"reason"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "errors_total",
+			Help:      "Number of errors when talking to the LN node or the storage",
+		}, []string{"source"}),
+		CheckInvoiceDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "check_invoice_duration_seconds",
+			Help:      "Duration of checking an invoice with the LN node",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		CircuitBreakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "paywall",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker around the LN node calls: 0 (closed), 1 (half-open) or 2 (open)",
+		}),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.InvoicesGenerated,
+		m.PaymentsVerified,
+		m.PreimagesRejected,
+		m.Errors,
+		m.CheckInvoiceDuration,
+		m.CircuitBreakerState,
+	}
+}
+
+// The following methods are nil-safe, so the paywall doesn't have to check if metrics are enabled.
+
+func (m *Metrics) invoiceGenerated() {
+	if m != nil {
+		m.InvoicesGenerated.Inc()
+	}
+}
+
+func (m *Metrics) paymentVerified() {
+	if m != nil {
+		m.PaymentsVerified.Inc()
+	}
+}
+
+func (m *Metrics) preimageRejected(reason string) {
+	if m != nil {
+		m.PreimagesRejected.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *Metrics) error(source string) {
+	if m != nil {
+		m.Errors.WithLabelValues(source).Inc()
+	}
+}
+
+func (m *Metrics) checkInvoiceDone(start time.Time) {
+	if m != nil {
+		m.CheckInvoiceDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) circuitBreakerStateChanged(state gobreaker.State) {
+	if m != nil {
+		m.CircuitBreakerState.Set(float64(state))
+	}
+}
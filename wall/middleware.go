@@ -1,16 +1,34 @@
 package wall
 
 import (
-	"log"
-	"os"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/skip2/go-qrcode"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// stdOutLogger logs to stdout, while the default log package loggers log to stderr.
-var stdOutLogger = log.New(os.Stdout, "", log.LstdFlags)
+// invoiceContentType is the Content-Type of a response that contains an invoice in its body.
+const invoiceContentType = "application/vnd.lightning.bolt11"
+
+// InvoiceExpiryHeaderName is the name of the header of a response with an invoice that contains
+// the Unix timestamp (in seconds) at which the invoice expires. The expiry is configured in the LN client,
+// for example with the Expiry of ln.LNDoptions.
+const InvoiceExpiryHeaderName = "X-Invoice-Expiry"
 
-// InvoiceOptions are the options for an invoice.
+// InvoiceOptions are the options for an invoice and for how the paywall handles requests.
 type InvoiceOptions struct {
 	// Amount of Satoshis you want to have paid for one API call.
 	// Values below 1 are automatically changed to the default value.
@@ -20,73 +38,1103 @@ type InvoiceOptions struct {
 	// for example: "API call to api.example.com".
 	// Optional ("" by default).
 	Memo string
+	// Function that determines the memo for a request,
+	// for example "Access to /reports on 2024-01-02 from 1.2.3.4".
+	// When set, it overrides Memo.
+	// Memos that are longer than the 639 bytes a BOLT11 invoice allows are trimmed.
+	// Not used by the gRPC interceptor.
+	// Optional (nil by default).
+	MemoFunc func(r *http.Request) string
+	// Function that determines the price (in Satoshis) for a request, for example based on the requested path.
+	// When set, it overrides Price, both for generating the invoice and for checking the paid amount.
+	// It's called for the request without preimage and again for the request with the preimage,
+	// so it must return the same price for both. Don't base it on values that differ between the two requests.
+	// Return values below 1 lead to Price being used.
+	// Not used by the gRPC interceptor.
+	// Optional (nil by default).
+	PriceFunc func(r *http.Request) int64
+	// Prices (in Satoshis) per request path, for example {"/cheap": 1, "/expensive": 1000}.
+	// Matching works like with the http.ServeMux: A key matches the exact path,
+	// but a key that ends with a slash matches all paths with that prefix, for example "/images/".
+	// The longest matching key wins.
+	// The keys are compared to the actual request path, not to route patterns of a router,
+	// so for a route with path parameters like "/users/:id" use the prefix "/users/".
+	// For the gRPC interceptor the keys are full method names, for example "/helloworld.Greeter/SayHello".
+	// Requests that don't match any key cost PriceUSD or Price. PriceFunc takes precedence over this.
+	// Values below 1 lead to Price being used.
+	// Optional (nil by default).
+	RoutePrices map[string]int64
+	// Prices (in Satoshis) per HTTP method, for example {"POST": 10, "PUT": 10, "DELETE": 10} for free reads and paid writes.
+	// When set, only requests with the methods in the map that have a price above 0 must be paid for.
+	// All other requests, including those with a price of 0, are passed on to the next handler without payment.
+	// For paid methods the matching price of RoutePrices takes precedence, so with both options set
+	// MethodPrices determines which requests are paid for and RoutePrices how much they cost,
+	// with the method price as fallback. PriceFunc takes precedence over both.
+	// The keys must be uppercase, like the method in the request is.
+	// Not used by the gRPC interceptor.
+	// Optional (nil by default).
+	MethodPrices map[string]int64
+	// HTTP methods of requests that are always passed on to the next handler without payment, for example "HEAD".
+	// By default these are CORS preflight requests ("OPTIONS"), which browsers send without the preimage header
+	// before the actual request, so the actual request would never be sent if they had to be paid for.
+	// To charge for all methods, set it to an empty slice.
+	// The methods must be uppercase, like the method in the request is.
+	// Not used by the gRPC interceptor.
+	// Optional ({"OPTIONS"} by default).
+	SkipMethods []string
+	// Price in US dollars, for example 0.01 for one cent.
+	// When set together with a RateProvider, it overrides Price.
+	// The amount of Satoshis is calculated with the current exchange rate when the invoice is generated.
+	// Because the exchange rate can change until the client sends the preimage,
+	// payments of at least 95% of the amount that's calculated at that time are accepted.
+	// Optional (0 by default).
+	PriceUSD float64
+	// Leads to amountless invoices ("pay what you want"), for which the payer's wallet lets the user choose the amount.
+	// The price (Price, PriceFunc, RoutePrices or PriceUSD) is then the minimum amount that must be paid,
+	// which is checked with the amount that was actually paid, not with the amount of the invoice.
+	// If the LN client implements AmountPaidLNclient, the next handler can get the amount that was actually paid
+	// with AmountPaid(...) and tailor the response to it, for example to let tips unlock more data.
+	// Not all LN clients support amountless invoices, for example ln.LNbitsClient doesn't.
+	// Optional (false by default).
+	AmountlessInvoices bool
+	// Provides the exchange rate for PriceUSD.
+	// See the rate package for an implementation.
+	// Optional (nil by default).
+	RateProvider RateProvider
+	// Enables the L402 (formerly known as LSAT) authentication mode.
+	// In addition to the invoice in the body, the response with the status code 402 then contains the header
+	// `WWW-Authenticate: L402 macaroon="...", invoice="..."`, with a macaroon that's bound to the payment hash of the invoice.
+	// After paying the invoice the client sends the header `Authorization: L402 <macaroon>:<preimage>`,
+	// with the macaroon in Base64 and the preimage in hex, like Aperture and other L402 clients do.
+	// The header with the name HeaderName is still accepted as well.
+	// Like the preimage in that header, a token can only be used for one request.
+	// Optional (false by default).
+	L402 bool
+	// Secret key for signing and verifying the macaroons in L402 mode.
+	// It should consist of at least 32 random bytes.
+	// If not set, a random key is generated when the middleware is created,
+	// which means that unused tokens become invalid when the web service restarts
+	// and that multiple instances of the web service don't accept each other's tokens.
+	// Optional (nil by default).
+	L402RootKey []byte
+	// Duration for which a single payment grants access.
+	// When set, the response to a request with a valid preimage contains a session token in the header
+	// with the name SessionHeaderName. Requests with a valid token in that header are passed on without
+	// payment until the token expires. After that the next request leads to a new invoice.
+	// The token is signed and contains its expiry time, so it doesn't need to be stored.
+	// It also contains the paid amount and is only accepted for requests that don't cost more,
+	// so paying for a cheap route or method doesn't grant access to an expensive one.
+	// Optional (0 by default, which means every request must be paid for).
+	SessionDuration time.Duration
+	// Secret key for signing and verifying the session tokens.
+	// It should consist of at least 32 random bytes.
+	// If not set, a random key is generated when the middleware is created,
+	// which means that sessions end when the web service restarts
+	// and that multiple instances of the web service don't accept each other's tokens.
+	// Optional (nil by default).
+	SessionKey []byte
+	// Name of the header in which the session token is sent, both in the response and in subsequent requests.
+	// Optional ("X-Session-Token" by default).
+	SessionHeaderName string
+	// Leads to preimages not being checked against and stored in the StorageClient,
+	// so that a preimage of a paid invoice can be used for any number of requests.
+	// The paywall then only checks if the invoice was paid, which saves the round-trip to the storage
+	// and makes it possible to pass nil as StorageClient, unless FreeRequests is set.
+	// Only enable this for endpoints where replays aren't a concern or if you prevent them elsewhere.
+	// The same applies to L402 tokens and keysend payments. The OnPaid function is called for each request then.
+	// The option is inverted so that the zero value of InvoiceOptions keeps the replay protection enabled.
+	// Optional (false by default, which means each preimage can only be used for one request).
+	AllowPreimageReuse bool
+	// Function that's called when a payment was verified, i.e. after a preimage was accepted for the first time
+	// and before the request is passed on to the next handler.
+	// This is the right place for side effects of a payment, like accounting, increasing a credit balance,
+	// sending an email or logging to analytics, because it's called exactly once per payment.
+	// It's called with the request, the Base64 encoded preimage and the amount in Satoshis,
+	// which is the same as the amount that AmountPaid(...) returns.
+	// It's called synchronously, so it delays the request. Start a goroutine for slow side effects.
+	// A panic in the function is recovered and logged, so the request is still passed on.
+	// For the gRPC interceptor the request is nil.
+	// Optional (nil by default).
+	OnPaid func(r *http.Request, preimage string, amount int64)
+	// Prometheus collectors that count the generated invoices, verified payments, rejected preimages and errors.
+	// See NewMetrics(...).
+	// Optional (nil by default, which means no metrics are collected).
+	Metrics *Metrics
+	// Format of the body of the response with the status code 402.
+	// Clients can request a different format with the Accept header: "application/vnd.lightning.bolt11"
+	// leads to ResponseFormatText, "application/json" to ResponseFormatJSON and "image/png" to ResponseFormatPNG.
+	// Wildcards like "*/*" don't select a format, so browsers get the format that's configured here.
+	// Not used by the gRPC interceptor.
+	// Optional (ResponseFormatText by default).
+	ResponseFormat ResponseFormat
+	// Width and height (in pixels) of the QR code image when ResponseFormatPNG is used.
+	// Optional (256 by default).
+	QRCodeSize int
+	// Function that creates the body of the response with the status code 402, for full control over the response,
+	// for example an HTML page with the invoice embedded and a "lightning:" link for paying in the browser.
+	// It's called with the invoice and the amount in Satoshis (with AmountlessInvoices it's the minimum amount)
+	// and returns the Content-Type and the body. An empty Content-Type is detected from the body.
+	// When set, it's used instead of the ResponseFormat, unless the client requests a format with the Accept header,
+	// so machine clients still get the invoice in the format they expect.
+	// The body is the client's only source of the invoice (except in L402 mode), so it must contain the invoice.
+	// Not used by the gRPC interceptor.
+	// Optional (nil by default).
+	ResponseTemplate func(invoice string, amount int64) (contentType string, body []byte)
+	// Time it usually takes a client to pay an invoice, which is sent in the Retry-After header
+	// of the response with the status code 402 (in seconds, rounded up).
+	// Generic HTTP clients and retry libraries that respect the header then retry the request after that time,
+	// by which the client should have paid and can send the preimage.
+	// A negative value leads to the header not being sent.
+	// Optional (5 seconds by default).
+	ExpectedPaymentTime time.Duration
+	// Name of the header in which the client sends the preimage.
+	// As always with HTTP headers, the name is case-insensitive.
+	// For the gRPC interceptor it's the key of the metadata, which is always lowercase.
+	// Optional ("X-Preimage" by default).
+	HeaderName string
+	// Parts of the request from which the preimage is read, in the order in which they're checked.
+	// The first source that contains a value is used, for example {PreimageSourceHeader, PreimageSourceAuthorization}
+	// for accepting both the header with the name HeaderName and `Authorization: Bearer <preimage>`.
+	// L402 tokens are always read from the Authorization header in L402 mode, independent of this option.
+	// Optional ({PreimageSourceHeader} by default).
+	PreimageSources []PreimageSource
+	// Name of the query parameter for PreimageSourceQuery.
+	// Optional ("preimage" by default).
+	PreimageQueryParam string
+	// Name of the cookie for PreimageSourceCookie.
+	// Optional ("preimage" by default).
+	PreimageCookieName string
+	// IP addresses and CIDR ranges of clients that don't need to pay,
+	// for example {"127.0.0.1", "10.0.0.0/8", "::1"} for internal monitoring and health checks.
+	// Requests from these clients are passed on to the next handler without an invoice being generated.
+	// An invalid entry leads to a panic when the middleware is created.
+	// Optional (nil by default).
+	Whitelist []string
+	// Leads to the client IP being taken from the X-Forwarded-For header instead of the remote address of the connection.
+	// Only the last address in the header is used, which is the one your reverse proxy added,
+	// because the addresses before it can be set by the client.
+	// Only enable this if the web service is only reachable via a reverse proxy that sets the header,
+	// otherwise clients can spoof their IP address to bypass the paywall.
+	// Optional (false by default).
+	TrustProxy bool
+	// Number of requests per client IP and FreeRequestsWindow that are passed on to the next handler without payment,
+	// for a free tier. Only after a client exceeds the quota the paywall responds with an invoice.
+	// The requests are counted in the StorageClient, which must implement CounterStorageClient,
+	// otherwise the creation of the middleware panics. With a shared storage like Redis the quota applies
+	// to all instances of the web service together.
+	// The counters are stored with the key "free-requests:<IP>", next to the preimages.
+	// The header with the name FreeRequestsHeaderName in the response contains the number of free requests left.
+	// Only requests that would have to be paid for count: Requests from clients in the Whitelist, with a valid API key,
+	// with a valid session token (see SessionDuration), of free methods (see MethodPrices and SkipMethods)
+	// and with a preimage don't use up the quota and don't get the header.
+	// The client IP is determined like for the Whitelist, so TrustProxy applies as well.
+	// If the counter can't be incremented, for example because the storage isn't reachable, the request must be paid for,
+	// unless the FailurePolicy is FailOpen.
+	// Not available for NewInvoiceHandler(...), which doesn't protect a resource.
+	// Optional (0 by default, which means every request must be paid for).
+	FreeRequests int
+	// Duration of the window in which the FreeRequests are counted. The window of a client starts with its first request.
+	// Optional (1 hour by default).
+	FreeRequestsWindow time.Duration
+	// Name of the header in which the response contains the number of free requests the client has left in the current window.
+	// Optional ("X-Free-Requests-Remaining" by default).
+	FreeRequestsHeaderName string
+	// Leads to the response with the status code 402 also containing the headers for paying with a keysend payment
+	// (a spontaneous payment without an invoice) instead of paying the invoice, which is still included:
+	// "X-Keysend-Pubkey" with the pubkey of the node, "X-Keysend-Amount" with the price in Satoshis,
+	// "X-Keysend-TLV-Type" with the type of the custom TLV record and the header with the name KeysendHeaderName
+	// with a nonce (hex encoded) that's signed with KeysendKey. The client sends a keysend payment of at least the amount
+	// to the node, with the nonce as value of the TLV record, and then sends the request again with the nonce in the same header.
+	// Only nonces issued by the middleware are accepted, not ones chosen by the client.
+	// Like a preimage, the payment can only be used for one request. It's stored as used with its preimage.
+	// The LN client must implement KeysendLNclient, otherwise the creation of the middleware panics.
+	// For ln.LNDclient the KeysendTLVType option must be set.
+	// Optional (false by default).
+	Keysend bool
+	// Name of the header in which the response contains the nonce for a keysend payment
+	// and in which the client sends the nonce after paying.
+	// Optional ("X-Keysend-Nonce" by default).
+	KeysendHeaderName string
+	// Secret key for signing and verifying the keysend nonces, so that only nonces issued by the middleware are accepted.
+	// It should consist of at least 32 random bytes.
+	// If not set, a random key is generated when the middleware is created,
+	// which means that nonces from before a restart of the web service can't be used anymore
+	// and that multiple instances of the web service don't accept each other's nonces.
+	// Optional (nil by default).
+	KeysendKey []byte
+	// API keys of trusted callers that don't need to pay, for example partners who pay out-of-band.
+	// Requests with one of these keys in the header with the name APIKeyHeaderName are passed on
+	// to the next handler without an invoice being generated.
+	// This is an alternative way of authorization for callers you know, not a replacement for the payment flow:
+	// Anyone who obtains a key can use the API for free, so treat the keys like passwords.
+	// The keys are compared in constant time.
+	// Optional (nil by default).
+	APIKeys []string
+	// Name of the header in which trusted callers send their API key.
+	// Optional ("X-API-Key" by default).
+	APIKeyHeaderName string
+	// Encoding of the preimage in the header with the name HeaderName and the other PreimageSources.
+	// With PreimageEncodingAuto both Base64 and hex are accepted, see ln.DecodePreimage(...) for how it's detected.
+	// Not relevant for L402 tokens, in which the preimage is always hex encoded.
+	// Optional (PreimageEncodingAuto by default).
+	PreimageEncoding PreimageEncoding
+	// Determines how requests are handled when the LN node, the storage or the RateProvider returns an error,
+	// for example because it can't be reached. See FailClosed and FailOpen.
+	// The error is logged in both cases.
+	// Requests whose context is canceled or whose deadline is exceeded are never let through,
+	// because then the error is most likely caused by the request, for example a gRPC client with a short deadline.
+	// Optional (FailClosed by default).
+	FailurePolicy FailurePolicy
+	// Number of consecutive failed calls to the LN client after which the circuit breaker opens.
+	// While it's open, requests that need the LN node aren't sent to it, but handled according to the FailurePolicy
+	// right away, so that requests don't pile up while the node is struggling or unreachable.
+	// After CircuitBreakerTimeout one call is let through to probe if the node recovered (half-open),
+	// which closes the circuit breaker again if it succeeds and opens it again if it fails.
+	// Errors that are caused by the request, like a preimage without invoice, don't count as failures.
+	// The state is reported via the CircuitBreakerState of the Metrics.
+	// Optional (0 by default, which means there's no circuit breaker).
+	CircuitBreakerThreshold int
+	// Duration for which the circuit breaker stays open before it lets a probe through.
+	// Optional (30 seconds by default).
+	CircuitBreakerTimeout time.Duration
+	// Provider of the OpenTelemetry tracer for spans around the calls to the LN client and the storage client,
+	// with the amount and the payment hash as attributes.
+	// The spans are children of the span in the context of the incoming request, if there is one,
+	// for example one that was started by otelhttp or otelgrpc.
+	// Optional (nil by default, which means no spans are created).
+	TracerProvider trace.TracerProvider
+	// Logger for info messages, like the sending of an invoice, and for errors.
+	// *log.Logger from the standard library implements the interface,
+	// for example log.New(os.Stdout, "", log.LstdFlags).
+	// Optional (ln.NoopLogger by default, which means nothing is logged).
+	Logger ln.Logger
+}
+
+// ResponseFormat is the format of the body of a response that contains an invoice.
+type ResponseFormat string
+
+const (
+	// ResponseFormatText leads to the invoice being the only content of the body,
+	// with the Content-Type "application/vnd.lightning.bolt11".
+	ResponseFormatText ResponseFormat = "text"
+	// ResponseFormatJSON leads to a JSON object in the body, with the Content-Type "application/json".
+	// Example: {"invoice":"lnbc...","amount":100,"payment_hash":"...","memo":"API call","expires_at":1700003600}
+	ResponseFormatJSON ResponseFormat = "json"
+	// ResponseFormatPNG leads to a PNG image of a QR code of the invoice in the body, with the Content-Type "image/png".
+	// This way the paywall can be used directly in a browser, and the invoice can be scanned with a mobile wallet.
+	// The QR code contains the invoice as uppercase "LIGHTNING:LNBC..." URI, which leads to a smaller QR code
+	// and is supported by all common wallets.
+	ResponseFormatPNG ResponseFormat = "png"
+	// responseFormatTemplate leads to the body being created by the ResponseTemplate of the InvoiceOptions.
+	// It's not exported, because it's selected by setting the ResponseTemplate.
+	responseFormatTemplate ResponseFormat = "template"
+)
+
+// PreimageEncoding is the encoding of the preimage that clients send.
+type PreimageEncoding string
+
+const (
+	// PreimageEncodingAuto leads to hex encoded preimages (64 characters) being accepted as well as Base64 encoded ones.
+	PreimageEncodingAuto PreimageEncoding = "auto"
+	// PreimageEncodingBase64 only accepts Base64 encoded preimages, like in previous versions.
+	PreimageEncodingBase64 PreimageEncoding = "base64"
+	// PreimageEncodingHex only accepts hex encoded preimages, like most wallets and lncli show them.
+	PreimageEncodingHex PreimageEncoding = "hex"
+)
+
+// FailurePolicy determines how requests are handled when a backend of the paywall returns an error.
+type FailurePolicy string
+
+const (
+	// FailClosed leads to requests being rejected with the status code 500 when a backend returns an error.
+	// No request gets through without payment, but during an outage of the LN node or the storage
+	// the web service isn't usable.
+	FailClosed FailurePolicy = "closed"
+	// FailOpen leads to requests being passed on to the next handler without payment when a backend returns an error.
+	// This keeps the web service usable during an outage of the LN node or the storage,
+	// for example for non-critical APIs where availability is more important than monetization.
+	// Invalid preimages are still rejected.
+	FailOpen FailurePolicy = "open"
+)
+
+// invoiceResponse is the body of a response with an invoice when ResponseFormatJSON is used.
+type invoiceResponse struct {
+	Invoice string `json:"invoice"`
+	// Amount in Satoshis. With AmountlessInvoices it's the minimum amount.
+	Amount int64 `json:"amount"`
+	// Payment hash in hex
+	PaymentHash string `json:"payment_hash"`
+	Memo        string `json:"memo"`
+	// Unix timestamp (in seconds) at which the invoice expires
+	ExpiresAt int64 `json:"expires_at"`
 }
 
 // DefaultInvoiceOptions provides default values for InvoiceOptions.
 var DefaultInvoiceOptions = InvoiceOptions{
-	Price: 1,
-	Memo:  "API call",
+	Price:                  1,
+	Memo:                   "API call",
+	ResponseFormat:         ResponseFormatText,
+	QRCodeSize:             256,
+	HeaderName:             "X-Preimage",
+	PreimageSources:        []PreimageSource{PreimageSourceHeader},
+	PreimageQueryParam:     "preimage",
+	PreimageCookieName:     "preimage",
+	SessionHeaderName:      "X-Session-Token",
+	PreimageEncoding:       PreimageEncodingAuto,
+	FailurePolicy:          FailClosed,
+	APIKeyHeaderName:       "X-API-Key",
+	SkipMethods:            []string{http.MethodOptions},
+	FreeRequestsWindow:     time.Hour,
+	CircuitBreakerTimeout:  30 * time.Second,
+	FreeRequestsHeaderName: "X-Free-Requests-Remaining",
+	KeysendHeaderName:      "X-Keysend-Nonce",
+	ExpectedPaymentTime:    5 * time.Second,
 }
 
 // StorageClient is an abstraction for different storage client implementations.
 // A storage client must only be able to check if a preimage was already used for a payment bofore
 // and to store a preimage that was used before.
+// SetIfNotUsed must check and store the preimage atomically and return true only if the preimage
+// wasn't stored before, so that a preimage can't be used for multiple concurrent requests.
+// Close is called by the user of the storage client, for example when the web service shuts down,
+// and must release all resources like files and connections.
 type StorageClient interface {
 	WasUsed(string) (bool, error)
-	SetUsed(string) error
+	SetIfNotUsed(string) (bool, error)
+	Close() error
 }
 
+// PaymentStorageClient is an optional extension of StorageClient for storage clients
+// that can also store the amount and time of a payment and report the revenue of a time window.
+// If the StorageClient also implements PaymentStorageClient, the middlewares call SetPaymentIfNotUsed
+// instead of SetIfNotUsed, with the price of the request (in Satoshis) as amount.
+// SetPaymentIfNotUsed has the same semantics as SetIfNotUsed.
+// Revenue must return the number of payments and their total amount in the time window,
+// including from and excluding to.
+// See NewRevenueHandler(...). storage.GoMap and storage.BoltClient implement it.
+type PaymentStorageClient interface {
+	SetPaymentIfNotUsed(preimage string, amount int64, paidAt time.Time) (bool, error)
+	Revenue(from, to time.Time) (count int64, total int64, err error)
+}
+
+// IterableStorageClient is an optional extension of StorageClient for storage clients
+// that can iterate over all stored preimages, which is required for storage.MigrateStorage(...).
+// ForEach must call the given function for each stored preimage that didn't expire yet,
+// and stop and return the error if the function returns one.
+// It must be possible to use the storage client from within the function.
+// All storage clients from the storage package except storage.MemcacheClient implement it.
+type IterableStorageClient interface {
+	ForEach(fn func(preimage string) error) error
+}
+
+// RateProvider is an abstraction for different sources of the exchange rate between Bitcoin and US dollars.
+// SatsPerUSD must return how many Satoshis one US dollar is worth.
+type RateProvider interface {
+	SatsPerUSD() (int64, error)
+}
+
+// fiatPriceTolerance is the fraction by which the paid amount may be lower than the price
+// when the price is calculated from PriceUSD.
+const fiatPriceTolerance = 0.05
+
 // LNclient is an abstraction of a client that connects to a Lightning Network node implementation (like lnd, c-lightning and eclair)
 // and provides the methods required by the paywall.
+// CheckInvoice must verify that at least the given amount (in Satoshis) was paid.
+// It should return ln.ErrInvoiceCanceled for invoices that were canceled or have expired,
+// so that the middleware responds with a new invoice instead of rejecting the preimage.
 type LNclient interface {
 	GenerateInvoice(int64, string) (string, error)
-	CheckInvoice(string) (bool, error)
+	CheckInvoice(string, int64) (bool, error)
+}
+
+// ContextLNclient is an optional extension of LNclient with methods that take a context.
+// If an LNclient also implements ContextLNclient, the middlewares call these methods with the context
+// of the incoming request, so that requests to the LN node are canceled when the client disconnects
+// and respect the deadline of the request.
+// ln.LNDclient implements it.
+type ContextLNclient interface {
+	GenerateInvoiceCtx(context.Context, int64, string) (string, error)
+	CheckInvoiceCtx(context.Context, string, int64) (bool, error)
+}
+
+// AmountPaidLNclient is an optional extension of LNclient for clients that can report how much was paid for an invoice.
+// With AmountlessInvoices the middlewares call CheckInvoicePaid instead of CheckInvoice,
+// check the minimum amount themselves and make the paid amount available via AmountPaid(...).
+// CheckInvoicePaid must return the amount in Satoshis that the payer actually sent,
+// and ln.ErrInvoiceCanceled for invoices that were canceled or have expired, like CheckInvoice.
+// ln.LNDclient and ln.FakeClient implement it.
+type AmountPaidLNclient interface {
+	CheckInvoicePaid(preimage string) (settled bool, amountPaid int64, err error)
+}
+
+// ContextAmountPaidLNclient is an optional extension of AmountPaidLNclient with a method that takes a context.
+// If an AmountPaidLNclient also implements it, the middlewares call CheckInvoicePaidCtx with the context
+// of the incoming request, like the methods of ContextLNclient.
+// ln.LNDclient implements it.
+type ContextAmountPaidLNclient interface {
+	CheckInvoicePaidCtx(ctx context.Context, preimage string) (settled bool, amountPaid int64, err error)
+}
+
+// paywall contains the logic that's the same for all middlewares, no matter which web framework is used.
+type paywall struct {
+	invoiceOptions InvoiceOptions
+	lnClient       LNclient
+	storageClient  StorageClient
+	l402           l402
+	session        session
+	keysend        keysendNonces
+	whitelist      whitelist
+	freemium       freemium
+	apiKeys        apiKeys
+	metrics        *Metrics
+	breaker        *gobreaker.CircuitBreaker
+	tracer         trace.Tracer
+	logger         ln.Logger
+}
+
+func newPaywall(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) paywall {
+	invoiceOptions = assignDefaultValues(invoiceOptions)
+	result := paywall{
+		invoiceOptions: invoiceOptions,
+		lnClient:       lnClient,
+		storageClient:  storageClient,
+		metrics:        invoiceOptions.Metrics,
+		tracer:         newTracer(invoiceOptions.TracerProvider),
+		logger:         invoiceOptions.Logger,
+	}
+	if invoiceOptions.L402 {
+		result.l402 = newL402(invoiceOptions.L402RootKey)
+	}
+	if invoiceOptions.SessionDuration > 0 {
+		result.session = newSession(invoiceOptions.SessionKey, invoiceOptions.SessionDuration)
+	}
+	if len(invoiceOptions.Whitelist) > 0 {
+		result.whitelist = newWhitelist(invoiceOptions.Whitelist)
+	}
+	if invoiceOptions.FreeRequests > 0 {
+		result.freemium = newFreemium(storageClient, int64(invoiceOptions.FreeRequests), invoiceOptions.FreeRequestsWindow)
+	}
+	if len(invoiceOptions.APIKeys) > 0 {
+		result.apiKeys = newAPIKeys(invoiceOptions.APIKeys)
+	}
+	if invoiceOptions.Keysend {
+		checkKeysendLNclient(lnClient)
+		result.keysend = newKeysendNonces(invoiceOptions.KeysendKey)
+	}
+	if invoiceOptions.CircuitBreakerThreshold > 0 {
+		result.breaker = newCircuitBreaker(uint32(invoiceOptions.CircuitBreakerThreshold), invoiceOptions.CircuitBreakerTimeout, invoiceOptions.Metrics, invoiceOptions.Logger)
+	}
+	return result
+}
+
+// newRandomKey returns 32 random bytes for signing tokens.
+func newRandomKey() []byte {
+	key := make([]byte, 32)
+	// Without a random key the tokens could be forged, so there's no sensible way to continue
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Couldn't generate a random key: %v", err))
+	}
+	return key
+}
+
+// result is the outcome of handling a request.
+type result struct {
+	// ok is true if the request was paid for and must be passed on to the next handler.
+	// Only the header and the amountPaid are relevant then, all other fields are only relevant if ok is false.
+	ok bool
+	// Amount in Satoshis that was paid with the preimage of the request.
+	// 0 if the request didn't need to be paid for, for example because of a session token.
+	amountPaid int64
+	// Status code of the response
+	statusCode int
+	// Headers to set in the response. The Content-Type is only set for responses with an invoice.
+	// Must also be set in the response of the next handler if ok is true.
+	header http.Header
+	// Body of the response
+	body string
+	// Only set if an invoice was generated
+	invoice string
+	// Only set in L402 mode if an invoice was generated
+	macaroon string
+	// Only set in case of an internal server error
+	err error
+}
+
+// handleRequest checks if the request contains a valid payment proof and generates an invoice if it doesn't.
+// ctx is the context of the request.
+// getHeader must return the value of the request header with the given name.
+// getQueryParam must return the value of the query parameter with the given name.
+// method is the HTTP method of the request, empty for gRPC.
+// path is the request path, or the full method name for gRPC.
+// remoteAddr is the address of the client connection, with or without port.
+// r can be nil if there's no HTTP request or converting it isn't necessary. The PriceFunc and MemoFunc aren't used then.
+func (p paywall) handleRequest(ctx context.Context, getHeader func(string) string, getQueryParam func(string) string, method string, path string, remoteAddr string, r *http.Request) result {
+	if isSkippedMethod(p.invoiceOptions, method) {
+		p.logger.Printf("Requests with the method %v are skipped. Continuing to the next handler.\n", method)
+		return result{ok: true}
+	}
+	if len(p.whitelist) > 0 {
+		if clientIP := getClientIP(remoteAddr, getHeader, p.invoiceOptions.TrustProxy); p.whitelist.contains(clientIP) {
+			p.logger.Printf("The client IP %v is whitelisted. Continuing to the next handler.\n", clientIP)
+			return result{ok: true}
+		}
+	}
+	if len(p.apiKeys) > 0 && p.apiKeys.contains(getHeader(p.invoiceOptions.APIKeyHeaderName)) {
+		p.logger.Printf("The provided API key is valid. Continuing to the next handler.\n")
+		return result{ok: true}
+	}
+
+	if isFreeMethod(p.invoiceOptions, method) {
+		p.logger.Printf("Requests with the method %v are free. Continuing to the next handler.\n", method)
+		return result{ok: true}
+	}
+
+	price, isFiatPrice, err := getPrice(p.invoiceOptions, method, path, r)
+	if err != nil {
+		errorMsg := fmt.Sprintf("Couldn't determine the price: %+v", err)
+		p.logger.Printf("%v\n", errorMsg)
+		return p.applyFailurePolicy(ctx, result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err})
+	}
+
+	// The exchange rate can change between generating the invoice and checking it
+	expectedAmount := price
+	if isFiatPrice {
+		expectedAmount = int64(math.Floor(float64(price) * (1 - fiatPriceTolerance)))
+	}
+
+	if sessionToken := getHeader(p.invoiceOptions.SessionHeaderName); p.invoiceOptions.SessionDuration > 0 && sessionToken != "" {
+		// An invalid or expired token or one for a lower amount doesn't lead to an error, but to the usual payment flow
+		if p.session.verify(sessionToken, expectedAmount) {
+			p.logger.Printf("The provided session token is valid. Continuing to the next handler.\n")
+			return result{ok: true}
+		}
+	}
+
+	if nonce := getHeader(p.invoiceOptions.KeysendHeaderName); p.invoiceOptions.Keysend && nonce != "" {
+		preimage, amountPaid, invalidNonceMsg, err := p.handleKeysend(ctx, nonce, expectedAmount)
+		if err != nil {
+			errorMsg := fmt.Sprintf("An error occurred during checking the keysend payment: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			return p.applyFailurePolicy(ctx, result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err})
+		} else if invalidNonceMsg != "" {
+			p.logger.Printf("%v\n", invalidNonceMsg)
+			return result{statusCode: http.StatusBadRequest, body: invalidNonceMsg}
+		}
+		p.logger.Printf("The keysend payment for the provided nonce is valid. Continuing to the next handler.\n")
+		return p.paid(r, preimage, amountPaid)
+	}
+
+	var preimage string
+	if authHeader := getHeader("Authorization"); p.invoiceOptions.L402 && isL402Header(authHeader) {
+		var invalidTokenMsg string
+		preimage, invalidTokenMsg = p.l402.verify(authHeader)
+		if invalidTokenMsg != "" {
+			p.logger.Printf("%v\n", invalidTokenMsg)
+			return result{statusCode: http.StatusUnauthorized, body: invalidTokenMsg}
+		}
+	} else {
+		// Check if the request contains the preimage that we need to check if the requester paid
+		preimage = p.getPreimage(getHeader, getQueryParam)
+		var invalidEncodingMsg string
+		preimage, invalidEncodingMsg = p.normalizePreimage(preimage)
+		if invalidEncodingMsg != "" {
+			p.metrics.preimageRejected("invalid")
+			p.logger.Printf("%v\n", invalidEncodingMsg)
+			return result{statusCode: http.StatusBadRequest, body: invalidEncodingMsg}
+		}
+	}
+	if preimage == "" {
+		if p.invoiceOptions.FreeRequests <= 0 {
+			return p.generateInvoice(ctx, price, getMemo(p.invoiceOptions, r), p.getResponseFormat(getHeader("Accept")))
+		}
+		freeRes, ok := p.handleFreeRequest(ctx, getClientIP(remoteAddr, getHeader, p.invoiceOptions.TrustProxy))
+		if ok {
+			return freeRes
+		}
+		res := p.generateInvoice(ctx, price, getMemo(p.invoiceOptions, r), p.getResponseFormat(getHeader("Accept")))
+		// Let the client know that it has no free requests left
+		if res.header != nil {
+			for key, values := range freeRes.header {
+				res.header[key] = values
+			}
+		}
+		return res
+	}
+
+	// The preimage is a secret that grants access, so only its hash is logged
+	preimageHash, _ := ln.HashPreimage(preimage)
+
+	// Check if the provided preimage belongs to a settled API payment invoice and that it wasn't already used. Also store used preimages.
+	amountPaid, invalidPreimageMsg, err := p.handlePreimage(ctx, preimage, price, expectedAmount)
+	if err == ln.ErrInvoiceCanceled {
+		// The client can't pay the invoice anymore, so instead of rejecting the preimage it gets a new invoice
+		p.logger.Printf("The invoice of the provided preimage was canceled or has expired, sending a new one. Preimage hash: %v\n", preimageHash)
+		return p.generateInvoice(ctx, price, getMemo(p.invoiceOptions, r), p.getResponseFormat(getHeader("Accept")))
+	} else if err != nil {
+		errorMsg := fmt.Sprintf("An error occurred during checking the preimage: %+v", err)
+		p.logger.Printf("%v\n", errorMsg)
+		return p.applyFailurePolicy(ctx, result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err})
+	} else if invalidPreimageMsg != "" {
+		p.logger.Printf("%v. Preimage hash: %v\n", invalidPreimageMsg, preimageHash)
+		return result{statusCode: http.StatusBadRequest, body: invalidPreimageMsg}
+	}
+	p.logger.Printf("The provided preimage is valid. Continuing to the next handler. Preimage hash: %v\n", preimageHash)
+	return p.paid(r, preimage, amountPaid)
+}
+
+// paid returns the result for a request that was paid for with the given preimage,
+// after calling the OnPaid function and issuing a session token if they're configured.
+func (p paywall) paid(r *http.Request, preimage string, amountPaid int64) result {
+	if p.invoiceOptions.OnPaid != nil {
+		p.callOnPaid(r, preimage, amountPaid)
+	}
+	res := result{ok: true, amountPaid: amountPaid}
+	if p.invoiceOptions.SessionDuration > 0 {
+		sessionToken, err := p.session.issue(amountPaid)
+		if err != nil {
+			// The request was paid for, so it's passed on nevertheless
+			p.logger.Printf("Couldn't create the session token: %v\n", err)
+		} else {
+			res.header = http.Header{}
+			res.header.Set(p.invoiceOptions.SessionHeaderName, sessionToken)
+		}
+	}
+	return res
+}
+
+// callOnPaid calls the OnPaid function and recovers from a panic in it,
+// because the request was paid for and must be passed on nevertheless.
+func (p paywall) callOnPaid(r *http.Request, preimage string, amount int64) {
+	defer func() {
+		if err := recover(); err != nil {
+			p.logger.Printf("The OnPaid function panicked: %v\n", err)
+		}
+	}()
+	p.invoiceOptions.OnPaid(r, preimage, amount)
+}
+
+// normalizePreimage converts the preimage to the canonical Base64 encoding of its 32 bytes,
+// depending on the PreimageEncoding.
+// All LN clients and storage clients get the preimage in canonical Base64,
+// so that the same preimage can't be used twice by sending it in different encodings.
+// This includes different spellings of the same bytes in Base64, because the base64 package accepts
+// line breaks and non-zero padding bits, which the LN clients would accept as well.
+// The returned message is only set if the preimage isn't encoded as the PreimageEncoding requires.
+// Invalid encodings are rejected here, before the storage and LN clients are called,
+// so that they're all rejected in the same way and the response doesn't depend on any lookup.
+func (p paywall) normalizePreimage(preimage string) (string, string) {
+	if preimage == "" {
+		return "", ""
+	}
+	var decodedPreimage []byte
+	var err error
+	switch p.invoiceOptions.PreimageEncoding {
+	case PreimageEncodingHex:
+		decodedPreimage, err = hex.DecodeString(preimage)
+		if err != nil {
+			return preimage, "The provided preimage contains invalid hex characters"
+		}
+	case PreimageEncodingBase64:
+		// The LN clients would accept it, but then the same preimage could be used again in Base64
+		if ln.IsHexPreimage(preimage) {
+			return preimage, "The provided preimage must be Base64 encoded, not hex"
+		}
+		fallthrough
+	default:
+		decodedPreimage, err = ln.DecodePreimage(preimage)
+		if err != nil {
+			return preimage, "The provided preimage contains invalid Base64 characters"
+		}
+	}
+	if len(decodedPreimage) != 32 {
+		return preimage, "The provided preimage must have 32 bytes"
+	}
+	return base64.StdEncoding.EncodeToString(decodedPreimage), ""
+}
+
+// applyFailurePolicy returns the given result of a failed backend call if the FailurePolicy is FailClosed,
+// and a result that lets the request through if it's FailOpen.
+// If the context of the request is canceled or its deadline is exceeded, the result is always returned,
+// because then the backend call most likely failed because of the request and not because of the backend,
+// and a client must not be able to get access by canceling its request or setting a short deadline.
+func (p paywall) applyFailurePolicy(ctx context.Context, res result) result {
+	if ctx.Err() != nil {
+		return res
+	}
+	if p.invoiceOptions.FailurePolicy == FailOpen {
+		p.logger.Printf("Continuing to the next handler without payment, because the failure policy is %v\n", FailOpen)
+		return result{ok: true}
+	}
+	return res
+}
+
+// generateInvoice generates an invoice for the given price and returns the result with the status code 402.
+// The body of the result has the given format.
+func (p paywall) generateInvoice(ctx context.Context, price int64, memo string, format ResponseFormat) result {
+	memo = ln.TrimMemo(memo)
+	// The price is the minimum amount then, which is checked when the preimage is sent
+	amount := price
+	if p.invoiceOptions.AmountlessInvoices {
+		amount = 0
+	}
+	spanCtx, span := p.startSpan(ctx, "LNclient.GenerateInvoice", attributeAmount.Int64(amount))
+	var invoice string
+	err := p.callLN(func() error {
+		var err error
+		if lnClient, ok := p.lnClient.(ContextLNclient); ok {
+			invoice, err = lnClient.GenerateInvoiceCtx(spanCtx, amount, memo)
+		} else {
+			invoice, err = p.lnClient.GenerateInvoice(amount, memo)
+		}
+		return err
+	})
+	if err == nil {
+		if paymentHash, hashErr := ln.PaymentHashFromInvoice(invoice); hashErr == nil {
+			span.SetAttributes(attributePaymentHash.String(hex.EncodeToString(paymentHash)))
+		}
+	}
+	endSpan(span, err)
+	if err == ln.ErrInsufficientInboundLiquidity {
+		// Not an error of the LN node, but the client couldn't pay the invoice anyway
+		errorMsg := "The Lightning Network node of this web service can't receive payments at the moment, please try again later"
+		p.logger.Printf("Couldn't generate invoice: %v\n", err)
+		return result{statusCode: http.StatusServiceUnavailable, body: errorMsg, err: err}
+	} else if err != nil {
+		p.metrics.error("ln")
+		errorMsg := fmt.Sprintf("Couldn't generate invoice: %+v", err)
+		p.logger.Printf("%v\n", errorMsg)
+		return p.applyFailurePolicy(ctx, result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err})
+	}
+	res := result{
+		statusCode: http.StatusPaymentRequired,
+		header:     http.Header{},
+		// The actual invoice goes into the body
+		body:    invoice,
+		invoice: invoice,
+	}
+	res.header.Set("Content-Type", invoiceContentType)
+	// Lets clients know when to stop waiting for the payment and request a new invoice
+	if expiresAt, err := ln.ExpiryFromInvoice(invoice); err == nil {
+		res.header.Set(InvoiceExpiryHeaderName, strconv.FormatInt(expiresAt.Unix(), 10))
+	}
+	// Lets generic HTTP clients know when to retry the request, by which it should be paid
+	if p.invoiceOptions.ExpectedPaymentTime > 0 {
+		res.header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(p.invoiceOptions.ExpectedPaymentTime.Seconds())), 10))
+	}
+	switch format {
+	case ResponseFormatJSON:
+		res.body, err = jsonBody(invoice, price, memo)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't create the JSON response: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			return result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err}
+		}
+		res.header.Set("Content-Type", "application/json")
+	case ResponseFormatPNG:
+		res.body, err = pngBody(invoice, p.invoiceOptions.QRCodeSize)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't create the QR code: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			return result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err}
+		}
+		res.header.Set("Content-Type", "image/png")
+	case responseFormatTemplate:
+		contentType, body := p.invoiceOptions.ResponseTemplate(invoice, price)
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		res.body = string(body)
+		res.header.Set("Content-Type", contentType)
+	}
+	if p.invoiceOptions.Keysend {
+		if err = p.setKeysendHeaders(res.header, price); err != nil {
+			// The invoice can still be paid, so the response is sent without the keysend headers
+			p.logger.Printf("Couldn't get the keysend destination: %v\n", err)
+		}
+	}
+	if p.invoiceOptions.L402 {
+		res.macaroon, err = p.l402.mint(invoice)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't create the L402 macaroon: %+v", err)
+			p.logger.Printf("%v\n", errorMsg)
+			return result{statusCode: http.StatusInternalServerError, body: errorMsg, err: err}
+		}
+		res.header.Set("WWW-Authenticate", l402Challenge(res.macaroon, invoice))
+	}
+	p.metrics.invoiceGenerated()
+	p.logger.Printf("Sending invoice in response: %v", invoice)
+	return res
+}
+
+// jsonBody returns the body of a response with an invoice in JSON format.
+func jsonBody(invoice string, price int64, memo string) (string, error) {
+	paymentHash, err := ln.PaymentHashFromInvoice(invoice)
+	if err != nil {
+		return "", err
+	}
+	expiresAt, err := ln.ExpiryFromInvoice(invoice)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(invoiceResponse{
+		Invoice:     invoice,
+		Amount:      price,
+		PaymentHash: hex.EncodeToString(paymentHash),
+		Memo:        memo,
+		ExpiresAt:   expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// pngBody returns the body of a response with an invoice as PNG image of a QR code.
+func pngBody(invoice string, size int) (string, error) {
+	// Uppercase letters allow the alphanumeric mode of QR codes, which leads to a smaller QR code
+	png, err := qrcode.Encode(strings.ToUpper("lightning:"+invoice), qrcode.Medium, size)
+	if err != nil {
+		return "", err
+	}
+	return string(png), nil
+}
+
+// responseFormatMediaTypes maps the media types of the Accept header to the response formats.
+var responseFormatMediaTypes = map[string]ResponseFormat{
+	invoiceContentType: ResponseFormatText,
+	"application/json": ResponseFormatJSON,
+	"image/png":        ResponseFormatPNG,
+}
+
+// getResponseFormat returns the response format that the client requested via the given Accept header.
+// Of the media types that correspond to a format, the one with the highest quality value wins.
+// If the header doesn't contain any of them, responseFormatTemplate is returned if a ResponseTemplate is configured,
+// and the configured ResponseFormat otherwise.
+func (p paywall) getResponseFormat(accept string) ResponseFormat {
+	result := p.invoiceOptions.ResponseFormat
+	if p.invoiceOptions.ResponseTemplate != nil {
+		result = responseFormatTemplate
+	}
+	bestQuality := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		format, ok := responseFormatMediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > bestQuality {
+			result = format
+			bestQuality = quality
+		}
+	}
+	return result
+}
+
+// getPrice returns the price for the given request.
+// It's the result of the PriceFunc if one is set and the result is valid,
+// otherwise the matching price of RoutePrices, the price of the method in MethodPrices, the converted PriceUSD or the static Price.
+// isFiatPrice is true if the price was converted from PriceUSD.
+func getPrice(invoiceOptions InvoiceOptions, method string, path string, r *http.Request) (price int64, isFiatPrice bool, err error) {
+	if invoiceOptions.PriceFunc != nil && r != nil {
+		if price := invoiceOptions.PriceFunc(r); price > 0 {
+			return price, false, nil
+		}
+	}
+	if price, ok := getRoutePrice(invoiceOptions, path); ok {
+		return price, false, nil
+	}
+	if price := invoiceOptions.MethodPrices[method]; price > 0 {
+		return price, false, nil
+	}
+	if invoiceOptions.PriceUSD > 0 && invoiceOptions.RateProvider != nil {
+		satsPerUSD, err := invoiceOptions.RateProvider.SatsPerUSD()
+		if err != nil {
+			return 0, false, err
+		}
+		price := int64(math.Ceil(invoiceOptions.PriceUSD * float64(satsPerUSD)))
+		if price < 1 {
+			price = 1
+		}
+		return price, true, nil
+	}
+	return invoiceOptions.Price, false, nil
 }
 
-// handlePreimage does four things:
+// getMemo returns the memo for the given request.
+// It's the result of the MemoFunc if one is set, otherwise the static Memo.
+func getMemo(invoiceOptions InvoiceOptions, r *http.Request) string {
+	if invoiceOptions.MemoFunc != nil && r != nil {
+		return invoiceOptions.MemoFunc(r)
+	}
+	return invoiceOptions.Memo
+}
+
+// isSkippedMethod returns true if the method is one of the SkipMethods.
+// An empty method, like for gRPC, is never skipped.
+func isSkippedMethod(invoiceOptions InvoiceOptions, method string) bool {
+	for _, skipMethod := range invoiceOptions.SkipMethods {
+		if method == skipMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// isFreeMethod returns true if MethodPrices is set and doesn't contain a price above 0 for the method.
+// An empty method, like for gRPC, is never free.
+func isFreeMethod(invoiceOptions InvoiceOptions, method string) bool {
+	if len(invoiceOptions.MethodPrices) == 0 || method == "" {
+		return false
+	}
+	return invoiceOptions.MethodPrices[method] <= 0
+}
+
+// getRoutePrice returns the price of the longest key in RoutePrices that matches the given path.
+// ok is false if there's no match.
+func getRoutePrice(invoiceOptions InvoiceOptions, path string) (price int64, ok bool) {
+	if price, ok := invoiceOptions.RoutePrices[path]; ok {
+		return price, price > 0
+	}
+	var longestPrefix string
+	for key := range invoiceOptions.RoutePrices {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(path, key) && len(key) > len(longestPrefix) {
+			longestPrefix = key
+		}
+	}
+	if price := invoiceOptions.RoutePrices[longestPrefix]; longestPrefix != "" && price > 0 {
+		return price, true
+	}
+	return 0, false
+}
+
+// handlePreimage does five things:
 // 1) Checks if the preimage was already used as a payment proof before.
 // 2) Checks if the preimage corresponds to an existing invoice on the connected LN node.
 // 3) Checks if the corresponding invoice was settled.
-// 4) Store the preimage to the storage for future checks.
-// Returns a string and an error.
+// 4) Checks if at least the expected amount was paid.
+// 5) Store the preimage to the storage for future checks.
+// If the storage client implements PaymentStorageClient, the paid amount is stored along with the preimage.
+// With AllowPreimageReuse 1) and 5) are skipped.
+// Returns the paid amount, a string and an error.
+// The paid amount is the price, unless it's reported by an AmountPaidLNclient with AmountlessInvoices.
 // The string contains detailed info about the result in case the preimage is invalid.
-// The error is only non-nil if an error occurs during the check (like the LN node can't be reached).
+// The error is only non-nil if an error occurs during the check (like the LN node can't be reached),
+// or if the invoice was canceled or has expired, in which case it's ln.ErrInvoiceCanceled.
 // The preimage is only valid if the string is empty and the error is nil.
-func handlePreimage(preimage string, storageClient StorageClient, lnClient LNclient) (string, error) {
+func (p paywall) handlePreimage(ctx context.Context, preimage string, price int64, expectedAmount int64) (int64, string, error) {
+	paymentHash := paymentHashAttribute(preimage)
+
 	// Check if it was already used before
-	wasUsed, err := storageClient.WasUsed(preimage)
-	if err != nil {
-		return "", err
-	}
-	if wasUsed {
-		// Key was found, which means the payment was already used for an API call.
-		return "The provided preimage was already used in a previous request", nil
+	if !p.invoiceOptions.AllowPreimageReuse {
+		_, span := p.startSpan(ctx, "StorageClient.WasUsed", paymentHash)
+		wasUsed, err := p.storageClient.WasUsed(preimage)
+		endSpan(span, err)
+		if err != nil {
+			p.metrics.error("storage")
+			return 0, "", err
+		}
+		if wasUsed {
+			// Key was found, which means the payment was already used for an API call.
+			p.metrics.preimageRejected("reused")
+			return 0, "The provided preimage was already used in a previous request", nil
+		}
 	}
 
 	// Check if a corresponding invoice exists and is settled
-	settled, err := lnClient.CheckInvoice(preimage)
+	start := time.Now()
+	spanCtx, span := p.startSpan(ctx, "LNclient.CheckInvoice", paymentHash, attributeAmount.Int64(expectedAmount))
+	var settled bool
+	amountPaid := price
+	err := p.callLN(func() error {
+		var err error
+		if lnClient, ok := p.lnClient.(AmountPaidLNclient); ok && p.invoiceOptions.AmountlessInvoices {
+			if ctxClient, ok := p.lnClient.(ContextAmountPaidLNclient); ok {
+				settled, amountPaid, err = ctxClient.CheckInvoicePaidCtx(spanCtx, preimage)
+			} else {
+				settled, amountPaid, err = lnClient.CheckInvoicePaid(preimage)
+			}
+			if err == nil && settled && amountPaid < expectedAmount {
+				err = ln.ErrInsufficientAmount
+			}
+		} else if lnClient, ok := p.lnClient.(ContextLNclient); ok {
+			settled, err = lnClient.CheckInvoiceCtx(spanCtx, preimage, expectedAmount)
+		} else {
+			settled, err = p.lnClient.CheckInvoice(preimage, expectedAmount)
+		}
+		return err
+	})
+	endSpan(span, err)
+	p.metrics.checkInvoiceDone(start)
 	if err != nil {
 		// Returning a non-nil error leads to an "internal server error", but in some cases it's a "bad request".
 		// TODO: Both checks should be done in a more robust and elegant way
 		if reflect.TypeOf(err).Name() == "CorruptInputError" {
-			return "The provided preimage contains invalid Base64 characters", nil
+			p.metrics.preimageRejected("invalid")
+			return 0, "The provided preimage contains invalid Base64 characters", nil
 		} else if strings.Contains(err.Error(), "unable to locate invoice") {
-			return "No corresponding invoice was found for the provided preimage", nil
+			p.metrics.preimageRejected("not_found")
+			return 0, "No corresponding invoice was found for the provided preimage", nil
+		} else if err == ln.ErrInsufficientAmount {
+			p.metrics.preimageRejected("insufficient_amount")
+			return 0, "The invoice of the provided preimage was paid with a lower amount than the price of this endpoint", nil
+		} else if err == ln.ErrInvoiceCanceled {
+			// Leads to a new invoice
+			p.metrics.preimageRejected("canceled")
+			return 0, "", err
 		} else {
-			return "", err
+			p.metrics.error("ln")
+			return 0, "", err
 		}
 	}
 	if !settled {
-		return "You somehow obtained the preimage of the invoice, but the invoice is not settled yet", nil
+		p.metrics.preimageRejected("not_settled")
+		return 0, "You somehow obtained the preimage of the invoice, but the invoice is not settled yet", nil
 	}
 
-	// Key not found, so it wasn't used before.
 	// Insert key for future checks.
-	err = storageClient.SetUsed(preimage)
+	// This must be atomic, because concurrent requests with the same preimage
+	// can all pass the WasUsed check above before the first one stores the preimage.
+	wasNew, err := p.storePreimage(ctx, preimage, amountPaid)
 	if err != nil {
-		return "", err
+		return 0, "", err
 	}
-	return "", nil
+	if !wasNew {
+		p.metrics.preimageRejected("reused")
+		return 0, "The provided preimage was already used in a previous request", nil
+	}
+	p.metrics.paymentVerified()
+	return amountPaid, "", nil
+}
+
+// storePreimage stores the preimage as used, along with the paid amount if the storage client implements PaymentStorageClient.
+// Returns false if the preimage was already stored before.
+// With AllowPreimageReuse nothing is stored and true is returned.
+func (p paywall) storePreimage(ctx context.Context, preimage string, amountPaid int64) (bool, error) {
+	if p.invoiceOptions.AllowPreimageReuse {
+		return true, nil
+	}
+	_, span := p.startSpan(ctx, "StorageClient.SetIfNotUsed", paymentHashAttribute(preimage))
+	var wasNew bool
+	var err error
+	if storageClient, ok := p.storageClient.(PaymentStorageClient); ok {
+		wasNew, err = storageClient.SetPaymentIfNotUsed(preimage, amountPaid, time.Now())
+	} else {
+		wasNew, err = p.storageClient.SetIfNotUsed(preimage)
+	}
+	endSpan(span, err)
+	if err != nil {
+		p.metrics.error("storage")
+	}
+	return wasNew, err
 }
 
 func assignDefaultValues(invoiceOptions InvoiceOptions) InvoiceOptions {
@@ -95,6 +1143,60 @@ func assignDefaultValues(invoiceOptions InvoiceOptions) InvoiceOptions {
 		invoiceOptions.Price = DefaultInvoiceOptions.Price
 	}
 	// Empty Memo is okay.
+	if invoiceOptions.ResponseFormat == "" {
+		invoiceOptions.ResponseFormat = DefaultInvoiceOptions.ResponseFormat
+	}
+	if invoiceOptions.QRCodeSize <= 0 {
+		invoiceOptions.QRCodeSize = DefaultInvoiceOptions.QRCodeSize
+	}
+	if invoiceOptions.HeaderName == "" {
+		invoiceOptions.HeaderName = DefaultInvoiceOptions.HeaderName
+	}
+	// An empty slice is okay as well, but it means that no preimage is accepted.
+	if invoiceOptions.PreimageSources == nil {
+		invoiceOptions.PreimageSources = DefaultInvoiceOptions.PreimageSources
+	}
+	if invoiceOptions.PreimageQueryParam == "" {
+		invoiceOptions.PreimageQueryParam = DefaultInvoiceOptions.PreimageQueryParam
+	}
+	if invoiceOptions.PreimageCookieName == "" {
+		invoiceOptions.PreimageCookieName = DefaultInvoiceOptions.PreimageCookieName
+	}
+	if invoiceOptions.SessionHeaderName == "" {
+		invoiceOptions.SessionHeaderName = DefaultInvoiceOptions.SessionHeaderName
+	}
+	if invoiceOptions.APIKeyHeaderName == "" {
+		invoiceOptions.APIKeyHeaderName = DefaultInvoiceOptions.APIKeyHeaderName
+	}
+	if invoiceOptions.FreeRequestsWindow <= 0 {
+		invoiceOptions.FreeRequestsWindow = DefaultInvoiceOptions.FreeRequestsWindow
+	}
+	if invoiceOptions.FreeRequestsHeaderName == "" {
+		invoiceOptions.FreeRequestsHeaderName = DefaultInvoiceOptions.FreeRequestsHeaderName
+	}
+	if invoiceOptions.KeysendHeaderName == "" {
+		invoiceOptions.KeysendHeaderName = DefaultInvoiceOptions.KeysendHeaderName
+	}
+	if invoiceOptions.CircuitBreakerTimeout <= 0 {
+		invoiceOptions.CircuitBreakerTimeout = DefaultInvoiceOptions.CircuitBreakerTimeout
+	}
+	// Negative values disable the header
+	if invoiceOptions.ExpectedPaymentTime == 0 {
+		invoiceOptions.ExpectedPaymentTime = DefaultInvoiceOptions.ExpectedPaymentTime
+	}
+	if invoiceOptions.PreimageEncoding == "" {
+		invoiceOptions.PreimageEncoding = DefaultInvoiceOptions.PreimageEncoding
+	}
+	if invoiceOptions.FailurePolicy == "" {
+		invoiceOptions.FailurePolicy = DefaultInvoiceOptions.FailurePolicy
+	}
+	// An empty slice is okay, it means that no method is skipped.
+	if invoiceOptions.SkipMethods == nil {
+		invoiceOptions.SkipMethods = DefaultInvoiceOptions.SkipMethods
+	}
+	if invoiceOptions.Logger == nil {
+		invoiceOptions.Logger = ln.NoopLogger{}
+	}
 
 	return invoiceOptions
 }
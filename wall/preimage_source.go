@@ -0,0 +1,72 @@
+package wall
+
+import (
+	"net/http"
+	"strings"
+)
+
+// PreimageSource is a part of the request from which the middlewares read the preimage.
+type PreimageSource string
+
+const (
+	// PreimageSourceHeader leads to the preimage being read from the header with the name HeaderName.
+	PreimageSourceHeader PreimageSource = "header"
+	// PreimageSourceAuthorization leads to the preimage being read from the Authorization header
+	// as Bearer token (`Authorization: Bearer <preimage>`), which many API clients and gateways support out of the box.
+	PreimageSourceAuthorization PreimageSource = "authorization"
+	// PreimageSourceQuery leads to the preimage being read from the query parameter with the name PreimageQueryParam,
+	// for example "/api/data?preimage=...". Be aware that URLs including the query can be logged by proxies and web servers.
+	// Not available for the gRPC interceptor.
+	PreimageSourceQuery PreimageSource = "query"
+	// PreimageSourceCookie leads to the preimage being read from the cookie with the name PreimageCookieName.
+	PreimageSourceCookie PreimageSource = "cookie"
+)
+
+// bearerPrefix is the prefix of a Bearer token in the Authorization header.
+// As all authentication schemes it's case-insensitive.
+const bearerPrefix = "bearer "
+
+// getPreimage returns the preimage from the first one of the PreimageSources that contains a value,
+// or an empty string if none does.
+// getHeader must return the value of the request header with the given name,
+// getQueryParam the value of the query parameter with the given name.
+func (p paywall) getPreimage(getHeader func(string) string, getQueryParam func(string) string) string {
+	for _, source := range p.invoiceOptions.PreimageSources {
+		var preimage string
+		switch source {
+		case PreimageSourceHeader:
+			preimage = getHeader(p.invoiceOptions.HeaderName)
+		case PreimageSourceAuthorization:
+			if authHeader := getHeader("Authorization"); len(authHeader) > len(bearerPrefix) && strings.EqualFold(authHeader[:len(bearerPrefix)], bearerPrefix) {
+				preimage = authHeader[len(bearerPrefix):]
+			}
+		case PreimageSourceQuery:
+			preimage = getQueryParam(p.invoiceOptions.PreimageQueryParam)
+		case PreimageSourceCookie:
+			preimage = getCookie(getHeader("Cookie"), p.invoiceOptions.PreimageCookieName)
+		}
+		if preimage = strings.TrimSpace(preimage); preimage != "" {
+			return preimage
+		}
+	}
+	return ""
+}
+
+// getCookie returns the value of the cookie with the given name from the given Cookie header.
+// The Cookie header is parsed the same way as net/http does, which isn't available for all web frameworks.
+func getCookie(cookieHeader string, name string) string {
+	if cookieHeader == "" {
+		return ""
+	}
+	r := http.Request{Header: http.Header{"Cookie": {cookieHeader}}}
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// noQueryParams can be passed as getQueryParam when there are no query parameters, like for gRPC.
+func noQueryParams(string) string {
+	return ""
+}
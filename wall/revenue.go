@@ -0,0 +1,82 @@
+package wall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultRevenueWindow is the time window of the revenue report if the request doesn't contain the "from" parameter.
+const defaultRevenueWindow = 24 * time.Hour
+
+// revenueResponse is the body of a response of the revenue handler.
+type revenueResponse struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Number of paid requests
+	PaidRequests int64 `json:"paid_requests"`
+	// Total amount in Satoshis
+	TotalSat int64 `json:"total_sat"`
+}
+
+// NewRevenueHandler returns an http.Handler that reports the revenue of the paywall as JSON, for example:
+// {"from":"2024-01-01T00:00:00Z","to":"2024-01-02T00:00:00Z","paid_requests":42,"total_sat":4200}
+//
+// The time window can be set with the query parameters "from" and "to" in RFC 3339 format,
+// for example "/revenue?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z".
+// By default it's the last 24 hours.
+// The storage client must be the same as the one of the middleware, so that the payments are recorded in it.
+//
+// The handler is guarded by the API keys of the InvoiceOptions:
+// Requests without one of the APIKeys in the header with the name APIKeyHeaderName are rejected
+// with the status code 401. If no API keys are configured, all requests are rejected.
+// Note that callers with an API key can also use the paywalled endpoints without paying,
+// so only give the keys to trusted operators.
+func NewRevenueHandler(invoiceOptions InvoiceOptions, storageClient PaymentStorageClient) http.Handler {
+	invoiceOptions = assignDefaultValues(invoiceOptions)
+	keys := newAPIKeys(invoiceOptions.APIKeys)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !keys.contains(r.Header.Get(invoiceOptions.APIKeyHeaderName)) {
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		}
+
+		to := time.Now()
+		from := to.Add(-defaultRevenueWindow)
+		var err error
+		if toParam := r.URL.Query().Get("to"); toParam != "" {
+			if to, err = time.Parse(time.RFC3339, toParam); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid \"to\" parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+			from = to.Add(-defaultRevenueWindow)
+		}
+		if fromParam := r.URL.Query().Get("from"); fromParam != "" {
+			if from, err = time.Parse(time.RFC3339, fromParam); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid \"from\" parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		count, total, err := storageClient.Revenue(from, to)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't get the revenue from the storage: %+v", err)
+			invoiceOptions.Logger.Printf("%v\n", errorMsg)
+			http.Error(w, errorMsg, http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(revenueResponse{
+			From:         from,
+			To:           to,
+			PaidRequests: count,
+			TotalSat:     total,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
@@ -0,0 +1,69 @@
+package wall
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+// session issues and verifies the session tokens that grant access for a while after a payment.
+// A token consists of the expiry time (8 bytes), the paid amount in Satoshis (8 bytes), a random nonce (16 bytes)
+// and an HMAC-SHA256 (32 bytes) of all three, encoded with URL-safe Base64.
+// The paid amount is part of the token, so that paying for a cheap route doesn't grant access to an expensive one.
+type session struct {
+	key      []byte
+	duration time.Duration
+}
+
+const (
+	sessionNonceLength   = 16
+	sessionPayloadLength = 8 + 8 + sessionNonceLength
+)
+
+func newSession(key []byte, duration time.Duration) session {
+	if len(key) == 0 {
+		key = newRandomKey()
+	}
+	return session{
+		key:      key,
+		duration: duration,
+	}
+}
+
+// issue creates a new token for the given paid amount that expires after the session duration.
+func (s session) issue(amount int64) (string, error) {
+	token := make([]byte, sessionPayloadLength, sessionPayloadLength+sha256.Size)
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Add(s.duration).Unix()))
+	binary.BigEndian.PutUint64(token[8:], uint64(amount))
+	if _, err := rand.Read(token[16:]); err != nil {
+		return "", err
+	}
+	token = append(token, s.sign(token)...)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// verify returns true if the token was issued with the same key, isn't expired
+// and was issued for at least the given amount.
+func (s session) verify(encodedToken string, amount int64) bool {
+	token, err := base64.RawURLEncoding.DecodeString(encodedToken)
+	if err != nil || len(token) != sessionPayloadLength+sha256.Size {
+		return false
+	}
+	payload := token[:sessionPayloadLength]
+	// Constant time comparison to prevent timing attacks
+	if !hmac.Equal(token[sessionPayloadLength:], s.sign(payload)) {
+		return false
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	paidAmount := int64(binary.BigEndian.Uint64(payload[8:]))
+	return time.Now().Before(expiry) && paidAmount >= amount
+}
+
+func (s session) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,66 @@
+package wall
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	s := newSession([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	token, err := s.issue(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.verify(token, 10) {
+		t.Error("Expected the token to be valid for the paid amount")
+	}
+	if !s.verify(token, 5) {
+		t.Error("Expected the token to be valid for a lower amount")
+	}
+	if s.verify(token, 11) {
+		t.Error("Expected the token to be invalid for a higher amount")
+	}
+
+	// Another key, for example of another web service
+	otherSession := newSession([]byte("fedcba9876543210fedcba9876543210"), time.Hour)
+	if otherSession.verify(token, 10) {
+		t.Error("Expected the token to be invalid for another key")
+	}
+	// A random key is generated if none is set
+	if newSession(nil, time.Hour).verify(token, 10) {
+		t.Error("Expected the token to be invalid for a random key")
+	}
+
+	expiredToken, err := newSession(s.key, -time.Second).issue(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.verify(expiredToken, 10) {
+		t.Error("Expected an expired token to be invalid")
+	}
+
+	decodedToken, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(index int) string {
+		tamperedToken := append([]byte{}, decodedToken...)
+		tamperedToken[index] ^= 1
+		return base64.RawURLEncoding.EncodeToString(tamperedToken)
+	}
+	// Raising the paid amount or changing the HMAC must both be detected
+	if s.verify(tamper(15), 11) {
+		t.Error("Expected a token with a tampered amount to be invalid")
+	}
+	if s.verify(tamper(len(decodedToken)-1), 10) {
+		t.Error("Expected a token with a tampered HMAC to be invalid")
+	}
+
+	for _, invalidToken := range []string{"", "not Base64!", token[:len(token)-4]} {
+		if s.verify(invalidToken, 0) {
+			t.Errorf("Expected the token %q to be invalid", invalidToken)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package wall
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/philippgille/ln-paywall/ln"
+)
+
+// DefaultSettlementTimeout is the maximum time the settlement handler waits for a payment
+// if the timeout that's passed to NewSettlementHandler(...) is below 1.
+const DefaultSettlementTimeout = 60 * time.Second
+
+// settlementKeepAliveInterval is the interval in which the settlement handler sends a comment to Server-Sent Events
+// clients while waiting, so that proxies don't close the idle connection.
+const settlementKeepAliveInterval = 15 * time.Second
+
+// SettlementLNclient is an abstraction of an LN client that can wait until an invoice is settled,
+// which is required for NewSettlementHandler(...).
+// WaitForSettlement must block until the invoice with the given hex encoded payment hash is settled
+// or the context is done, in which case it must return the error of the context.
+// It should return ln.ErrInvoiceCanceled for invoices that were canceled or have expired
+// and ln.ErrSettlementTimeout if it has its own timeout.
+// ln.LNDclient and ln.FakeClient implement it.
+type SettlementLNclient interface {
+	WaitForSettlement(ctx context.Context, paymentHash string) error
+}
+
+// settlementResponse is the body of a response of the settlement handler.
+type settlementResponse struct {
+	// Payment hash in hex
+	PaymentHash string `json:"payment_hash"`
+	// "paid", "canceled" or "pending"
+	Status string `json:"status"`
+}
+
+// NewSettlementHandler returns an http.HandlerFunc that holds the connection open until an invoice is paid,
+// so that frontends can show "waiting for payment... paid!" without polling repeatedly.
+// It's meant to be used together with NewInvoiceHandler(...).
+//
+// The invoice is identified by the query parameter "payment_hash" (hex encoded) or "invoice" (BOLT11),
+// for example "/settlement?payment_hash=8d2c...". Only GET requests are allowed.
+// The response is JSON with the payment hash and the status, for example:
+// {"payment_hash":"8d2c...","status":"paid"}
+// The status is "paid" when the invoice was settled, "canceled" when it was canceled or has expired,
+// and "pending" when it wasn't paid within the timeout, in which case the client can send the request again (long polling).
+//
+// Clients that send the header "Accept: text/event-stream" get Server-Sent Events instead,
+// like the EventSource API of browsers does. The handler then sends comments while waiting,
+// and one event with the status as event type and the JSON as data, before it closes the stream:
+//
+//	event: paid
+//	data: {"payment_hash":"8d2c...","status":"paid"}
+//
+// Values of timeout below 1 lead to DefaultSettlementTimeout. The LN client might have its own timeout,
+// like the PollTimeout of ln.LNDoptions, in which case the shorter one applies.
+// ln.LNDclient uses lnd's SubscribeSingleInvoice RPC, so it doesn't poll lnd.
+func NewSettlementHandler(lnClient SettlementLNclient, timeout time.Duration) http.HandlerFunc {
+	if timeout <= 0 {
+		timeout = DefaultSettlementTimeout
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		paymentHash, invalidParamMsg := getSettlementPaymentHash(r)
+		if invalidParamMsg != "" {
+			http.Error(w, invalidParamMsg, http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			status, statusCode, errorMsg := waitForSettlement(r.Context(), lnClient, paymentHash, timeout)
+			if r.Context().Err() != nil {
+				// The client is gone
+				return
+			} else if errorMsg != "" {
+				http.Error(w, errorMsg, statusCode)
+				return
+			}
+			body, _ := json.Marshal(settlementResponse{PaymentHash: paymentHash, Status: status})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Disables the response buffering of nginx
+		w.Header().Set("X-Accel-Buffering", "no")
+		fmt.Fprint(w, ": waiting for payment\n\n")
+		flusher.Flush()
+
+		type waitResult struct {
+			status   string
+			errorMsg string
+		}
+		done := make(chan waitResult, 1)
+		go func() {
+			status, _, errorMsg := waitForSettlement(r.Context(), lnClient, paymentHash, timeout)
+			done <- waitResult{status, errorMsg}
+		}()
+		ticker := time.NewTicker(settlementKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				fmt.Fprint(w, ": waiting for payment\n\n")
+				flusher.Flush()
+			case res := <-done:
+				if res.errorMsg != "" {
+					fmt.Fprintf(w, "event: error\ndata: %v\n\n", res.errorMsg)
+				} else {
+					body, _ := json.Marshal(settlementResponse{PaymentHash: paymentHash, Status: res.status})
+					fmt.Fprintf(w, "event: %v\ndata: %s\n\n", res.status, body)
+				}
+				flusher.Flush()
+				return
+			}
+		}
+	}
+}
+
+// getSettlementPaymentHash returns the hex encoded payment hash from the query parameter "payment_hash",
+// or from the invoice in the query parameter "invoice".
+// The returned message is only set if neither parameter contains a valid value.
+func getSettlementPaymentHash(r *http.Request) (string, string) {
+	query := r.URL.Query()
+	if paymentHash := query.Get("payment_hash"); paymentHash != "" {
+		if decoded, err := hex.DecodeString(paymentHash); err != nil || len(decoded) != 32 {
+			return "", "The \"payment_hash\" parameter must be a hex encoded payment hash of 32 bytes"
+		}
+		return strings.ToLower(paymentHash), ""
+	}
+	if invoice := query.Get("invoice"); invoice != "" {
+		paymentHash, err := ln.PaymentHashFromInvoice(invoice)
+		if err != nil {
+			return "", fmt.Sprintf("The \"invoice\" parameter doesn't contain a valid invoice: %v", err)
+		}
+		return hex.EncodeToString(paymentHash), ""
+	}
+	return "", "The \"payment_hash\" or \"invoice\" parameter is required"
+}
+
+// waitForSettlement waits until the invoice is settled, canceled or the timeout is reached, and returns the status.
+// In case of an error the status code and the message for the response are returned instead.
+func waitForSettlement(ctx context.Context, lnClient SettlementLNclient, paymentHash string, timeout time.Duration) (status string, statusCode int, errorMsg string) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := lnClient.WaitForSettlement(timeoutCtx, paymentHash)
+	switch {
+	case err == nil:
+		return "paid", http.StatusOK, ""
+	case err == ln.ErrInvoiceCanceled:
+		return "canceled", http.StatusOK, ""
+	case err == ln.ErrSettlementTimeout || (timeoutCtx.Err() != nil && ctx.Err() == nil):
+		return "pending", http.StatusOK, ""
+	case err == ln.ErrInvoiceNotFound || strings.Contains(err.Error(), "unable to locate invoice"):
+		return "", http.StatusNotFound, "No invoice was found for the payment hash"
+	default:
+		return "", http.StatusInternalServerError, fmt.Sprintf("Couldn't wait for the settlement of the invoice: %+v", err)
+	}
+}
@@ -1,64 +1,51 @@
 package wall
 
 import (
-	"fmt"
-	"log"
 	"net/http"
-
-	"github.com/philippgille/ln-paywall/ln"
 )
 
 // NewHandlerFuncMiddleware returns a function which you can use within an http.HandlerFunc chain.
 func NewHandlerFuncMiddleware(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
-		return createHandlerFunc(invoiceOptions, lnClient, storageClient, next, "HandlerFunc")
+		return createHandlerFunc(invoiceOptions, lnClient, storageClient, next)
 	}
 }
 
 // NewHandlerMiddleware returns a function which you can use within an http.Handler chain.
 func NewHandlerMiddleware(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(createHandlerFunc(invoiceOptions, lnClient, storageClient, next.ServeHTTP, "Handler"))
+		return http.HandlerFunc(createHandlerFunc(invoiceOptions, lnClient, storageClient, next.ServeHTTP))
 	}
 }
 
-func createHandlerFunc(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient, next http.HandlerFunc, handlingType string) func(w http.ResponseWriter, r *http.Request) {
-	invoiceOptions = assignDefaultValues(invoiceOptions)
+func createHandlerFunc(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient, next http.HandlerFunc) func(w http.ResponseWriter, r *http.Request) {
+	p := newPaywall(invoiceOptions, lnClient, storageClient)
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check if the request contains a header with the preimage that we need to check if the requester paid
-		preimage := r.Header.Get("x-preimage")
-		if preimage == "" {
-			// Generate the invoice
-			invoice, err := lnClient.GenerateInvoice(invoiceOptions.Price, invoiceOptions.Memo)
-			if err != nil {
-				errorMsg := fmt.Sprintf("Couldn't generate invoice: %+v", err)
-				log.Println(errorMsg)
-				http.Error(w, errorMsg, http.StatusInternalServerError)
-			} else {
-				stdOutLogger.Printf("Sending invoice in response: %v", invoice)
-				// Note: w.Header().Set(...) must be called before w.WriteHeader(...)!
-				w.Header().Set("Content-Type", "application/vnd.lightning.bolt11")
-				w.WriteHeader(http.StatusPaymentRequired)
-				// The actual invoice goes into the body
-				w.Write([]byte(invoice))
-			}
-		} else {
-			// Check if the provided preimage belongs to a settled API payment invoice and that it wasn't already used. Also store used preimages.
-			invalidPreimageMsg, err := handlePreimage(preimage, storageClient, lnClient)
-			if err != nil {
-				errorMsg := fmt.Sprintf("An error occurred during checking the preimage: %+v", err)
-				log.Printf("%v\n", errorMsg)
-				http.Error(w, errorMsg, http.StatusInternalServerError)
-			} else if invalidPreimageMsg != "" {
-				log.Printf("%v: %v\n", invalidPreimageMsg, preimage)
-				http.Error(w, invalidPreimageMsg, http.StatusBadRequest)
-			} else {
-				preimageHash, err := ln.HashPreimage(preimage)
-				if err == nil {
-					stdOutLogger.Printf("The provided preimage is valid. Continuing to the next %v. Preimage hash: %v\n", handlingType, preimageHash)
-				}
-				next.ServeHTTP(w, r)
-			}
+		res := p.handleRequest(r.Context(), r.Header.Get, r.URL.Query().Get, r.Method, r.URL.Path, r.RemoteAddr, r)
+		if res.ok {
+			setHeader(w, res)
+			next.ServeHTTP(w, requestWithAmountPaid(r, res))
+			return
 		}
+		writeResult(w, res)
+	}
+}
+
+// writeResult writes the result of handling a request to a net/http response.
+func writeResult(w http.ResponseWriter, res result) {
+	setHeader(w, res)
+	if res.statusCode == http.StatusPaymentRequired {
+		w.WriteHeader(res.statusCode)
+		w.Write([]byte(res.body))
+	} else {
+		http.Error(w, res.body, res.statusCode)
+	}
+}
+
+// setHeader sets the headers of the result in the net/http response.
+func setHeader(w http.ResponseWriter, res result) {
+	// Note: w.Header().Set(...) must be called before w.WriteHeader(...)!
+	for key, values := range res.header {
+		w.Header()[key] = values
 	}
 }
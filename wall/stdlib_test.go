@@ -0,0 +1,1806 @@
+package wall_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/philippgille/ln-paywall/ln"
+	"github.com/philippgille/ln-paywall/storage"
+	"github.com/philippgille/ln-paywall/wall"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// fakeLNclient is an LNclient that treats all preimages as belonging to paid invoices.
+type fakeLNclient struct{}
+
+func (c fakeLNclient) GenerateInvoice(amount int64, memo string) (string, error) {
+	return "lnbc1", nil
+}
+
+func (c fakeLNclient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	return true, nil
+}
+
+// testPreimage returns a Base64 encoded preimage with 32 bytes that's derived from the given string,
+// for LN clients that treat all preimages as paid.
+func testPreimage(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// TestHeaderName tests if the preimage is read from the header with the configured name,
+// independent of the case of the name.
+func TestHeaderName(t *testing.T) {
+	invoiceOptions := wall.InvoiceOptions{
+		HeaderName: "X-Payment-Proof",
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		headerName   string
+		preimage     string
+		expectedCode int
+	}{
+		{"X-Payment-Proof", testPreimage("preimage1"), http.StatusOK},
+		{"x-payment-proof", testPreimage("preimage2"), http.StatusOK},
+		// The default header name must not be used anymore
+		{"X-Preimage", testPreimage("preimage3"), http.StatusPaymentRequired},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(testCase.headerName, testCase.preimage)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for header %v, but was %v", testCase.expectedCode, testCase.headerName, res.Code)
+		}
+	}
+}
+
+// TestCanceledInvoice tests if a preimage of a canceled or expired invoice leads to a new invoice.
+func TestCanceledInvoice(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.DefaultInvoiceOptions, lnClient, storage.NewGoMap())(next)
+
+	invoice, err := lnClient.GenerateInvoice(1, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, err := lnClient.Preimage(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lnClient.Cancel(invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Preimage", preimage)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.Code)
+	}
+	newInvoice, _ := ioutil.ReadAll(res.Body)
+	if string(newInvoice) == invoice {
+		t.Error("Expected a new invoice, but got the canceled one")
+	}
+}
+
+// failingLNclient is an LNclient that always returns an error, like when the LN node can't be reached.
+type failingLNclient struct{}
+
+func (c failingLNclient) GenerateInvoice(amount int64, memo string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func (c failingLNclient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// TestFailurePolicy tests if requests are rejected or let through when the LN node returns errors,
+// depending on the failure policy.
+func TestFailurePolicy(t *testing.T) {
+	testCases := []struct {
+		failurePolicy wall.FailurePolicy
+		expectedCode  int
+	}{
+		{"", http.StatusInternalServerError},
+		{wall.FailClosed, http.StatusInternalServerError},
+		{wall.FailOpen, http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		invoiceOptions := wall.InvoiceOptions{
+			FailurePolicy: testCase.failurePolicy,
+		}
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		handler := wall.NewHandlerMiddleware(invoiceOptions, failingLNclient{}, storage.NewGoMap())(next)
+
+		// Without preimage for generating an invoice, and with preimage for checking the invoice
+		for _, preimage := range []string{"", testPreimage("test")} {
+			req := httptest.NewRequest("GET", "/", nil)
+			if preimage != "" {
+				req.Header.Set("X-Preimage", preimage)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if res.Code != testCase.expectedCode {
+				t.Errorf("Expected status code %v for failure policy %q and preimage %q, but was %v", testCase.expectedCode, testCase.failurePolicy, preimage, res.Code)
+			}
+		}
+	}
+}
+
+// TestFailurePolicyCanceledRequest tests if requests whose context is canceled or whose deadline is exceeded
+// aren't let through with FailOpen, because a client could otherwise get access by canceling its request.
+func TestFailurePolicyCanceledRequest(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{FailurePolicy: wall.FailOpen}, contextErrLNclient{}, storage.NewGoMap())(next)
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expiredCtx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expiredCtx.Done()
+	for _, ctx := range []context.Context{canceledCtx, expiredCtx} {
+		for _, preimage := range []string{"", testPreimage("test")} {
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			if preimage != "" {
+				req.Header.Set("X-Preimage", preimage)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if res.Code == http.StatusOK {
+				t.Errorf("Expected the request with the context error %v and preimage %q to be rejected, but it was let through", ctx.Err(), preimage)
+			}
+		}
+	}
+}
+
+// contextErrLNclient is a ContextLNclient that returns the error of the context, like a gRPC client does.
+type contextErrLNclient struct {
+	failingLNclient
+}
+
+func (c contextErrLNclient) GenerateInvoiceCtx(ctx context.Context, amount int64, memo string) (string, error) {
+	return "", ctx.Err()
+}
+
+func (c contextErrLNclient) CheckInvoiceCtx(ctx context.Context, preimage string, expectedAmount int64) (bool, error) {
+	return false, ctx.Err()
+}
+
+// countingFailingLNclient is an LNclient that counts its calls and fails while failing is 1.
+type countingFailingLNclient struct {
+	calls   *int32
+	failing *int32
+}
+
+func (c countingFailingLNclient) GenerateInvoice(amount int64, memo string) (string, error) {
+	atomic.AddInt32(c.calls, 1)
+	if atomic.LoadInt32(c.failing) == 1 {
+		return "", errors.New("connection refused")
+	}
+	return "lnbc1", nil
+}
+
+func (c countingFailingLNclient) CheckInvoice(preimage string, expectedAmount int64) (bool, error) {
+	atomic.AddInt32(c.calls, 1)
+	if atomic.LoadInt32(c.failing) == 1 {
+		return false, errors.New("connection refused")
+	}
+	return true, nil
+}
+
+// TestCircuitBreaker tests if the LN client isn't called anymore after the threshold of failures was reached,
+// if the failure policy still applies, and if the circuit breaker closes again after a successful probe.
+func TestCircuitBreaker(t *testing.T) {
+	calls, failing := int32(0), int32(1)
+	lnClient := countingFailingLNclient{calls: &calls, failing: &failing}
+	metrics := wall.NewMetrics("")
+	invoiceOptions := wall.InvoiceOptions{
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerTimeout:   50 * time.Millisecond,
+		Metrics:                 metrics,
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+	send := func(preimage string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if preimage != "" {
+			req.Header.Set("X-Preimage", preimage)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	state := func() float64 {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(metrics)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() == "paywall_circuit_breaker_state" {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatal("The circuit breaker state metric is missing")
+		return 0
+	}
+
+	// Two failures open the circuit breaker, after which the LN client isn't called anymore
+	for _, preimage := range []string{"", testPreimage("test"), "", testPreimage("test")} {
+		if code := send(preimage); code != http.StatusInternalServerError {
+			t.Errorf("Expected status code %v, but was %v", http.StatusInternalServerError, code)
+		}
+	}
+	if calls != 2 || state() != 2 {
+		t.Errorf("Expected 2 calls and the state 2 (open), but was %v and %v", calls, state())
+	}
+
+	// After the timeout a successful probe closes the circuit breaker
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if code := send(""); code != http.StatusPaymentRequired {
+			t.Errorf("Expected status code %v, but was %v", http.StatusPaymentRequired, code)
+		}
+	}
+	if calls != 4 || state() != 0 {
+		t.Errorf("Expected 4 calls and the state 0 (closed), but was %v and %v", calls, state())
+	}
+}
+
+// TestWhitelist tests if requests from whitelisted IP addresses and CIDR ranges are passed on without payment.
+func TestWhitelist(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Whitelist: []string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32"},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+	invoiceOptions.TrustProxy = true
+	proxyHandler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		handler      http.Handler
+		remoteAddr   string
+		forwardedFor string
+		expectedCode int
+	}{
+		// Single IP
+		{handler, "192.0.2.1:1234", "", http.StatusOK},
+		{handler, "192.0.2.2:1234", "", http.StatusPaymentRequired},
+		// CIDR ranges
+		{handler, "10.1.2.3:1234", "", http.StatusOK},
+		{handler, "11.1.2.3:1234", "", http.StatusPaymentRequired},
+		{handler, "[2001:db8::1]:1234", "", http.StatusOK},
+		{handler, "[2001:db9::1]:1234", "", http.StatusPaymentRequired},
+		// X-Forwarded-For must be ignored without TrustProxy
+		{handler, "203.0.113.1:1234", "192.0.2.1", http.StatusPaymentRequired},
+		// With TrustProxy only the last address in X-Forwarded-For counts
+		{proxyHandler, "203.0.113.1:1234", "192.0.2.1", http.StatusOK},
+		{proxyHandler, "203.0.113.1:1234", "203.0.113.2, 10.0.0.1", http.StatusOK},
+		{proxyHandler, "203.0.113.1:1234", "10.0.0.1, 203.0.113.2", http.StatusPaymentRequired},
+		{proxyHandler, "192.0.2.1:1234", "203.0.113.2", http.StatusPaymentRequired},
+		{proxyHandler, "192.0.2.1:1234", "", http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = testCase.remoteAddr
+		if testCase.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+		}
+		res := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for remote address %v and X-Forwarded-For %q, but was %v",
+				testCase.expectedCode, testCase.remoteAddr, testCase.forwardedFor, res.Code)
+		}
+	}
+}
+
+// TestAPIKeys tests if requests with a valid API key are passed on without payment.
+func TestAPIKeys(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		APIKeys: []string{"key1", "key2"},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+	invoiceOptions.APIKeyHeaderName = "X-Partner-Key"
+	customHeaderHandler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		handler      http.Handler
+		headerName   string
+		apiKey       string
+		expectedCode int
+	}{
+		{handler, "X-API-Key", "key1", http.StatusOK},
+		{handler, "X-API-Key", "key2", http.StatusOK},
+		{handler, "X-API-Key", "key3", http.StatusPaymentRequired},
+		{handler, "X-API-Key", "key", http.StatusPaymentRequired},
+		{handler, "X-API-Key", "", http.StatusPaymentRequired},
+		{customHeaderHandler, "X-Partner-Key", "key1", http.StatusOK},
+		{customHeaderHandler, "X-API-Key", "key1", http.StatusPaymentRequired},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(testCase.headerName, testCase.apiKey)
+		res := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for API key %q in header %v, but was %v",
+				testCase.expectedCode, testCase.apiKey, testCase.headerName, res.Code)
+		}
+	}
+}
+
+// TestFreeRequests tests if the first requests of a client are passed on without payment
+// and if the response contains the number of free requests left.
+func TestFreeRequests(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		FreeRequests:       2,
+		FreeRequestsWindow: 100 * time.Millisecond,
+		Whitelist:          []string{"10.0.0.1"},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		remoteAddr        string
+		preimage          string
+		expectedCode      int
+		expectedRemaining string
+	}{
+		{"192.0.2.1:1234", "", http.StatusOK, "1"},
+		// Requests with a preimage don't use up the quota
+		{"192.0.2.1:1234", testPreimage("some preimage"), http.StatusOK, ""},
+		{"192.0.2.1:1234", "", http.StatusOK, "0"},
+		{"192.0.2.1:1234", "", http.StatusPaymentRequired, "0"},
+		// Each client has its own quota
+		{"192.0.2.2:1234", "", http.StatusOK, "1"},
+		// Whitelisted clients don't use up the quota
+		{"10.0.0.1:1234", "", http.StatusOK, ""},
+	}
+	send := func(remoteAddr string, preimage string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if preimage != "" {
+			req.Header.Set("X-Preimage", preimage)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	for _, testCase := range testCases {
+		res := send(testCase.remoteAddr, testCase.preimage)
+		remaining := res.Header().Get("X-Free-Requests-Remaining")
+		if res.Code != testCase.expectedCode || remaining != testCase.expectedRemaining {
+			t.Errorf("Expected status code %v and %q free requests left for remote address %v, but was %v and %q",
+				testCase.expectedCode, testCase.expectedRemaining, testCase.remoteAddr, res.Code, remaining)
+		}
+	}
+
+	// A new window starts after the previous one
+	time.Sleep(150 * time.Millisecond)
+	if res := send("192.0.2.1:1234", ""); res.Code != http.StatusOK {
+		t.Errorf("Expected status code %v in a new window, but was %v", http.StatusOK, res.Code)
+	}
+
+	// With FailOpen a failing counter lets requests through, but canceled ones lead to an invoice
+	failingHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{FreeRequests: 2, FailurePolicy: wall.FailOpen}, fakeLNclient{}, failingCounterStorageClient{storage.NewGoMap()})(next)
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, ctx := range []context.Context{context.Background(), canceledCtx} {
+		expectedCode := http.StatusOK
+		if ctx.Err() != nil {
+			expectedCode = http.StatusPaymentRequired
+		}
+		res := httptest.NewRecorder()
+		failingHandler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if res.Code != expectedCode {
+			t.Errorf("Expected status code %v for a failing counter and the context error %v, but was %v", expectedCode, ctx.Err(), res.Code)
+		}
+	}
+
+	// Storage clients without counters can't be used
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a storage client that doesn't implement CounterStorageClient")
+		}
+	}()
+	wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewMemoryLRU(10))(next)
+}
+
+// failingCounterStorageClient is a CounterStorageClient whose counters can't be incremented.
+type failingCounterStorageClient struct {
+	storage.GoMap
+}
+
+func (c failingCounterStorageClient) Increment(key string, ttl time.Duration) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+// TestPreimageSources tests if the preimage is read from the configured parts of the request.
+func TestPreimageSources(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{}, fakeLNclient{}, storage.NewGoMap())(next)
+	invoiceOptions := wall.InvoiceOptions{
+		PreimageSources: []wall.PreimageSource{
+			wall.PreimageSourceAuthorization,
+			wall.PreimageSourceQuery,
+			wall.PreimageSourceCookie,
+		},
+		PreimageCookieName: "pay",
+	}
+	allSourcesHandler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		handler      http.Handler
+		name         string
+		prepare      func(req *http.Request, preimage string)
+		expectedCode int
+	}{
+		{handler, "header", func(req *http.Request, preimage string) { req.Header.Set("X-Preimage", preimage) }, http.StatusOK},
+		// Only the header is used by default
+		{handler, "bearer token", func(req *http.Request, preimage string) { req.Header.Set("Authorization", "Bearer "+preimage) }, http.StatusPaymentRequired},
+		{allSourcesHandler, "header", func(req *http.Request, preimage string) { req.Header.Set("X-Preimage", preimage) }, http.StatusPaymentRequired},
+		{allSourcesHandler, "bearer token", func(req *http.Request, preimage string) { req.Header.Set("Authorization", "Bearer "+preimage) }, http.StatusOK},
+		{allSourcesHandler, "lowercase bearer token", func(req *http.Request, preimage string) { req.Header.Set("Authorization", "bearer "+preimage) }, http.StatusOK},
+		{allSourcesHandler, "basic auth", func(req *http.Request, preimage string) { req.Header.Set("Authorization", "Basic "+preimage) }, http.StatusPaymentRequired},
+		{allSourcesHandler, "query parameter", func(req *http.Request, preimage string) {
+			req.URL.RawQuery = "preimage=" + neturl.QueryEscape(preimage)
+		}, http.StatusOK},
+		{allSourcesHandler, "cookie", func(req *http.Request, preimage string) { req.AddCookie(&http.Cookie{Name: "pay", Value: preimage}) }, http.StatusOK},
+		{allSourcesHandler, "other cookie", func(req *http.Request, preimage string) {
+			req.AddCookie(&http.Cookie{Name: "preimage", Value: preimage})
+		}, http.StatusPaymentRequired},
+	}
+	for i, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		// Each preimage can only be used once
+		testCase.prepare(req, testPreimage(fmt.Sprintf("preimage %v", i)))
+		res := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for the preimage in the %v, but was %v", testCase.expectedCode, testCase.name, res.Code)
+		}
+	}
+}
+
+// TestResponseFormat tests if the format of the response with the invoice can be configured
+// and selected via the Accept header.
+func TestResponseFormat(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{}, ln.NewFakeClient(), storage.NewGoMap())(next)
+	pngHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{ResponseFormat: wall.ResponseFormatPNG, QRCodeSize: 300}, ln.NewFakeClient(), storage.NewGoMap())(next)
+
+	testCases := []struct {
+		handler             http.Handler
+		accept              string
+		expectedContentType string
+		// Only relevant for PNG responses
+		expectedSize int
+	}{
+		{handler, "", "application/vnd.lightning.bolt11", 0},
+		{handler, "*/*", "application/vnd.lightning.bolt11", 0},
+		{handler, "image/png", "image/png", 256},
+		{handler, "application/json", "application/json", 0},
+		{handler, "text/html, image/png;q=0.5, application/json;q=0.8", "application/json", 0},
+		{handler, "image/png;q=0", "application/vnd.lightning.bolt11", 0},
+		{pngHandler, "", "image/png", 300},
+		{pngHandler, "text/html,application/xhtml+xml,*/*;q=0.8", "image/png", 300},
+		{pngHandler, "application/vnd.lightning.bolt11", "application/vnd.lightning.bolt11", 0},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", testCase.accept)
+		res := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(res, req)
+		if res.Code != http.StatusPaymentRequired {
+			t.Fatalf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.Code)
+		}
+		contentType := res.Header().Get("Content-Type")
+		if contentType != testCase.expectedContentType {
+			t.Errorf("Expected Content-Type %v for Accept header %q, but was %v", testCase.expectedContentType, testCase.accept, contentType)
+		}
+		if contentType != "image/png" {
+			continue
+		}
+		img, err := png.Decode(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Dx(); size != testCase.expectedSize {
+			t.Errorf("Expected the QR code to be %v pixels wide, but was %v", testCase.expectedSize, size)
+		}
+	}
+}
+
+// TestRetryAfter tests if the response with the invoice contains the Retry-After header with the ExpectedPaymentTime,
+// and that a negative ExpectedPaymentTime leads to no header.
+func TestRetryAfter(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	testCases := []struct {
+		expectedPaymentTime time.Duration
+		expectedHeader      string
+	}{
+		{0, "5"},
+		{1500 * time.Millisecond, "2"},
+		{-1, ""},
+	}
+	for _, testCase := range testCases {
+		invoiceOptions := wall.InvoiceOptions{
+			ExpectedPaymentTime: testCase.expectedPaymentTime,
+		}
+		handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+		req := httptest.NewRequest("GET", "/", nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != http.StatusPaymentRequired {
+			t.Errorf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.Code)
+		}
+		if header := res.Header().Get("Retry-After"); header != testCase.expectedHeader {
+			t.Errorf("Expected the Retry-After header %q for an ExpectedPaymentTime of %v, but was %q", testCase.expectedHeader, testCase.expectedPaymentTime, header)
+		}
+	}
+}
+
+// TestResponseTemplate tests if the ResponseTemplate is used for the body of the response with the invoice,
+// unless the client requests a format with the Accept header.
+func TestResponseTemplate(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price: 42,
+		ResponseTemplate: func(invoice string, amount int64) (string, []byte) {
+			return "", []byte(fmt.Sprintf("<html><body><a href=\"lightning:%v\">Pay %v Satoshis</a></body></html>", invoice, amount))
+		},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, ln.NewFakeClient(), storage.NewGoMap())(next)
+
+	testCases := []struct {
+		accept              string
+		expectedContentType string
+	}{
+		{"", "text/html; charset=utf-8"},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"application/json", "application/json"},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", testCase.accept)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != http.StatusPaymentRequired {
+			t.Fatalf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.Code)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != testCase.expectedContentType {
+			t.Errorf("Expected Content-Type %v for Accept header %q, but was %v", testCase.expectedContentType, testCase.accept, contentType)
+		}
+		if testCase.expectedContentType == "text/html; charset=utf-8" && !strings.Contains(res.Body.String(), "Pay 42 Satoshis") {
+			t.Errorf("Expected the body to be created by the template, but was %v", res.Body.String())
+		}
+	}
+}
+
+// TestTracerProvider tests if spans are created for the calls to the LN client and the storage client,
+// as children of the span in the request context.
+func TestTracerProvider(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	lnClient := ln.NewFakeClient()
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{TracerProvider: tracerProvider}, lnClient, storage.NewGoMap())(next)
+	ctx, parentSpan := tracerProvider.Tracer("test").Start(context.Background(), "parent")
+	defer parentSpan.End()
+
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	preimage, err := lnClient.Pay(res.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	req.Header.Set("X-Preimage", preimage)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status code %v, but was %v", http.StatusOK, res.Code)
+	}
+
+	expectedNames := []string{"LNclient.GenerateInvoice", "StorageClient.WasUsed", "LNclient.CheckInvoice", "StorageClient.SetIfNotUsed"}
+	spans := spanRecorder.Ended()
+	if len(spans) != len(expectedNames) {
+		t.Fatalf("Expected %v spans, but were %v", len(expectedNames), len(spans))
+	}
+	for i, span := range spans {
+		if span.Name() != expectedNames[i] {
+			t.Errorf("Expected span %v to be named %v, but was %v", i, expectedNames[i], span.Name())
+		}
+		if span.Parent().SpanID() != parentSpan.SpanContext().SpanID() {
+			t.Errorf("Expected span %v to be a child of the span in the request context", span.Name())
+		}
+		var hasPaymentHash bool
+		for _, attr := range span.Attributes() {
+			if attr.Key == "ln_paywall.payment_hash" && len(attr.Value.AsString()) == 64 {
+				hasPaymentHash = true
+			}
+		}
+		if !hasPaymentHash {
+			t.Errorf("Expected span %v to have the payment hash as attribute, but it didn't", span.Name())
+		}
+	}
+}
+
+// contextLNclient is an LNclient that also implements ContextLNclient and ContextAmountPaidLNclient
+// and records the contexts it's called with.
+type contextLNclient struct {
+	fakeLNclient
+	contexts *[]context.Context
+}
+
+func (c contextLNclient) GenerateInvoiceCtx(ctx context.Context, amount int64, memo string) (string, error) {
+	*c.contexts = append(*c.contexts, ctx)
+	return c.GenerateInvoice(amount, memo)
+}
+
+func (c contextLNclient) CheckInvoiceCtx(ctx context.Context, preimage string, expectedAmount int64) (bool, error) {
+	*c.contexts = append(*c.contexts, ctx)
+	return c.CheckInvoice(preimage, expectedAmount)
+}
+
+func (c contextLNclient) CheckInvoicePaid(preimage string) (bool, int64, error) {
+	return true, 100, nil
+}
+
+func (c contextLNclient) CheckInvoicePaidCtx(ctx context.Context, preimage string) (bool, int64, error) {
+	*c.contexts = append(*c.contexts, ctx)
+	return c.CheckInvoicePaid(preimage)
+}
+
+// TestContextLNclient tests if the context of the request is passed to an LNclient that implements ContextLNclient,
+// and with AmountlessInvoices to one that implements ContextAmountPaidLNclient.
+func TestContextLNclient(t *testing.T) {
+	type ctxKey struct{}
+	var contexts []context.Context
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+
+	for _, amountlessInvoices := range []bool{false, true} {
+		invoiceOptions := wall.InvoiceOptions{AmountlessInvoices: amountlessInvoices}
+		handler := wall.NewHandlerMiddleware(invoiceOptions, contextLNclient{contexts: &contexts}, storage.NewGoMap())(next)
+		for _, preimage := range []string{"", testPreimage("test")} {
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			req.Header.Set("X-Preimage", preimage)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if preimage != "" && res.Code != http.StatusOK {
+				t.Errorf("Expected status code %v for the preimage (AmountlessInvoices: %v), but was %v", http.StatusOK, amountlessInvoices, res.Code)
+			}
+		}
+	}
+	if len(contexts) != 4 {
+		t.Fatalf("Expected the methods with context to be called 4 times, but were called %v times", len(contexts))
+	}
+	for _, lnCtx := range contexts {
+		if lnCtx.Value(ctxKey{}) != "request" {
+			t.Error("Expected the context of the request to be passed on, but it wasn't")
+		}
+	}
+}
+
+// TestAmountlessInvoices tests if amountless invoices are generated and if the price is enforced as minimum amount.
+func TestAmountlessInvoices(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, wall.AmountPaid(r))
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price:              10,
+		AmountlessInvoices: true,
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		amountPaid   int64
+		expectedCode int
+	}{
+		{9, http.StatusBadRequest},
+		{10, http.StatusOK},
+		{1000, http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		invoice := res.Body.String()
+		// The amount would follow directly after the prefix, but "1" is the separator of the human-readable part
+		if !strings.HasPrefix(invoice, "lnbcrt1") {
+			t.Fatalf("Expected an amountless invoice, but was %v", invoice)
+		}
+		if _, err := lnClient.Pay(invoice); err == nil {
+			t.Error("Expected an error when paying an amountless invoice without amount, but was nil")
+		}
+		preimage, err := lnClient.PayAmount(invoice, testCase.amountPaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Preimage", preimage)
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for a paid amount of %v, but was %v", testCase.expectedCode, testCase.amountPaid, res.Code)
+		}
+		// The next handler gets the amount that was actually paid
+		if res.Code == http.StatusOK && res.Body.String() != strconv.FormatInt(testCase.amountPaid, 10) {
+			t.Errorf("Expected AmountPaid to be %v, but was %v", testCase.amountPaid, res.Body.String())
+		}
+	}
+}
+
+// TestAmountPaid tests if the next handler gets the price as paid amount without AmountlessInvoices,
+// and 0 for requests that didn't need to be paid for.
+func TestAmountPaid(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, wall.AmountPaid(r))
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price:     10,
+		Whitelist: []string{"10.0.0.1"},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	// Overpaying doesn't matter with regular invoices
+	preimage, err := lnClient.PayAmount(res.Body.String(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Preimage", preimage)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Body.String() != "10" {
+		t.Errorf("Expected AmountPaid to be the price 10, but was %v", res.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Body.String() != "0" {
+		t.Errorf("Expected AmountPaid to be 0 for a whitelisted client, but was %v", res.Body.String())
+	}
+}
+
+// l402ChallengeRegexp matches the WWW-Authenticate header of a response in L402 mode.
+var l402ChallengeRegexp = regexp.MustCompile(`^L402 macaroon="(.+)", invoice="(.+)"$`)
+
+// TestL402 tests if only L402 tokens with a macaroon that was minted with the root key
+// and the preimage of its payment hash are accepted, and only once.
+func TestL402(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rootKey := []byte("0123456789abcdef0123456789abcdef")
+	lnClient := ln.NewFakeClient()
+	handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{L402: true, L402RootKey: rootKey}, lnClient, storage.NewGoMap())(next)
+	otherHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{L402: true, L402RootKey: []byte("fedcba9876543210fedcba9876543210")}, lnClient, storage.NewGoMap())(next)
+	send := func(handler http.Handler, authHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	// token returns the macaroon of a new challenge of the handler and the hex encoded preimage of its invoice.
+	// The invoice is only paid if pay is true, otherwise the preimage is the one of another invoice.
+	token := func(handler http.Handler, pay bool) (mac string, preimage string) {
+		res := send(handler, "")
+		if res.Code != http.StatusPaymentRequired {
+			t.Fatalf("Expected status code %v for the challenge, but was %v", http.StatusPaymentRequired, res.Code)
+		}
+		matches := l402ChallengeRegexp.FindStringSubmatch(res.Header().Get("WWW-Authenticate"))
+		if matches == nil {
+			t.Fatalf("Expected an L402 challenge, but the WWW-Authenticate header was %q", res.Header().Get("WWW-Authenticate"))
+		}
+		invoice := matches[2]
+		if !pay {
+			otherInvoice, err := lnClient.GenerateInvoice(1, "other")
+			if err != nil {
+				t.Fatal(err)
+			}
+			invoice = otherInvoice
+		}
+		encodedPreimage, err := lnClient.Pay(invoice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preimageBytes, err := base64.StdEncoding.DecodeString(encodedPreimage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches[1], hex.EncodeToString(preimageBytes)
+	}
+	// withCaveat adds a first party caveat to the macaroon, like a client could do
+	withCaveat := func(mac string) string {
+		macBytes, err := base64.StdEncoding.DecodeString(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &macaroon.Macaroon{}
+		if err = m.UnmarshalBinary(macBytes); err != nil {
+			t.Fatal(err)
+		}
+		if err = m.AddFirstPartyCaveat([]byte("time < 2100-01-01T00:00:00Z")); err != nil {
+			t.Fatal(err)
+		}
+		macBytes, err = m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(macBytes)
+	}
+	// withVersion mints a macaroon with the root key, but with another version of the identifier
+	withVersion := func(version byte, preimage string) string {
+		preimageBytes, err := hex.DecodeString(preimage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(preimageBytes)
+		id := append(append([]byte{0, version}, hash[:]...), make([]byte, 32)...)
+		m, err := macaroon.New(rootKey, id, "ln-paywall", macaroon.LatestVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		macBytes, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(macBytes)
+	}
+
+	mac, preimage := token(handler, true)
+	unpaidMac, otherPreimage := token(handler, false)
+	otherKeyMac, otherKeyPreimage := token(otherHandler, true)
+	caveatMac, caveatPreimage := token(handler, true)
+	_, versionPreimage := token(handler, true)
+	lsatMac, lsatPreimage := token(handler, true)
+	testCases := []struct {
+		name         string
+		authHeader   string
+		expectedCode int
+	}{
+		{"valid token", "L402 " + mac + ":" + preimage, http.StatusOK},
+		{"reused preimage", "L402 " + mac + ":" + preimage, http.StatusBadRequest},
+		{"preimage of another invoice", "L402 " + unpaidMac + ":" + otherPreimage, http.StatusUnauthorized},
+		{"other root key", "L402 " + otherKeyMac + ":" + otherKeyPreimage, http.StatusUnauthorized},
+		{"client-added caveat", "L402 " + withCaveat(caveatMac) + ":" + caveatPreimage, http.StatusUnauthorized},
+		{"missing preimage", "L402 " + caveatMac, http.StatusUnauthorized},
+		{"too many parts", "L402 " + caveatMac + ":" + caveatPreimage + ":" + caveatPreimage, http.StatusUnauthorized},
+		{"unknown identifier version", "L402 " + withVersion(1, versionPreimage) + ":" + versionPreimage, http.StatusUnauthorized},
+		{"known identifier version", "L402 " + withVersion(0, versionPreimage) + ":" + versionPreimage, http.StatusOK},
+		{"legacy LSAT scheme", "LSAT " + lsatMac + ":" + lsatPreimage, http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		if res := send(handler, testCase.authHeader); res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for the %v, but was %v (body: %q)", testCase.expectedCode, testCase.name, res.Code, res.Body.String())
+		}
+	}
+}
+
+// TestSessionDuration tests if the response to a paid request contains a session token that replaces the payment,
+// but only for requests that don't cost more than the paid one.
+func TestSessionDuration(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price:           1,
+		RoutePrices:     map[string]int64{"/expensive": 100},
+		SessionDuration: time.Hour,
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+	send := func(path string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("/", "X-Preimage", testPreimage("cheap"))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status code %v for the payment, but was %v", http.StatusOK, res.Code)
+	}
+	cheapToken := res.Header().Get("X-Session-Token")
+	if cheapToken == "" {
+		t.Fatal("Expected a session token in the response to the payment")
+	}
+	// The token replaces the payment, so no preimage is required
+	if code := send("/", "X-Session-Token", cheapToken).Code; code != http.StatusOK {
+		t.Errorf("Expected status code %v for a valid session token, but was %v", http.StatusOK, code)
+	}
+	if code := send("/", "X-Session-Token", cheapToken+"A").Code; code != http.StatusPaymentRequired {
+		t.Errorf("Expected status code %v for a tampered session token, but was %v", http.StatusPaymentRequired, code)
+	}
+	// A token for a cheap route must not grant access to an expensive one
+	if code := send("/expensive", "X-Session-Token", cheapToken).Code; code != http.StatusPaymentRequired {
+		t.Errorf("Expected status code %v for a session token of a cheaper route, but was %v", http.StatusPaymentRequired, code)
+	}
+
+	res = send("/expensive", "X-Preimage", testPreimage("expensive"))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status code %v for the payment, but was %v", http.StatusOK, res.Code)
+	}
+	expensiveToken := res.Header().Get("X-Session-Token")
+	for _, path := range []string{"/expensive", "/"} {
+		if code := send(path, "X-Session-Token", expensiveToken).Code; code != http.StatusOK {
+			t.Errorf("Expected status code %v for %v with the session token of the expensive route, but was %v", http.StatusOK, path, code)
+		}
+	}
+}
+
+// TestMethodPrices tests if only requests with the methods in MethodPrices must be paid for
+// and if RoutePrices take precedence for the price.
+func TestMethodPrices(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price:          1,
+		MethodPrices:   map[string]int64{"POST": 10, "DELETE": 0},
+		RoutePrices:    map[string]int64{"/expensive": 100},
+		ResponseFormat: wall.ResponseFormatJSON,
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, ln.NewFakeClient(), storage.NewGoMap())(next)
+
+	testCases := []struct {
+		method         string
+		path           string
+		expectedCode   int
+		expectedAmount int64
+	}{
+		{"GET", "/", http.StatusOK, 0},
+		{"GET", "/expensive", http.StatusOK, 0},
+		{"DELETE", "/", http.StatusOK, 0},
+		{"POST", "/", http.StatusPaymentRequired, 10},
+		{"POST", "/expensive", http.StatusPaymentRequired, 100},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, testCase.path, nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for %v %v, but was %v", testCase.expectedCode, testCase.method, testCase.path, res.Code)
+		}
+		if res.Code != http.StatusPaymentRequired {
+			continue
+		}
+		var body struct {
+			Amount int64 `json:"amount"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Amount != testCase.expectedAmount {
+			t.Errorf("Expected the amount %v for %v %v, but was %v", testCase.expectedAmount, testCase.method, testCase.path, body.Amount)
+		}
+	}
+}
+
+// TestSkipMethods tests if CORS preflight requests are passed on without payment by default
+// and if the skipped methods can be configured.
+func TestSkipMethods(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defaultHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{}, ln.NewFakeClient(), storage.NewGoMap())(next)
+	headHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{SkipMethods: []string{"OPTIONS", "HEAD"}}, ln.NewFakeClient(), storage.NewGoMap())(next)
+	noSkipHandler := wall.NewHandlerMiddleware(wall.InvoiceOptions{SkipMethods: []string{}}, ln.NewFakeClient(), storage.NewGoMap())(next)
+
+	testCases := []struct {
+		name         string
+		handler      http.Handler
+		method       string
+		expectedCode int
+	}{
+		{"default", defaultHandler, "OPTIONS", http.StatusNoContent},
+		{"default", defaultHandler, "HEAD", http.StatusPaymentRequired},
+		{"default", defaultHandler, "GET", http.StatusPaymentRequired},
+		{"head", headHandler, "HEAD", http.StatusNoContent},
+		{"noSkip", noSkipHandler, "OPTIONS", http.StatusPaymentRequired},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, "/", nil)
+		if testCase.method == "OPTIONS" {
+			// Preflight request like a browser sends it before a request with the preimage header
+			req.Header.Set("Origin", "https://example.com")
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "x-preimage")
+		}
+		res := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for %v with the %v handler, but was %v", testCase.expectedCode, testCase.method, testCase.name, res.Code)
+		}
+	}
+}
+
+// keysendLNclient is an LNclient that has received keysend payments of 10 Satoshis for the nonces in the map,
+// with the mapped preimages.
+type keysendLNclient struct {
+	fakeLNclient
+	payments map[string]string
+}
+
+func (c keysendLNclient) KeysendDestination() (string, uint64, error) {
+	return "02abc", 696969, nil
+}
+
+func (c keysendLNclient) KeysendPayment(nonce string) (string, int64, error) {
+	preimage, ok := c.payments[nonce]
+	if !ok {
+		return "", 0, ln.ErrInvoiceNotFound
+	}
+	return preimage, 10, nil
+}
+
+// TestKeysend tests if the response with the invoice contains the keysend headers
+// and if a request with the nonce of a keysend payment is only passed on once, only if enough was paid
+// and only if the middleware issued the nonce.
+func TestKeysend(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	lnClient := keysendLNclient{payments: map[string]string{}}
+	invoiceOptions := wall.InvoiceOptions{
+		Price:   10,
+		Keysend: true,
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+	send := func(path string, nonce string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if nonce != "" {
+			req.Header.Set("X-Keysend-Nonce", nonce)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("/", "")
+	nonce := res.Header().Get("X-Keysend-Nonce")
+	if res.Code != http.StatusPaymentRequired || res.Body.String() != "lnbc1" || len(nonce) != 64 ||
+		res.Header().Get("X-Keysend-Pubkey") != "02abc" || res.Header().Get("X-Keysend-TLV-Type") != "696969" ||
+		res.Header().Get("X-Keysend-Amount") != "10" {
+		t.Fatalf("Expected an invoice and the keysend headers, but was %v %q with headers %v", res.Code, res.Body.String(), res.Header())
+	}
+	if send("/", nonce).Code != http.StatusBadRequest {
+		t.Error("Expected the nonce to be rejected before the keysend payment was received")
+	}
+	lnClient.payments[nonce] = "c29tZSBwcmVpbWFnZQ=="
+	// The nonce is accepted in uppercase, but only once
+	for _, expectedCode := range []int{http.StatusOK, http.StatusBadRequest} {
+		if res = send("/", strings.ToUpper(nonce)); res.Code != expectedCode {
+			t.Errorf("Expected status code %v, but was %v (%v)", expectedCode, res.Code, res.Body.String())
+		}
+	}
+	if res = send("/", "invalid"); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %v for an invalid nonce, but was %v", http.StatusBadRequest, res.Code)
+	}
+	// Nonces that the middleware didn't issue must be rejected, even if there's a payment for them
+	tamperedNonce := "0" + nonce[1:]
+	if nonce[0] == '0' {
+		tamperedNonce = "1" + nonce[1:]
+	}
+	for _, clientNonce := range []string{strings.Repeat("ab", 32), tamperedNonce, nonce[:32]} {
+		lnClient.payments[clientNonce] = "Y2xpZW50IHByZWltYWdl"
+		if res = send("/", clientNonce); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "invalid") {
+			t.Errorf("Expected the nonce %v to be rejected, but was %v %q", clientNonce, res.Code, res.Body.String())
+		}
+	}
+
+	// Too low amount
+	invoiceOptions.Price = 11
+	invoiceOptions.KeysendKey = []byte("0123456789abcdef0123456789abcdef")
+	handler = wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+	nonce = send("/", "").Header().Get("X-Keysend-Nonce")
+	lnClient.payments[nonce] = "b3RoZXIgcHJlaW1hZ2U="
+	if res = send("/", nonce); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "lower amount") {
+		t.Errorf("Expected the keysend payment to be rejected because of the amount, but was %v %q", res.Code, res.Body.String())
+	}
+	// Another instance with the same key accepts the nonce
+	invoiceOptions.Price = 10
+	handler = wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+	if res = send("/", nonce); res.Code != http.StatusOK {
+		t.Errorf("Expected another instance with the same key to accept the nonce, but was %v %q", res.Code, res.Body.String())
+	}
+
+	// LN clients without keysend support can't be used
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an LN client that doesn't implement KeysendLNclient")
+		}
+	}()
+	wall.NewHandlerMiddleware(invoiceOptions, fakeLNclient{}, storage.NewGoMap())(next)
+}
+
+// TestAllowPreimageReuse tests if a preimage can be used for multiple requests without a storage client
+// when AllowPreimageReuse is set, and if the invoice is still checked.
+func TestAllowPreimageReuse(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		AllowPreimageReuse: true,
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, nil)(next)
+	send := func(preimage string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Preimage", preimage)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	invoice, err := lnClient.GenerateInvoice(1, "API call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpaidPreimage, _, err := ln.NewPreimage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := send(unpaidPreimage); code != http.StatusBadRequest {
+		t.Errorf("Expected status code %v for a preimage without invoice, but was %v", http.StatusBadRequest, code)
+	}
+	preimage, err := lnClient.Pay(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if code := send(preimage); code != http.StatusOK {
+			t.Errorf("Expected status code %v for request %v, but was %v", http.StatusOK, i+1, code)
+		}
+	}
+}
+
+// TestOnPaid tests if the OnPaid function is called once per payment, before the next handler,
+// and if a panic in it doesn't prevent the request from being passed on.
+func TestOnPaid(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	var calls []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "next")
+		w.WriteHeader(http.StatusOK)
+	})
+	invoiceOptions := wall.InvoiceOptions{
+		Price: 10,
+		OnPaid: func(r *http.Request, preimage string, amount int64) {
+			calls = append(calls, fmt.Sprintf("%v %v %v", r.URL.Path, preimage, amount))
+			panic("buggy hook")
+		},
+	}
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+
+	req := httptest.NewRequest("GET", "/paid", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	preimage, err := lnClient.Pay(res.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second request with the same preimage is rejected and mustn't lead to another call
+	for _, expectedCode := range []int{http.StatusOK, http.StatusBadRequest} {
+		req = httptest.NewRequest("GET", "/paid", nil)
+		req.Header.Set("X-Preimage", preimage)
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != expectedCode {
+			t.Errorf("Expected status code %v, but was %v", expectedCode, res.Code)
+		}
+	}
+	expected := []string{"/paid " + preimage + " 10", "next"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the calls %v, but were %v", expected, calls)
+	}
+}
+
+// TestRevenueHandler tests if the revenue handler reports the payments that were made via the middleware
+// and if it requires an API key.
+func TestRevenueHandler(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	storageClient := storage.NewGoMap()
+	invoiceOptions := wall.InvoiceOptions{
+		Price:   10,
+		APIKeys: []string{"admin"},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storageClient)(next)
+	revenueHandler := wall.NewRevenueHandler(invoiceOptions, storageClient)
+
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		preimage, err := lnClient.Pay(res.Body.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Preimage", preimage)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, apiKey := range []string{"", "wrong"} {
+		req := httptest.NewRequest("GET", "/revenue", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		res := httptest.NewRecorder()
+		revenueHandler.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code %v for API key %q, but was %v", http.StatusUnauthorized, apiKey, res.Code)
+		}
+	}
+
+	testCases := []struct {
+		query         string
+		expectedCode  int
+		expectedCount int64
+		expectedTotal int64
+	}{
+		{"", http.StatusOK, 2, 20},
+		{"?from=2000-01-01T00:00:00Z&to=2000-01-02T00:00:00Z", http.StatusOK, 0, 0},
+		{"?from=yesterday", http.StatusBadRequest, 0, 0},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "/revenue"+testCase.query, nil)
+		req.Header.Set("X-API-Key", "admin")
+		res := httptest.NewRecorder()
+		revenueHandler.ServeHTTP(res, req)
+		if res.Code != testCase.expectedCode {
+			t.Errorf("Expected status code %v for query %q, but was %v", testCase.expectedCode, testCase.query, res.Code)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			PaidRequests int64 `json:"paid_requests"`
+			TotalSat     int64 `json:"total_sat"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.PaidRequests != testCase.expectedCount || body.TotalSat != testCase.expectedTotal {
+			t.Errorf("Expected %v paid requests with a total of %v for query %q, but were %v and %v",
+				testCase.expectedCount, testCase.expectedTotal, testCase.query, body.PaidRequests, body.TotalSat)
+		}
+	}
+}
+
+// TestInvoiceHandler tests if the invoice handler returns invoices as JSON with the price of the given path,
+// whose preimages are accepted by the middleware.
+func TestInvoiceHandler(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	invoiceOptions := wall.InvoiceOptions{
+		Price:       10,
+		RoutePrices: map[string]int64{"/api/data": 20},
+	}
+	invoiceHandler := wall.NewInvoiceHandler(invoiceOptions, lnClient)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := wall.NewHandlerMiddleware(invoiceOptions, lnClient, storage.NewGoMap())(next)
+
+	testCases := []struct {
+		url            string
+		expectedAmount int64
+	}{
+		{"/invoice", 10},
+		{"/invoice?path=/api/data", 20},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", testCase.url, nil)
+		res := httptest.NewRecorder()
+		invoiceHandler.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected status code %v, but was %v", http.StatusOK, res.Code)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Expected the Content-Type application/json, but was %v", contentType)
+		}
+		var body struct {
+			Invoice     string `json:"invoice"`
+			Amount      int64  `json:"amount"`
+			PaymentHash string `json:"payment_hash"`
+			ExpiresAt   int64  `json:"expires_at"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Amount != testCase.expectedAmount || body.PaymentHash == "" {
+			t.Errorf("Expected the amount %v and a payment hash, but was %+v", testCase.expectedAmount, body)
+		}
+		// Fake invoices have a fixed timestamp and the default expiry of 1 hour
+		if expiry := res.Header().Get(wall.InvoiceExpiryHeaderName); body.ExpiresAt != 1496314658+3600 || expiry != strconv.FormatInt(body.ExpiresAt, 10) {
+			t.Errorf("Expected the expiry %v in the body and the header, but was %v and %q", 1496314658+3600, body.ExpiresAt, expiry)
+		}
+
+		preimage, err := lnClient.Pay(body.Invoice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Preimage", preimage)
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		// The invoice for the default price isn't enough for the more expensive route
+		expectedCode := http.StatusBadRequest
+		if testCase.expectedAmount == 20 {
+			expectedCode = http.StatusOK
+		}
+		if res.Code != expectedCode {
+			t.Errorf("Expected status code %v for the protected resource, but was %v", expectedCode, res.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/invoice", nil)
+	res := httptest.NewRecorder()
+	invoiceHandler.ServeHTTP(res, req)
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %v, but was %v", http.StatusMethodNotAllowed, res.Code)
+	}
+}
+
+// TestSettlementHandler tests if the settlement handler waits until the invoice is paid,
+// both with long polling and with Server-Sent Events, and if it reports canceled and unpaid invoices.
+func TestSettlementHandler(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	handler := wall.NewSettlementHandler(lnClient, time.Second)
+
+	// Long polling
+	invoice, _ := lnClient.GenerateInvoice(10, "API call")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/settlement?invoice="+invoice, nil))
+		done <- res
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lnClient.Pay(invoice)
+	res := <-done
+	paymentHash, _ := ln.PaymentHashFromInvoice(invoice)
+	expectedBody := fmt.Sprintf(`{"payment_hash":"%x","status":"paid"}`, paymentHash)
+	if res.Code != http.StatusOK || res.Body.String() != expectedBody {
+		t.Errorf("Expected status code %v and body %v, but was %v and %v", http.StatusOK, expectedBody, res.Code, res.Body.String())
+	}
+
+	// Server-Sent Events
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	invoice, _ = lnClient.GenerateInvoice(10, "API call")
+	paymentHash, _ = ln.PaymentHashFromInvoice(invoice)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/settlement?payment_hash=%x", server.URL, paymentHash), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	sseRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sseRes.Body.Close()
+	// The headers are sent before the invoice is paid
+	if contentType := sseRes.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected the Content-Type text/event-stream, but was %v", contentType)
+	}
+	lnClient.Pay(invoice)
+	body, err := ioutil.ReadAll(sseRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEvent := fmt.Sprintf("event: paid\ndata: {\"payment_hash\":\"%x\",\"status\":\"paid\"}\n\n", paymentHash)
+	if !strings.HasSuffix(string(body), expectedEvent) {
+		t.Errorf("Expected the stream to end with %q, but was %q", expectedEvent, body)
+	}
+
+	// Canceled and unpaid invoices, invalid parameters and unknown invoices
+	canceledInvoice, _ := lnClient.GenerateInvoice(10, "API call")
+	lnClient.Cancel(canceledInvoice)
+	unpaidInvoice, _ := lnClient.GenerateInvoice(10, "API call")
+	handler = wall.NewSettlementHandler(lnClient, 50*time.Millisecond)
+	testCases := []struct {
+		url          string
+		expectedCode int
+		expectedBody string
+	}{
+		{"/settlement?invoice=" + canceledInvoice, http.StatusOK, `"status":"canceled"`},
+		{"/settlement?invoice=" + unpaidInvoice, http.StatusOK, `"status":"pending"`},
+		{"/settlement", http.StatusBadRequest, "parameter is required"},
+		{"/settlement?payment_hash=123", http.StatusBadRequest, "32 bytes"},
+		{"/settlement?payment_hash=" + strings.Repeat("00", 32), http.StatusNotFound, "No invoice"},
+	}
+	for _, testCase := range testCases {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", testCase.url, nil))
+		if res.Code != testCase.expectedCode || !strings.Contains(res.Body.String(), testCase.expectedBody) {
+			t.Errorf("Expected status code %v and a body containing %v for %v, but was %v and %v", testCase.expectedCode, testCase.expectedBody, testCase.url, res.Code, res.Body.String())
+		}
+	}
+}
+
+// TestWebSocketHandler tests if a WebSocket connection is only established after the payment,
+// with the preimage in the header or in the query parameter.
+func TestWebSocketHandler(t *testing.T) {
+	lnClient := ln.NewFakeClient()
+	handler := wall.NewWebSocketHandler(wall.InvoiceOptions{}, lnClient, storage.NewGoMap(), nil, func(conn *websocket.Conn, r *http.Request) {
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, inQuery := range []bool{false, true} {
+		// Regular request for the invoice
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoice, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusPaymentRequired {
+			t.Fatalf("Expected status code %v, but was %v", http.StatusPaymentRequired, res.StatusCode)
+		}
+
+		// Handshake without preimage
+		_, res, err = websocket.DefaultDialer.Dial(wsURL, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusPaymentRequired {
+			t.Fatalf("Expected the handshake to fail with status code %v, but the error was %v", http.StatusPaymentRequired, err)
+		}
+
+		preimage, err := lnClient.Pay(string(invoice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := wsURL
+		header := http.Header{}
+		if inQuery {
+			url += "?preimage=" + neturl.QueryEscape(preimage)
+		} else {
+			header.Set("X-Preimage", preimage)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		conn.Close()
+		if err != nil || string(msg) != "hello" {
+			t.Errorf("Expected the message \"hello\", but was %q (error: %v)", msg, err)
+		}
+
+		// The preimage must only be accepted once
+		if _, _, err = websocket.DefaultDialer.Dial(url, header); err == nil {
+			t.Error("Expected the handshake with a used preimage to fail, but it succeeded")
+		}
+	}
+}
+
+// countingStorageClient is a StorageClient that counts its calls and never contains a preimage.
+type countingStorageClient struct {
+	calls *int32
+}
+
+func (c countingStorageClient) WasUsed(preimage string) (bool, error) {
+	atomic.AddInt32(c.calls, 1)
+	return false, nil
+}
+
+func (c countingStorageClient) SetIfNotUsed(preimage string) (bool, error) {
+	atomic.AddInt32(c.calls, 1)
+	return true, nil
+}
+
+func (c countingStorageClient) Close() error {
+	return nil
+}
+
+// TestInvalidPreimageEncodings tests if preimages with an invalid encoding are all rejected with the same response,
+// without calling the storage or LN client.
+func TestInvalidPreimageEncodings(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	validHex := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	testCases := []struct {
+		encoding     wall.PreimageEncoding
+		preimage     string
+		expectedBody string
+	}{
+		{"", "not Base64!", "The provided preimage contains invalid Base64 characters"},
+		{"", "dGVzdA", "The provided preimage contains invalid Base64 characters"},
+		{"", "dGVzdA==dGVzdA==", "The provided preimage contains invalid Base64 characters"},
+		{"", validHex[1:], "The provided preimage contains invalid Base64 characters"},
+		{wall.PreimageEncodingBase64, "not Base64!", "The provided preimage contains invalid Base64 characters"},
+		{wall.PreimageEncodingBase64, validHex, "The provided preimage must be Base64 encoded, not hex"},
+		{wall.PreimageEncodingHex, "dGVzdA==", "The provided preimage contains invalid hex characters"},
+		{wall.PreimageEncodingHex, validHex[1:], "The provided preimage contains invalid hex characters"},
+		{wall.PreimageEncodingHex, "zz" + validHex[2:], "The provided preimage contains invalid hex characters"},
+		// Valid encodings, but preimages always have 32 bytes
+		{"", "dGVzdA==", "The provided preimage must have 32 bytes"},
+		{"", base64.StdEncoding.EncodeToString(make([]byte, 31)), "The provided preimage must have 32 bytes"},
+		{wall.PreimageEncodingBase64, base64.StdEncoding.EncodeToString(make([]byte, 33)), "The provided preimage must have 32 bytes"},
+		{wall.PreimageEncodingHex, validHex[2:], "The provided preimage must have 32 bytes"},
+		{wall.PreimageEncodingHex, validHex + "00", "The provided preimage must have 32 bytes"},
+	}
+	for _, testCase := range testCases {
+		var lnCalls, storageCalls, failing int32
+		lnClient := countingFailingLNclient{calls: &lnCalls, failing: &failing}
+		storageClient := countingStorageClient{calls: &storageCalls}
+		handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{PreimageEncoding: testCase.encoding}, lnClient, storageClient)(next)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Preimage", testCase.preimage)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %v for preimage %q with encoding %q, but was %v", http.StatusBadRequest, testCase.preimage, testCase.encoding, res.Code)
+		}
+		if body := strings.TrimSpace(res.Body.String()); body != testCase.expectedBody {
+			t.Errorf("Expected body %q for preimage %q with encoding %q, but was %q", testCase.expectedBody, testCase.preimage, testCase.encoding, body)
+		}
+		if lnCalls != 0 || storageCalls != 0 {
+			t.Errorf("Expected no calls for preimage %q with encoding %q, but the LN client was called %v times and the storage client %v times", testCase.preimage, testCase.encoding, lnCalls, storageCalls)
+		}
+	}
+}
+
+// TestPreimageCanonicalization tests if the storage client gets non-canonical spellings of a preimage
+// in the canonical Base64 encoding, so that a later request with the canonical spelling is rejected.
+func TestPreimageCanonicalization(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	preimage := testPreimage("canonical")
+	decodedPreimage, err := base64.StdEncoding.DecodeString(preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spellings := append(nonCanonicalBase64(preimage), hex.EncodeToString(decodedPreimage), strings.ToUpper(hex.EncodeToString(decodedPreimage)))
+	for _, spelling := range spellings {
+		storageClient := storage.NewGoMap()
+		handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{}, fakeLNclient{}, storageClient)(next)
+		send := func(preimage string) int {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Preimage", preimage)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			return res.Code
+		}
+
+		if code := send(spelling); code != http.StatusOK {
+			t.Errorf("Expected status code %v for the spelling %q, but was %v", http.StatusOK, spelling, code)
+		}
+		if wasUsed, err := storageClient.WasUsed(preimage); err != nil || !wasUsed {
+			t.Errorf("Expected the canonical preimage to be stored for the spelling %q, but was %v (error: %v)", spelling, wasUsed, err)
+		}
+		if code := send(preimage); code != http.StatusBadRequest {
+			t.Errorf("Expected status code %v for the canonical spelling after %q, but was %v", http.StatusBadRequest, spelling, code)
+		}
+	}
+}
+
+// nonCanonicalBase64 returns other spellings of the Base64 encoded 32 bytes that the base64 package decodes
+// to the same bytes: With non-zero padding bits in the last character before the padding and with line breaks.
+func nonCanonicalBase64(preimage string) []string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	// 32 bytes are 43 characters with 258 bits, so the last 2 bits of the 43rd character are padding
+	last := strings.IndexByte(alphabet, preimage[42])
+	var result []string
+	for i := 1; i < 4; i++ {
+		result = append(result, preimage[:42]+string(alphabet[last+i])+preimage[43:])
+	}
+	return append(result, preimage[:20]+"\n"+preimage[20:], preimage[:20]+"\r\n"+preimage[20:])
+}
+
+// TestPreimageEncoding tests if hex encoded preimages are accepted depending on the PreimageEncoding,
+// and that a preimage can't be used twice by sending it in different encodings.
+func TestPreimageEncoding(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testCases := []struct {
+		encoding          wall.PreimageEncoding
+		expectedBase64    int
+		expectedHex       int
+		expectedHexReused int
+	}{
+		{"", http.StatusOK, http.StatusOK, http.StatusBadRequest},
+		{wall.PreimageEncodingBase64, http.StatusOK, http.StatusBadRequest, http.StatusBadRequest},
+		{wall.PreimageEncodingHex, http.StatusBadRequest, http.StatusOK, http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		lnClient := ln.NewFakeClient()
+		handler := wall.NewHandlerMiddleware(wall.InvoiceOptions{PreimageEncoding: testCase.encoding}, lnClient, storage.NewGoMap())(next)
+		send := func(preimage string) int {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Preimage", preimage)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			return res.Code
+		}
+		pay := func() (base64Preimage string, hexPreimage string) {
+			invoice, err := lnClient.GenerateInvoice(1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			base64Preimage, err = lnClient.Pay(invoice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decodedPreimage, err := base64.StdEncoding.DecodeString(base64Preimage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return base64Preimage, hex.EncodeToString(decodedPreimage)
+		}
+
+		base64Preimage, _ := pay()
+		if code := send(base64Preimage); code != testCase.expectedBase64 {
+			t.Errorf("Expected status code %v for a Base64 preimage with encoding %q, but was %v", testCase.expectedBase64, testCase.encoding, code)
+		}
+		// Other spellings of the same bytes must be detected as reused
+		if testCase.expectedBase64 == http.StatusOK {
+			for _, spelling := range nonCanonicalBase64(base64Preimage) {
+				if code := send(spelling); code != http.StatusBadRequest {
+					t.Errorf("Expected status code %v for the non-canonical spelling %q of a used preimage with encoding %q, but was %v", http.StatusBadRequest, spelling, testCase.encoding, code)
+				}
+			}
+		}
+		base64Preimage, hexPreimage := pay()
+		if code := send(hexPreimage); code != testCase.expectedHex {
+			t.Errorf("Expected status code %v for a hex preimage with encoding %q, but was %v", testCase.expectedHex, testCase.encoding, code)
+		}
+		// Same preimage in the other encoding
+		if code := send(base64Preimage); testCase.expectedHex == http.StatusOK && code != testCase.expectedHexReused {
+			t.Errorf("Expected status code %v for a reused preimage with encoding %q, but was %v", testCase.expectedHexReused, testCase.encoding, code)
+		}
+	}
+}
+
+// testPaymentRoundTrip tests the payment flow of a middleware with an ln.FakeClient:
+// Getting the invoice, sending the request again with the preimage of the paid invoice and trying to reuse the preimage.
+// The PriceFunc makes "/expensive" cost 20 instead of 10 Satoshis.
+// createHandler must create the middleware with the given arguments, for a handler at "/" and "/expensive"
+// that responds with the paid amount from AmountPaid(...) or AmountPaidFromContext(...).
+func testPaymentRoundTrip(t *testing.T, createHandler func(wall.InvoiceOptions, wall.LNclient, wall.StorageClient) http.Handler) {
+	lnClient := ln.NewFakeClient()
+	invoiceOptions := wall.InvoiceOptions{
+		Price: 10,
+		PriceFunc: func(r *http.Request) int64 {
+			if r.URL.Path == "/expensive" {
+				return 20
+			}
+			return 10
+		},
+	}
+	handler := createHandler(invoiceOptions, lnClient, storage.NewGoMap())
+	send := func(path string, preimage string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if preimage != "" {
+			req.Header.Set("X-Preimage", preimage)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, path := range []string{"/", "/expensive"} {
+		expectedAmount := invoiceOptions.PriceFunc(httptest.NewRequest("GET", path, nil))
+		res := send(path, "")
+		invoice := res.Body.String()
+		if res.Code != http.StatusPaymentRequired || res.Header().Get(wall.InvoiceExpiryHeaderName) == "" {
+			t.Fatalf("Expected an invoice for %v, but was %v %q with headers %v", path, res.Code, invoice, res.Header())
+		}
+		if _, err := ln.PaymentHashFromInvoice(invoice); err != nil {
+			t.Fatalf("Expected a valid invoice for %v, but was %q (error: %v)", path, invoice, err)
+		}
+		preimage, err := lnClient.Pay(invoice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res = send(path, preimage); res.Code != http.StatusOK || res.Body.String() != strconv.FormatInt(expectedAmount, 10) {
+			t.Errorf("Expected the paid amount %v for %v, but was %v %q", expectedAmount, path, res.Code, res.Body.String())
+		}
+		if res = send(path, preimage); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %v for a reused preimage for %v, but was %v", http.StatusBadRequest, path, res.Code)
+		}
+	}
+
+	// The invoice for the cheaper route doesn't pay for the expensive one
+	preimage, err := lnClient.Pay(send("/", "").Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := send("/expensive", preimage); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %v for a preimage of a cheaper invoice, but was %v", http.StatusBadRequest, res.Code)
+	}
+}
+
+// TestHandlerMiddlewareRoundTrip tests the payment flow of the middleware from NewHandlerMiddleware.
+func TestHandlerMiddlewareRoundTrip(t *testing.T) {
+	testPaymentRoundTrip(t, func(invoiceOptions wall.InvoiceOptions, lnClient wall.LNclient, storageClient wall.StorageClient) http.Handler {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, wall.AmountPaid(r))
+		})
+		return wall.NewHandlerMiddleware(invoiceOptions, lnClient, storageClient)(next)
+	})
+}
@@ -0,0 +1,54 @@
+package wall
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer, which is the import path of the package, as recommended by OpenTelemetry.
+const tracerName = "github.com/philippgille/ln-paywall/wall"
+
+// Attribute keys of the spans
+const (
+	attributeAmount      = attribute.Key("ln_paywall.amount")
+	attributePaymentHash = attribute.Key("ln_paywall.payment_hash")
+)
+
+func newTracer(tracerProvider trace.TracerProvider) trace.Tracer {
+	if tracerProvider == nil {
+		tracerProvider = trace.NewNoopTracerProvider()
+	}
+	return tracerProvider.Tracer(tracerName)
+}
+
+// startSpan starts a span as child of the span in the given context, if there is one.
+func (p paywall) startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return p.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// endSpan ends the span and records the error, if it's not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// paymentHashAttribute returns the hex encoded payment hash of the Base64 encoded preimage as span attribute.
+// The preimage itself is secret, so it must not be added to spans.
+// For an invalid preimage the value is empty.
+func paymentHashAttribute(preimage string) attribute.KeyValue {
+	decodedPreimage, err := base64.StdEncoding.DecodeString(preimage)
+	if err != nil {
+		return attributePaymentHash.String("")
+	}
+	hash := sha256.Sum256(decodedPreimage)
+	return attributePaymentHash.String(hex.EncodeToString(hash[:]))
+}
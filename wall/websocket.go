@@ -0,0 +1,74 @@
+package wall
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketPreimageParam is the name of the query parameter in which clients can send the preimage
+// in the WebSocket handshake, because browsers can't set headers for WebSocket connections.
+const websocketPreimageParam = "preimage"
+
+// NewWebSocketHandler returns an http.Handler that requires a single payment for a WebSocket connection.
+// The payment is checked during the handshake, i.e. before the HTTP connection is upgraded,
+// and after the upgrade the connection can be used for free for its whole lifetime.
+// Only after the payment was verified the connection is upgraded with the given upgrader
+// and the handler is called with the connection. The handler owns the connection and must close it.
+// If upgrader is nil, a websocket.Upgrader with default values is used,
+// which rejects cross-origin requests.
+//
+// The client obtains and presents the preimage like this:
+//
+// 1. It sends a request to the WebSocket URL, either a regular HTTP request or a handshake request without preimage.
+// The response has the status code 402 and contains the invoice, like the responses of the other middlewares.
+// Regular HTTP requests always lead to an invoice, preimages in them are ignored.
+// Note that browsers don't expose the response of a failed handshake to JavaScript,
+// so browser clients should send a regular request with fetch(...) first.
+// 2. It pays the invoice and opens the WebSocket connection with the preimage in the header with the name HeaderName
+// ("X-Preimage" by default), or in the query parameter "preimage" (URL-encoded),
+// for example "wss://api.example.com/ws?preimage=...".
+// The query parameter exists because the WebSocket API of browsers doesn't allow setting headers.
+// Be aware that URLs including the query can be logged by proxies and web servers.
+// 3. The handshake succeeds and the connection is free to use. As usual, the preimage can't be used again.
+//
+// L402 tokens and session tokens are accepted in the handshake as well.
+func NewWebSocketHandler(invoiceOptions InvoiceOptions, lnClient LNclient, storageClient StorageClient, upgrader *websocket.Upgrader, handler func(*websocket.Conn, *http.Request)) http.Handler {
+	p := newPaywall(invoiceOptions, lnClient, storageClient)
+	if upgrader == nil {
+		upgrader = &websocket.Upgrader{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			// Regular requests are only for obtaining an invoice.
+			// Their preimages are ignored, so that a preimage isn't used up without a connection being established.
+			res := p.handleRequest(r.Context(), func(string) string { return "" }, noQueryParams, r.Method, r.URL.Path, r.RemoteAddr, r)
+			if res.ok {
+				http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+				return
+			}
+			writeResult(w, res)
+			return
+		}
+		getHeader := func(key string) string {
+			value := r.Header.Get(key)
+			if value == "" && http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(p.invoiceOptions.HeaderName) {
+				value = r.URL.Query().Get(websocketPreimageParam)
+			}
+			return value
+		}
+		res := p.handleRequest(r.Context(), getHeader, r.URL.Query().Get, r.Method, r.URL.Path, r.RemoteAddr, r)
+		if !res.ok {
+			writeResult(w, res)
+			return
+		}
+		// The headers of the result, like a session token, are sent in the handshake response
+		conn, err := upgrader.Upgrade(w, r, res.header)
+		if err != nil {
+			// The upgrader already responded with an error
+			p.logger.Printf("Couldn't upgrade the connection to WebSocket: %v\n", err)
+			return
+		}
+		handler(conn, requestWithAmountPaid(r, res))
+	})
+}
@@ -0,0 +1,74 @@
+package wall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// whitelist contains the IP ranges of clients that don't need to pay.
+type whitelist []*net.IPNet
+
+// newWhitelist parses the IP addresses and CIDR ranges of the Whitelist option.
+// Single IP addresses are converted to ranges that only contain the address.
+// An invalid entry leads to a panic, because it's a configuration error
+// and ignoring it could lead to clients unexpectedly having to pay or not having to pay.
+func newWhitelist(entries []string) whitelist {
+	var result whitelist
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid CIDR range in the whitelist: %v", entry))
+			}
+			result = append(result, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			panic(fmt.Sprintf("Invalid IP address in the whitelist: %v", entry))
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return result
+}
+
+// contains returns true if the given IP address is in one of the ranges of the whitelist.
+func (w whitelist) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range w {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the IP address of the client.
+// remoteAddr is the address of the peer of the connection, with or without port.
+// If trustProxy is true, the last address in the X-Forwarded-For header is used instead, if the header is set.
+// That's the address the proxy in front of the web service added.
+// Addresses before it can be set by the client, so they can't be trusted.
+// nil is returned if the address can't be parsed.
+func getClientIP(remoteAddr string, getHeader func(string) string, trustProxy bool) net.IP {
+	if trustProxy {
+		if forwardedFor := getHeader("X-Forwarded-For"); forwardedFor != "" {
+			addrs := strings.Split(forwardedFor, ",")
+			return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// No port
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}